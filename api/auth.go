@@ -0,0 +1,357 @@
+package api
+
+import (
+	"bytes"
+	"cdex/db"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ScopeRead   = "read"
+	ScopeTrade  = "trade"
+	ScopeCancel = "cancel"
+	ScopeWrite  = "write"
+)
+
+const (
+	apiKeyHeader       = "X-CDEX-APIKEY"
+	apiTimestampHeader = "X-CDEX-TIMESTAMP"
+	apiSignatureHeader = "X-CDEX-SIGNATURE"
+
+	authAddressKey = "auth_address"
+	// authSessionKey names the credential of a request: its session, or its
+	// API key.
+	authSessionKey = "auth_session"
+
+	// signatureWindow is how far a signed request's timestamp may drift
+	// from the server clock before it is rejected.
+	signatureWindow = 30 * time.Second
+
+	defaultAPIKeyTTL = 90 * 24 * time.Hour
+)
+
+var (
+	errUnauthorized     = errors.New("unauthorized")
+	errForbidden        = errors.New("forbidden")
+	errInvalidSignature = errors.New("invalid signature")
+	errExpiredSignature = errors.New("request timestamp outside replay window")
+	errReplayedRequest  = errors.New("replayed request")
+)
+
+// keyring derives API key secrets from the server master secret, so that only
+// a hash of each secret needs to be stored, and remembers recently seen
+// signatures to reject replays inside the signature window. It also holds the
+// pending sign-in nonces.
+type keyring struct {
+	master []byte
+
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	nonces map[string]challenge
+}
+
+func newKeyring(master string) *keyring {
+	return &keyring{
+		master: []byte(master),
+		seen:   make(map[string]time.Time),
+		nonces: make(map[string]challenge),
+	}
+}
+
+// secret returns the signing secret of the key with the given id.
+func (k *keyring) secret(id string) string {
+	mac := hmac.New(sha256.New, k.master)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a signed request made with key.
+func (k *keyring) verify(key *db.APIKey, timestamp, signature, method, path string, body []byte, now time.Time) error {
+	secret := k.secret(key.ID)
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(key.SecretHash)) != 1 {
+		return errInvalidSignature
+	}
+
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+	ts := time.UnixMilli(ms)
+	if ts.Before(now.Add(-signatureWindow)) || ts.After(now.Add(signatureWindow)) {
+		return errExpiredSignature
+	}
+
+	expected := signRequest(secret, timestamp, method, path, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return errInvalidSignature
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for sig, exp := range k.seen {
+		if now.After(exp) {
+			delete(k.seen, sig)
+		}
+	}
+	if _, ok := k.seen[expected]; ok {
+		return errReplayedRequest
+	}
+	k.seen[expected] = ts.Add(signatureWindow)
+
+	return nil
+}
+
+// signRequest returns the hex encoded HMAC-SHA256 of timestamp, method,
+// request URI and body concatenated, keyed with secret.
+func signRequest(secret, timestamp, method, path string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte(method))
+	mac.Write([]byte(path))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authMiddleware accepts either a session bearer token or an API key signed
+// request granted scope. Sessions carry every scope.
+func (s *Server) authMiddleware(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		address, err := s.authenticate(ctx, scope)
+		if err != nil {
+			abortUnauthorized(ctx, err)
+			return
+		}
+
+		ctx.Set(authAddressKey, address)
+		ctx.Next()
+	}
+}
+
+// optionalAuthMiddleware is authMiddleware for public endpoints that show
+// more to an authenticated caller. Requests without credentials pass
+// anonymously; requests with invalid credentials are still rejected.
+func (s *Server) optionalAuthMiddleware(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.GetHeader("Authorization") == "" && ctx.GetHeader(apiKeyHeader) == "" {
+			ctx.Next()
+			return
+		}
+
+		address, err := s.authenticate(ctx, scope)
+		if err != nil {
+			abortUnauthorized(ctx, err)
+			return
+		}
+
+		ctx.Set(authAddressKey, address)
+		ctx.Next()
+	}
+}
+
+func (s *Server) authenticate(ctx *gin.Context, scope string) (string, error) {
+	switch {
+	case ctx.GetHeader("Authorization") != "":
+		return s.authenticateSession(ctx)
+	case ctx.GetHeader(apiKeyHeader) != "":
+		return s.authenticateAPIKey(ctx, scope)
+	default:
+		return "", errUnauthorized
+	}
+}
+
+func abortUnauthorized(ctx *gin.Context, err error) {
+	status := http.StatusUnauthorized
+	switch {
+	case errors.Is(err, errForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, errBodyTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	}
+	ctx.AbortWithStatusJSON(status, errorResponse(err))
+}
+
+// sessionMiddleware only accepts session bearer tokens. It guards endpoints
+// that must not be reachable with an API key, such as key management.
+func (s *Server) sessionMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		address, err := s.authenticateSession(ctx)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse(err))
+			return
+		}
+
+		ctx.Set(authAddressKey, address)
+		ctx.Next()
+	}
+}
+
+func (s *Server) authenticateSession(ctx *gin.Context) (string, error) {
+	header := ctx.GetHeader("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || token == "" {
+		return "", errUnauthorized
+	}
+
+	session, err := s.store.GetSession(ctx, hashToken(token))
+	if err != nil {
+		return "", errUnauthorized
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return "", errUnauthorized
+	}
+
+	ctx.Set(authSessionKey, "session:"+session.TokenHash)
+	return session.Address, nil
+}
+
+func (s *Server) authenticateAPIKey(ctx *gin.Context, scope string) (string, error) {
+	key, err := s.store.GetAPIKey(ctx, ctx.GetHeader(apiKeyHeader))
+	if err != nil {
+		return "", errUnauthorized
+	}
+	if key.Revoked || time.Now().After(key.ExpiresAt) {
+		return "", errUnauthorized
+	}
+
+	// The signature covers the body, which is read before the handler
+	// applies its own limit.
+	var body []byte
+	if ctx.Request.Body != nil {
+		body, err = io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, s.bodyLimit(ctx)))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return "", errBodyTooLarge
+		}
+		if err != nil {
+			return "", err
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	err = s.keys.verify(key, ctx.GetHeader(apiTimestampHeader), ctx.GetHeader(apiSignatureHeader),
+		ctx.Request.Method, ctx.Request.URL.RequestURI(), body, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if !key.HasScope(scope) {
+		return "", errForbidden
+	}
+
+	ctx.Set(authSessionKey, "key:"+key.ID)
+	return key.Owner, nil
+}
+
+// authAddress returns the address authenticated by authMiddleware or
+// sessionMiddleware.
+func authAddress(ctx *gin.Context) string {
+	return ctx.GetString(authAddressKey)
+}
+
+// authSession returns the credential, a session or an API key, authenticated
+// by authMiddleware or sessionMiddleware.
+func authSession(ctx *gin.Context) string {
+	return ctx.GetString(authSessionKey)
+}
+
+type createAPIKeyRequest struct {
+	Scopes    []string `json:"scopes" binding:"required,min=1,dive,oneof=read trade cancel write"`
+	ExpiresIn int64    `json:"expires_in" binding:"omitempty,min=1,max=31536000"`
+}
+
+type createAPIKeyResponse struct {
+	*db.APIKey
+	Secret string `json:"secret"`
+}
+
+func (s *Server) createAPIKey(ctx *gin.Context) {
+	var (
+		err error
+		req createAPIKeyRequest
+		key *db.APIKey
+	)
+	if err = ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if len(s.keys.master) == 0 {
+		ctx.JSON(http.StatusServiceUnavailable, errorResponse(errors.New("api keys are not configured")))
+		return
+	}
+
+	ttl := defaultAPIKeyTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+
+	id, err := randomID()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	secret := s.keys.secret(id)
+	now := time.Now()
+
+	key, err = s.store.InsertAPIKey(ctx, db.CreateAPIKeyParams{
+		ID:         id,
+		Owner:      authAddress(ctx),
+		SecretHash: hashToken(secret),
+		Scopes:     req.Scopes,
+		ExpiresAt:  now.Add(ttl),
+		CreatedAt:  now,
+	})
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, createAPIKeyResponse{APIKey: key, Secret: secret})
+}
+
+func (s *Server) listAPIKey(ctx *gin.Context) {
+	keys, err := s.store.GetAPIKeysByOwner(ctx, authAddress(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, keys)
+}
+
+func (s *Server) revokeAPIKey(ctx *gin.Context) {
+	err := s.store.RevokeAPIKey(ctx, ctx.Param("id"), authAddress(ctx))
+	if errors.Is(err, db.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, errorResponse(err))
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, msgResponse("api key revoked"))
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"cdex/db"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyringVerify(t *testing.T) {
+	k := newKeyring("master")
+	key := &db.APIKey{ID: "key", SecretHash: hashToken(k.secret("key"))}
+	now := time.Now()
+	ts := strconv.FormatInt(now.UnixMilli(), 10)
+	body := []byte(`{"price":1}`)
+	sig := signRequest(k.secret("key"), ts, "POST", "/api/order", body)
+
+	if err := k.verify(key, ts, sig, "POST", "/api/order", body, now); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if err := k.verify(key, ts, sig, "POST", "/api/order", body, now); err != errReplayedRequest {
+		t.Errorf("replay: got %v, want %v", err, errReplayedRequest)
+	}
+	if err := k.verify(key, ts, sig, "POST", "/api/order", []byte(`{"price":2}`), now); err != errInvalidSignature {
+		t.Errorf("tampered body: got %v, want %v", err, errInvalidSignature)
+	}
+	if err := k.verify(key, ts, sig, "POST", "/api/order", body, now.Add(time.Minute)); err != errExpiredSignature {
+		t.Errorf("stale timestamp: got %v, want %v", err, errExpiredSignature)
+	}
+	if err := newKeyring("rotated").verify(key, ts, sig, "POST", "/api/order", body, now); err != errInvalidSignature {
+		t.Errorf("rotated master: got %v, want %v", err, errInvalidSignature)
+	}
+}
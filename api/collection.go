@@ -2,33 +2,42 @@ package api
 
 import (
 	"cdex/db"
+	"cdex/stats"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"strconv"
 	"time"
 )
 
+var (
+	errOpenOrders    = errors.New("there are open orders")
+	errItemSold      = errors.New("item was sold")
+	errItemExists    = errors.New("item already exists")
+	errNoTokenURI    = errors.New("item has no token_uri")
+	errChainMismatch = errors.New("chain differs from the chain of the collection")
+)
+
 type createCollectionRequest struct {
-	Name         string `json:"name" binding:"required"`
-	Chain        int8   `json:"chain" binding:"numeric"`
-	Address      string `json:"address"`
-	Creator      string `json:"creator" binding:"required"`
-	Type         int8   `json:"type" binding:"numeric"`
-	Tax          int8   `json:"tax" binding:"numeric"`
-	Symbol       string `json:"symbol" binding:"required"`
-	Currency     string `json:"currency" binding:"required"`
-	Visible      int8   `json:"visible"`
-	Status       int8   `json:"status"`
-	Image        string `json:"image" binding:"required"`
-	Background   string `json:"background" binding:"required"`
-	Banner       string `json:"banner" binding:"required"`
-	Description  string `json:"description"`
-	Introduction string `json:"introduction"`
-	Properties   string `json:"properties"`
-	Twitter      string `json:"twitter"`
-	Instagram    string `json:"instagram"`
-	Discord      string `json:"discord"`
-	Web          string `json:"web"`
+	Name         string        `json:"name" binding:"required"`
+	Chain        int8          `json:"chain" binding:"numeric"`
+	Address      string        `json:"address"`
+	Type         int8          `json:"type" binding:"numeric"`
+	Tax          int8          `json:"tax" binding:"numeric"`
+	Symbol       string        `json:"symbol" binding:"required"`
+	Currency     string        `json:"currency" binding:"required"`
+	Visible      int8          `json:"visible"`
+	Status       int8          `json:"status"`
+	Image        string        `json:"image" binding:"required"`
+	Background   string        `json:"background" binding:"required"`
+	Banner       string        `json:"banner" binding:"required"`
+	Description  string        `json:"description"`
+	Introduction string        `json:"introduction"`
+	Properties   db.Attributes `json:"properties"`
+	Twitter      string        `json:"twitter"`
+	Instagram    string        `json:"instagram"`
+	Discord      string        `json:"discord"`
+	Web          string        `json:"web"`
 }
 
 func (s *Server) createCollection(ctx *gin.Context) {
@@ -41,11 +50,22 @@ func (s *Server) createCollection(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, errorResponse(err))
 		return
 	}
+	if err := req.Properties.Validate(); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if req.Currency, err = s.registry.CheckCurrency(req.Chain, req.Currency); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if !s.checkMedia(ctx, &req.Image, &req.Background, &req.Banner) {
+		return
+	}
 	arg := db.CreateCollectionParams{
 		Name:         req.Name,
 		Chain:        req.Chain,
 		Address:      req.Address,
-		Creator:      req.Creator,
+		Creator:      authAddress(ctx),
 		Type:         req.Type,
 		Tax:          req.Tax,
 		Symbol:       req.Symbol,
@@ -73,67 +93,235 @@ func (s *Server) createCollection(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, c)
 }
 
+type listCollectionRequest struct {
+	Chain    *int8  `form:"chain"`
+	Type     *int8  `form:"type"`
+	Status   *int8  `form:"status"`
+	Visible  *int8  `form:"visible"`
+	Currency string `form:"currency"`
+	Creator  string `form:"creator"`
+	Sort     string `form:"sort" binding:"omitempty,oneof=created name volume floor"`
+	Order    string `form:"order" binding:"omitempty,oneof=asc desc"`
+}
+
+// sortDesc returns whether a list is sorted in descending order. Without an
+// explicit order, names, floors and rarity ranks sort ascending, dates and
+// volumes descending.
+func sortDesc(sort, order string) bool {
+	if order != "" {
+		return order == "desc"
+	}
+	return sort != db.SortName && sort != db.SortFloor && sort != db.SortRarity
+}
+
 func (s *Server) listCollection(ctx *gin.Context) {
-	var (
-		err         error
-		page        int64 = 1
-		pageSize    int64 = 10
-		collections []*db.Collection
-	)
+	var req listCollectionRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	s.queryCollections(ctx, req)
+}
 
-	if pageStr, ok := ctx.GetQuery("page"); ok {
-		page, err = strconv.ParseInt(pageStr, 10, 64)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, errorResponse(err))
-			return
-		}
+func (s *Server) listAddressCollection(ctx *gin.Context) {
+	var req listCollectionRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
 	}
-	if pageSizeStr, ok := ctx.GetQuery("pageSize"); ok {
-		pageSize, err = strconv.ParseInt(pageSizeStr, 10, 64)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, errorResponse(err))
-			return
-		}
+	req.Creator = ctx.Param("id")
+	s.queryCollections(ctx, req)
+}
+
+// queryCollections lists the collections selected by req. Hidden collections
+// are only listed to their creator.
+func (s *Server) queryCollections(ctx *gin.Context, req listCollectionRequest) {
+	p, err := bindPage(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
 	}
 
-	collections, err = s.store.GetCollections(ctx, int(page), int(pageSize))
+	arg := db.CollectionQuery{
+		Chain:         req.Chain,
+		Type:          req.Type,
+		Status:        req.Status,
+		Visible:       req.Visible,
+		Currency:      req.Currency,
+		Creator:       req.Creator,
+		IncludeHidden: req.Creator != "" && req.Creator == authAddress(ctx),
+		Sort:          req.Sort,
+		Desc:          sortDesc(req.Sort, req.Order),
+		Page:          p,
+	}
+	collections, next, err := s.store.GetCollections(ctx, arg)
+	if errors.Is(err, db.ErrInvalidCursor) || errors.Is(err, db.ErrSortCurrency) {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
 		return
 	}
 
-	ctx.JSON(http.StatusOK, collections)
+	res := make([]*collectionResponse, len(collections))
+	for i, c := range collections {
+		res[i] = &collectionResponse{Collection: c, Stats: s.stats.Stats(c.ID)}
+	}
+	pageResponse(ctx, p, res, next)
 }
 
-func (s *Server) listAddressCollection(ctx *gin.Context) {
-	var (
-		err         error
-		address     string
-		page        int64 = 1
-		pageSize    int64 = 10
-		collections []*db.Collection
-	)
-	address = ctx.Param("address")
-	if pageStr, ok := ctx.GetQuery("page"); ok {
-		page, err = strconv.ParseInt(pageStr, 10, 64)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, errorResponse(err))
-			return
-		}
+// collectionResponse is a collection with its market statistics.
+type collectionResponse struct {
+	*db.Collection
+	Stats *stats.Stats `json:"stats"`
+}
+
+func (s *Server) getCollectionStats(ctx *gin.Context) {
+	c, ok := s.collection(ctx)
+	if !ok {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, s.stats.Stats(c.ID))
+}
+
+type updateCollectionRequest struct {
+	Name         *string        `json:"name" binding:"omitempty,min=1,max=32"`
+	Visible      *int8          `json:"visible" binding:"omitempty,oneof=0 1"`
+	Tax          *int8          `json:"tax" binding:"omitempty,min=0,max=100"`
+	Image        *string        `json:"image" binding:"omitempty,max=128"`
+	Background   *string        `json:"background" binding:"omitempty,max=128"`
+	Banner       *string        `json:"banner" binding:"omitempty,max=128"`
+	Description  *string        `json:"description" binding:"omitempty,max=256"`
+	Introduction *string        `json:"introduction" binding:"omitempty,max=256"`
+	Properties   *db.Attributes `json:"properties"`
+	Twitter      *string        `json:"twitter" binding:"omitempty,max=256"`
+	Instagram    *string        `json:"instagram" binding:"omitempty,max=256"`
+	Discord      *string        `json:"discord" binding:"omitempty,max=256"`
+	Web          *string        `json:"web" binding:"omitempty,max=256"`
+}
+
+// collection loads the collection named by the id parameter. It writes a 404
+// for a missing collection, or for a hidden one unless the caller is its
+// creator.
+func (s *Server) collection(ctx *gin.Context) (*db.Collection, bool) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return nil, false
+	}
+
+	c, err := s.store.GetCollectionByID(ctx, id)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && c.Visible == 0 && c.Creator != authAddress(ctx)) {
+		ctx.JSON(http.StatusNotFound, errorResponse(db.ErrNotFound))
+		return nil, false
 	}
-	if pageSizeStr, ok := ctx.GetQuery("pageSize"); ok {
-		pageSize, err = strconv.ParseInt(pageSizeStr, 10, 64)
-		if err != nil {
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return nil, false
+	}
+
+	return c, true
+}
+
+// ownCollection is collection for endpoints restricted to the creator.
+func (s *Server) ownCollection(ctx *gin.Context) (*db.Collection, bool) {
+	c, ok := s.collection(ctx)
+	if !ok {
+		return nil, false
+	}
+	if c.Creator != authAddress(ctx) {
+		ctx.JSON(http.StatusForbidden, errorResponse(errForbidden))
+		return nil, false
+	}
+
+	return c, true
+}
+
+func (s *Server) getCollection(ctx *gin.Context) {
+	c, ok := s.collection(ctx)
+	if !ok {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, &collectionResponse{Collection: c, Stats: s.stats.Stats(c.ID)})
+}
+
+func (s *Server) updateCollection(ctx *gin.Context) {
+	var req updateCollectionRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if req.Properties != nil {
+		if err := req.Properties.Validate(); err != nil {
 			ctx.JSON(http.StatusBadRequest, errorResponse(err))
 			return
 		}
 	}
 
-	collections, err = s.store.GetCollectionByCreator(ctx, address, int(page), int(pageSize))
+	if !s.checkMedia(ctx, req.Image, req.Background, req.Banner) {
+		return
+	}
+
+	c, ok := s.ownCollection(ctx)
+	if !ok {
+		return
+	}
+
+	arg := db.UpdateCollectionParams{
+		Name:         req.Name,
+		Visible:      req.Visible,
+		Tax:          req.Tax,
+		Image:        req.Image,
+		Background:   req.Background,
+		Banner:       req.Banner,
+		Description:  req.Description,
+		Introduction: req.Introduction,
+		Properties:   req.Properties,
+		Twitter:      req.Twitter,
+		Instagram:    req.Instagram,
+		Discord:      req.Discord,
+		Web:          req.Web,
+	}
+	c, err := s.store.UpdateCollection(ctx, c.ID, arg)
+	if errors.Is(err, db.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, errorResponse(err))
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, &collectionResponse{Collection: c, Stats: s.stats.Stats(c.ID)})
+}
+
+func (s *Server) deleteCollection(ctx *gin.Context) {
+	c, ok := s.ownCollection(ctx)
+	if !ok {
+		return
+	}
+	if s.hasOpenOrders(c.ID, 0) {
+		ctx.JSON(http.StatusConflict, errorResponse(errOpenOrders))
+		return
+	}
+
+	err := s.store.DeleteCollection(ctx, c.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, errorResponse(err))
+		return
+	}
+	if errors.Is(err, db.ErrItemsSold) {
+		ctx.JSON(http.StatusConflict, errorResponse(err))
+		return
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
 		return
 	}
+	s.stats.CollectionRemoved(c.ID)
 
-	ctx.JSON(http.StatusOK, collections)
+	ctx.JSON(http.StatusOK, msgResponse("collection deleted"))
 }
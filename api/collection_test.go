@@ -0,0 +1,132 @@
+package api
+
+import (
+	"cdex/db"
+	"cdex/exchange"
+	"cdex/media"
+	"cdex/metadata"
+	"cdex/stats"
+	"cdex/utils"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	// gin panics on conflicting routes.
+	if _, err := NewServer(utils.Config{}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectionCRUD(t *testing.T) {
+	store := db.NewMemoryDB()
+	for _, visible := range []int8{1, 0} {
+		if _, err := store.InsertCollection(context.Background(), db.CreateCollectionParams{Creator: "alice", Visible: visible}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := &Server{
+		ex:    exchange.NewExchange(),
+		stats: stats.NewTracker(),
+		store: store,
+		media: media.NewService(media.NewDirStore(t.TempDir()), "/static/", 1<<20),
+	}
+	as := func(address string) gin.HandlerFunc {
+		return func(ctx *gin.Context) {
+			if address != "" {
+				ctx.Set(authAddressKey, address)
+			}
+		}
+	}
+	send := func(method, path, caller, body string) int {
+		router := gin.New()
+		router.GET("/api/collection/:id", as(caller), server.getCollection)
+		router.GET("/api/collection/:id/stats", as(caller), server.getCollectionStats)
+		router.PATCH("/api/collection/:id", as(caller), server.updateCollection)
+		router.DELETE("/api/collection/:id", as(caller), server.deleteCollection)
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert(t, send("GET", "/api/collection/1", "", ""), http.StatusOK)
+	assert(t, send("GET", "/api/collection/3", "", ""), http.StatusNotFound)
+	assert(t, send("GET", "/api/collection/x", "", ""), http.StatusBadRequest)
+	// Hidden collections are only shown to their creator.
+	assert(t, send("GET", "/api/collection/2", "bob", ""), http.StatusNotFound)
+	assert(t, send("GET", "/api/collection/2", "alice", ""), http.StatusOK)
+	assert(t, send("GET", "/api/collection/1/stats", "", ""), http.StatusOK)
+	assert(t, send("GET", "/api/collection/3/stats", "", ""), http.StatusNotFound)
+	assert(t, send("GET", "/api/collection/2/stats", "bob", ""), http.StatusNotFound)
+	assert(t, send("GET", "/api/collection/2/stats", "alice", ""), http.StatusOK)
+
+	assert(t, send("PATCH", "/api/collection/1", "bob", `{"banner":"b.png"}`), http.StatusForbidden)
+	assert(t, send("PATCH", "/api/collection/1", "alice", `{"name":""}`), http.StatusBadRequest)
+	assert(t, send("PATCH", "/api/collection/1", "alice", `{"visible":2}`), http.StatusBadRequest)
+	assert(t, send("PATCH", "/api/collection/1", "alice", `{"banner":"b.png"}`), http.StatusOK)
+	c, _ := store.GetCollectionByID(context.Background(), 1)
+	assert(t, c.Banner, "b.png")
+	assert(t, send("PATCH", "/api/collection/1", "alice", `{"image":"/static/missing.png"}`), http.StatusBadRequest)
+
+	// A collection with sold items cannot be deleted.
+	ctx := context.Background()
+	if _, err := store.InsertItem(ctx, db.CreateItemParams{Collection: 2, TokenID: 1, Creator: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertTrade(ctx, &db.Trade{Market: "fra", Collection: 2, TokenID: 1, Size: 1, Buyer: "bob", Seller: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, send("DELETE", "/api/collection/2", "alice", ""), http.StatusConflict)
+	assert(t, send("DELETE", "/api/collection/1", "alice", ""), http.StatusOK)
+}
+
+type stubFetcher map[string]*metadata.Metadata
+
+func (f stubFetcher) Fetch(ctx context.Context, uri string, tokenID int) (*metadata.Metadata, error) {
+	if m, ok := f[uri]; ok {
+		return m, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func TestRefreshItem(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryDB()
+	for id, uri := range []string{"", "ipfs://Qm/1", "ipfs://Qm/2"} {
+		if _, err := store.InsertItem(ctx, db.CreateItemParams{Name: "Ape", Collection: 1, TokenID: id + 1, Creator: "alice", TokenURI: uri}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := &Server{
+		store: store,
+		metadata: stubFetcher{"ipfs://Qm/2": {
+			Name:       "Ape #2",
+			Image:      "2.png",
+			Attributes: db.Attributes{{TraitType: "Hat", Value: "cap"}},
+		}},
+	}
+	send := func(path, caller string) int {
+		router := gin.New()
+		router.POST("/api/item/:collection/:token_id/refresh", func(ctx *gin.Context) {
+			ctx.Set(authAddressKey, caller)
+		}, server.refreshItem)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		return w.Code
+	}
+
+	assert(t, send("/api/item/1/2/refresh", "bob"), http.StatusForbidden)
+	assert(t, send("/api/item/1/1/refresh", "alice"), http.StatusBadRequest)
+	assert(t, send("/api/item/1/2/refresh", "alice"), http.StatusBadGateway)
+	assert(t, send("/api/item/1/3/refresh", "alice"), http.StatusOK)
+	item, _ := store.GetItem(ctx, 1, 3)
+	assert(t, item.Name, "Ape #2")
+	assert(t, item.Image, "2.png")
+	assert(t, item.Properties, db.Attributes{{TraitType: "Hat", Value: "cap"}})
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bytes"
+	"cdex/db"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyHeader         = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	// idempotencyTTL is how long a stored response is replayed for its key.
+	idempotencyTTL = 24 * time.Hour
+
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	errIdempotencyKeyInUse    = errors.New("a request with this idempotency key is in progress")
+	errIdempotencyKeyMismatch = errors.New("idempotency key reused with a different request")
+	errIdempotencyKeyTooLong  = errors.New("idempotency key too long")
+)
+
+// inflight serializes requests that share an owner and idempotency key, so a
+// retry arriving before the first attempt has finished is not executed twice.
+type inflight struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+func newInflight() *inflight {
+	return &inflight{keys: make(map[string]struct{})}
+}
+
+func (f *inflight) acquire(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.keys[key]; ok {
+		return false
+	}
+	f.keys[key] = struct{}{}
+	return true
+}
+
+func (f *inflight) release(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.keys, key)
+}
+
+// recorder keeps a copy of the response body written by the handlers.
+type recorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// idempotencyMiddleware makes authenticated write endpoints safe to retry.
+// The response to a request carrying an Idempotency-Key header is stored per
+// owner and key, and replayed verbatim when the same request is sent again.
+// Server errors are not stored so that the request can be retried.
+func (s *Server) idempotencyMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.GetHeader(idempotencyHeader)
+		if key == "" {
+			ctx.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, errorResponse(errIdempotencyKeyTooLong))
+			return
+		}
+
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, errorResponse(err))
+			return
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		owner := authAddress(ctx)
+		lock := owner + "\x00" + key
+		if !s.inflight.acquire(lock) {
+			ctx.AbortWithStatusJSON(http.StatusConflict, errorResponse(errIdempotencyKeyInUse))
+			return
+		}
+		defer s.inflight.release(lock)
+
+		hash := requestHash(ctx.Request.Method, ctx.Request.URL.RequestURI(), body)
+		stored, err := s.store.GetIdempotencyKey(ctx, owner, key)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, errorResponse(err))
+			return
+		}
+		if err == nil && time.Since(stored.CreatedAt) < idempotencyTTL {
+			if stored.RequestHash != hash {
+				ctx.AbortWithStatusJSON(http.StatusUnprocessableEntity, errorResponse(errIdempotencyKeyMismatch))
+				return
+			}
+			ctx.Header(idempotencyReplayedHeader, "true")
+			ctx.Data(stored.Status, gin.MIMEJSON, stored.Body)
+			ctx.Abort()
+			return
+		}
+
+		rec := &recorder{ResponseWriter: ctx.Writer}
+		ctx.Writer = rec
+		ctx.Next()
+
+		if rec.Status() >= http.StatusInternalServerError {
+			return
+		}
+		err = s.store.SaveIdempotencyKey(ctx, &db.IdempotencyKey{
+			Owner:       owner,
+			Key:         key,
+			RequestHash: hash,
+			Status:      rec.Status(),
+			Body:        rec.body.Bytes(),
+			CreatedAt:   time.Now(),
+		})
+		if err != nil {
+			ctx.Error(err)
+		}
+	}
+}
+
+func requestHash(method, uri string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte(uri))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
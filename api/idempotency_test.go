@@ -0,0 +1,57 @@
+package api
+
+import (
+	"cdex/db"
+	"cdex/exchange"
+	"cdex/registry"
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdempotentPlaceOrder(t *testing.T) {
+	ex := exchange.NewExchange()
+	store := db.NewMemoryDB()
+	if _, err := store.InsertCollection(context.Background(), db.CreateCollectionParams{Creator: "bob", Chain: 1}); err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		ex:       ex,
+		store:    store,
+		hub:      newHub(ex, 0),
+		inflight: newInflight(),
+		registry: registry.Default(),
+	}
+	router := gin.New()
+	router.POST("/api/v2/order", func(ctx *gin.Context) {
+		ctx.Set(authAddressKey, "alice")
+	}, server.idempotencyMiddleware(), server.placeOrder2)
+
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/order", strings.NewReader(body))
+		req.Header.Set(idempotencyHeader, key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	body := `{"owner":"alice","currency":"eth","market":"fra","type":"limit","bid":true,"collection":1,"token_id":2,"quantity":1,"price":10,"client_order_id":"c1"}`
+	first := send("k1", body)
+	assert(t, first.Code, http.StatusOK)
+
+	retry := send("k1", body)
+	assert(t, retry.Code, http.StatusOK)
+	assert(t, retry.Body.String(), first.Body.String())
+	assert(t, retry.Header().Get(idempotencyReplayedHeader), "true")
+
+	ob, _ := ex.OrderBook(exchange.MarketFRA)
+	levels := ob.Levels(true, nil)
+	assert(t, len(levels), 1)
+	assert(t, levels[0].Volume, 1)
+
+	assert(t, send("k1", strings.Replace(body, `"price":10`, `"price":11`, 1)).Code, http.StatusUnprocessableEntity)
+	assert(t, send("k2", body).Code, http.StatusConflict)
+}
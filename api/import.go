@@ -0,0 +1,65 @@
+package api
+
+import (
+	"bytes"
+	"cdex/importer"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+)
+
+// maxImportSize bounds the body of an import request.
+const maxImportSize = 64 << 20
+
+// importItems adds items to a collection from the request body: a CSV file
+// (text/csv), an NDJSON file (application/x-ndjson) or a zip archive of
+// ERC-721 metadata files (application/zip). The response is the import
+// report.
+func (s *Server) importItems(ctx *gin.Context) {
+	c, ok := s.ownCollection(ctx)
+	if !ok {
+		return
+	}
+
+	var (
+		rows []importer.Row
+		err  error
+		body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxImportSize)
+	)
+	switch ctx.ContentType() {
+	case "text/csv":
+		rows, err = importer.ReadCSV(body)
+	case "application/x-ndjson":
+		rows, err = importer.ReadNDJSON(body)
+	case "application/zip":
+		var data []byte
+		if data, err = io.ReadAll(body); err == nil {
+			rows, err = importer.ReadZip(bytes.NewReader(data), int64(len(data)))
+		}
+	default:
+		ctx.JSON(http.StatusUnsupportedMediaType, errorResponse(fmt.Errorf("unsupported content type %q", ctx.ContentType())))
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || errors.Is(err, importer.ErrTooLarge) {
+		ctx.JSON(http.StatusRequestEntityTooLarge, errorResponse(err))
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+
+	report, err := importer.Import(ctx, s.store, c, rows, s.media.Check)
+	for _, item := range report.Items {
+		s.stats.ItemAdded(item.Collection, item.Owner)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, report)
+}
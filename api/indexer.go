@@ -0,0 +1,72 @@
+package api
+
+import (
+	"cdex/db"
+	"cdex/indexer"
+	"cdex/utils"
+	"context"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// newIndexers returns an indexer for every registered chain with an RPC
+// endpoint.
+func (s *Server) newIndexers(config utils.Config) []*indexer.Indexer {
+	var indexers []*indexer.Indexer
+	for _, c := range s.registry.Chains() {
+		if c.RPC == "" {
+			continue
+		}
+		rpc := indexer.NewClient(&http.Client{Timeout: 30 * time.Second}, c.RPC)
+		ix := indexer.New(rpc, s.store, s.ex, indexer.Config{
+			Chain:         c.ID,
+			Confirmations: c.Confirmations,
+			BlockRange:    config.IndexerBlockRange,
+			StartBlock:    c.StartBlock,
+			PollInterval:  config.IndexerPoll,
+		})
+		ix.OnOwnerChange(s.onOwnerChange)
+		ix.OnSkipped(onSkipped)
+		indexers = append(indexers, ix)
+	}
+	return indexers
+}
+
+// onOwnerChange counts the owners of items transferred on chain.
+func (s *Server) onOwnerChange(changes []*db.OwnerChange) {
+	for _, c := range changes {
+		s.stats.ItemTransferred(c.Collection, c.From, c.To)
+	}
+}
+
+// onSkipped logs the transfers the indexers cannot store: the balances of
+// their tokens are not followed, and asks for them are not canceled when they
+// are transferred.
+func onSkipped(skipped []*indexer.Skipped) {
+	for _, t := range skipped {
+		logrus.WithFields(logrus.Fields{
+			"chain":       t.Chain,
+			"collection":  t.Collection,
+			"tx":          t.TxHash,
+			"log":         t.LogIndex,
+			"batch_index": t.BatchIndex,
+			"token_id":    t.TokenID,
+			"amount":      t.Amount,
+		}).Error("transfer not indexed: token id or amount out of range")
+	}
+}
+
+// StartIndexers runs the chain indexers until ctx is done or the server is
+// shut down. It is called after LoadOrders, so that asks of transferred tokens
+// are canceled.
+func (s *Server) StartIndexers(ctx context.Context) {
+	ctx, s.stopIndexers = context.WithCancel(ctx)
+	for _, ix := range s.indexers {
+		s.workers.Add(1)
+		go func(ix *indexer.Indexer) {
+			defer s.workers.Done()
+			ix.Run(ctx)
+		}(ix)
+	}
+}
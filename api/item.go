@@ -2,21 +2,25 @@ package api
 
 import (
 	"cdex/db"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type createItemRequest struct {
-	Name        string `json:"name"`
-	Collection  int    `json:"collection" binding:"required"`
-	TokenID     int    `json:"token_id" binding:"required"`
-	Chain       int8   `json:"chain" binding:"numeric"`
-	Creator     string `json:"creator" binding:"required"`
-	Image       string `json:"image"`
-	Description string `json:"description"`
-	Properties  string `json:"properties"`
+	Name        string        `json:"name"`
+	Collection  int           `json:"collection" binding:"required"`
+	TokenID     int           `json:"token_id" binding:"required"`
+	Chain       int8          `json:"chain" binding:"numeric"`
+	Image       string        `json:"image"`
+	Description string        `json:"description"`
+	Properties  db.Attributes `json:"properties"`
+	TokenURI    string        `json:"token_uri" binding:"max=256"`
 }
 
 func (s *Server) createItem(ctx *gin.Context) {
@@ -29,93 +33,374 @@ func (s *Server) createItem(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, errorResponse(err))
 		return
 	}
+	if err := req.Properties.Validate(); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if req.Chain != 0 {
+		if err := s.registry.CheckChain(req.Chain); err != nil {
+			ctx.JSON(http.StatusBadRequest, errorResponse(err))
+			return
+		}
+	}
+
+	c, err := s.store.GetCollectionByID(ctx, req.Collection)
+	if errors.Is(err, db.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, errorResponse(err))
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	if c.Creator != authAddress(ctx) {
+		ctx.JSON(http.StatusForbidden, errorResponse(errForbidden))
+		return
+	}
+	// Items live on the chain of their collection, where orders settle and
+	// the indexer follows them.
+	if req.Chain != 0 && req.Chain != c.Chain {
+		ctx.JSON(http.StatusBadRequest, errorResponse(errChainMismatch))
+		return
+	}
+
+	if !s.checkMedia(ctx, &req.Image) {
+		return
+	}
 	arg := db.CreateItemParams{
 		Name:        req.Name,
 		Collection:  req.Collection,
 		TokenID:     req.TokenID,
-		Chain:       req.Chain,
+		Chain:       c.Chain,
 		CreatedAt:   time.Now(),
-		Creator:     req.Creator,
+		Creator:     c.Creator,
 		Image:       req.Image,
 		Description: req.Description,
 		Properties:  req.Properties,
+		TokenURI:    req.TokenURI,
 	}
 
 	item, err = s.store.InsertItem(ctx, arg)
+	if errors.Is(err, db.ErrDuplicate) {
+		ctx.JSON(http.StatusConflict, errorResponse(errItemExists))
+		return
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
 		return
 	}
 
-	ctx.JSON(http.StatusOK, item)
+	s.stats.ItemAdded(item.Collection, item.Owner)
+
+	ctx.JSON(http.StatusOK, s.rescore(ctx, item))
 }
 
-func (s *Server) listItem(ctx *gin.Context) {
-	var (
-		err      error
-		page     int64 = 1
-		pageSize int64 = 10
-		items    []*db.Item
-	)
-	if pageStr, ok := ctx.GetQuery("page"); ok {
-		page, err = strconv.ParseInt(pageStr, 10, 64)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, errorResponse(err))
-			return
-		}
+// rescore updates the rarity of the collection of item and returns item with
+// its new score. The item is kept even when its collection cannot be
+// rescored; the next item added to the collection rescores it.
+func (s *Server) rescore(ctx *gin.Context, item *db.Item) *db.Item {
+	if err := s.store.UpdateRarity(ctx, item.Collection); err != nil {
+		logrus.WithError(err).WithField("collection", item.Collection).Error("cannot update rarity")
+		return item
 	}
-	if pageSizeStr, ok := ctx.GetQuery("pageSize"); ok {
-		pageSize, err = strconv.ParseInt(pageSizeStr, 10, 64)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, errorResponse(err))
-			return
+	if scored, err := s.store.GetItem(ctx, item.Collection, item.TokenID); err == nil {
+		return scored
+	}
+	return item
+}
+
+type listItemRequest struct {
+	Chain   *int8    `form:"chain"`
+	Creator string   `form:"creator"`
+	Traits  []string `form:"trait"`
+	Sort    string   `form:"sort" binding:"omitempty,oneof=created name rarity"`
+	Order   string   `form:"order" binding:"omitempty,oneof=asc desc"`
+}
+
+// traits parses trait filters written as type:value.
+func (req listItemRequest) traits() (map[string][]string, error) {
+	if len(req.Traits) == 0 {
+		return nil, nil
+	}
+
+	traits := make(map[string][]string)
+	for _, trait := range req.Traits {
+		i := strings.IndexByte(trait, ':')
+		if i <= 0 || i == len(trait)-1 {
+			return nil, fmt.Errorf("invalid trait filter %q, want type:value", trait)
 		}
+		traits[trait[:i]] = append(traits[trait[:i]], trait[i+1:])
 	}
 
-	items, err = s.store.GetItems(ctx, int(page), int(pageSize))
+	return traits, nil
+}
+
+func (s *Server) listItem(ctx *gin.Context) {
+	var req listItemRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	s.queryItems(ctx, 0, req)
+}
+
+func (s *Server) listCollectionItem(ctx *gin.Context) {
+	var req listItemRequest
+	id, err := strconv.Atoi(ctx.Param("collection"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if err = ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	s.queryItems(ctx, id, req)
+}
+
+// queryItems lists the items selected by req, in collection when it is not
+// zero. Items of hidden collections are only listed to their creator.
+func (s *Server) queryItems(ctx *gin.Context, collection int, req listItemRequest) {
+	p, err := bindPage(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	traits, err := req.traits()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+
+	arg := db.ItemQuery{
+		Collection:    collection,
+		Chain:         req.Chain,
+		Creator:       req.Creator,
+		Traits:        traits,
+		IncludeHidden: req.Creator != "" && req.Creator == authAddress(ctx),
+		Sort:          req.Sort,
+		Desc:          sortDesc(req.Sort, req.Order),
+		Page:          p,
+	}
+	items, next, err := s.store.GetItems(ctx, arg)
+	if errors.Is(err, db.ErrInvalidCursor) {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
 		return
 	}
 
-	ctx.JSON(http.StatusOK, items)
+	pageResponse(ctx, p, items, next)
 }
 
-func (s *Server) listCollectionItem(ctx *gin.Context) {
-	var (
-		err      error
-		id       int64
-		page     int64 = 1
-		pageSize int64 = 10
-		items    []*db.Item
-	)
-
-	id, err = strconv.ParseInt(ctx.Param("collection"), 10, 64)
+func (s *Server) listCollectionTraits(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("collection"))
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, errorResponse(err))
 		return
 	}
 
-	if pageStr, ok := ctx.GetQuery("page"); ok {
-		page, err = strconv.ParseInt(pageStr, 10, 64)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, errorResponse(err))
-			return
+	traits, err := s.store.GetCollectionTraits(ctx, id)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, traits)
+}
+
+type updateItemRequest struct {
+	Name        *string        `json:"name" binding:"omitempty,min=1,max=32"`
+	Image       *string        `json:"image" binding:"omitempty,max=128"`
+	Description *string        `json:"description" binding:"omitempty,max=128"`
+	Properties  *db.Attributes `json:"properties"`
+	TokenURI    *string        `json:"token_uri" binding:"omitempty,max=256"`
+	Hidden      *bool          `json:"hidden"`
+}
+
+// item loads the item named by the collection and token_id parameters. It
+// writes a 404 for a missing item, or for a hidden item or an item of a hidden
+// collection unless the caller is its creator.
+func (s *Server) item(ctx *gin.Context) (*db.Item, bool) {
+	collection, err := strconv.Atoi(ctx.Param("collection"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return nil, false
+	}
+	tokenID, err := strconv.Atoi(ctx.Param("token_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return nil, false
+	}
+
+	item, err := s.store.GetItem(ctx, collection, tokenID)
+	if errors.Is(err, db.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, errorResponse(err))
+		return nil, false
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return nil, false
+	}
+	if item.Creator == authAddress(ctx) {
+		return item, true
+	}
+
+	hidden := item.Hidden
+	if !hidden {
+		c, err := s.store.GetCollectionByID(ctx, collection)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+			return nil, false
 		}
+		hidden = err == nil && c.Visible == 0
 	}
-	if pageSizeStr, ok := ctx.GetQuery("pageSize"); ok {
-		pageSize, err = strconv.ParseInt(pageSizeStr, 10, 64)
-		if err != nil {
+	if hidden {
+		ctx.JSON(http.StatusNotFound, errorResponse(db.ErrNotFound))
+		return nil, false
+	}
+
+	return item, true
+}
+
+// ownItem is item for endpoints restricted to the creator.
+func (s *Server) ownItem(ctx *gin.Context) (*db.Item, bool) {
+	item, ok := s.item(ctx)
+	if !ok {
+		return nil, false
+	}
+	if item.Creator != authAddress(ctx) {
+		ctx.JSON(http.StatusForbidden, errorResponse(errForbidden))
+		return nil, false
+	}
+
+	return item, true
+}
+
+func (s *Server) getItem(ctx *gin.Context) {
+	item, ok := s.item(ctx)
+	if !ok {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, item)
+}
+
+func (s *Server) updateItem(ctx *gin.Context) {
+	var req updateItemRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if req.Properties != nil {
+		if err := req.Properties.Validate(); err != nil {
 			ctx.JSON(http.StatusBadRequest, errorResponse(err))
 			return
 		}
 	}
 
-	items, err = s.store.GetCollectionItems(ctx, int(id), int(page), int(pageSize))
+	if !s.checkMedia(ctx, req.Image) {
+		return
+	}
+
+	item, ok := s.ownItem(ctx)
+	if !ok {
+		return
+	}
+
+	arg := db.UpdateItemParams{
+		Name:        req.Name,
+		Image:       req.Image,
+		Description: req.Description,
+		Properties:  req.Properties,
+		TokenURI:    req.TokenURI,
+		Hidden:      req.Hidden,
+	}
+	item, err := s.store.UpdateItem(ctx, item.Collection, item.TokenID, arg)
+	if errors.Is(err, db.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, errorResponse(err))
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	if req.Properties != nil {
+		item = s.rescore(ctx, item)
+	}
+
+	ctx.JSON(http.StatusOK, item)
+}
+
+// refreshItem fetches the metadata of an item from its token URI again and
+// replaces the name, description, image and properties of the item with it.
+func (s *Server) refreshItem(ctx *gin.Context) {
+	item, ok := s.ownItem(ctx)
+	if !ok {
+		return
+	}
+	if item.TokenURI == "" {
+		ctx.JSON(http.StatusBadRequest, errorResponse(errNoTokenURI))
+		return
+	}
+
+	m, err := s.metadata.Fetch(ctx, item.TokenURI, item.TokenID)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, errorResponse(err))
+		return
+	}
+	m.Apply(item)
+
+	arg := db.UpdateItemParams{
+		Name:        &item.Name,
+		Image:       &item.Image,
+		Description: &item.Description,
+		Properties:  &item.Properties,
+	}
+	item, err = s.store.UpdateItem(ctx, item.Collection, item.TokenID, arg)
+	if errors.Is(err, db.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, errorResponse(err))
+		return
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
 		return
 	}
 
-	ctx.JSON(http.StatusOK, items)
+	ctx.JSON(http.StatusOK, s.rescore(ctx, item))
+}
+
+// deleteItem deletes an item that was never sold and has no open order.
+func (s *Server) deleteItem(ctx *gin.Context) {
+	item, ok := s.ownItem(ctx)
+	if !ok {
+		return
+	}
+	if item.Owner != item.Creator {
+		ctx.JSON(http.StatusConflict, errorResponse(errItemSold))
+		return
+	}
+	if s.hasOpenOrders(item.Collection, item.TokenID) {
+		ctx.JSON(http.StatusConflict, errorResponse(errOpenOrders))
+		return
+	}
+
+	err := s.store.DeleteItem(ctx, item.Collection, item.TokenID)
+	if errors.Is(err, db.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, errorResponse(err))
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	s.stats.ItemRemoved(item.Collection, item.Owner)
+	if err = s.store.UpdateRarity(ctx, item.Collection); err != nil {
+		logrus.WithError(err).WithField("collection", item.Collection).Error("cannot update rarity")
+	}
+
+	ctx.JSON(http.StatusOK, msgResponse("item deleted"))
 }
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"cdex/db"
+	"cdex/exchange"
+	"context"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// journalBuffer is how many records may wait for the database before the
+// matching path is slowed down to the speed of the writer.
+const journalBuffer = 4096
+
+// A record that cannot be written is tried journalAttempts times, waiting
+// journalBackoff after the first failure and twice as long after each next
+// one, up to journalMaxBackoff.
+const (
+	journalAttempts   = 8
+	journalBackoff    = 100 * time.Millisecond
+	journalMaxBackoff = 5 * time.Second
+)
+
+// journal keeps the orders and trades tables in sync with the exchange. It
+// records the state of every order touched by an event, and every trade,
+// while the exchange is locked, and writes the records in order from a single
+// goroutine. Records are either *exchange.Order or *matchRecord.
+//
+// Once an order in a final state is written, its client order id is released
+// with release: storage now guards against its reuse.
+//
+// Failed writes are retried with backoff. When a record still cannot be
+// written, failed is closed so that the server is shut down rather than
+// trading on with a database that no longer follows the engine; the records
+// left are then tried once each.
+type journal struct {
+	store   db.Storage
+	records chan interface{}
+	done    chan struct{}
+	backoff time.Duration
+	release func(*exchange.Order)
+
+	failed   chan struct{}
+	failOnce sync.Once
+}
+
+// matchRecord is a match: the new state of both orders and the trade, which
+// also transfers the token. They are written in one transaction.
+type matchRecord struct {
+	ask, bid *exchange.Order
+	trade    *db.Trade
+}
+
+func newJournal(store db.Storage, release func(*exchange.Order)) *journal {
+	j := &journal{
+		store:   store,
+		records: make(chan interface{}, journalBuffer),
+		done:    make(chan struct{}),
+		backoff: journalBackoff,
+		release: release,
+		failed:  make(chan struct{}),
+	}
+	go j.run()
+
+	return j
+}
+
+// onEvent is registered as an exchange listener.
+func (j *journal) onEvent(ev exchange.Event) {
+	if ev.Type == exchange.EventMatch {
+		m := ev.Match
+		j.records <- &matchRecord{ask: m.Ask.Copy(), bid: m.Bid.Copy(), trade: &db.Trade{
+			Market:     string(ev.Market),
+			Collection: m.Collection,
+			TokenID:    m.TokenID,
+			Chain:      m.Chain,
+			Price:      m.Price,
+			Size:       m.SizeFilled,
+			Currency:   m.Currency,
+			Buyer:      m.Bid.Owner,
+			Seller:     m.Ask.Owner,
+			BidOrder:   m.Bid.ID,
+			AskOrder:   m.Ask.ID,
+			CreatedAt:  time.Unix(0, m.Timestamp),
+		}}
+		return
+	}
+
+	j.records <- ev.Order.Copy()
+}
+
+func (j *journal) run() {
+	defer close(j.done)
+
+	for record := range j.records {
+		if err := j.write(record); err != nil {
+			entry := logrus.WithError(err)
+			switch r := record.(type) {
+			case *exchange.Order:
+				entry.WithField("order", r.ID).Error("cannot persist order")
+			case *matchRecord:
+				entry.WithField("bid", r.bid.ID).WithField("ask", r.ask.ID).Error("cannot persist match")
+			}
+			j.failOnce.Do(func() { close(j.failed) })
+			continue
+		}
+		switch r := record.(type) {
+		case *exchange.Order:
+			j.release(r)
+		case *matchRecord:
+			j.release(r.ask)
+			j.release(r.bid)
+		}
+	}
+}
+
+// write writes one record, retrying with backoff until it is written, it has
+// been tried journalAttempts times or the journal has failed.
+func (j *journal) write(record interface{}) error {
+	delay := j.backoff
+	for attempt := 1; ; attempt++ {
+		var err error
+		switch r := record.(type) {
+		case *exchange.Order:
+			err = j.store.UpsertOrder(context.Background(), r)
+		case *matchRecord:
+			err = j.store.RunInTx(context.Background(), r.write)
+		}
+		if err == nil || attempt == journalAttempts || j.hasFailed() {
+			return err
+		}
+		logrus.WithError(err).WithField("attempt", attempt).Warn("cannot persist journal record, retrying")
+		time.Sleep(delay)
+		if delay *= 2; delay > journalMaxBackoff {
+			delay = journalMaxBackoff
+		}
+	}
+}
+
+func (j *journal) hasFailed() bool {
+	select {
+	case <-j.failed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *matchRecord) write(tx db.Storage) error {
+	ctx := context.Background()
+	if err := tx.UpsertOrder(ctx, r.ask); err != nil {
+		return err
+	}
+	if err := tx.UpsertOrder(ctx, r.bid); err != nil {
+		return err
+	}
+	return tx.InsertTrade(ctx, r.trade)
+}
+
+// Close writes the pending records and stops the journal.
+func (j *journal) Close() {
+	close(j.records)
+	<-j.done
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"cdex/db"
+	"cdex/exchange"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// flakyStore fails the first failures writes of orders.
+type flakyStore struct {
+	db.Storage
+	mu       sync.Mutex
+	failures int
+}
+
+func (f *flakyStore) UpsertOrder(ctx context.Context, order *exchange.Order) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("connection refused")
+	}
+	return f.Storage.UpsertOrder(ctx, order)
+}
+
+func TestJournalRetry(t *testing.T) {
+	ctx := context.Background()
+	store := &flakyStore{Storage: db.NewMemoryDB(), failures: journalAttempts - 1}
+	j := newJournal(store, exchange.NewExchange().ReleaseClientOrderID)
+	j.backoff = 0
+
+	order := exchange.NewOrder("alice", "eth", false, 1, 2, 1, 10)
+	j.onEvent(exchange.Event{Type: exchange.EventOrderAdded, Order: order})
+	j.Close()
+
+	assert(t, j.hasFailed(), false)
+	if _, err := store.GetOrder(ctx, order.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalFailed(t *testing.T) {
+	ctx := context.Background()
+	store := &flakyStore{Storage: db.NewMemoryDB(), failures: journalAttempts}
+	j := newJournal(store, exchange.NewExchange().ReleaseClientOrderID)
+	j.backoff = 0
+
+	lost := exchange.NewOrder("alice", "eth", false, 1, 2, 1, 10)
+	next := exchange.NewOrder("alice", "eth", false, 1, 3, 1, 10)
+	j.onEvent(exchange.Event{Type: exchange.EventOrderAdded, Order: lost})
+	j.onEvent(exchange.Event{Type: exchange.EventOrderAdded, Order: next})
+	j.Close()
+
+	// The first order used up every attempt; the next one is still written.
+	assert(t, j.hasFailed(), true)
+	if _, err := store.GetOrder(ctx, lost.ID); err == nil {
+		t.Fatal("lost order stored")
+	}
+	assert(t, store.failures, 0)
+	if _, err := store.GetOrder(ctx, next.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalRelease(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryDB()
+	ex := exchange.NewExchange()
+	released := make(chan *exchange.Order, 4)
+	j := newJournal(store, func(o *exchange.Order) {
+		// Claims are only released once storage holds the order.
+		if stored, err := store.GetOrder(ctx, o.ID); err != nil || stored.Status != o.Status {
+			t.Errorf("order %s released before it was stored", o.ID)
+		}
+		released <- o
+	})
+	ex.Subscribe(j.onEvent)
+
+	a := exchange.NewOrder("alice", "eth", true, 1, 2, 1, 10)
+	a.ClientOrderID = "x"
+	if _, err := ex.PlaceLimitOrder(exchange.MarketFRA, 10, a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ex.CancelOrder(exchange.MarketFRA, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	ex.Close()
+	j.Close()
+
+	assert(t, (<-released).Status, exchange.OrderNew)
+	assert(t, (<-released).Status, exchange.OrderCanceled)
+}
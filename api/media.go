@@ -0,0 +1,183 @@
+package api
+
+import (
+	"cdex/media"
+	"cdex/utils"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+)
+
+// mediaFormOverhead leaves room for the rest of an upload form around the
+// file.
+const mediaFormOverhead = 64 << 10
+
+// newAssetStore returns the asset store set by MEDIA_BACKEND.
+func newAssetStore(config utils.Config) (media.AssetStore, error) {
+	switch config.MediaBackend {
+	case "", "fs":
+		return media.NewDirStore(config.MediaDir), nil
+	case "s3":
+		return media.NewS3Store(&http.Client{Timeout: time.Minute}, media.S3Config{
+			Endpoint:  config.S3Endpoint,
+			Region:    config.S3Region,
+			Bucket:    config.S3Bucket,
+			AccessKey: config.S3AccessKey,
+			SecretKey: config.S3SecretKey,
+			PublicURL: config.S3PublicURL,
+			URLExpiry: config.S3URLExpiry,
+		}), nil
+	case "ipfs":
+		return media.NewIPFSStore(&http.Client{Timeout: time.Minute}, config.IPFSAPI, config.IPFSGateway), nil
+	}
+	return nil, fmt.Errorf("unknown MEDIA_BACKEND %q, want fs, s3 or ipfs", config.MediaBackend)
+}
+
+// uploadMedia stores the image sent as the file field of a multipart form.
+// The response names the URL of the image and of its thumbnails, to be used
+// as the images of collections and items.
+func (s *Server) uploadMedia(ctx *gin.Context) {
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, s.media.MaxSize()+mediaFormOverhead)
+	header, err := ctx.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		ctx.JSON(http.StatusRequestEntityTooLarge, errorResponse(media.ErrTooLarge))
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	f, err := header.Open()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	defer f.Close()
+
+	asset, err := s.media.Save(ctx, f)
+	switch {
+	case errors.Is(err, media.ErrTooLarge):
+		ctx.JSON(http.StatusRequestEntityTooLarge, errorResponse(err))
+	case errors.Is(err, media.ErrUnsupportedType):
+		ctx.JSON(http.StatusUnsupportedMediaType, errorResponse(err))
+	case errors.Is(err, media.ErrInvalidImage):
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+	case err != nil:
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+	default:
+		ctx.JSON(http.StatusOK, asset)
+	}
+}
+
+// checkMedia writes a 400 and returns false when one of urls names an image
+// that was never uploaded. Nil urls are not set by the request.
+func (s *Server) checkMedia(ctx *gin.Context, urls ...*string) bool {
+	for _, url := range urls {
+		if url == nil {
+			continue
+		}
+		err := s.media.Check(ctx, *url)
+		if errors.Is(err, media.ErrNotUploaded) {
+			ctx.JSON(http.StatusBadRequest, errorResponse(err))
+			return false
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+			return false
+		}
+	}
+	return true
+}
+
+// serveMedia serves a stored file. Files of a store that clients can reach
+// directly are redirected to, through a signed URL for a private bucket,
+// unless MEDIA_PROXY is set; the others are proxied.
+func (s *Server) serveMedia(ctx *gin.Context) {
+	name := path.Clean("/" + ctx.Param("name"))[1:]
+	assets := s.media.Assets()
+
+	if !s.proxy {
+		url, err := assets.URL(ctx, name)
+		if errors.Is(err, media.ErrNotUploaded) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusBadGateway, errorResponse(err))
+			return
+		}
+		if url != "" {
+			ctx.Redirect(http.StatusFound, url)
+			return
+		}
+	}
+
+	f, err := assets.Open(ctx, name)
+	if errors.Is(err, media.ErrNotUploaded) {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, errorResponse(err))
+		return
+	}
+	defer f.Close()
+
+	if media.Uploaded(name) {
+		ctx.Header("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(ctx.Writer, ctx.Request, name, time.Time{}, rs)
+		return
+	}
+	ctx.DataFromReader(http.StatusOK, -1, mime.TypeByExtension(path.Ext(name)), f, nil)
+}
+
+type imageRequest struct {
+	Width   int    `form:"w" binding:"min=0"`
+	Height  int    `form:"h" binding:"min=0"`
+	Format  string `form:"format"`
+	Quality int    `form:"q" binding:"min=0,max=100"`
+}
+
+// serveImage serves an uploaded image resized to the w and h parameters and
+// encoded in format, with quality q for JPEG and WebP.
+func (s *Server) serveImage(ctx *gin.Context) {
+	var req imageRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	name := path.Clean("/" + ctx.Param("name"))[1:]
+	opts := media.VariantOptions{Width: req.Width, Height: req.Height, Format: req.Format, Quality: req.Quality}
+
+	etag, err := s.images.ETag(name, opts)
+	if err == nil && ctx.GetHeader("If-None-Match") == etag {
+		ctx.Header("ETag", etag)
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+
+	variant, err := s.images.Get(ctx, name, opts)
+	switch {
+	case errors.Is(err, media.ErrNotUploaded):
+		ctx.Status(http.StatusNotFound)
+		return
+	case errors.Is(err, media.ErrVariantNotAllowed), errors.Is(err, media.ErrInvalidImage):
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	case err != nil:
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	ctx.Header("Cache-Control", "public, max-age=31536000, immutable")
+	ctx.Header("ETag", variant.ETag)
+	ctx.Data(http.StatusOK, variant.ContentType, variant.Data)
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"bytes"
+	"cdex/media"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadMedia(t *testing.T) {
+	server := &Server{media: media.NewService(media.NewDirStore(t.TempDir()), "/static/", 1<<10)}
+	router := gin.New()
+	router.POST("/api/media", server.uploadMedia)
+	upload := func(data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "a.png")
+		part.Write(data)
+		form.Close()
+		req := httptest.NewRequest("POST", "/api/media", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 16, 16)))
+	w := upload(img.Bytes())
+	assert(t, w.Code, http.StatusOK)
+	var asset media.Asset
+	assert(t, json.Unmarshal(w.Body.Bytes(), &asset), nil)
+	assert(t, server.media.Check(context.Background(), asset.URL), nil)
+
+	assert(t, upload([]byte("GIF89a, or not")).Code, http.StatusBadRequest)
+	assert(t, upload([]byte("plain text")).Code, http.StatusUnsupportedMediaType)
+	assert(t, upload(make([]byte, 2<<10)).Code, http.StatusRequestEntityTooLarge)
+	assert(t, upload(make([]byte, 1<<20)).Code, http.StatusRequestEntityTooLarge)
+}
+
+func TestServeMedia(t *testing.T) {
+	ctx := context.Background()
+	name := strings.Repeat("ab", 32) + ".png"
+	dir := media.NewDirStore(t.TempDir())
+	if err := dir.Put(ctx, name, "image/png", []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	get := func(server *Server, path string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/static/*name", server.serveMedia)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// Files on the local disk are served.
+	server := &Server{media: media.NewService(dir, "/static/", 1<<20)}
+	w := get(server, "/static/"+name)
+	assert(t, w.Code, http.StatusOK)
+	assert(t, w.Body.String(), "png")
+	assert(t, w.Header().Get("Cache-Control"), "public, max-age=31536000, immutable")
+	assert(t, get(server, "/static/missing.png").Code, http.StatusNotFound)
+
+	// Files in a bucket are redirected to, or proxied.
+	s3 := media.NewS3Store(nil, media.S3Config{Endpoint: "http://localhost:9000", Bucket: "media", PublicURL: "https://cdn.example.com"})
+	server = &Server{media: media.NewService(s3, "/static/", 1<<20)}
+	w = get(server, "/static/"+name)
+	assert(t, w.Code, http.StatusFound)
+	assert(t, w.Header().Get("Location"), "https://cdn.example.com/"+name)
+	server = &Server{media: media.NewService(dir, "/static/", 1<<20), proxy: true}
+	assert(t, get(server, "/static/"+name).Code, http.StatusOK)
+}
+
+func TestServeImage(t *testing.T) {
+	service := media.NewService(media.NewDirStore(t.TempDir()), "/static/", 1<<20)
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 400, 200)))
+	asset, err := service.Save(context.Background(), &img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{media: service, images: media.NewVariants(service, media.VariantConfig{
+		Sizes: []int{100}, Qualities: []int{80}, Workers: 1, CacheDir: t.TempDir(), CacheSize: 1 << 20,
+	})}
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/img/*name", server.serveImage)
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	path := "/img/" + asset.Hash + ".png"
+	w := get(path+"?w=100&format=jpeg", "")
+	assert(t, w.Code, http.StatusOK)
+	assert(t, w.Header().Get("Content-Type"), "image/jpeg")
+	assert(t, w.Header().Get("Cache-Control"), "public, max-age=31536000, immutable")
+	etag := w.Header().Get("ETag")
+	assert(t, get(path+"?w=100&format=jpeg&q=80", etag).Code, http.StatusNotModified)
+	assert(t, get(path+"?w=100", etag).Code, http.StatusOK)
+	assert(t, get(path+"?w=101", "").Code, http.StatusBadRequest)
+	w = get(path+"?w=100&format=webp", "")
+	if media.WebPSupported {
+		assert(t, w.Code, http.StatusOK)
+		assert(t, w.Header().Get("Content-Type"), "image/webp")
+	} else {
+		assert(t, w.Code, http.StatusBadRequest)
+	}
+	assert(t, get(path+"?format=gif", "").Code, http.StatusBadRequest)
+	assert(t, get("/img/test.png?w=100", "").Code, http.StatusNotFound)
+}
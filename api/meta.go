@@ -0,0 +1,40 @@
+package api
+
+import (
+	"cdex/registry"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// chainResponse is a registered chain with its currencies. The RPC endpoint
+// of the chain may hold an API key and is not shown.
+type chainResponse struct {
+	ID            int8                 `json:"id"`
+	ChainID       int64                `json:"chain_id"`
+	Name          string               `json:"name"`
+	Explorer      string               `json:"explorer"`
+	Confirmations int64                `json:"confirmations"`
+	Currencies    []*registry.Currency `json:"currencies"`
+}
+
+// listChains lists the supported chains and their currencies, for clients to
+// render chain names and price amounts.
+func (s *Server) listChains(ctx *gin.Context) {
+	chains := []*chainResponse{}
+	for _, c := range s.registry.Chains() {
+		currencies := s.registry.Currencies(c.ID)
+		if currencies == nil {
+			currencies = []*registry.Currency{}
+		}
+		chains = append(chains, &chainResponse{
+			ID:            c.ID,
+			ChainID:       c.ChainID,
+			Name:          c.Name,
+			Explorer:      c.Explorer,
+			Confirmations: c.Confirmations,
+			Currencies:    currencies,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, chains)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"cdex/db"
+	"cdex/media"
+	"cdex/registry"
+	"cdex/stats"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestListChains(t *testing.T) {
+	chains, err := registry.New(
+		[]*registry.Chain{{ID: 1, ChainID: 1, Name: "Ethereum", RPC: "https://key@rpc.example.com", Confirmations: 12}},
+		[]*registry.Currency{{Symbol: "eth", Chain: 1, Decimals: 18}},
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{registry: chains}
+	router := gin.New()
+	router.GET("/api/meta/chains", server.listChains)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/meta/chains", nil))
+	assert(t, w.Code, http.StatusOK)
+	assert(t, strings.Contains(w.Body.String(), "rpc.example.com"), false)
+	var res []*chainResponse
+	if err = json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, res, []*chainResponse{{ID: 1, ChainID: 1, Name: "Ethereum", Confirmations: 12,
+		Currencies: []*registry.Currency{{Symbol: "eth", Chain: 1, Decimals: 18}}}})
+}
+
+func TestRegistryValidation(t *testing.T) {
+	server := &Server{
+		store:    db.NewMemoryDB(),
+		stats:    stats.NewTracker(),
+		media:    media.NewService(media.NewDirStore(t.TempDir()), "/static/", 1<<20),
+		registry: registry.Default(),
+	}
+	send := func(path, caller, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		as := func(ctx *gin.Context) { ctx.Set(authAddressKey, caller) }
+		router.POST("/api/collection", as, server.createCollection)
+		router.POST("/api/item", as, server.createItem)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return w
+	}
+
+	collection := `{"name":"c","symbol":"C","image":"a.png","background":"b.png","banner":"c.png",`
+	assert(t, send("/api/collection", "alice", collection+`"chain":1,"currency":"doge"}`).Code, http.StatusBadRequest)
+	assert(t, send("/api/collection", "alice", collection+`"chain":100,"currency":"eth"}`).Code, http.StatusBadRequest)
+	w := send("/api/collection", "alice", collection+`"creator":"bob","chain":1,"currency":"ETH"}`)
+	assert(t, w.Code, http.StatusOK)
+	var c db.Collection
+	json.Unmarshal(w.Body.Bytes(), &c)
+	assert(t, c.Currency, "eth")
+	assert(t, c.Creator, "alice")
+
+	assert(t, send("/api/item", "alice", `{"collection":1,"token_id":1,"chain":100}`).Code, http.StatusBadRequest)
+	assert(t, send("/api/item", "alice", `{"collection":2,"token_id":1,"chain":1}`).Code, http.StatusNotFound)
+	assert(t, send("/api/item", "bob", `{"collection":1,"token_id":1,"chain":1}`).Code, http.StatusForbidden)
+	// Items are on the chain of their collection.
+	assert(t, send("/api/item", "alice", `{"collection":1,"token_id":1,"chain":2}`).Code, http.StatusBadRequest)
+	w = send("/api/item", "alice", `{"collection":1,"token_id":1,"chain":1,"creator":"bob"}`)
+	assert(t, w.Code, http.StatusOK)
+	var item db.Item
+	json.Unmarshal(w.Body.Bytes(), &item)
+	assert(t, item.Creator, "alice")
+	w = send("/api/item", "alice", `{"collection":1,"token_id":2}`)
+	assert(t, w.Code, http.StatusOK)
+	json.Unmarshal(w.Body.Bytes(), &item)
+	assert(t, item.Chain, int8(1))
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// corsHeaders are the request headers browsers may send cross-origin: the
+// session and API key headers, and Idempotency-Key.
+var corsHeaders = strings.Join([]string{
+	"Authorization", "Content-Type", idempotencyHeader,
+	apiKeyHeader, apiTimestampHeader, apiSignatureHeader,
+}, ", ")
+
+// corsMiddleware lets browsers on origins call the API; "*" allows every
+// origin. Preflight requests are answered without reaching the routes.
+// Credentials go in headers rather than cookies, so they are not allowed.
+func corsMiddleware(origins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		allowed[strings.TrimSuffix(o, "/")] = true
+	}
+
+	return func(ctx *gin.Context) {
+		origin := ctx.GetHeader("Origin")
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			ctx.Next()
+			return
+		}
+
+		h := ctx.Writer.Header()
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Expose-Headers", idempotencyReplayedHeader)
+		if ctx.Request.Method == http.MethodOptions && ctx.GetHeader("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, DELETE")
+			h.Set("Access-Control-Allow-Headers", corsHeaders)
+			h.Set("Access-Control-Max-Age", "600")
+			ctx.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// defaultMaxBodySize bounds request bodies when MAX_BODY_SIZE is not set.
+const defaultMaxBodySize = 1 << 20
+
+// bodyLimit returns the largest body accepted by the route of ctx. Uploads and
+// imports have larger limits of their own.
+func (s *Server) bodyLimit(ctx *gin.Context) int64 {
+	switch ctx.FullPath() {
+	case "/api/media":
+		return s.media.MaxSize() + mediaFormOverhead
+	case "/api/collection/:id/import":
+		return maxImportSize
+	}
+	if s.maxBody > 0 {
+		return s.maxBody
+	}
+	return defaultMaxBodySize
+}
+
+// bodyLimitMiddleware bounds request bodies to the limit of their route,
+// before any middleware reads them.
+func (s *Server) bodyLimitMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		max := s.bodyLimit(ctx)
+		if ctx.Request.ContentLength > max {
+			ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, errorResponse(errBodyTooLarge))
+			return
+		}
+		if ctx.Request.Body != nil {
+			ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, max)
+		}
+		ctx.Next()
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"cdex/db"
+	"cdex/media"
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	router := gin.New()
+	router.Use(corsMiddleware([]string{"https://app.example/"}))
+	router.GET("/api/search", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+
+	send := func(method, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/search", nil)
+		r.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send(http.MethodGet, "https://app.example")
+	assert(t, w.Code, http.StatusOK)
+	assert(t, w.Header().Get("Access-Control-Allow-Origin"), "https://app.example")
+	w = send(http.MethodOptions, "https://app.example")
+	assert(t, w.Code, http.StatusNoContent)
+	assert(t, strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), idempotencyHeader), true)
+	w = send(http.MethodGet, "https://evil.example")
+	assert(t, w.Code, http.StatusOK)
+	assert(t, w.Header().Get("Access-Control-Allow-Origin"), "")
+}
+
+func TestBodyLimit(t *testing.T) {
+	store := db.NewMemoryDB()
+	server := &Server{
+		store:   store,
+		keys:    newKeyring("master"),
+		maxBody: 8,
+		media:   media.NewService(media.NewDirStore(t.TempDir()), "/static/", 1<<10),
+	}
+	if _, err := store.InsertAPIKey(context.Background(), db.CreateAPIKeyParams{
+		ID: "key", Owner: "alice", SecretHash: hashToken(server.keys.secret("key")),
+		Scopes: []string{ScopeWrite}, ExpiresAt: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	ok := func(ctx *gin.Context) { ctx.Status(http.StatusOK) }
+	router.POST("/api/order", server.bodyLimitMiddleware(), ok)
+	router.POST("/api/media", server.bodyLimitMiddleware(), ok)
+	// Without the middleware, the API key check still bounds what it reads.
+	router.POST("/api/item", server.authMiddleware(ScopeWrite), ok)
+
+	send := func(path, body string, chunked bool) int {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if chunked {
+			r.ContentLength = -1
+		}
+		r.Header.Set(apiKeyHeader, "key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert(t, send("/api/order", "{}", false), http.StatusOK)
+	assert(t, send("/api/order", "0123456789", false), http.StatusRequestEntityTooLarge)
+	assert(t, send("/api/media", "0123456789", false), http.StatusOK)
+	assert(t, send("/api/item", "0123456789", true), http.StatusRequestEntityTooLarge)
+	assert(t, send("/api/item", "{}", true), http.StatusUnauthorized)
+}
@@ -1,12 +1,13 @@
 package api
 
 import (
+	"cdex/db"
 	"cdex/exchange"
 	"errors"
-	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
-	"strconv"
+	"strings"
+	"time"
 )
 
 type PlaceOrderRequest struct {
@@ -18,6 +19,8 @@ type PlaceOrderRequest struct {
 	TokenID    int     `json:"token_id" binding:"required,numeric"`
 	Quantity   int     `json:"quantity" binding:"required,numeric"`
 	Price      float64 `json:"price"`
+
+	ClientOrderID string `json:"client_order_id" binding:"max=64"`
 }
 
 type PlaceOrderRequest2 struct {
@@ -30,90 +33,162 @@ type PlaceOrderRequest2 struct {
 	TokenID    int                `json:"token_id" binding:"required,numeric"`
 	Quantity   int                `json:"quantity" binding:"required,numeric"`
 	Price      float64            `json:"price"`
-}
+	ExpiresAt  int64              `json:"expires_at"`
 
-type OrderData struct {
-	ID         string  `json:"id"`
-	Currency   string  `json:"currency"`
-	Owner      string  `json:"owner"`
-	Bid        bool    `json:"bid"`
-	Collection int     `json:"collection"`
-	TokenID    int     `json:"token_id"`
-	Quantity   int     `json:"quantity"`
-	Price      float64 `json:"price"`
-	Timestamp  int64   `json:"timestamp"`
+	ClientOrderID string `json:"client_order_id" binding:"max=64"`
 }
 
 type OrderBookData struct {
-	TotalBidVolume int          `json:"total_bid_volume"`
-	TotalAskVolume int          `json:"total_ask_volume"`
-	Asks           []*OrderData `json:"asks"`
-	Bids           []*OrderData `json:"bids"`
+	TotalBidVolume int               `json:"total_bid_volume"`
+	TotalAskVolume int               `json:"total_ask_volume"`
+	Asks           []*exchange.Order `json:"asks"`
+	Bids           []*exchange.Order `json:"bids"`
+}
+
+// MarketData describes a market: the currencies it accepts, and a quote for
+// every currency with resting orders.
+type MarketData struct {
+	Market     exchange.Market  `json:"market"`
+	Currencies []string         `json:"currencies"`
+	Quotes     []exchange.Quote `json:"quotes"`
 }
 
 func (s *Server) getMarket(ctx *gin.Context) {
+	markets := []*MarketData{}
+	for _, market := range s.ex.Markets() {
+		ob, err := s.ex.OrderBook(market)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+			return
+		}
 
+		data := MarketData{Market: market, Currencies: s.ex.Currencies(market), Quotes: ob.Quotes()}
+		if data.Currencies == nil {
+			data.Currencies = []string{}
+		}
+		markets = append(markets, &data)
+	}
+
+	ctx.JSON(http.StatusOK, markets)
+}
+
+func bookOrders(limits []*exchange.Limit) ([]*exchange.Order, int) {
+	var (
+		orders = []*exchange.Order{}
+		volume int
+	)
+	for _, limit := range limits {
+		volume += limit.TotalVolume
+		orders = append(orders, limit.Orders...)
+	}
+	return orders, volume
 }
 
 func (s *Server) getMartBook2(ctx *gin.Context) {
 	market := exchange.Market(ctx.Param("market"))
 	ob, err := s.ex.OrderBook(market)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		ctx.JSON(http.StatusNotFound, errorResponse(err))
 		return
 	}
 
-	orderBookData := OrderBookData{
-		TotalBidVolume: ob.BidTotalVolume(),
-		TotalAskVolume: ob.AskTotalVolume(),
-		Asks:           []*OrderData{},
-		Bids:           []*OrderData{},
-	}
-
-	for _, limit := range ob.Asks() {
-		for _, o := range limit.Orders {
-			order := OrderData{
-				ID:         o.ID,
-				Currency:   o.Currency,
-				Owner:      o.Owner,
-				Bid:        o.Bid,
-				Collection: o.Collection,
-				TokenID:    o.TokenID,
-				Quantity:   o.Quantity,
-				Timestamp:  o.Timestamp,
-				Price:      limit.Price,
-			}
-			orderBookData.Asks = append(orderBookData.Asks, &order)
-		}
+	var orderBookData OrderBookData
+	bids, asks := ob.Depth()
+	orderBookData.Bids, orderBookData.TotalBidVolume = bookOrders(bids)
+	orderBookData.Asks, orderBookData.TotalAskVolume = bookOrders(asks)
+
+	ctx.JSON(http.StatusOK, orderBookData)
+}
+
+type PlaceOrderResponse2 struct {
+	OrderID       string           `json:"order_id"`
+	ClientOrderID string           `json:"client_order_id,omitempty"`
+	Matches       []exchange.Match `json:"matches"`
+}
+
+type PlaceOrderResponse struct {
+	OrderID       string `json:"order_id"`
+	ClientOrderID string `json:"client_order_id,omitempty"`
+}
+
+// checkClientOrderID rejects a client order id already used by owner. The
+// engine only knows the ids it has seen since startup; older orders are found
+// in storage.
+func (s *Server) checkClientOrderID(ctx *gin.Context, owner, clientOrderID string) bool {
+	if clientOrderID == "" {
+		return true
+	}
+
+	_, err := s.store.GetOrderByClientID(ctx, owner, clientOrderID)
+	if errors.Is(err, db.ErrNotFound) {
+		return true
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return false
 	}
 
-	for _, limit := range ob.Bids() {
-		for _, o := range limit.Orders {
-			order := OrderData{
-				ID:         o.ID,
-				Currency:   o.Currency,
-				Owner:      o.Owner,
-				Bid:        o.Bid,
-				Collection: o.Collection,
-				TokenID:    o.TokenID,
-				Quantity:   o.Quantity,
-				Timestamp:  o.Timestamp,
-				Price:      limit.Price,
-			}
-			orderBookData.Bids = append(orderBookData.Bids, &order)
+	ctx.JSON(http.StatusConflict, errorResponse(exchange.ErrDuplicateClientOrderID))
+	return false
+}
+
+// hasOpenOrders reports whether a book holds an order for the collection, or
+// for one of its tokens when tokenID is not zero.
+func (s *Server) hasOpenOrders(collection, tokenID int) bool {
+	filter := func(o *exchange.Order) bool {
+		return o.Collection == collection && (tokenID == 0 || o.TokenID == tokenID)
+	}
+	for _, market := range s.ex.Markets() {
+		ob, err := s.ex.OrderBook(market)
+		if err != nil {
+			continue
+		}
+		if len(ob.Levels(true, filter)) > 0 || len(ob.Levels(false, filter)) > 0 {
+			return true
 		}
 	}
+	return false
+}
 
-	ctx.JSON(http.StatusOK, orderBookData)
+// orderChain resolves the currency of an order against the chain of the
+// collection it trades, since a symbol names a different token on each chain.
+// It writes the response and returns false when the collection is missing or
+// the currency is not on its chain.
+func (s *Server) orderChain(ctx *gin.Context, collection int, currency *string) (int8, bool) {
+	c, err := s.store.GetCollectionByID(ctx, collection)
+	if errors.Is(err, db.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, errorResponse(err))
+		return 0, false
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return 0, false
+	}
+	if *currency, err = s.registry.CheckCurrency(c.Chain, *currency); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return 0, false
+	}
+	return c.Chain, true
 }
 
-type PlaceOrderResponse2 struct {
-	OrderID string           `json:"order_id"`
-	Matches []exchange.Match `json:"matches"`
+// placeError maps an error from the engine to a response status.
+func placeError(err error) int {
+	switch {
+	case errors.Is(err, exchange.ErrDuplicateClientOrderID):
+		return http.StatusConflict
+	case errors.Is(err, exchange.ErrClosed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
 }
 
-type PlaceOrderResponse struct {
-	OrderID string `json:"order_id"`
+// cancelError maps an error from CancelOrder to a response status, status
+// being the one for an order that is not in the book.
+func cancelError(err error, status int) int {
+	if errors.Is(err, exchange.ErrClosed) {
+		return http.StatusServiceUnavailable
+	}
+	return status
 }
 
 func (s *Server) createOrder(ctx *gin.Context) {
@@ -131,101 +206,73 @@ func (s *Server) createOrder(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, errorResponse(errors.New("invalid quantity")))
 		return
 	}
+	// Addresses are case-insensitive; orders carry the address of the session.
+	owner := authAddress(ctx)
+	if !strings.EqualFold(req.Owner, owner) {
+		ctx.JSON(http.StatusForbidden, errorResponse(errForbidden))
+		return
+	}
+	chain, ok := s.orderChain(ctx, req.Collection, &req.Currency)
+	if !ok {
+		return
+	}
 
-	order := exchange.NewOrder(req.Owner, req.Currency, req.Bid, req.Collection, req.TokenID, req.Quantity, req.Price)
-	err = s.store.Insert(ctx, order)
-	if err != nil {
-		fmt.Println("--->>>", err)
-		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+	if req.Price <= 0 {
+		ctx.JSON(http.StatusBadRequest, errorResponse(errors.New("invalid price")))
+		return
+	}
+
+	// Orders placed through the v1 API are limit orders on the default
+	// market; the journal persists them once the engine has placed them.
+	if !s.checkClientOrderID(ctx, owner, req.ClientOrderID) {
+		return
+	}
+	order := exchange.NewOrder(owner, req.Currency, req.Bid != 0, req.Collection, req.TokenID, req.Quantity, req.Price)
+	order.Chain = chain
+	order.ClientOrderID = req.ClientOrderID
+	s.hub.track(authSession(ctx), exchange.MarketFRA, order.ID)
+	if _, err = s.ex.PlaceLimitOrder(exchange.MarketFRA, req.Price, order); err != nil {
+		s.hub.untrack(order.ID)
+		ctx.JSON(placeError(err), errorResponse(err))
 		return
 	}
 	res.OrderID = order.ID
+	res.ClientOrderID = order.ClientOrderID
 
 	ctx.JSON(http.StatusOK, res)
 }
 
 func (s *Server) getBidOrders(ctx *gin.Context) {
-	var (
-		err      error
-		page     int64 = 1
-		pageSize int64 = 10
-		orders   []*exchange.Order
-		sort     = "desc"
-		status   = "pending"
-	)
-	sortParam, _ := ctx.GetQuery("sort")
-	if len(sortParam) != 0 {
-		sort = sortParam
-	}
-	statusParam, _ := ctx.GetQuery("status")
-	if len(statusParam) != 0 {
-		status = statusParam
-	}
-
-	if pageStr, ok := ctx.GetQuery("page"); ok {
-		page, err = strconv.ParseInt(pageStr, 10, 64)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, errorResponse(err))
-			return
-		}
-	}
-	if pageSizeStr, ok := ctx.GetQuery("pageSize"); ok {
-		pageSize, err = strconv.ParseInt(pageSizeStr, 10, 64)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, errorResponse(err))
-			return
-		}
-	}
-
-	orders, err = s.store.GetOrders(ctx, 1, int(page), int(pageSize), status, sort)
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
-		return
-	}
-	fmt.Println(len(orders))
-	ctx.JSON(http.StatusOK, orders)
+	s.listOrders(ctx, true)
 }
 
 func (s *Server) getAskOrders(ctx *gin.Context) {
-	var (
-		err      error
-		page     int64 = 1
-		pageSize int64 = 10
-		orders   []*exchange.Order
-		sort     = "desc"
-		status   = "pending"
-	)
-	sortParam, _ := ctx.GetQuery("sort")
-	if len(sortParam) != 0 {
-		sort = sortParam
-	}
-	statusParam, _ := ctx.GetQuery("status")
-	if len(statusParam) != 0 {
-		status = statusParam
-	}
+	s.listOrders(ctx, false)
+}
 
-	if pageStr, ok := ctx.GetQuery("page"); ok {
-		page, err = strconv.ParseInt(pageStr, 10, 64)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, errorResponse(err))
-			return
-		}
+func (s *Server) listOrders(ctx *gin.Context, bid bool) {
+	sort := ctx.Query("sort")
+	if len(sort) == 0 {
+		sort = "desc"
 	}
-	if pageSizeStr, ok := ctx.GetQuery("pageSize"); ok {
-		pageSize, err = strconv.ParseInt(pageSizeStr, 10, 64)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, errorResponse(err))
-			return
-		}
+	status := ctx.Query("status")
+	// "pending" is how open orders were called before the order lifecycle.
+	if len(status) == 0 || status == "pending" {
+		status = db.OpenOrderStatus
+	}
+	p, err := bindPage(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
 	}
 
-	orders, err = s.store.GetOrders(ctx, 0, int(page), int(pageSize), status, sort)
+	orders, next, err := s.store.GetOrders(ctx, bid, status, sort, p)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
 		return
 	}
 
-	ctx.JSON(http.StatusOK, orders)
+	pageResponse(ctx, p, orders, next)
 }
 
 func (s *Server) placeOrder2(ctx *gin.Context) {
@@ -243,42 +290,89 @@ func (s *Server) placeOrder2(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, errorResponse(errors.New("invalid quantity")))
 		return
 	}
+	// Addresses are case-insensitive; orders carry the address of the session.
+	owner := authAddress(ctx)
+	if !strings.EqualFold(req.Owner, owner) {
+		ctx.JSON(http.StatusForbidden, errorResponse(errForbidden))
+		return
+	}
+	chain, ok := s.orderChain(ctx, req.Collection, &req.Currency)
+	if !ok {
+		return
+	}
 
-	order := exchange.NewOrder2(req.Owner, req.Currency, req.Bid, req.Collection, req.TokenID, req.Quantity)
+	if !s.checkClientOrderID(ctx, owner, req.ClientOrderID) {
+		return
+	}
+	order := exchange.NewOrder(owner, req.Currency, req.Bid, req.Collection, req.TokenID, req.Quantity, req.Price)
+	order.Chain = chain
+	order.ClientOrderID = req.ClientOrderID
+	if req.ExpiresAt > 0 {
+		order.ExpiresAt = time.Unix(req.ExpiresAt, 0)
+	}
 	res.OrderID = order.ID
+	res.ClientOrderID = order.ClientOrderID
 
 	switch req.Type {
 	case exchange.LimitOrder:
-		res.Matches, err = s.ex.PlaceLimitOrder(req.Market, req.Price, order)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		if req.Price <= 0 {
+			ctx.JSON(http.StatusBadRequest, errorResponse(errors.New("invalid price")))
 			return
 		}
-		ctx.JSON(http.StatusOK, res)
+		s.hub.track(authSession(ctx), req.Market, order.ID)
+		if res.Matches, err = s.ex.PlaceLimitOrder(req.Market, req.Price, order); err != nil {
+			s.hub.untrack(order.ID)
+		}
 	case exchange.MarketOrder:
 		res.Matches, err = s.ex.PlaceMarketOrder(req.Market, order)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, errorResponse(err))
-		}
-		ctx.JSON(http.StatusOK, res)
 	default:
 		ctx.JSON(http.StatusBadRequest, errorResponse(errors.New("unknown order type")))
+		return
+	}
+	if err != nil {
+		ctx.JSON(placeError(err), errorResponse(err))
+		return
 	}
+
+	ctx.JSON(http.StatusOK, res)
 }
 
 type CancelOrderRequest struct {
 	Market exchange.Market `json:"market" binding:"required"`
-	Bid    bool            `json:"bid" binding:"required"`
+	Bid    bool            `json:"bid"`
 	ID     string          `json:"id" binding:"required"`
 }
 
+// cancelOrder cancels an order by id alone. The engine knows resting orders
+// before the journal has stored them, so it is asked first; storage tells
+// apart the orders that are gone from those that never existed.
 func (s *Server) cancelOrder(ctx *gin.Context) {
-	var err error
 	orderID := ctx.Param("id")
 
-	err = s.store.UpdateOrderStatus(ctx, orderID, "canceled")
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+	order, ok := s.ex.Order(orderID)
+	if !ok {
+		var err error
+		order, err = s.store.GetOrder(ctx, orderID)
+		if errors.Is(err, db.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, errorResponse(err))
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+			return
+		}
+	}
+	if order.Owner != authAddress(ctx) {
+		ctx.JSON(http.StatusForbidden, errorResponse(errForbidden))
+		return
+	}
+	if !order.Status.Open() {
+		ctx.JSON(http.StatusBadRequest, errorResponse(errors.New("order is not open")))
+		return
+	}
+
+	if _, err := s.ex.CancelOrder(order.Market, orderID); err != nil {
+		ctx.JSON(cancelError(err, http.StatusBadRequest), errorResponse(err))
 		return
 	}
 
@@ -303,27 +397,20 @@ func (s *Server) cancelOrder2(ctx *gin.Context) {
 		return
 	}
 
-	if req.Bid {
-		for _, limit := range ob.Bids() {
-			for _, o := range limit.Orders {
-				if o.ID == req.ID {
-					ob.CancelOrder(o)
-					ctx.JSON(http.StatusOK, msgResponse("order canceled"))
-					return
-				}
-			}
-		}
-	} else {
-		for _, limit := range ob.Asks() {
-			for _, o := range limit.Orders {
-				if o.ID == req.ID {
-					ob.CancelOrder(o)
-					ctx.JSON(http.StatusOK, msgResponse("order canceled"))
-					return
-				}
-			}
-		}
+	o, ok := ob.Order(req.ID)
+	if !ok {
+		ctx.JSON(http.StatusNotFound, msgResponse("order not found"))
+		return
+	}
+	if o.Owner != authAddress(ctx) {
+		ctx.JSON(http.StatusForbidden, errorResponse(errForbidden))
+		return
 	}
 
-	ctx.JSON(http.StatusBadRequest, msgResponse("oder not found"))
+	if _, err = s.ex.CancelOrder(req.Market, req.ID); err != nil {
+		ctx.JSON(cancelError(err, http.StatusNotFound), errorResponse(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, msgResponse("order canceled"))
 }
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"cdex/db"
+	"cdex/exchange"
+	"cdex/registry"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOrderChain(t *testing.T) {
+	store := db.NewMemoryDB()
+	for _, chain := range []int8{1, 2} {
+		if _, err := store.InsertCollection(context.Background(), db.CreateCollectionParams{Creator: "bob", Chain: chain}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ex := exchange.NewExchange()
+	server := &Server{
+		ex:       ex,
+		store:    store,
+		hub:      newHub(ex, 0),
+		registry: registry.Default(),
+	}
+	router := gin.New()
+	router.POST("/api/v2/order", func(ctx *gin.Context) {
+		ctx.Set(authAddressKey, "alice")
+	}, server.placeOrder2)
+	send := func(collection, currency string) *httptest.ResponseRecorder {
+		body := `{"owner":"alice","currency":"` + currency + `","market":"fra","type":"limit","collection":` + collection + `,"token_id":2,"quantity":1,"price":10}`
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v2/order", strings.NewReader(body)))
+		return w
+	}
+
+	assert(t, send("3", "usdc").Code, http.StatusNotFound)
+	assert(t, send("2", "eth").Code, http.StatusBadRequest)
+	for _, collection := range []string{"1", "2"} {
+		w := send(collection, "USDC")
+		assert(t, w.Code, http.StatusOK)
+		var res PlaceOrderResponse2
+		json.Unmarshal(w.Body.Bytes(), &res)
+		ob, _ := ex.OrderBook(exchange.MarketFRA)
+		o, _ := ob.Order(res.OrderID)
+		assert(t, o.Currency, "usdc")
+		assert(t, o.Chain, int8(collection[0]-'0'))
+	}
+}
+
+func TestOrderOwner(t *testing.T) {
+	store := db.NewMemoryDB()
+	if _, err := store.InsertCollection(context.Background(), db.CreateCollectionParams{Creator: "bob", Chain: 1}); err != nil {
+		t.Fatal(err)
+	}
+	ex := exchange.NewExchange()
+	server := &Server{ex: ex, store: store, hub: newHub(ex, 0), registry: registry.Default()}
+	const address = "0x00000000000000000000000000000000000000ab"
+	as := func(ctx *gin.Context) {
+		ctx.Set(authAddressKey, address)
+	}
+	router := gin.New()
+	router.POST("/api/order", as, server.createOrder)
+	router.POST("/api/v2/order", as, server.placeOrder2)
+
+	for _, path := range []string{"/api/order", "/api/v2/order"} {
+		send := func(owner string) *httptest.ResponseRecorder {
+			body := `{"owner":"` + owner + `","currency":"eth","market":"fra","type":"limit","collection":1,"token_id":2,"quantity":1,"price":10}`
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+			return w
+		}
+
+		assert(t, send("0x00000000000000000000000000000000000000cd").Code, http.StatusForbidden)
+		// A checksummed address is the address of the session.
+		w := send("0x" + strings.ToUpper(address[2:]))
+		assert(t, w.Code, http.StatusOK)
+		var res PlaceOrderResponse2
+		json.Unmarshal(w.Body.Bytes(), &res)
+		ob, _ := ex.OrderBook(exchange.MarketFRA)
+		o, _ := ob.Order(res.OrderID)
+		assert(t, o.Owner, address)
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	store := db.NewMemoryDB()
+	ex := exchange.NewExchange()
+	server := &Server{ex: ex, store: store}
+	router := gin.New()
+	router.DELETE("/api/order/:id", func(ctx *gin.Context) {
+		ctx.Set(authAddressKey, "alice")
+	}, server.cancelOrder)
+	cancel := func(id string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/order/"+id, nil))
+		return w.Code
+	}
+
+	// Resting orders are canceled before the journal has stored them.
+	ask := exchange.NewOrder("alice", "eth", false, 1, 2, 1, 10)
+	if _, err := ex.PlaceLimitOrder(exchange.MarketFRA, 10, ask); err != nil {
+		t.Fatal(err)
+	}
+	bid := exchange.NewOrder("bob", "eth", true, 1, 2, 1, 5)
+	if _, err := ex.PlaceLimitOrder(exchange.MarketFRA, 5, bid); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, cancel(bid.ID), http.StatusForbidden)
+	assert(t, cancel(ask.ID), http.StatusOK)
+	assert(t, ask.Status, exchange.OrderCanceled)
+
+	assert(t, cancel("missing"), http.StatusNotFound)
+	if err := store.UpsertOrder(context.Background(), ask); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, cancel(ask.ID), http.StatusBadRequest)
+}
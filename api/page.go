@@ -0,0 +1,74 @@
+package api
+
+import (
+	"cdex/db"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageSize = 10
+	maxPageSize     = 100
+)
+
+var errInvalidPageSize = errors.New("invalid page size")
+
+// ListResponse is the envelope of cursor paginated lists. NextCursor is
+// passed as the cursor query parameter to fetch the next page and is empty on
+// the last page.
+type ListResponse struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// bindPage reads the pageSize and cursor query parameters of a list request.
+// Requests that still send a page number get offset pagination instead.
+func bindPage(ctx *gin.Context) (db.PageParams, error) {
+	var (
+		err error
+		p   = db.PageParams{Size: defaultPageSize}
+	)
+
+	if pageSizeStr, ok := ctx.GetQuery("pageSize"); ok {
+		p.Size, err = strconv.Atoi(pageSizeStr)
+		if err != nil {
+			return p, err
+		}
+		if p.Size < 1 || p.Size > maxPageSize {
+			return p, errInvalidPageSize
+		}
+	}
+	if cursor := ctx.Query("cursor"); cursor != "" {
+		p.Cursor, err = db.DecodeCursor(cursor)
+		return p, err
+	}
+	if pageStr, ok := ctx.GetQuery("page"); ok {
+		p.Number, err = strconv.Atoi(pageStr)
+		if err != nil {
+			return p, err
+		}
+		if p.Number < 1 {
+			p.Number = 1
+		}
+	}
+
+	return p, nil
+}
+
+// pageResponse writes a page of a list. Page number requests are answered
+// with the bare array they got before cursors, everything else with a
+// ListResponse.
+func pageResponse(ctx *gin.Context, p db.PageParams, data interface{}, next *db.Cursor) {
+	if p.Number > 0 {
+		ctx.JSON(http.StatusOK, data)
+		return
+	}
+
+	res := ListResponse{Data: data}
+	if next != nil {
+		res.NextCursor = next.Encode()
+	}
+	ctx.JSON(http.StatusOK, res)
+}
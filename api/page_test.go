@@ -0,0 +1,48 @@
+package api
+
+import (
+	"cdex/db"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPagination(t *testing.T) {
+	cursor := &db.Cursor{CreatedAt: time.Date(2023, 1, 2, 3, 4, 5, 6000, time.UTC), ID: "7"}
+
+	bind := func(query string) (*httptest.ResponseRecorder, *gin.Context, db.PageParams, error) {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest("GET", "/list?"+query, nil)
+		p, err := bindPage(ctx)
+		return w, ctx, p, err
+	}
+
+	w, ctx, p, err := bind("pageSize=5&cursor=" + cursor.Encode())
+	assert(t, err, nil)
+	assert(t, p.Size, 5)
+	assert(t, p.Cursor.CreatedAt.Equal(cursor.CreatedAt), true)
+	assert(t, p.Cursor.ID, "7")
+	pageResponse(ctx, p, []int{1, 2}, cursor)
+	var res struct {
+		Data       []int  `json:"data"`
+		NextCursor string `json:"next_cursor"`
+	}
+	assert(t, json.Unmarshal(w.Body.Bytes(), &res), nil)
+	assert(t, res.Data, []int{1, 2})
+	assert(t, res.NextCursor, cursor.Encode())
+
+	// Page numbers keep the bare array of the offset API.
+	w, ctx, p, err = bind("page=2")
+	assert(t, err, nil)
+	assert(t, p.Number, 2)
+	pageResponse(ctx, p, []int{3}, cursor)
+	assert(t, w.Body.String(), "[3]")
+
+	_, _, _, err = bind("cursor=bogus")
+	assert(t, err, db.ErrInvalidCursor)
+	_, _, _, err = bind("pageSize=1000")
+	assert(t, err, errInvalidPageSize)
+}
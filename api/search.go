@@ -0,0 +1,33 @@
+package api
+
+import (
+	"cdex/db"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+type searchRequest struct {
+	Q     string `form:"q" binding:"required,max=128"`
+	Limit int    `form:"limit" binding:"omitempty,min=1,max=50"`
+}
+
+// search looks up collections and items by full text, and creators by
+// address prefix, for typeahead.
+func (s *Server) search(ctx *gin.Context) {
+	var req searchRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultPageSize
+	}
+
+	res, err := s.store.Search(ctx, db.SearchQuery{Terms: req.Q, Limit: req.Limit})
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
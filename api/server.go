@@ -3,60 +3,277 @@ package api
 import (
 	"cdex/db"
 	"cdex/exchange"
+	"cdex/indexer"
+	"cdex/media"
+	"cdex/metadata"
+	"cdex/registry"
+	"cdex/stats"
+	"cdex/utils"
+	"context"
+	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"net/http"
 	"sync"
+	"time"
 )
 
+// metadataFetcher fetches the metadata of a token from its token URI.
+type metadataFetcher interface {
+	Fetch(ctx context.Context, uri string, tokenID int) (*metadata.Metadata, error)
+}
+
 // Server serves HTTP requests for our banking service.
 type Server struct {
 	ex      *exchange.Exchange
 	store   db.Storage
+	keys    *keyring
 	router  *gin.Engine
-	mu      sync.RWMutex
-	clients map[string]*websocket.Conn
+	http    *http.Server
+	tlsCert string
+	tlsKey  string
+	maxBody int64
+	hub     *hub
+	journal *journal
+	stats   *stats.Tracker
+
+	registry *registry.Registry
+
+	metadata metadataFetcher
+	media    *media.Service
+	images   *media.Variants
+	proxy    bool
+
+	indexers []*indexer.Indexer
+
+	// stop stops expireOrders and stopIndexers the indexers; workers counts
+	// them until they return.
+	stop         chan struct{}
+	stopIndexers context.CancelFunc
+	workers      sync.WaitGroup
+
+	inflight *inflight
 }
 
 // NewServer creates a new HTTP server and setup routing.
-func NewServer(store db.Storage) *Server {
+func NewServer(config utils.Config, store db.Storage) (*Server, error) {
 	ex := exchange.NewExchange()
+	chains, err := registry.Load(config.ChainsFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load CHAINS_FILE: %w", err)
+	}
+	for _, m := range chains.Markets() {
+		if err = ex.SetCurrencies(exchange.Market(m.Name), m.Currencies...); err != nil {
+			return nil, fmt.Errorf("cannot set currencies of market %s: %w", m.Name, err)
+		}
+	}
+	assets, err := newAssetStore(config)
+	if err != nil {
+		return nil, err
+	}
 	server := &Server{
-		ex:      ex,
-		store:   store,
-		clients: make(map[string]*websocket.Conn),
+		ex:       ex,
+		store:    store,
+		keys:     newKeyring(config.APIKeySecret),
+		hub:      newHub(ex, config.CancelGrace),
+		journal:  newJournal(store, ex.ReleaseClientOrderID),
+		stats:    stats.NewTracker(),
+		registry: chains,
+		inflight: newInflight(),
+		metadata: metadata.NewFetcher(metadata.NewClient(config.MetadataTimeout, config.IPFSGateway), config.IPFSGateway, config.MetadataMaxSize),
+		media:    media.NewService(assets, config.MediaURL, config.MediaMaxSize),
+		proxy:    config.MediaProxy,
+		tlsCert:  config.TLSCertFile,
+		tlsKey:   config.TLSKeyFile,
+		maxBody:  config.MaxBodySize,
+		stop:     make(chan struct{}),
 	}
+	ex.Subscribe(server.journal.onEvent)
+	ex.Subscribe(server.hub.onEvent)
+	ex.Subscribe(server.stats.OnEvent)
+	server.images = media.NewVariants(server.media, media.VariantConfig{
+		Sizes:     config.ImageSizes,
+		Qualities: config.ImageQualities,
+		Workers:   config.ImageWorkers,
+		CacheDir:  config.ImageCacheDir,
+		CacheSize: config.ImageCacheSize,
+	})
+	server.indexers = server.newIndexers(config)
+	server.workers.Add(1)
+	go server.expireOrders()
 
 	router := gin.Default()
+	if len(config.CORSOrigins) > 0 {
+		router.Use(corsMiddleware(config.CORSOrigins))
+	}
+	router.Use(server.bodyLimitMiddleware())
 
-	router.StaticFS("/static/", gin.Dir("./public/images", false))
+	router.GET("/static/*name", server.serveMedia)
+	router.HEAD("/static/*name", server.serveMedia)
+	router.GET("/img/*name", server.serveImage)
+	router.HEAD("/img/*name", server.serveImage)
+	router.POST("/api/media", server.authMiddleware(ScopeWrite), server.uploadMedia)
 
-	router.GET("/api/index/explore", server.listCollection)
+	router.GET("/api/index/explore", server.optionalAuthMiddleware(ScopeRead), server.listCollection)
+
+	router.GET("/api/search", server.search)
+
+	router.GET("/api/meta/chains", server.listChains)
+
+	// market data
+	router.GET("/ws", server.serveWS)
+	router.GET("/ws/private", server.authMiddleware(ScopeRead), server.servePrivateWS)
 
 	// collection
-	router.POST("/api/collection", server.createCollection)
-	router.GET("/api/collection/list", server.listCollection)
-	router.GET("/api/collection/:address/list", server.listAddressCollection)
+	router.POST("/api/collection", server.authMiddleware(ScopeWrite), server.createCollection)
+	router.GET("/api/collection/list", server.optionalAuthMiddleware(ScopeRead), server.listCollection)
+	// :id is the creator address in /list, which predates collection ids in
+	// paths; gin needs one wildcard name per segment.
+	router.GET("/api/collection/:id/list", server.optionalAuthMiddleware(ScopeRead), server.listAddressCollection)
+	router.GET("/api/collection/:id/stats", server.optionalAuthMiddleware(ScopeRead), server.getCollectionStats)
+	router.GET("/api/collection/:id", server.optionalAuthMiddleware(ScopeRead), server.getCollection)
+	router.PATCH("/api/collection/:id", server.authMiddleware(ScopeWrite), server.updateCollection)
+	router.DELETE("/api/collection/:id", server.authMiddleware(ScopeWrite), server.deleteCollection)
+	router.POST("/api/collection/:id/import", server.authMiddleware(ScopeWrite), server.importItems)
 
 	// item
-	router.POST("/api/item", server.createItem)
-	router.GET("/api/item/list", server.listItem)
-	router.GET("/api/item/:collection/list", server.listCollectionItem)
+	router.POST("/api/item", server.authMiddleware(ScopeWrite), server.createItem)
+	router.GET("/api/item/list", server.optionalAuthMiddleware(ScopeRead), server.listItem)
+	router.GET("/api/item/:collection/list", server.optionalAuthMiddleware(ScopeRead), server.listCollectionItem)
+	router.GET("/api/item/:collection/traits", server.listCollectionTraits)
+	router.GET("/api/item/:collection/:token_id", server.optionalAuthMiddleware(ScopeRead), server.getItem)
+	router.PATCH("/api/item/:collection/:token_id", server.authMiddleware(ScopeWrite), server.updateItem)
+	router.DELETE("/api/item/:collection/:token_id", server.authMiddleware(ScopeWrite), server.deleteItem)
+	router.POST("/api/item/:collection/:token_id/refresh", server.authMiddleware(ScopeWrite), server.refreshItem)
+
+	// sign-in
+	router.POST("/api/auth/nonce", server.createNonce)
+	router.POST("/api/auth/session", server.createSession)
+
+	// api key
+	router.POST("/api/apikey", server.sessionMiddleware(), server.idempotencyMiddleware(), server.createAPIKey)
+	router.GET("/api/apikey", server.sessionMiddleware(), server.listAPIKey)
+	router.DELETE("/api/apikey/:id", server.sessionMiddleware(), server.revokeAPIKey)
 
 	// order
-	router.POST("/api/order", server.createOrder)
+	router.POST("/api/order", server.authMiddleware(ScopeTrade), server.idempotencyMiddleware(), server.createOrder)
 	router.GET("/api/order/bids", server.getBidOrders)
 	router.GET("/api/order/asks", server.getAskOrders)
-	router.DELETE("/api/order/:id", server.cancelOrder)
-	router.POST("/api/order/")
+	router.DELETE("/api/order/:id", server.authMiddleware(ScopeCancel), server.idempotencyMiddleware(), server.cancelOrder)
+
+	// matching engine
+	router.GET("/api/v2/markets", server.getMarket)
+	router.GET("/api/v2/markets/:market/book", server.getMartBook2)
+	router.POST("/api/v2/order", server.authMiddleware(ScopeTrade), server.idempotencyMiddleware(), server.placeOrder2)
+	router.DELETE("/api/v2/order", server.authMiddleware(ScopeCancel), server.idempotencyMiddleware(), server.cancelOrder2)
 
 	server.router = router
+	server.http = &http.Server{
+		Addr:         config.ServerAddress,
+		Handler:      router,
+		ReadTimeout:  config.HTTPReadTimeout,
+		WriteTimeout: config.HTTPWriteTimeout,
+		IdleTimeout:  config.HTTPIdleTimeout,
+	}
 
-	return server
+	return server, nil
 }
 
-// Start runs the HTTP server on a specific address.
-func (s *Server) Start(address string) error {
-	return s.router.Run(address)
+// LoadOrders rests the pending orders from storage in the exchange books, so
+// the engine picks up where it stopped.
+func (s *Server) LoadOrders(ctx context.Context) error {
+	orders, err := s.store.GetOpenOrders(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range orders {
+		if err = s.ex.Restore(o); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadStats loads the collection statistics. It is called after LoadOrders.
+func (s *Server) LoadStats(ctx context.Context) error {
+	return s.stats.Load(ctx, s.store)
+}
+
+// expireOrders removes expired orders from the books every second, until
+// stop is closed.
+func (s *Server) expireOrders() {
+	defer s.workers.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.ex.ExpireOrders(now)
+		}
+	}
+}
+
+// Start runs the HTTP server on SERVER_ADDRESS, over TLS when a certificate
+// is configured.
+func (s *Server) Start() error {
+	if s.tlsCert != "" {
+		logrus.Infof("listening on %s with TLS", s.http.Addr)
+		return s.http.ListenAndServeTLS(s.tlsCert, s.tlsKey)
+	}
+	logrus.Infof("listening on %s", s.http.Addr)
+	return s.http.ListenAndServe()
+}
+
+// Failed is closed once the exchange can no longer be stored because writes
+// to the database keep failing. The server should then be shut down, which
+// saves the resting orders once more.
+func (s *Server) Failed() <-chan struct{} {
+	return s.journal.failed
+}
+
+// Shutdown stops the server. New orders and cancels are refused at once and
+// HTTP requests are drained until ctx is done. The WebSocket clients are then
+// sent a close frame, the journal is flushed and the resting orders are saved,
+// so that LoadOrders restores the books as they were. The storage is left
+// open for the caller to close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	// Cancel-on-disconnect cancels due while the server is down are run
+	// rather than lost.
+	s.hub.cancelPending()
+	orders := s.ex.Close()
+
+	close(s.stop)
+	if s.stopIndexers != nil {
+		s.stopIndexers()
+	}
+	s.workers.Wait()
+
+	err := s.http.Shutdown(ctx)
+	if err != nil {
+		err = fmt.Errorf("cannot drain requests: %w", err)
+	}
+	s.hub.close(ctx)
+	s.journal.Close()
+
+	// The journal logs the records it cannot write; saving every resting
+	// order again makes up for them. ctx may be done already.
+	saved := s.store.RunInTx(context.Background(), func(tx db.Storage) error {
+		for _, o := range orders {
+			if err := tx.UpsertOrder(context.Background(), o); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if saved != nil && err == nil {
+		err = fmt.Errorf("cannot save the books: %w", saved)
+	}
+	return err
 }
 
 func errorResponse(err error) gin.H {
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"cdex/db"
+	"cdex/exchange"
+	"cdex/utils"
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	store := db.NewMemoryDB()
+	server, err := NewServer(utils.Config{MediaDir: t.TempDir()}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if err = conn.WriteJSON(wsRequest{Op: "subscribe", Channels: []string{"book:fra:1:2:eth"}}); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	readMessage(t, conn)
+
+	ask := exchange.NewOrder("alice", "eth", false, 1, 2, 1, 10)
+	if _, err = server.ex.PlaceLimitOrder(exchange.MarketFRA, 10, ask); err != nil {
+		t.Fatal(err)
+	}
+	readMessage(t, conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	assert(t, errors.As(err, &closeErr) && closeErr.Code == websocket.CloseGoingAway, true)
+
+	_, err = server.ex.PlaceLimitOrder(exchange.MarketFRA, 10, exchange.NewOrder("bob", "eth", true, 1, 2, 1, 10))
+	assert(t, err, exchange.ErrClosed)
+	orders, err := store.GetOpenOrders(context.Background())
+	assert(t, err, nil)
+	assert(t, len(orders), 1)
+	assert(t, orders[0].ID, ask.ID)
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"cdex/db"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/sha3"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// nonceTTL is how long a sign-in nonce can be signed.
+	nonceTTL   = 5 * time.Minute
+	sessionTTL = 7 * 24 * time.Hour
+)
+
+var (
+	errInvalidNonce = errors.New("unknown or expired nonce")
+	addressPattern  = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+)
+
+// challenge is a sign-in nonce issued to an address.
+type challenge struct {
+	address   string
+	expiresAt time.Time
+}
+
+// issueNonce returns a new sign-in nonce for address.
+func (k *keyring) issueNonce(address string, now time.Time) (string, time.Time, error) {
+	nonce, err := randomID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for n, c := range k.nonces {
+		if now.After(c.expiresAt) {
+			delete(k.nonces, n)
+		}
+	}
+	expiresAt := now.Add(nonceTTL)
+	k.nonces[nonce] = challenge{address: address, expiresAt: expiresAt}
+
+	return nonce, expiresAt, nil
+}
+
+// useNonce consumes a nonce issued to address. A nonce is used once, whether
+// the signature turns out valid or not.
+func (k *keyring) useNonce(address, nonce string, now time.Time) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	c, ok := k.nonces[nonce]
+	delete(k.nonces, nonce)
+	if !ok || c.address != address || now.After(c.expiresAt) {
+		return errInvalidNonce
+	}
+	return nil
+}
+
+// signInMessage is the message a wallet signs with personal_sign to sign in.
+func signInMessage(address, nonce string) string {
+	return "Sign in to cDex\n\nAddress: " + address + "\nNonce: " + nonce
+}
+
+func keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// pubkeyAddress returns the lowercase Ethereum address of a public key.
+func pubkeyAddress(pub *secp256k1.PublicKey) string {
+	return "0x" + hex.EncodeToString(keccak256(pub.SerializeUncompressed()[1:])[12:])
+}
+
+// hashMessage returns the EIP-191 hash personal_sign signs.
+func hashMessage(message string) []byte {
+	return keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+}
+
+// recoverAddress returns the address of the key that signed message with
+// personal_sign. sig is r, s and v, v being 0, 1, 27 or 28.
+func recoverAddress(message string, sig []byte) (string, error) {
+	if len(sig) != 65 {
+		return "", errInvalidSignature
+	}
+	v := sig[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 1 {
+		return "", errInvalidSignature
+	}
+
+	// RecoverCompact takes the recovery code first.
+	compact := make([]byte, 65)
+	compact[0] = 27 + v
+	copy(compact[1:], sig[:64])
+	pub, _, err := ecdsa.RecoverCompact(compact, hashMessage(message))
+	if err != nil {
+		return "", errInvalidSignature
+	}
+	return pubkeyAddress(pub), nil
+}
+
+type nonceRequest struct {
+	Address string `json:"address" binding:"required"`
+}
+
+type nonceResponse struct {
+	Nonce     string    `json:"nonce"`
+	Message   string    `json:"message"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// createNonce starts a wallet sign-in: the wallet signs the returned message
+// and sends the signature to createSession.
+func (s *Server) createNonce(ctx *gin.Context) {
+	var req nonceRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	if !addressPattern.MatchString(req.Address) {
+		ctx.JSON(http.StatusBadRequest, errorResponse(errors.New("invalid address")))
+		return
+	}
+	address := strings.ToLower(req.Address)
+
+	nonce, expiresAt, err := s.keys.issueNonce(address, time.Now())
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, nonceResponse{Nonce: nonce, Message: signInMessage(address, nonce), ExpiresAt: expiresAt})
+}
+
+type sessionRequest struct {
+	Address   string `json:"address" binding:"required"`
+	Nonce     string `json:"nonce" binding:"required"`
+	Signature string `json:"signature" binding:"required"`
+}
+
+type sessionResponse struct {
+	*db.Session
+	Token string `json:"token"`
+}
+
+// createSession signs a wallet in with its signature of the sign-in message
+// and returns a session token.
+func (s *Server) createSession(ctx *gin.Context) {
+	var req sessionRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	address := strings.ToLower(req.Address)
+	now := time.Now()
+	if err := s.keys.useNonce(address, req.Nonce, now); err != nil {
+		ctx.JSON(http.StatusUnauthorized, errorResponse(err))
+		return
+	}
+
+	sig, err := hex.DecodeString(strings.TrimPrefix(req.Signature, "0x"))
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, errorResponse(errInvalidSignature))
+		return
+	}
+	signer, err := recoverAddress(signInMessage(address, req.Nonce), sig)
+	if err != nil || signer != address {
+		ctx.JSON(http.StatusUnauthorized, errorResponse(errInvalidSignature))
+		return
+	}
+
+	token, err := randomID()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	session := &db.Session{TokenHash: hashToken(token), Address: address, ExpiresAt: now.Add(sessionTTL), CreatedAt: now}
+	if err = s.store.Insert(ctx, session); err != nil {
+		ctx.JSON(http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, sessionResponse{Session: session, Token: token})
+}
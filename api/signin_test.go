@@ -0,0 +1,83 @@
+package api
+
+import (
+	"bytes"
+	"cdex/db"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// personalSign signs message like a wallet, returning r, s and v.
+func personalSign(key *secp256k1.PrivateKey, message string) string {
+	compact := ecdsa.SignCompact(key, hashMessage(message), false)
+	sig := append(append([]byte{}, compact[1:]...), compact[0])
+	return "0x" + hex.EncodeToString(sig)
+}
+
+func TestPubkeyAddress(t *testing.T) {
+	var one secp256k1.ModNScalar
+	one.SetInt(1)
+	key := secp256k1.NewPrivateKey(&one)
+	assert(t, pubkeyAddress(key.PubKey()), "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf")
+}
+
+func TestSignIn(t *testing.T) {
+	key, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := pubkeyAddress(key.PubKey())
+	server := &Server{store: db.NewMemoryDB(), keys: newKeyring("master")}
+	router := gin.New()
+	router.POST("/api/auth/nonce", server.createNonce)
+	router.POST("/api/auth/session", server.createSession)
+	router.POST("/api/apikey", server.sessionMiddleware(), server.createAPIKey)
+	send := func(path string, body interface{}, token string) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	challenge := func() nonceResponse {
+		w := send("/api/auth/nonce", nonceRequest{Address: address}, "")
+		assert(t, w.Code, http.StatusOK)
+		var res nonceResponse
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+
+	assert(t, send("/api/auth/nonce", nonceRequest{Address: "alice"}, "").Code, http.StatusBadRequest)
+
+	// A signature by another key is refused, and burns the nonce.
+	other, _ := secp256k1.GeneratePrivateKey()
+	c := challenge()
+	req := sessionRequest{Address: address, Nonce: c.Nonce, Signature: personalSign(other, c.Message)}
+	assert(t, send("/api/auth/session", req, "").Code, http.StatusUnauthorized)
+	req.Signature = personalSign(key, c.Message)
+	assert(t, send("/api/auth/session", req, "").Code, http.StatusUnauthorized)
+
+	c = challenge()
+	req = sessionRequest{Address: address, Nonce: c.Nonce, Signature: personalSign(key, c.Message)}
+	w := send("/api/auth/session", req, "")
+	assert(t, w.Code, http.StatusOK)
+	var session sessionResponse
+	json.Unmarshal(w.Body.Bytes(), &session)
+	assert(t, session.Address, address)
+	assert(t, send("/api/auth/session", req, "").Code, http.StatusUnauthorized)
+
+	w = send("/api/apikey", createAPIKeyRequest{Scopes: []string{ScopeTrade}}, session.Token)
+	assert(t, w.Code, http.StatusOK)
+	var apiKey createAPIKeyResponse
+	json.Unmarshal(w.Body.Bytes(), &apiKey)
+	assert(t, apiKey.Owner, address)
+}
@@ -0,0 +1,618 @@
+package api
+
+import (
+	"cdex/exchange"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsReadLimit  = 4096
+
+	// wsSendBuffer is how many messages may queue up for a client before it
+	// is considered too slow and disconnected.
+	wsSendBuffer = 256
+
+	tradeWindow = 24 * time.Hour
+)
+
+const (
+	channelBook   = "book"
+	channelTrades = "trades"
+	channelTicker = "ticker"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+type wsRequest struct {
+	Op       string   `json:"op"`
+	Channels []string `json:"channels"`
+}
+
+type wsMessage struct {
+	Channel string      `json:"channel"`
+	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq"`
+	Data    interface{} `json:"data"`
+}
+
+type bookData struct {
+	Bids []exchange.Level `json:"bids"`
+	Asks []exchange.Level `json:"asks"`
+}
+
+type bookUpdateData struct {
+	Bid    bool    `json:"bid"`
+	Price  float64 `json:"price"`
+	Volume int     `json:"volume"`
+}
+
+// marketBookData is the snapshot of a whole market: the levels of every token
+// and currency with resting orders.
+type marketBookData struct {
+	Books []exchange.Book `json:"books"`
+}
+
+// marketBookUpdateData is a level delta of the whole market, with the token
+// and currency of its book.
+type marketBookUpdateData struct {
+	Collection int     `json:"collection"`
+	TokenID    int     `json:"token_id"`
+	Chain      int8    `json:"chain"`
+	Currency   string  `json:"currency"`
+	Bid        bool    `json:"bid"`
+	Price      float64 `json:"price"`
+	Volume     int     `json:"volume"`
+}
+
+type tradeData struct {
+	Collection int     `json:"collection"`
+	TokenID    int     `json:"token_id"`
+	Chain      int8    `json:"chain"`
+	Currency   string  `json:"currency"`
+	Price      float64 `json:"price"`
+	Size       int     `json:"size"`
+	TakerBid   bool    `json:"taker_bid"`
+	Timestamp  int64   `json:"timestamp"`
+}
+
+type tickerData struct {
+	Market    exchange.Market `json:"market"`
+	Chain     int8            `json:"chain"`
+	Currency  string          `json:"currency"`
+	LastPrice float64         `json:"last_price"`
+	BestBid   float64         `json:"best_bid"`
+	BestAsk   float64         `json:"best_ask"`
+	Volume24h float64         `json:"volume_24h"`
+	Trades24h int             `json:"trades_24h"`
+}
+
+// channel is a parsed subscription name. Prices can only be compared within
+// one currency of one chain, so book and ticker channels are per currency:
+// "book:<market>:<collection>:<token_id>:<currency>" carries the levels of
+// one token, the orders that can match each other, and
+// "ticker:<market>:<chain>:<currency>" the trades and best prices of a
+// currency. "book:<market>" carries the levels of every token and currency of
+// the market, each tagged with its book, and "trades:<market>" every trade
+// with its currency.
+type channel struct {
+	kind       string
+	market     exchange.Market
+	collection int
+	tokenID    int
+	chain      int8
+	currency   string
+}
+
+func parseChannel(name string) (channel, error) {
+	var c channel
+	invalid := fmt.Errorf("invalid channel %q", name)
+	parts := strings.Split(name, ":")
+	if len(parts) < 2 {
+		return c, invalid
+	}
+	c.kind, c.market = parts[0], exchange.Market(parts[1])
+
+	switch {
+	case c.kind == channelBook && len(parts) == 5:
+		var err error
+		if c.collection, err = strconv.Atoi(parts[2]); err != nil {
+			return c, invalid
+		}
+		if c.tokenID, err = strconv.Atoi(parts[3]); err != nil {
+			return c, invalid
+		}
+	case c.kind == channelTicker && len(parts) == 4:
+		chain, err := strconv.ParseInt(parts[2], 10, 8)
+		if err != nil {
+			return c, invalid
+		}
+		c.chain = int8(chain)
+	case (c.kind == channelBook || c.kind == channelTrades) && len(parts) == 2:
+		return c, nil
+	default:
+		return c, invalid
+	}
+	if c.currency = strings.ToLower(parts[len(parts)-1]); c.currency == "" {
+		return c, invalid
+	}
+
+	return c, nil
+}
+
+func (c channel) String() string {
+	switch c.kind {
+	case channelBook:
+		if c.currency == "" {
+			break
+		}
+		return fmt.Sprintf("%s:%s:%d:%d:%s", c.kind, c.market, c.collection, c.tokenID, c.currency)
+	case channelTicker:
+		return fmt.Sprintf("%s:%s:%d:%s", c.kind, c.market, c.chain, c.currency)
+	}
+	return fmt.Sprintf("%s:%s", c.kind, c.market)
+}
+
+func (c channel) filter() func(*exchange.Order) bool {
+	switch c.kind {
+	case channelBook:
+		if c.currency == "" {
+			return nil
+		}
+		return func(o *exchange.Order) bool {
+			return o.Collection == c.collection && o.TokenID == c.tokenID && o.Currency == c.currency
+		}
+	case channelTicker:
+		return func(o *exchange.Order) bool {
+			return o.Chain == c.chain && o.Currency == c.currency
+		}
+	}
+	return nil
+}
+
+type wsClient struct {
+	conn *websocket.Conn
+	send chan []byte
+
+	// owner is the authenticated address of a private connection, and
+	// session the credential it was opened with.
+	owner              string
+	session            string
+	cancelOnDisconnect bool
+
+	// closeCode is the code of the close frame sent once send is closed,
+	// normal closure when zero.
+	closeCode int
+}
+
+// hub fans exchange events out to subscribed WebSocket clients. Every channel
+// has its own sequence number, and a subscription starts with a snapshot
+// carrying the current one, so a client that sees a gap can resubscribe.
+type hub struct {
+	ex *exchange.Exchange
+
+	mu       sync.Mutex
+	clients  map[*wsClient]map[string]struct{}
+	channels map[string]map[*wsClient]struct{}
+	seq      map[string]uint64
+	trades   map[exchange.Market][]tradeData
+	last     map[channel]float64
+
+	// guardians counts the live cancel-on-disconnect connections per
+	// session, and pending holds the cancel timers of sessions that have none
+	// left, started with afterFunc. placed holds the resting limit orders
+	// placed with each session, by id, and sessions the session of each.
+	grace     time.Duration
+	guardians map[string]int
+	pending   map[string]*time.Timer
+	afterFunc func(time.Duration, func()) *time.Timer
+	placed    map[string]map[string]exchange.Market
+	sessions  map[string]string
+
+	// pumps counts the running write pumps; once closed, no client is
+	// registered anymore.
+	pumps  sync.WaitGroup
+	closed bool
+}
+
+func newHub(ex *exchange.Exchange, grace time.Duration) *hub {
+	return &hub{
+		ex:        ex,
+		clients:   make(map[*wsClient]map[string]struct{}),
+		channels:  make(map[string]map[*wsClient]struct{}),
+		seq:       make(map[string]uint64),
+		trades:    make(map[exchange.Market][]tradeData),
+		last:      make(map[channel]float64),
+		grace:     grace,
+		guardians: make(map[string]int),
+		pending:   make(map[string]*time.Timer),
+		afterFunc: time.AfterFunc,
+		placed:    make(map[string]map[string]exchange.Market),
+		sessions:  make(map[string]string),
+	}
+}
+
+// serve runs the pumps of a new client until its connection is closed.
+func (h *hub) serve(c *wsClient) {
+	if !h.register(c) {
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(wsWriteWait))
+		c.conn.Close()
+		return
+	}
+	go func() {
+		defer h.pumps.Done()
+		c.writePump()
+	}()
+	h.readPump(c)
+}
+
+func (h *hub) register(c *wsClient) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return false
+	}
+	h.pumps.Add(1)
+	h.clients[c] = make(map[string]struct{})
+	if c.cancelOnDisconnect {
+		h.guardLocked(c.session)
+	}
+	return true
+}
+
+// close sends a going away close frame to every client and waits, until ctx
+// is done, for the frames to be written. Closing the connections this way
+// does not cancel the orders of cancel-on-disconnect clients.
+func (h *hub) close(ctx context.Context) {
+	h.mu.Lock()
+	h.closed = true
+	for c := range h.clients {
+		c.closeCode = websocket.CloseGoingAway
+		h.dropLocked(c)
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (h *hub) unregister(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[c]; ok && c.cancelOnDisconnect {
+		h.unguardLocked(c.session)
+	}
+	h.dropLocked(c)
+}
+
+// dropLocked removes c from every channel and closes its send queue, which
+// makes its write pump close the connection.
+func (h *hub) dropLocked(c *wsClient) {
+	subs, ok := h.clients[c]
+	if !ok {
+		return
+	}
+	for name := range subs {
+		h.leaveLocked(c, name)
+	}
+	delete(h.clients, c)
+	close(c.send)
+}
+
+func (h *hub) leaveLocked(c *wsClient, name string) {
+	delete(h.clients[c], name)
+	delete(h.channels[name], c)
+	if len(h.channels[name]) == 0 {
+		delete(h.channels, name)
+		delete(h.seq, name)
+	}
+}
+
+func (h *hub) subscribe(c *wsClient, name string) error {
+	if name == channelOrders || name == channelFills {
+		return h.subscribePrivate(c, name)
+	}
+
+	ch, err := parseChannel(name)
+	if err != nil {
+		return err
+	}
+	name = ch.String()
+
+	// Snapshot keeps the exchange from emitting while the subscription is
+	// set up, so the snapshot sequence is exact.
+	return h.ex.Snapshot(ch.market, ch.filter(), func(bids, asks []exchange.Level) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if !h.joinLocked(c, name) {
+			return
+		}
+
+		var data interface{}
+		switch ch.kind {
+		case channelBook:
+			data = bookData{Bids: bids, Asks: asks}
+			if ch.currency == "" {
+				ob, _ := h.ex.OrderBook(ch.market)
+				data = marketBookData{Books: ob.Books()}
+			}
+		case channelTrades:
+			data = append([]tradeData{}, h.pruneTradesLocked(ch.market, time.Now())...)
+		case channelTicker:
+			data = h.tickerLocked(ch, bids, asks)
+		}
+		h.sendLocked(c, wsMessage{Channel: name, Type: "snapshot", Seq: h.seq[name], Data: data})
+	})
+}
+
+// joinLocked adds c to the channel, unless c was dropped meanwhile.
+func (h *hub) joinLocked(c *wsClient, name string) bool {
+	if _, ok := h.clients[c]; !ok {
+		return false
+	}
+	if h.channels[name] == nil {
+		h.channels[name] = make(map[*wsClient]struct{})
+	}
+	h.channels[name][c] = struct{}{}
+	h.clients[c][name] = struct{}{}
+
+	return true
+}
+
+func (h *hub) unsubscribe(c *wsClient, name string) {
+	if name == channelOrders || name == channelFills {
+		name = privateChannel(name, c.owner)
+	} else if ch, err := parseChannel(name); err == nil {
+		name = ch.String()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[c]; ok {
+		h.leaveLocked(c, name)
+	}
+}
+
+// onEvent is registered as an exchange listener.
+func (h *hub) onEvent(ev exchange.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if ev.Type == exchange.EventMatch {
+		t := tradeData{
+			Collection: ev.Match.Collection,
+			TokenID:    ev.Match.TokenID,
+			Chain:      ev.Match.Chain,
+			Currency:   ev.Match.Currency,
+			Price:      ev.Match.Price,
+			Size:       ev.Match.SizeFilled,
+			TakerBid:   ev.Order.Bid,
+			Timestamp:  ev.Match.Timestamp,
+		}
+		h.trades[ev.Market] = append(h.pruneTradesLocked(ev.Market, time.Now()), t)
+		h.last[channel{kind: channelTicker, market: ev.Market, chain: t.Chain, currency: t.Currency}] = t.Price
+		h.publishLocked(channel{kind: channelTrades, market: ev.Market}.String(), t)
+	}
+
+	for _, u := range ev.Updates {
+		book := channel{kind: channelBook, market: ev.Market, collection: u.Collection, tokenID: u.TokenID, currency: u.Currency}
+		h.publishLocked(book.String(), bookUpdateData{Bid: u.Bid, Price: u.Price, Volume: u.CurrencyVolume})
+		h.publishLocked(channel{kind: channelBook, market: ev.Market}.String(), marketBookUpdateData{
+			Collection: u.Collection,
+			TokenID:    u.TokenID,
+			Chain:      u.Chain,
+			Currency:   u.Currency,
+			Bid:        u.Bid,
+			Price:      u.Price,
+			Volume:     u.CurrencyVolume,
+		})
+	}
+
+	ticker := channel{kind: channelTicker, market: ev.Market, chain: ev.Order.Chain, currency: ev.Order.Currency}
+	if name := ticker.String(); len(h.channels[name]) > 0 {
+		if ob, err := h.ex.OrderBook(ev.Market); err == nil {
+			h.publishLocked(name, h.tickerLocked(ticker, ob.Levels(true, ticker.filter()), ob.Levels(false, ticker.filter())))
+		}
+	}
+
+	h.publishPrivateLocked(ev)
+	h.forgetDoneLocked(ev)
+}
+
+func (h *hub) publishLocked(name string, data interface{}) {
+	subs := h.channels[name]
+	if len(subs) == 0 {
+		return
+	}
+
+	h.seq[name]++
+	msg, err := json.Marshal(wsMessage{Channel: name, Type: "update", Seq: h.seq[name], Data: data})
+	if err != nil {
+		return
+	}
+	for c := range subs {
+		h.queueLocked(c, msg)
+	}
+}
+
+func (h *hub) sendLocked(c *wsClient, m wsMessage) {
+	msg, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	h.queueLocked(c, msg)
+}
+
+// queueLocked never blocks: a client whose queue is full is dropped so a slow
+// consumer cannot hold up the matching path.
+func (h *hub) queueLocked(c *wsClient, msg []byte) {
+	select {
+	case c.send <- msg:
+	default:
+		h.dropLocked(c)
+	}
+}
+
+// pruneTradesLocked drops trades older than the ticker window and returns the
+// remaining ones.
+func (h *hub) pruneTradesLocked(market exchange.Market, now time.Time) []tradeData {
+	trades := h.trades[market]
+	cutoff := now.Add(-tradeWindow).UnixNano()
+	i := 0
+	for i < len(trades) && trades[i].Timestamp < cutoff {
+		i++
+	}
+	h.trades[market] = trades[i:]
+
+	return h.trades[market]
+}
+
+// tickerLocked returns the ticker of a ticker channel, given the levels of
+// its currency.
+func (h *hub) tickerLocked(ch channel, bids, asks []exchange.Level) tickerData {
+	t := tickerData{Market: ch.market, Chain: ch.chain, Currency: ch.currency, LastPrice: h.last[ch]}
+	for _, trade := range h.pruneTradesLocked(ch.market, time.Now()) {
+		if trade.Chain == ch.chain && trade.Currency == ch.currency {
+			t.Volume24h += trade.Price * float64(trade.Size)
+			t.Trades24h++
+		}
+	}
+	if len(bids) > 0 {
+		t.BestBid = bids[0].Price
+	}
+	if len(asks) > 0 {
+		t.BestAsk = asks[0].Price
+	}
+
+	return t
+}
+
+func (h *hub) readPump(c *wsClient) {
+	defer func() {
+		h.unregister(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(wsReadLimit)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var req wsRequest
+		if err := c.conn.ReadJSON(&req); err != nil {
+			return
+		}
+
+		for _, name := range req.Channels {
+			var err error
+			switch req.Op {
+			case "subscribe":
+				err = h.subscribe(c, name)
+			case "unsubscribe":
+				h.unsubscribe(c, name)
+			default:
+				err = errors.New("unknown op")
+			}
+			if err != nil {
+				h.mu.Lock()
+				if _, ok := h.clients[c]; ok {
+					h.sendLocked(c, wsMessage{Channel: name, Type: "error", Data: err.Error()})
+				}
+				h.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				code := websocket.CloseNormalClosure
+				if c.closeCode != 0 {
+					code = c.closeCode
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) serveWS(ctx *gin.Context) {
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		return
+	}
+
+	s.hub.serve(&wsClient{conn: conn, send: make(chan []byte, wsSendBuffer)})
+}
+
+// servePrivateWS serves an authenticated connection that can also subscribe
+// to the orders and fills channels of its owner. With
+// cancel_on_disconnect=true, the resting orders placed with the session or
+// API key of the connection are canceled once the last such connection has
+// been gone for the grace period.
+func (s *Server) servePrivateWS(ctx *gin.Context) {
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		return
+	}
+
+	c := &wsClient{
+		conn:               conn,
+		send:               make(chan []byte, wsSendBuffer),
+		owner:              authAddress(ctx),
+		session:            authSession(ctx),
+		cancelOnDisconnect: ctx.Query("cancel_on_disconnect") == "true",
+	}
+	s.hub.serve(c)
+}
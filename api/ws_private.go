@@ -0,0 +1,202 @@
+package api
+
+import (
+	"cdex/exchange"
+	"errors"
+	"time"
+)
+
+const (
+	channelOrders = "orders"
+	channelFills  = "fills"
+)
+
+type fillData struct {
+	OrderID    string          `json:"order_id"`
+	Market     exchange.Market `json:"market"`
+	Collection int             `json:"collection"`
+	TokenID    int             `json:"token_id"`
+	Price      float64         `json:"price"`
+	Size       int             `json:"size"`
+	Maker      bool            `json:"maker"`
+	Timestamp  int64           `json:"timestamp"`
+}
+
+// privateChannel is the hub channel name of an owner's orders or fills.
+func privateChannel(kind, owner string) string {
+	return kind + ":" + owner
+}
+
+func (h *hub) subscribePrivate(c *wsClient, kind string) error {
+	if c.owner == "" {
+		return errors.New("authentication required")
+	}
+	name := privateChannel(kind, c.owner)
+
+	h.ex.OpenOrders(c.owner, func(orders []*exchange.Order) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if !h.joinLocked(c, name) {
+			return
+		}
+
+		var data interface{}
+		if kind == channelOrders {
+			open := []*exchange.Order{}
+			for _, o := range orders {
+				open = append(open, o.Copy())
+			}
+			data = open
+		} else {
+			data = []fillData{}
+		}
+		h.sendLocked(c, wsMessage{Channel: name, Type: "snapshot", Seq: h.seq[name], Data: data})
+	})
+
+	return nil
+}
+
+func (h *hub) publishPrivateLocked(ev exchange.Event) {
+	if ev.Type != exchange.EventMatch {
+		h.publishLocked(privateChannel(channelOrders, ev.Order.Owner), ev.Order)
+		return
+	}
+
+	m := ev.Match
+	maker := m.Bid
+	if ev.Order.Bid {
+		maker = m.Ask
+	}
+	for _, side := range []*exchange.Order{maker, ev.Order} {
+		h.publishLocked(privateChannel(channelOrders, side.Owner), side)
+		h.publishLocked(privateChannel(channelFills, side.Owner), fillData{
+			OrderID:    side.ID,
+			Market:     ev.Market,
+			Collection: m.Collection,
+			TokenID:    m.TokenID,
+			Price:      m.Price,
+			Size:       m.SizeFilled,
+			Maker:      side == maker,
+			Timestamp:  m.Timestamp,
+		})
+	}
+}
+
+// track records that the limit order with the given id is placed in market
+// with session. It is called before the order is placed, and untrack when
+// placing it fails.
+func (h *hub) track(session string, market exchange.Market, id string) {
+	if session == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.placed[session] == nil {
+		h.placed[session] = make(map[string]exchange.Market)
+	}
+	h.placed[session][id] = market
+	h.sessions[id] = session
+}
+
+func (h *hub) untrack(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.untrackLocked(id)
+}
+
+func (h *hub) untrackLocked(id string) {
+	session, ok := h.sessions[id]
+	if !ok {
+		return
+	}
+	delete(h.sessions, id)
+	delete(h.placed[session], id)
+	if len(h.placed[session]) == 0 {
+		delete(h.placed, session)
+	}
+}
+
+// forgetDoneLocked untracks the orders an event takes out of the books.
+func (h *hub) forgetDoneLocked(ev exchange.Event) {
+	switch ev.Type {
+	case exchange.EventOrderCanceled, exchange.EventOrderExpired, exchange.EventOrderRejected:
+		h.untrackLocked(ev.Order.ID)
+	case exchange.EventMatch:
+		for _, o := range []*exchange.Order{ev.Match.Ask, ev.Match.Bid} {
+			if o.IsFilled() {
+				h.untrackLocked(o.ID)
+			}
+		}
+	}
+}
+
+// cancelSession cancels the resting orders placed with session. The exchange
+// emits to the hub, so it must be called unlocked.
+func (h *hub) cancelSession(session string) {
+	h.mu.Lock()
+	placed := h.placed[session]
+	delete(h.placed, session)
+	for id := range placed {
+		delete(h.sessions, id)
+	}
+	h.mu.Unlock()
+
+	for id, market := range placed {
+		// The order may have been filled or canceled meanwhile.
+		h.ex.CancelOrder(market, id)
+	}
+}
+
+// cancelPending runs the pending cancel-on-disconnect cancels now, before the
+// exchange is closed, rather than losing them on shutdown.
+func (h *hub) cancelPending() {
+	h.mu.Lock()
+	sessions := make([]string, 0, len(h.pending))
+	for session, t := range h.pending {
+		t.Stop()
+		delete(h.pending, session)
+		sessions = append(sessions, session)
+	}
+	h.mu.Unlock()
+
+	for _, session := range sessions {
+		h.cancelSession(session)
+	}
+}
+
+// guardLocked records a new cancel-on-disconnect connection of session and
+// stops a pending cancel.
+func (h *hub) guardLocked(session string) {
+	h.guardians[session]++
+	if t, ok := h.pending[session]; ok {
+		t.Stop()
+		delete(h.pending, session)
+	}
+}
+
+// unguardLocked schedules the cancel of the resting orders placed with
+// session once its last cancel-on-disconnect connection is gone.
+func (h *hub) unguardLocked(session string) {
+	h.guardians[session]--
+	if h.guardians[session] > 0 {
+		return
+	}
+	delete(h.guardians, session)
+
+	var t *time.Timer
+	t = h.afterFunc(h.grace, func() {
+		h.mu.Lock()
+		if h.pending[session] != t {
+			h.mu.Unlock()
+			return
+		}
+		delete(h.pending, session)
+		h.mu.Unlock()
+
+		h.cancelSession(session)
+	})
+	h.pending[session] = t
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"cdex/exchange"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readMessage(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	t.Helper()
+	var msg map[string]interface{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return msg
+}
+
+func TestBookChannel(t *testing.T) {
+	ex := exchange.NewExchange()
+	server := &Server{ex: ex, hub: newHub(ex, 0)}
+	ex.Subscribe(server.hub.onEvent)
+	router := gin.New()
+	router.GET("/ws", server.serveWS)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err = conn.WriteJSON(wsRequest{Op: "subscribe", Channels: []string{"book:fra", "book:fra:1:2:ETH", "ticker:fra:1:ETH"}}); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	msg := readMessage(t, conn)
+	assert(t, msg["channel"], "book:fra")
+	assert(t, msg["type"], "snapshot")
+	assert(t, msg["data"], map[string]interface{}{"books": []interface{}{}})
+	for i := 0; i < 2; i++ {
+		msg := readMessage(t, conn)
+		assert(t, msg["type"], "snapshot")
+		assert(t, msg["seq"], 0.0)
+	}
+
+	// Only the ticker of the currency on the chain of the order is updated.
+	order := exchange.NewOrder("alice", "eth", false, 1, 2, 1, 10)
+	order.Chain = 1
+	if _, err = server.ex.PlaceLimitOrder(exchange.MarketFRA, 10, order); err != nil {
+		t.Fatalf("place: %v", err)
+	}
+	other := exchange.NewOrder("bob", "eth", false, 1, 3, 1, 9)
+	if _, err = server.ex.PlaceLimitOrder(exchange.MarketFRA, 9, other); err != nil {
+		t.Fatalf("place: %v", err)
+	}
+
+	msg = readMessage(t, conn)
+	assert(t, msg["channel"], "book:fra:1:2:eth")
+	assert(t, msg["type"], "update")
+	assert(t, msg["seq"], 1.0)
+	data := msg["data"].(map[string]interface{})
+	assert(t, data["price"], 10.0)
+	assert(t, data["volume"], 1.0)
+
+	msg = readMessage(t, conn)
+	assert(t, msg["channel"], "book:fra")
+	assert(t, msg["seq"], 1.0)
+	assert(t, msg["data"], map[string]interface{}{
+		"collection": 1.0, "token_id": 2.0, "chain": 1.0, "currency": "eth", "bid": false, "price": 10.0, "volume": 1.0,
+	})
+
+	msg = readMessage(t, conn)
+	assert(t, msg["channel"], "ticker:fra:1:eth")
+	assert(t, msg["seq"], 1.0)
+	data = msg["data"].(map[string]interface{})
+	assert(t, data["best_ask"], 10.0)
+	assert(t, data["chain"], 1.0)
+	assert(t, data["currency"], "eth")
+
+	// The market channel carries the books of every token and currency.
+	msg = readMessage(t, conn)
+	assert(t, msg["channel"], "book:fra")
+	assert(t, msg["seq"], 2.0)
+	data = msg["data"].(map[string]interface{})
+	assert(t, data["token_id"], 3.0)
+	assert(t, data["price"], 9.0)
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err = conn.ReadJSON(&msg); err == nil {
+		t.Fatalf("unexpected message %v", msg)
+	}
+}
+
+func TestParseChannel(t *testing.T) {
+	for _, name := range []string{"book:fra:1:2", "book:fra:1:2:", "ticker:fra", "ticker:fra:x:eth", "ticker:fra:300:eth", "trades:fra:1"} {
+		_, err := parseChannel(name)
+		assert(t, err != nil, true)
+	}
+	ch, err := parseChannel("ticker:fra:2:USDC")
+	assert(t, err, nil)
+	assert(t, ch.String(), "ticker:fra:2:usdc")
+	ch, err = parseChannel("book:fra:1:2:ETH")
+	assert(t, err, nil)
+	assert(t, ch.String(), "book:fra:1:2:eth")
+	ch, err = parseChannel("book:fra")
+	assert(t, err, nil)
+	assert(t, ch.String(), "book:fra")
+}
+
+func TestCancelOnDisconnect(t *testing.T) {
+	ex := exchange.NewExchange()
+	h := newHub(ex, time.Minute)
+	ex.Subscribe(h.onEvent)
+
+	// Timers never fire on their own; the test runs their functions.
+	var timers []func()
+	h.afterFunc = func(d time.Duration, f func()) *time.Timer {
+		assert(t, d, time.Minute)
+		timers = append(timers, f)
+		timer := time.NewTimer(d)
+		timer.Stop()
+		return timer
+	}
+
+	// Only the orders placed with the session of the connection are canceled,
+	// not those placed with an API key of the same owner.
+	order := exchange.NewOrder("alice", "eth", true, 1, 2, 1, 10)
+	h.track("session:a", exchange.MarketFRA, order.ID)
+	if _, err := ex.PlaceLimitOrder(exchange.MarketFRA, 10, order); err != nil {
+		t.Fatalf("place: %v", err)
+	}
+	bot := exchange.NewOrder("alice", "eth", true, 1, 2, 1, 9)
+	h.track("key:b", exchange.MarketFRA, bot.ID)
+	if _, err := ex.PlaceLimitOrder(exchange.MarketFRA, 9, bot); err != nil {
+		t.Fatalf("place: %v", err)
+	}
+
+	first := &wsClient{send: make(chan []byte, wsSendBuffer), owner: "alice", session: "session:a", cancelOnDisconnect: true}
+	second := &wsClient{send: make(chan []byte, wsSendBuffer), owner: "alice", session: "session:a", cancelOnDisconnect: true}
+	h.register(first)
+	h.unregister(first)
+	h.register(second)
+	assert(t, len(timers), 1)
+
+	// The cancel of the first connection was stopped by the second one,
+	// even when its timer had fired already.
+	timers[0]()
+	assert(t, order.Status, exchange.OrderNew)
+
+	h.unregister(second)
+	assert(t, len(timers), 2)
+	timers[1]()
+	assert(t, order.Status, exchange.OrderCanceled)
+	assert(t, bot.Status, exchange.OrderNew)
+	assert(t, len(h.placed), 1)
+
+	// Orders that leave the book are forgotten.
+	ask := exchange.NewOrder("bob", "eth", false, 1, 2, 1, 9)
+	if _, err := ex.PlaceLimitOrder(exchange.MarketFRA, 9, ask); err != nil {
+		t.Fatalf("place: %v", err)
+	}
+	assert(t, bot.Status, exchange.OrderFilled)
+	assert(t, len(h.placed), 0)
+	assert(t, len(h.sessions), 0)
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Limits of the properties of a collection or an item.
+const (
+	MaxAttributes       = 100
+	MaxTraitTypeLength  = 64
+	MaxTraitValueLength = 128
+)
+
+// Display types of numeric traits.
+const (
+	DisplayNumber          = "number"
+	DisplayBoostNumber     = "boost_number"
+	DisplayBoostPercentage = "boost_percentage"
+	DisplayDate            = "date"
+)
+
+// Attribute is a trait in the OpenSea metadata format. Value is a string for
+// a textual trait, or a number, possibly with a DisplayType.
+type Attribute struct {
+	TraitType   string      `json:"trait_type"`
+	Value       interface{} `json:"value"`
+	DisplayType string      `json:"display_type,omitempty"`
+	MaxValue    *float64    `json:"max_value,omitempty"`
+}
+
+// Attributes is stored as a JSONB array. It also decodes the JSON encoded
+// string that properties used to be sent as.
+type Attributes []Attribute
+
+func (a *Attributes) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if s == "" {
+			*a = nil
+			return nil
+		}
+		data = []byte(s)
+	}
+
+	var attrs []Attribute
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return errors.New("properties must be a list of attributes")
+	}
+	*a = attrs
+
+	return nil
+}
+
+func (a Attributes) Value() (driver.Value, error) {
+	if a == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]Attribute(a))
+	return string(b), err
+}
+
+func (a *Attributes) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Attributes", src)
+	}
+
+	var attrs []Attribute
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return err
+	}
+	*a = attrs
+
+	return nil
+}
+
+// Validate checks that a is a list of well formed attributes with distinct
+// trait types.
+func (a Attributes) Validate() error {
+	if len(a) > MaxAttributes {
+		return fmt.Errorf("at most %d attributes are allowed", MaxAttributes)
+	}
+
+	seen := make(map[string]bool, len(a))
+	for _, attr := range a {
+		if attr.TraitType == "" || len(attr.TraitType) > MaxTraitTypeLength {
+			return fmt.Errorf("trait_type must be 1 to %d characters", MaxTraitTypeLength)
+		}
+		if seen[attr.TraitType] {
+			return fmt.Errorf("duplicate trait_type %q", attr.TraitType)
+		}
+		seen[attr.TraitType] = true
+
+		switch v := attr.Value.(type) {
+		case string:
+			if attr.DisplayType != "" {
+				return fmt.Errorf("trait %q: display_type %q needs a numeric value", attr.TraitType, attr.DisplayType)
+			}
+			if v == "" || len(v) > MaxTraitValueLength {
+				return fmt.Errorf("trait %q: value must be 1 to %d characters", attr.TraitType, MaxTraitValueLength)
+			}
+		case float64:
+			switch attr.DisplayType {
+			case "", DisplayNumber, DisplayBoostNumber, DisplayBoostPercentage, DisplayDate:
+			default:
+				return fmt.Errorf("trait %q: unknown display_type %q", attr.TraitType, attr.DisplayType)
+			}
+		default:
+			return fmt.Errorf("trait %q: value must be a string or a number", attr.TraitType)
+		}
+	}
+
+	return nil
+}
+
+// category returns the value of a textual trait. Numeric traits are ranges
+// rather than categories; they are not counted or scored.
+func (attr Attribute) category() (string, bool) {
+	v, ok := attr.Value.(string)
+	return v, ok
+}
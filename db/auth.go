@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+func (db *NartDB) InsertAPIKey(ctx context.Context, arg CreateAPIKeyParams) (*APIKey, error) {
+	key := APIKey{
+		ID:         arg.ID,
+		Owner:      arg.Owner,
+		SecretHash: arg.SecretHash,
+		Scopes:     arg.Scopes,
+		ExpiresAt:  arg.ExpiresAt,
+		CreatedAt:  arg.CreatedAt,
+	}
+	if _, err := db.db.NewInsert().Model(&key).Exec(ctx); err != nil {
+		return nil, uniqueViolation(err)
+	}
+
+	return &key, nil
+}
+
+func (db *NartDB) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	var key APIKey
+	err := db.db.NewSelect().Model(&key).Where("id = ?", id).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (db *NartDB) GetAPIKeysByOwner(ctx context.Context, owner string) ([]*APIKey, error) {
+	var keys []*APIKey
+	err := db.db.NewSelect().Model(&keys).Where("owner = ?", owner).Order("created_at DESC").Scan(ctx)
+	return keys, err
+}
+
+func (db *NartDB) RevokeAPIKey(ctx context.Context, id, owner string) error {
+	res, err := db.db.NewUpdate().Model((*APIKey)(nil)).Set("revoked = TRUE").Where("id = ? AND owner = ?", id, owner).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (db *NartDB) GetSession(ctx context.Context, tokenHash string) (*Session, error) {
+	var s Session
+	err := db.db.NewSelect().Model(&s).Where("token_hash = ?", tokenHash).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/uptrace/bun"
+)
+
+// setFields adds a SET clause for every non-nil field, and reports whether
+// there was any.
+func setFields(q *bun.UpdateQuery, fields map[string]interface{}) bool {
+	set := false
+	for column, value := range fields {
+		switch v := value.(type) {
+		case *string:
+			if v == nil {
+				continue
+			}
+		case *int8:
+			if v == nil {
+				continue
+			}
+		case *bool:
+			if v == nil {
+				continue
+			}
+		case *Attributes:
+			if v == nil {
+				continue
+			}
+			value = *v
+		}
+		q.Set("? = ?", bun.Ident(column), value)
+		set = true
+	}
+	return set
+}
+
+func (db *NartDB) UpdateCollection(ctx context.Context, id int, arg UpdateCollectionParams) (*Collection, error) {
+	q := db.db.NewUpdate().Model((*Collection)(nil)).Where("id = ?", id)
+	set := setFields(q, map[string]interface{}{
+		"name":         arg.Name,
+		"visible":      arg.Visible,
+		"tax":          arg.Tax,
+		"image":        arg.Image,
+		"background":   arg.Background,
+		"banner":       arg.Banner,
+		"description":  arg.Description,
+		"introduction": arg.Introduction,
+		"properties":   arg.Properties,
+		"twitter":      arg.Twitter,
+		"instagram":    arg.Instagram,
+		"discord":      arg.Discord,
+		"web":          arg.Web,
+	})
+	if set {
+		res, err := q.Exec(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil, ErrNotFound
+		}
+	}
+
+	return db.GetCollectionByID(ctx, id)
+}
+
+// DeleteCollection deletes a collection with its items and trait counts.
+// Trades are kept. It returns ErrItemsSold, deleting nothing, when an item is
+// owned by someone else than its creator.
+func (db *NartDB) DeleteCollection(ctx context.Context, id int) error {
+	return db.db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewDelete().Model((*Collection)(nil)).Where("id = ?", id).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrNotFound
+		}
+		sold, err := tx.NewSelect().Model((*Item)(nil)).Where("collection = ? AND owner <> creator", id).Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if sold {
+			return ErrItemsSold
+		}
+		if _, err = tx.NewDelete().Model((*Item)(nil)).Where("collection = ?", id).Exec(ctx); err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().Model((*TraitCount)(nil)).Where("collection = ?", id).Exec(ctx)
+		return err
+	})
+}
+
+func (db *NartDB) UpdateItem(ctx context.Context, collection, tokenID int, arg UpdateItemParams) (*Item, error) {
+	q := db.db.NewUpdate().Model((*Item)(nil)).Where("collection = ? AND token_id = ?", collection, tokenID)
+	set := setFields(q, map[string]interface{}{
+		"name":        arg.Name,
+		"image":       arg.Image,
+		"description": arg.Description,
+		"properties":  arg.Properties,
+		"token_uri":   arg.TokenURI,
+		"hidden":      arg.Hidden,
+	})
+	if set {
+		res, err := q.Exec(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil, ErrNotFound
+		}
+	}
+
+	return db.GetItem(ctx, collection, tokenID)
+}
+
+func (db *NartDB) DeleteItem(ctx context.Context, collection, tokenID int) error {
+	res, err := db.db.NewDelete().Model((*Item)(nil)).Where("collection = ? AND token_id = ?", collection, tokenID).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
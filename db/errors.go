@@ -0,0 +1,27 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// ErrNotFound is returned when the requested row does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicate is returned when a row conflicts with a unique constraint.
+var ErrDuplicate = errors.New("duplicate")
+
+// ErrItemsSold is returned when deleting a collection with items that are
+// owned by someone else than their creator.
+var ErrItemsSold = errors.New("items of the collection were sold")
+
+// uniqueViolation turns a unique constraint violation of Postgres into
+// ErrDuplicate, and returns other errors as they are.
+func uniqueViolation(err error) error {
+	var pgErr pgdriver.Error
+	if errors.As(err, &pgErr) && pgErr.Field('C') == "23505" {
+		return fmt.Errorf("%w: %s", ErrDuplicate, pgErr.Field('n'))
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+func (db *NartDB) GetIdempotencyKey(ctx context.Context, owner, key string) (*IdempotencyKey, error) {
+	var k IdempotencyKey
+	err := db.db.NewSelect().Model(&k).Where("owner = ? AND key = ?", owner, key).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// SaveIdempotencyKey stores the response for a key, replacing an expired one.
+func (db *NartDB) SaveIdempotencyKey(ctx context.Context, k *IdempotencyKey) error {
+	_, err := db.db.NewInsert().
+		Model(k).
+		On("CONFLICT (owner, key) DO UPDATE").
+		Set("request_hash = EXCLUDED.request_hash").
+		Set("status = EXCLUDED.status").
+		Set("body = EXCLUDED.body").
+		Set("created_at = EXCLUDED.created_at").
+		Exec(ctx)
+	return err
+}
@@ -0,0 +1,1138 @@
+package db
+
+import (
+	"cdex/exchange"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDB is a Storage held in memory, for tests and local development. It
+// follows NartDB: lists are ordered and paginated the same way, unique keys
+// are enforced with ErrDuplicate and missing rows return ErrNotFound. Column
+// lengths are not checked. Rows are copied in and out, so callers never share
+// them with the store.
+type MemoryDB struct {
+	mu sync.RWMutex
+
+	lastCollection int
+	lastTrade      int64
+
+	collections map[int]*Collection
+	items       map[itemID]*Item
+	traits      map[int][]*TraitCount
+	orders      map[string]*exchange.Order
+	trades      []*Trade
+	apiKeys     map[string]*APIKey
+	sessions    map[string]*Session
+	idempotency map[ownerKey]*IdempotencyKey
+	transfers   []*Transfer
+	balances    map[balanceKey]int
+	checkpoints map[int8]*Checkpoint
+}
+
+type itemID struct {
+	collection, tokenID int
+}
+
+type ownerKey struct {
+	owner, key string
+}
+
+type balanceKey struct {
+	collection, tokenID int
+	owner               string
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		collections: make(map[int]*Collection),
+		items:       make(map[itemID]*Item),
+		traits:      make(map[int][]*TraitCount),
+		orders:      make(map[string]*exchange.Order),
+		apiKeys:     make(map[string]*APIKey),
+		sessions:    make(map[string]*Session),
+		idempotency: make(map[ownerKey]*IdempotencyKey),
+		balances:    make(map[balanceKey]int),
+		checkpoints: make(map[int8]*Checkpoint),
+	}
+}
+
+// RunInTx runs fn on a copy of the store, which replaces the store when fn
+// returns nil. Transactions hold the store for their whole run, so fn must
+// only use tx; every other call waits.
+func (m *MemoryDB) RunInTx(ctx context.Context, fn func(tx Storage) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := m.copy()
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	m.lastCollection, m.lastTrade = tx.lastCollection, tx.lastTrade
+	m.collections, m.items, m.traits = tx.collections, tx.items, tx.traits
+	m.orders, m.trades = tx.orders, tx.trades
+	m.apiKeys, m.sessions, m.idempotency = tx.apiKeys, tx.sessions, tx.idempotency
+	m.transfers, m.balances, m.checkpoints = tx.transfers, tx.balances, tx.checkpoints
+	return nil
+}
+
+// copy returns a deep copy of the store. The caller holds m.mu.
+func (m *MemoryDB) copy() *MemoryDB {
+	c := NewMemoryDB()
+	c.lastCollection, c.lastTrade = m.lastCollection, m.lastTrade
+	for id, col := range m.collections {
+		c.collections[id] = cloneCollection(col)
+	}
+	for id, item := range m.items {
+		c.items[id] = cloneItem(item)
+	}
+	for id, traits := range m.traits {
+		for _, t := range traits {
+			clone := *t
+			c.traits[id] = append(c.traits[id], &clone)
+		}
+	}
+	for id, o := range m.orders {
+		c.orders[id] = o.Copy()
+	}
+	for _, t := range m.trades {
+		clone := *t
+		c.trades = append(c.trades, &clone)
+	}
+	for id, key := range m.apiKeys {
+		c.apiKeys[id] = cloneAPIKey(key)
+	}
+	for hash, s := range m.sessions {
+		clone := *s
+		c.sessions[hash] = &clone
+	}
+	for key, k := range m.idempotency {
+		c.idempotency[key] = cloneIdempotencyKey(k)
+	}
+	for _, t := range m.transfers {
+		clone := *t
+		c.transfers = append(c.transfers, &clone)
+	}
+	for key, amount := range m.balances {
+		c.balances[key] = amount
+	}
+	for chain, cp := range m.checkpoints {
+		clone := *cp
+		c.checkpoints[chain] = &clone
+	}
+	return c
+}
+
+// Insert inserts a model, or the models of a []interface{} in a single
+// transaction. Collections and trades without an ID are given the next one.
+func (m *MemoryDB) Insert(ctx context.Context, value interface{}) error {
+	values, ok := value.([]interface{})
+	if !ok {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		return m.insert(value)
+	}
+
+	return m.RunInTx(ctx, func(tx Storage) error {
+		for _, v := range values {
+			if err := tx.Insert(ctx, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *MemoryDB) insert(value interface{}) error {
+	switch v := value.(type) {
+	case *Collection:
+		if v.ID == 0 {
+			m.lastCollection++
+			v.ID = m.lastCollection
+		} else if _, ok := m.collections[v.ID]; ok {
+			return fmt.Errorf("%w: collections_pkey", ErrDuplicate)
+		} else if v.ID > m.lastCollection {
+			m.lastCollection = v.ID
+		}
+		m.collections[v.ID] = cloneCollection(v)
+	case *Item:
+		id := itemID{v.Collection, v.TokenID}
+		if _, ok := m.items[id]; ok {
+			return fmt.Errorf("%w: items_pkey", ErrDuplicate)
+		}
+		m.items[id] = cloneItem(v)
+	case *exchange.Order:
+		if _, ok := m.orders[v.ID]; ok {
+			return fmt.Errorf("%w: orders_pkey", ErrDuplicate)
+		}
+		return m.insertOrder(v)
+	case *Trade:
+		m.insertTrade(v)
+	case *APIKey:
+		if _, ok := m.apiKeys[v.ID]; ok {
+			return fmt.Errorf("%w: api_keys_pkey", ErrDuplicate)
+		}
+		m.apiKeys[v.ID] = cloneAPIKey(v)
+	case *Session:
+		if _, ok := m.sessions[v.TokenHash]; ok {
+			return fmt.Errorf("%w: sessions_pkey", ErrDuplicate)
+		}
+		clone := *v
+		m.sessions[v.TokenHash] = &clone
+	case *IdempotencyKey:
+		key := ownerKey{v.Owner, v.Key}
+		if _, ok := m.idempotency[key]; ok {
+			return fmt.Errorf("%w: idempotency_keys_pkey", ErrDuplicate)
+		}
+		m.idempotency[key] = cloneIdempotencyKey(v)
+	default:
+		return fmt.Errorf("cannot insert %T", value)
+	}
+	return nil
+}
+
+func (m *MemoryDB) InsertCollection(ctx context.Context, arg CreateCollectionParams) (*Collection, error) {
+	c := Collection{
+		Name:         arg.Name,
+		Address:      arg.Address,
+		Creator:      arg.Creator,
+		Chain:        arg.Chain,
+		Visible:      arg.Visible,
+		Status:       arg.Status,
+		Type:         arg.Type,
+		Tax:          arg.Tax,
+		Symbol:       arg.Symbol,
+		Currency:     arg.Currency,
+		CreatedAt:    arg.CreatedAt,
+		Image:        arg.Image,
+		Background:   arg.Background,
+		Banner:       arg.Banner,
+		Description:  arg.Description,
+		Introduction: arg.Introduction,
+		Properties:   arg.Properties,
+		Twitter:      arg.Twitter,
+		Instagram:    arg.Instagram,
+		Discord:      arg.Discord,
+		Web:          arg.Web,
+	}
+	if err := m.Insert(ctx, &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// InsertItem inserts an item owned by its creator.
+func (m *MemoryDB) InsertItem(ctx context.Context, arg CreateItemParams) (*Item, error) {
+	item := NewItem(arg)
+	if err := m.Insert(ctx, item); err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func (m *MemoryDB) GetCollections(ctx context.Context, arg CollectionQuery) ([]*Collection, *Cursor, error) {
+	if err := arg.check(); err != nil {
+		return nil, nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Volumes and floors only count trades and asks in the currency of the
+	// collection.
+	inCurrency := func(collection int, chain int8, currency string) bool {
+		c, ok := m.collections[collection]
+		return ok && c.Chain == chain && c.Currency == currency
+	}
+	volumes := make(map[int]float64)
+	for _, t := range m.trades {
+		if inCurrency(t.Collection, t.Chain, t.Currency) {
+			volumes[t.Collection] += t.Price * float64(t.Size)
+		}
+	}
+	floors := make(map[int]float64)
+	for _, o := range m.orders {
+		if f, ok := floors[o.Collection]; !o.Bid && o.Status.Open() && inCurrency(o.Collection, o.Chain, o.Currency) && (!ok || o.Price < f) {
+			floors[o.Collection] = o.Price
+		}
+	}
+
+	var collections []*Collection
+	for _, c := range m.collections {
+		switch {
+		case arg.Chain != nil && c.Chain != *arg.Chain,
+			arg.Type != nil && c.Type != *arg.Type,
+			arg.Status != nil && c.Status != *arg.Status,
+			arg.Visible != nil && c.Visible != *arg.Visible,
+			!arg.IncludeHidden && c.Visible == 0,
+			arg.Currency != "" && c.Currency != arg.Currency,
+			arg.Creator != "" && c.Creator != arg.Creator:
+			continue
+		}
+
+		clone := cloneCollection(c)
+		clone.Volume = volumes[c.ID]
+		if f, ok := floors[c.ID]; ok {
+			clone.Floor = &f
+		}
+		collections = append(collections, clone)
+	}
+
+	cursor := func(col *Collection) *Cursor { return collectionCursor(arg.Sort, col) }
+	collections, next := nextPage(memPage(collections, arg.Page, arg.Desc, cursor, collectionKey), arg.Page, cursor)
+	return collections, next, nil
+}
+
+func (m *MemoryDB) GetItems(ctx context.Context, arg ItemQuery) ([]*Item, *Cursor, error) {
+	if arg.Sort == "" {
+		arg.Sort = SortCreated
+	}
+	if arg.Page.Cursor != nil && arg.Page.Cursor.Sort != arg.Sort {
+		return nil, nil, ErrInvalidCursor
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var items []*Item
+	for _, item := range m.items {
+		switch {
+		case arg.Collection != 0 && item.Collection != arg.Collection,
+			arg.Chain != nil && item.Chain != *arg.Chain,
+			arg.Creator != "" && item.Creator != arg.Creator,
+			!arg.IncludeHidden && !m.visible(item),
+			!hasTraits(item, arg.Traits):
+			continue
+		}
+		items = append(items, cloneItem(item))
+	}
+
+	cursor := func(item *Item) *Cursor { return itemCursor(arg.Sort, item) }
+	items, next := nextPage(memPage(items, arg.Page, arg.Desc, cursor, itemKey), arg.Page, cursor)
+	return items, next, nil
+}
+
+// visible reports whether an item is shown in public listings: it is not
+// hidden and its collection exists and is visible.
+func (m *MemoryDB) visible(item *Item) bool {
+	c, ok := m.collections[item.Collection]
+	return !item.Hidden && ok && c.Visible != 0
+}
+
+// hasTraits reports whether an item has one of the values of every trait
+// type of traits, as textual traits.
+func hasTraits(item *Item, traits map[string][]string) bool {
+	for t, values := range traits {
+		found := false
+		for _, attr := range item.Properties {
+			if s, ok := attr.Value.(string); ok && attr.TraitType == t {
+				for _, v := range values {
+					found = found || s == v
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *MemoryDB) GetItem(ctx context.Context, collection, tokenID int) (*Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	item, ok := m.items[itemID{collection, tokenID}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneItem(item), nil
+}
+
+func (m *MemoryDB) UpdateItem(ctx context.Context, collection, tokenID int, arg UpdateItemParams) (*Item, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, ok := m.items[itemID{collection, tokenID}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	setString(&item.Name, arg.Name)
+	setString(&item.Image, arg.Image)
+	setString(&item.Description, arg.Description)
+	if arg.Properties != nil {
+		item.Properties = append(Attributes(nil), *arg.Properties...)
+	}
+	setString(&item.TokenURI, arg.TokenURI)
+	if arg.Hidden != nil {
+		item.Hidden = *arg.Hidden
+	}
+
+	return cloneItem(item), nil
+}
+
+func (m *MemoryDB) DeleteItem(ctx context.Context, collection, tokenID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := itemID{collection, tokenID}
+	if _, ok := m.items[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.items, id)
+	return nil
+}
+
+func (m *MemoryDB) UpdateRarity(ctx context.Context, collection int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var items []*Item
+	for _, item := range m.items {
+		if item.Collection == collection {
+			items = append(items, item)
+		}
+	}
+	traits := scoreRarity(items)
+	for _, t := range traits {
+		t.Collection = collection
+	}
+
+	if len(traits) > 0 {
+		m.traits[collection] = traits
+	} else {
+		delete(m.traits, collection)
+	}
+	return nil
+}
+
+func (m *MemoryDB) GetCollectionTraits(ctx context.Context, collection int) ([]*TraitCount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	traits := []*TraitCount{}
+	for _, t := range m.traits[collection] {
+		clone := *t
+		traits = append(traits, &clone)
+	}
+	sort.Slice(traits, func(i, j int) bool {
+		a, b := traits[i], traits[j]
+		if a.TraitType != b.TraitType {
+			return a.TraitType < b.TraitType
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Value < b.Value
+	})
+	return traits, nil
+}
+
+func (m *MemoryDB) GetCollectionByID(ctx context.Context, id int) (*Collection, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	c, ok := m.collections[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneCollection(c), nil
+}
+
+func (m *MemoryDB) UpdateCollection(ctx context.Context, id int, arg UpdateCollectionParams) (*Collection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.collections[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	setString(&c.Name, arg.Name)
+	setInt8(&c.Visible, arg.Visible)
+	setInt8(&c.Tax, arg.Tax)
+	setString(&c.Image, arg.Image)
+	setString(&c.Background, arg.Background)
+	setString(&c.Banner, arg.Banner)
+	setString(&c.Description, arg.Description)
+	setString(&c.Introduction, arg.Introduction)
+	if arg.Properties != nil {
+		c.Properties = append(Attributes(nil), *arg.Properties...)
+	}
+	setString(&c.Twitter, arg.Twitter)
+	setString(&c.Instagram, arg.Instagram)
+	setString(&c.Discord, arg.Discord)
+	setString(&c.Web, arg.Web)
+
+	return cloneCollection(c), nil
+}
+
+// DeleteCollection deletes a collection with its items and trait counts.
+// Trades are kept.
+func (m *MemoryDB) DeleteCollection(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.collections[id]; !ok {
+		return ErrNotFound
+	}
+	for key, item := range m.items {
+		if key.collection == id && item.Owner != item.Creator {
+			return ErrItemsSold
+		}
+	}
+	delete(m.collections, id)
+	for key := range m.items {
+		if key.collection == id {
+			delete(m.items, key)
+		}
+	}
+	delete(m.traits, id)
+	return nil
+}
+
+// Search ranks matches like ts_rank with its default weights: a word found
+// in a name or symbol weighs 1, in an introduction 0.4 and in a description
+// 0.2.
+func (m *MemoryDB) Search(ctx context.Context, arg SearchQuery) (*SearchResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := &SearchResult{
+		Collections: []*Collection{},
+		Items:       []*Item{},
+		Creators:    []*Creator{},
+	}
+
+	if words := searchWords(arg.Terms); len(words) > 0 {
+		collectionRanks := make(map[int]float64)
+		for _, c := range m.collections {
+			rank := searchRank(words, []weighted{{c.Name, 1}, {c.Symbol, 1}, {c.Introduction, 0.4}, {c.Description, 0.2}})
+			if rank > 0 && c.Visible != 0 {
+				collectionRanks[c.ID] = rank
+				res.Collections = append(res.Collections, cloneCollection(c))
+			}
+		}
+		sort.Slice(res.Collections, func(i, j int) bool {
+			a, b := res.Collections[i], res.Collections[j]
+			ra, rb := collectionRanks[a.ID], collectionRanks[b.ID]
+			if ra != rb {
+				return ra > rb
+			}
+			return a.ID > b.ID
+		})
+		res.Collections = limit(res.Collections, arg.Limit)
+
+		itemRanks := make(map[itemID]float64)
+		for id, item := range m.items {
+			rank := searchRank(words, []weighted{{item.Name, 1}, {item.Description, 0.2}})
+			if rank > 0 && m.visible(item) {
+				itemRanks[id] = rank
+				res.Items = append(res.Items, cloneItem(item))
+			}
+		}
+		sort.Slice(res.Items, func(i, j int) bool {
+			a, b := res.Items[i], res.Items[j]
+			ra, rb := itemRanks[itemID{a.Collection, a.TokenID}], itemRanks[itemID{b.Collection, b.TokenID}]
+			if ra != rb {
+				return ra > rb
+			}
+			return a.CreatedAt.After(b.CreatedAt)
+		})
+		res.Items = limit(res.Items, arg.Limit)
+	}
+
+	if prefix := strings.ToLower(strings.TrimSpace(arg.Terms)); prefix != "" {
+		counts := make(map[string]int)
+		for _, c := range m.collections {
+			if c.Visible != 0 && strings.HasPrefix(strings.ToLower(c.Creator), prefix) {
+				counts[c.Creator]++
+			}
+		}
+		for address, n := range counts {
+			res.Creators = append(res.Creators, &Creator{Address: address, Collections: n})
+		}
+		sort.Slice(res.Creators, func(i, j int) bool {
+			a, b := res.Creators[i], res.Creators[j]
+			if a.Collections != b.Collections {
+				return a.Collections > b.Collections
+			}
+			return a.Address < b.Address
+		})
+		res.Creators = limit(res.Creators, arg.Limit)
+	}
+
+	return res, nil
+}
+
+type weighted struct {
+	text   string
+	weight float64
+}
+
+// searchRank returns 0 when a word of words prefixes no word of fields, and
+// otherwise the sum over words of the weight of the heaviest field the word
+// is found in.
+func searchRank(words []string, fields []weighted) float64 {
+	var rank float64
+	for _, w := range words {
+		best := 0.0
+		for _, f := range fields {
+			if f.weight <= best {
+				continue
+			}
+			for _, fw := range searchWords(f.text) {
+				if strings.HasPrefix(fw, w) {
+					best = f.weight
+					break
+				}
+			}
+		}
+		if best == 0 {
+			return 0
+		}
+		rank += best
+	}
+	return rank
+}
+
+// limit keeps the first n rows, or every row when n is not positive, like
+// bun's Limit.
+func limit[T any](rows []T, n int) []T {
+	if n > 0 && len(rows) > n {
+		return rows[:n]
+	}
+	return rows
+}
+
+func (m *MemoryDB) GetOrder(ctx context.Context, id string) (*exchange.Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	o, ok := m.orders[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return o.Copy(), nil
+}
+
+func (m *MemoryDB) GetOrderByClientID(ctx context.Context, owner, clientOrderID string) (*exchange.Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if o := m.orderByClientID(owner, clientOrderID); o != nil {
+		return o.Copy(), nil
+	}
+	return nil, ErrNotFound
+}
+
+// orderByClientID returns the order of owner with a client order id, or nil.
+// Orders without a client order id never match, like NULLs in SQL.
+func (m *MemoryDB) orderByClientID(owner, clientOrderID string) *exchange.Order {
+	if clientOrderID == "" {
+		return nil
+	}
+	for _, o := range m.orders {
+		if o.Owner == owner && o.ClientOrderID == clientOrderID {
+			return o
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) GetOrders(ctx context.Context, bid bool, status, sort string, p PageParams) ([]*exchange.Order, *Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var orders []*exchange.Order
+	for _, o := range m.orders {
+		if o.Bid != bid {
+			continue
+		}
+		if status == OpenOrderStatus && !o.Status.Open() || status != OpenOrderStatus && string(o.Status) != status {
+			continue
+		}
+		orders = append(orders, o.Copy())
+	}
+
+	orders, next := nextPage(memPage(orders, p, sort == "desc", orderCursor, orderKey), p, orderCursor)
+	return orders, next, nil
+}
+
+// GetOpenOrders returns every open order, oldest first.
+func (m *MemoryDB) GetOpenOrders(ctx context.Context) ([]*exchange.Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var orders []*exchange.Order
+	for _, o := range m.orders {
+		if o.Status.Open() {
+			orders = append(orders, o.Copy())
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].CreatedAt.Before(orders[j].CreatedAt) })
+	return orders, nil
+}
+
+// UpsertOrder inserts the order, or updates its state when it already exists.
+func (m *MemoryDB) UpsertOrder(ctx context.Context, order *exchange.Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if o, ok := m.orders[order.ID]; ok {
+		o.Status = order.Status
+		o.Filled = order.Filled
+		o.UpdatedAt = order.UpdatedAt
+		return nil
+	}
+	return m.insertOrder(order)
+}
+
+func (m *MemoryDB) insertOrder(order *exchange.Order) error {
+	if m.orderByClientID(order.Owner, order.ClientOrderID) != nil {
+		return fmt.Errorf("%w: order_client_id_index", ErrDuplicate)
+	}
+	m.orders[order.ID] = order.Copy()
+	return nil
+}
+
+// InsertTrade records a trade and transfers the token to the buyer. Balances
+// follow the chain only, and change when the settlement is indexed.
+func (m *MemoryDB) InsertTrade(ctx context.Context, trade *Trade) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.insertTrade(trade)
+	return nil
+}
+
+func (m *MemoryDB) insertTrade(trade *Trade) {
+	if trade.ID == 0 {
+		m.lastTrade++
+		trade.ID = m.lastTrade
+	}
+	clone := *trade
+	m.trades = append(m.trades, &clone)
+
+	if item, ok := m.items[itemID{trade.Collection, trade.TokenID}]; ok {
+		item.Owner = trade.Buyer
+	}
+}
+
+// GetTrades returns the trades made since a time, oldest first.
+func (m *MemoryDB) GetTrades(ctx context.Context, since time.Time) ([]*Trade, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var trades []*Trade
+	for _, t := range m.trades {
+		if !t.CreatedAt.Before(since) {
+			clone := *t
+			trades = append(trades, &clone)
+		}
+	}
+	sort.Slice(trades, func(i, j int) bool {
+		if !trades[i].CreatedAt.Equal(trades[j].CreatedAt) {
+			return trades[i].CreatedAt.Before(trades[j].CreatedAt)
+		}
+		return trades[i].ID < trades[j].ID
+	})
+	return trades, nil
+}
+
+func (m *MemoryDB) GetTradeTotals(ctx context.Context) ([]*TradeTotal, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	type key struct {
+		collection int
+		currency   string
+	}
+	index := make(map[key]*TradeTotal)
+	var totals []*TradeTotal
+	for _, t := range m.trades {
+		total, ok := index[key{t.Collection, t.Currency}]
+		if !ok {
+			total = &TradeTotal{Collection: t.Collection, Currency: t.Currency}
+			index[key{t.Collection, t.Currency}] = total
+			totals = append(totals, total)
+		}
+		total.Sales++
+		total.Volume += t.Price * float64(t.Size)
+	}
+	return totals, nil
+}
+
+func (m *MemoryDB) GetItemOwners(ctx context.Context) ([]*OwnerCount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	type key struct {
+		collection int
+		owner      string
+	}
+	index := make(map[key]*OwnerCount)
+	var owners []*OwnerCount
+	for _, item := range m.items {
+		key := key{item.Collection, item.Owner}
+		count, ok := index[key]
+		if !ok {
+			count = &OwnerCount{Collection: item.Collection, Owner: item.Owner}
+			index[key] = count
+			owners = append(owners, count)
+		}
+		count.Items++
+	}
+	return owners, nil
+}
+
+func (m *MemoryDB) InsertAPIKey(ctx context.Context, arg CreateAPIKeyParams) (*APIKey, error) {
+	key := APIKey{
+		ID:         arg.ID,
+		Owner:      arg.Owner,
+		SecretHash: arg.SecretHash,
+		Scopes:     arg.Scopes,
+		ExpiresAt:  arg.ExpiresAt,
+		CreatedAt:  arg.CreatedAt,
+	}
+	if err := m.Insert(ctx, &key); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (m *MemoryDB) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, ok := m.apiKeys[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneAPIKey(key), nil
+}
+
+func (m *MemoryDB) GetAPIKeysByOwner(ctx context.Context, owner string) ([]*APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keys []*APIKey
+	for _, key := range m.apiKeys {
+		if key.Owner == owner {
+			keys = append(keys, cloneAPIKey(key))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (m *MemoryDB) RevokeAPIKey(ctx context.Context, id, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.apiKeys[id]
+	if !ok || key.Owner != owner {
+		return ErrNotFound
+	}
+	key.Revoked = true
+	return nil
+}
+
+func (m *MemoryDB) GetSession(ctx context.Context, tokenHash string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s, ok := m.sessions[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	clone := *s
+	return &clone, nil
+}
+
+func (m *MemoryDB) GetIdempotencyKey(ctx context.Context, owner, key string) (*IdempotencyKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	k, ok := m.idempotency[ownerKey{owner, key}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneIdempotencyKey(k), nil
+}
+
+// SaveIdempotencyKey stores the response for a key, replacing an expired one.
+func (m *MemoryDB) SaveIdempotencyKey(ctx context.Context, k *IdempotencyKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.idempotency[ownerKey{k.Owner, k.Key}] = cloneIdempotencyKey(k)
+	return nil
+}
+
+// keyed is a row with its sort key.
+type keyed[T any] struct {
+	row T
+	key []interface{}
+}
+
+// memPage is page for rows held in memory: it sorts rows by the key of their
+// cursor and returns the page selected by p, with one row more than the page
+// size when another page follows.
+func memPage[T any](rows []T, p PageParams, desc bool, cursor func(T) *Cursor, key func(*Cursor) []interface{}) []T {
+	sorted := make([]keyed[T], len(rows))
+	for i, row := range rows {
+		sorted[i] = keyed[T]{row, key(cursor(row))}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		c := compareKeys(sorted[i].key, sorted[j].key)
+		return desc && c > 0 || !desc && c < 0
+	})
+
+	start := 0
+	switch {
+	case p.Cursor != nil:
+		after := key(p.Cursor)
+		start = sort.Search(len(sorted), func(i int) bool {
+			c := compareKeys(sorted[i].key, after)
+			return desc && c < 0 || !desc && c > 0
+		})
+	case p.Number > 1:
+		start = p.Size * (p.Number - 1)
+	}
+	if start > len(sorted) {
+		start = len(sorted)
+	}
+	end := start + p.Size + 1
+	if end > len(sorted) {
+		end = len(sorted)
+	}
+
+	page := make([]T, 0, end-start)
+	for _, k := range sorted[start:end] {
+		page = append(page, k.row)
+	}
+	return page
+}
+
+// compareKeys compares sort keys made of times, strings, floats and ints,
+// like a row comparison in SQL.
+func compareKeys(a, b []interface{}) int {
+	for i := range a {
+		c := 0
+		switch x := a[i].(type) {
+		case time.Time:
+			if y := b[i].(time.Time); x.Before(y) {
+				c = -1
+			} else if x.After(y) {
+				c = 1
+			}
+		case string:
+			c = strings.Compare(x, b[i].(string))
+		case float64:
+			c = compare(x, b[i].(float64))
+		case int:
+			c = compare(x, b[i].(int))
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compare[T int | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func setString(field *string, value *string) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+func setInt8(field *int8, value *int8) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+func cloneCollection(c *Collection) *Collection {
+	clone := *c
+	clone.Properties = append(Attributes(nil), c.Properties...)
+	clone.Volume, clone.Floor = 0, nil
+	return &clone
+}
+
+func cloneItem(item *Item) *Item {
+	clone := *item
+	clone.Properties = append(Attributes(nil), item.Properties...)
+	return &clone
+}
+
+func cloneAPIKey(key *APIKey) *APIKey {
+	clone := *key
+	clone.Scopes = append([]string(nil), key.Scopes...)
+	return &clone
+}
+
+func cloneIdempotencyKey(k *IdempotencyKey) *IdempotencyKey {
+	clone := *k
+	clone.Body = append([]byte(nil), k.Body...)
+	return &clone
+}
+
+// ApplyTransfers records transfers in order, updating balances and the
+// owners of the transferred ERC-721 items. Transfers already recorded are
+// skipped. It returns the items whose owner changed.
+func (m *MemoryDB) ApplyTransfers(ctx context.Context, transfers []*Transfer) ([]*OwnerChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var changes []*OwnerChange
+	for _, t := range transfers {
+		if m.transfer(t) != nil {
+			continue
+		}
+		t.PreviousOwner = ""
+		item, found := m.items[itemID{t.Collection, t.TokenID}]
+		found = found && t.Standard == ERC721
+		if found {
+			t.PreviousOwner = item.Owner
+		}
+		clone := *t
+		m.transfers = append(m.transfers, &clone)
+		m.addBalance(t.Collection, t.TokenID, t.From, -t.Amount)
+		m.addBalance(t.Collection, t.TokenID, t.To, t.Amount)
+
+		if found && item.Owner != t.To {
+			changes = append(changes, &OwnerChange{Collection: t.Collection, TokenID: t.TokenID, From: item.Owner, To: t.To})
+			item.Owner = t.To
+		}
+	}
+	return changes, nil
+}
+
+func (m *MemoryDB) transfer(t *Transfer) *Transfer {
+	for _, r := range m.transfers {
+		if r.Chain == t.Chain && r.TxHash == t.TxHash && r.LogIndex == t.LogIndex && r.BatchIndex == t.BatchIndex {
+			return r
+		}
+	}
+	return nil
+}
+
+// RevertTransfers deletes the transfers of a chain from a block on, after a
+// reorg, undoing them newest first. It returns the reverted transfers and
+// the items whose owner changed back.
+func (m *MemoryDB) RevertTransfers(ctx context.Context, chain int8, fromBlock int64) ([]*Transfer, []*OwnerChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var (
+		kept     []*Transfer
+		reverted []*Transfer
+		changes  []*OwnerChange
+	)
+	for _, t := range m.transfers {
+		if t.Chain == chain && t.Block >= fromBlock {
+			reverted = append(reverted, t)
+		} else {
+			kept = append(kept, t)
+		}
+	}
+	sort.SliceStable(reverted, func(i, j int) bool {
+		a, b := reverted[i], reverted[j]
+		if a.Block != b.Block {
+			return a.Block > b.Block
+		}
+		if a.LogIndex != b.LogIndex {
+			return a.LogIndex > b.LogIndex
+		}
+		return a.BatchIndex > b.BatchIndex
+	})
+
+	for _, t := range reverted {
+		m.addBalance(t.Collection, t.TokenID, t.To, -t.Amount)
+		m.addBalance(t.Collection, t.TokenID, t.From, t.Amount)
+		if t.PreviousOwner == "" || t.PreviousOwner == t.To {
+			continue
+		}
+		if item, ok := m.items[itemID{t.Collection, t.TokenID}]; ok {
+			item.Owner = t.PreviousOwner
+			changes = append(changes, &OwnerChange{Collection: t.Collection, TokenID: t.TokenID, From: t.To, To: t.PreviousOwner})
+		}
+	}
+	m.transfers = kept
+	return reverted, changes, nil
+}
+
+// addBalance adds amount, which may be negative, to the balance of owner.
+// The caller holds m.mu.
+func (m *MemoryDB) addBalance(collection, tokenID int, owner string, amount int) {
+	if owner == ZeroAddress {
+		return
+	}
+	key := balanceKey{collection, tokenID, owner}
+	if m.balances[key] += amount; m.balances[key] == 0 {
+		delete(m.balances, key)
+	}
+}
+
+// GetBalance returns the number of a token held by owner, 0 when it holds
+// none.
+func (m *MemoryDB) GetBalance(ctx context.Context, collection, tokenID int, owner string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.balances[balanceKey{collection, tokenID, owner}], nil
+}
+
+// HasTransfers reports whether an indexed transfer of a token was sent or
+// received by address. Without one, its balance is not known.
+func (m *MemoryDB) HasTransfers(ctx context.Context, collection, tokenID int, address string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, t := range m.transfers {
+		if t.Collection == collection && t.TokenID == tokenID && (t.From == address || t.To == address) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryDB) GetCheckpoint(ctx context.Context, chain int8) (*Checkpoint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cp, ok := m.checkpoints[chain]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	clone := *cp
+	return &clone, nil
+}
+
+func (m *MemoryDB) SaveCheckpoint(ctx context.Context, cp *Checkpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	clone := *cp
+	m.checkpoints[cp.Chain] = &clone
+	return nil
+}
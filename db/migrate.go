@@ -0,0 +1,86 @@
+package db
+
+import (
+	"cdex/db/migrations"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/uptrace/bun/migrate"
+)
+
+var ErrSchemaBehind = errors.New("database schema is behind the binary")
+
+// Migrator returns the migrator of the embedded migrations.
+func (db *NartDB) Migrator() *migrate.Migrator {
+	return migrate.NewMigrator(db.root, migrations.Migrations)
+}
+
+// CheckSchema returns ErrSchemaBehind, wrapped with the missing migrations,
+// when a migration of the binary has not been applied.
+func (db *NartDB) CheckSchema(ctx context.Context) error {
+	m := db.Migrator()
+	if err := m.Init(ctx); err != nil {
+		return err
+	}
+
+	ms, err := m.MigrationsWithStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	if unapplied := ms.Unapplied(); len(unapplied) > 0 {
+		return fmt.Errorf("%w: %s not applied", ErrSchemaBehind, unapplied)
+	}
+	return nil
+}
+
+// Baseline marks the migrations up to version applied without running
+// them, for databases created by hand before migrations existed. An empty
+// version marks the first migration only.
+func (db *NartDB) Baseline(ctx context.Context, version string) error {
+	m := db.Migrator()
+	if err := m.Init(ctx); err != nil {
+		return err
+	}
+
+	ms, err := m.MigrationsWithStatus(ctx)
+	if err != nil {
+		return err
+	}
+	baseline, err := baselineMigrations(ms, version)
+	if err != nil {
+		return err
+	}
+	for i := range baseline {
+		baseline[i].GroupID = 1
+		if err = m.MarkApplied(ctx, &baseline[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// baselineMigrations returns the unapplied migrations of ms up to version,
+// or an error when no migration has that version, before anything is marked.
+func baselineMigrations(ms migrate.MigrationSlice, version string) (migrate.MigrationSlice, error) {
+	if len(ms) == 0 {
+		return nil, nil
+	}
+	if version == "" {
+		version = ms[0].Name
+	}
+
+	for i := range ms {
+		if ms[i].Name != version {
+			continue
+		}
+		var baseline migrate.MigrationSlice
+		for _, m := range ms[:i+1] {
+			if !m.IsApplied() {
+				baseline = append(baseline, m)
+			}
+		}
+		return baseline, nil
+	}
+	return nil, fmt.Errorf("unknown migration %s", version)
+}
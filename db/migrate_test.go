@@ -0,0 +1,38 @@
+package db
+
+import (
+	"cdex/db/migrations"
+	"github.com/uptrace/bun/migrate"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	ms := migrations.Migrations.Sorted()
+	if len(ms) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for _, m := range ms {
+		if m.Up == nil || m.Down == nil {
+			t.Errorf("migration %s_%s lacks an up or down script", m.Name, m.Comment)
+		}
+	}
+}
+
+func TestBaselineMigrations(t *testing.T) {
+	ms := migrate.MigrationSlice{{Name: "1", ID: 1}, {Name: "2"}, {Name: "3"}}
+
+	baseline, err := baselineMigrations(ms, "")
+	check(t, err, nil)
+	check(t, len(baseline), 0)
+
+	baseline, err = baselineMigrations(ms, "3")
+	check(t, err, nil)
+	check(t, len(baseline), 2)
+	check(t, baseline[0].Name, "2")
+	check(t, baseline[1].Name, "3")
+
+	// An unknown version marks nothing.
+	baseline, err = baselineMigrations(ms, "4")
+	check(t, err.Error(), "unknown migration 4")
+	check(t, len(baseline), 0)
+}
@@ -1,3 +1,4 @@
+-- The schema the tables used to be created with by hand.
 CREATE TABLE collections(
     id SERIAL not null,
     name varchar(32) not null ,
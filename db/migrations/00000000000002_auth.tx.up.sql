@@ -0,0 +1,21 @@
+-- API keys store a hash of their secret; sessions a hash of their token.
+CREATE TABLE api_keys(
+    id varchar(64) not null,
+    owner varchar(65) not null,
+    secret_hash varchar(64) not null,
+    scopes text[] not null,
+    revoked boolean not null default false,
+    expires_at timestamp not null,
+    created_at timestamp not null,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX api_key_owner_index ON api_keys(owner);
+
+CREATE TABLE sessions(
+    token_hash varchar(64) not null,
+    address varchar(65) not null,
+    expires_at timestamp not null,
+    created_at timestamp not null,
+    PRIMARY KEY (token_hash)
+);
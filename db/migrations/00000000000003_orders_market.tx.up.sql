@@ -0,0 +1,2 @@
+-- Orders are placed through a market of the matching engine.
+ALTER TABLE orders ADD COLUMN market varchar(16) not null default 'fra';
@@ -0,0 +1,7 @@
+-- The filled quantity of partially filled orders is lost.
+UPDATE orders SET status = 'pending' WHERE status IN ('new', 'partially_filled');
+ALTER TABLE orders DROP COLUMN expires_at;
+ALTER TABLE orders DROP COLUMN updated_at;
+ALTER TABLE orders DROP COLUMN filled;
+ALTER TABLE orders DROP COLUMN type;
+ALTER TABLE orders ALTER COLUMN bid TYPE smallint USING CASE WHEN bid THEN 1 ELSE 0 END;
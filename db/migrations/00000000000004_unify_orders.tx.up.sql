@@ -0,0 +1,15 @@
+-- One order model for the engine, storage and API: boolean side, order type,
+-- filled quantity and the full status lifecycle.
+ALTER TABLE orders ALTER COLUMN bid TYPE boolean USING bid <> 0;
+ALTER TABLE orders ADD COLUMN type varchar(16) not null default 'limit';
+ALTER TABLE orders ADD COLUMN filled integer not null default 0;
+ALTER TABLE orders ADD COLUMN updated_at timestamp;
+ALTER TABLE orders ADD COLUMN expires_at timestamp;
+
+UPDATE orders SET updated_at = created_at;
+ALTER TABLE orders ALTER COLUMN updated_at SET NOT NULL;
+
+-- The journal stored the remaining quantity, so filled orders may have 0 left;
+-- orders were single-quantity until now.
+UPDATE orders SET quantity = GREATEST(quantity, 1), filled = GREATEST(quantity, 1) WHERE status = 'filled';
+UPDATE orders SET status = 'new' WHERE status = 'pending';
@@ -0,0 +1,3 @@
+DROP TABLE idempotency_keys;
+DROP INDEX order_client_id_index;
+ALTER TABLE orders DROP COLUMN client_order_id;
@@ -0,0 +1,14 @@
+-- Client order ids are unique per owner; NULLs do not conflict.
+ALTER TABLE orders ADD COLUMN client_order_id varchar(64);
+CREATE UNIQUE INDEX order_client_id_index ON orders(owner, client_order_id);
+
+-- Responses of write requests sent with an Idempotency-Key header.
+CREATE TABLE idempotency_keys(
+    owner varchar(65) not null,
+    key varchar(255) not null,
+    request_hash varchar(64) not null,
+    status integer not null,
+    body bytea not null,
+    created_at timestamp not null,
+    PRIMARY KEY (owner, key)
+);
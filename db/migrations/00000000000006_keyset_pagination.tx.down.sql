@@ -0,0 +1,5 @@
+DROP INDEX order_side_created_index;
+DROP INDEX item_collection_created_index;
+DROP INDEX item_created_index;
+DROP INDEX collection_creator_created_index;
+DROP INDEX collection_created_index;
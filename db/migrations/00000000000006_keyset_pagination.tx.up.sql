@@ -0,0 +1,6 @@
+-- Lists are paginated on (created_at, key) instead of offsets.
+CREATE INDEX collection_created_index ON collections(created_at, id);
+CREATE INDEX collection_creator_created_index ON collections(creator, created_at, id);
+CREATE INDEX item_created_index ON items(created_at, collection, token_id);
+CREATE INDEX item_collection_created_index ON items(collection, created_at, token_id);
+CREATE INDEX order_side_created_index ON orders(bid, status, created_at, id);
@@ -0,0 +1 @@
+DROP INDEX order_collection_ask_index;
@@ -0,0 +1,2 @@
+-- Collection volume and floor are aggregated from the asks of each collection.
+CREATE INDEX order_collection_ask_index ON orders(collection, status, price) WHERE NOT bid;
@@ -0,0 +1,9 @@
+DROP INDEX collection_creator_pattern_index;
+DROP INDEX item_search_index;
+DROP INDEX collection_search_index;
+DROP TRIGGER items_search ON items;
+DROP TRIGGER collections_search ON collections;
+DROP FUNCTION items_search_update();
+DROP FUNCTION collections_search_update();
+ALTER TABLE items DROP COLUMN search;
+ALTER TABLE collections DROP COLUMN search;
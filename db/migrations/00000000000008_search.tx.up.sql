@@ -0,0 +1,37 @@
+-- Full-text search over collections and items. The simple configuration keeps
+-- names and symbols as they are instead of stemming them as English words.
+ALTER TABLE collections ADD COLUMN search tsvector;
+ALTER TABLE items ADD COLUMN search tsvector;
+
+CREATE FUNCTION collections_search_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search :=
+        setweight(to_tsvector('simple', coalesce(NEW.name, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(NEW.symbol, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(NEW.introduction, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(NEW.description, '')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION items_search_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search :=
+        setweight(to_tsvector('simple', coalesce(NEW.name, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(NEW.description, '')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER collections_search BEFORE INSERT OR UPDATE OF name, symbol, introduction, description
+    ON collections FOR EACH ROW EXECUTE FUNCTION collections_search_update();
+CREATE TRIGGER items_search BEFORE INSERT OR UPDATE OF name, description
+    ON items FOR EACH ROW EXECUTE FUNCTION items_search_update();
+
+-- Fire the triggers once to index the existing rows.
+UPDATE collections SET name = name;
+UPDATE items SET name = name;
+
+CREATE INDEX collection_search_index ON collections USING GIN (search);
+CREATE INDEX item_search_index ON items USING GIN (search);
+CREATE INDEX collection_creator_pattern_index ON collections(lower(creator) varchar_pattern_ops);
@@ -0,0 +1,11 @@
+DROP TABLE collection_traits;
+DROP INDEX item_rarity_index;
+DROP INDEX item_properties_index;
+ALTER TABLE items DROP COLUMN statistical_rank;
+ALTER TABLE items DROP COLUMN statistical_rarity;
+ALTER TABLE items DROP COLUMN rarity_rank;
+ALTER TABLE items DROP COLUMN rarity_score;
+ALTER TABLE items ALTER COLUMN properties DROP DEFAULT;
+ALTER TABLE items ALTER COLUMN properties TYPE varchar(128) USING properties::text;
+ALTER TABLE collections ALTER COLUMN properties DROP DEFAULT;
+ALTER TABLE collections ALTER COLUMN properties TYPE text USING properties::text;
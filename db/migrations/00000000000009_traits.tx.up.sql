@@ -0,0 +1,35 @@
+-- Properties are OpenSea attribute lists. Values that are not valid JSON lists
+-- cannot be traits and are dropped.
+CREATE FUNCTION attributes_or_empty(properties text) RETURNS jsonb AS $$
+BEGIN
+    IF jsonb_typeof(properties::jsonb) = 'array' THEN
+        RETURN properties::jsonb;
+    END IF;
+    RETURN '[]'::jsonb;
+EXCEPTION WHEN others THEN
+    RETURN '[]'::jsonb;
+END
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+ALTER TABLE collections ALTER COLUMN properties TYPE jsonb USING attributes_or_empty(properties);
+ALTER TABLE collections ALTER COLUMN properties SET DEFAULT '[]';
+ALTER TABLE items ALTER COLUMN properties TYPE jsonb USING attributes_or_empty(properties);
+ALTER TABLE items ALTER COLUMN properties SET DEFAULT '[]';
+
+DROP FUNCTION attributes_or_empty(text);
+
+ALTER TABLE items ADD COLUMN rarity_score double precision not null default 0;
+ALTER TABLE items ADD COLUMN rarity_rank integer not null default 0;
+ALTER TABLE items ADD COLUMN statistical_rarity double precision not null default 1;
+ALTER TABLE items ADD COLUMN statistical_rank integer not null default 0;
+
+CREATE INDEX item_properties_index ON items USING GIN (properties jsonb_path_ops);
+CREATE INDEX item_rarity_index ON items(collection, rarity_rank);
+
+CREATE TABLE collection_traits(
+    collection integer not null,
+    trait_type varchar(64) not null,
+    value varchar(128) not null,
+    count integer not null,
+    PRIMARY KEY (collection, trait_type, value)
+);
@@ -0,0 +1,3 @@
+DROP TABLE trades;
+DROP INDEX item_owner_index;
+ALTER TABLE items DROP COLUMN owner;
@@ -0,0 +1,25 @@
+-- Items have an owner, the creator until the item is first traded.
+ALTER TABLE items ADD COLUMN owner varchar(65);
+UPDATE items SET owner = creator;
+ALTER TABLE items ALTER COLUMN owner SET NOT NULL;
+CREATE INDEX item_owner_index ON items(collection, owner);
+
+-- Matches of the engine. Trades made before this table existed are not known.
+CREATE TABLE trades(
+    id BIGSERIAL not null,
+    market varchar(16) not null,
+    collection integer not null,
+    token_id integer not null,
+    price decimal(18,2) not null,
+    size integer not null,
+    currency varchar(16) not null,
+    buyer varchar(65) not null,
+    seller varchar(65) not null,
+    bid_order varchar(128) not null,
+    ask_order varchar(128) not null,
+    created_at timestamp not null,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX trade_collection_index ON trades(collection, created_at);
+CREATE INDEX trade_created_index ON trades(created_at);
@@ -0,0 +1,2 @@
+-- Creators can hide an item from public listings without deleting it.
+ALTER TABLE items ADD COLUMN hidden boolean not null default false;
@@ -0,0 +1,2 @@
+-- The metadata URI of an item, fetched again when its metadata is refreshed.
+ALTER TABLE items ADD COLUMN token_uri varchar(256) not null default '';
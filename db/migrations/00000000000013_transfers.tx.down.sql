@@ -0,0 +1,3 @@
+DROP TABLE checkpoints;
+DROP TABLE balances;
+DROP TABLE transfers;
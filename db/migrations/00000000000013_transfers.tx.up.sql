@@ -0,0 +1,39 @@
+-- Token transfers read from the chain by the indexer. A TransferBatch log
+-- holds several transfers, told apart by batch_index. previous_owner is the
+-- owner of the item before an ERC-721 transfer, restored when a reorg drops
+-- the transfer.
+CREATE TABLE transfers(
+    chain smallint not null,
+    tx_hash varchar(66) not null,
+    log_index integer not null,
+    batch_index integer not null,
+    block bigint not null,
+    collection integer not null,
+    token_id integer not null,
+    "from" varchar(65) not null,
+    "to" varchar(65) not null,
+    amount integer not null,
+    standard smallint not null,
+    previous_owner varchar(65) not null default '',
+    PRIMARY KEY (chain, tx_hash, log_index, batch_index)
+);
+
+CREATE INDEX transfer_block_index ON transfers(chain, block);
+
+-- The number of each token held by an address, from the indexed transfers.
+CREATE TABLE balances(
+    collection integer not null,
+    token_id integer not null,
+    owner varchar(65) not null,
+    amount integer not null,
+    PRIMARY KEY (collection, token_id, owner)
+);
+
+-- The last block indexed on each chain, with its hash to detect reorgs.
+CREATE TABLE checkpoints(
+    chain smallint not null,
+    block bigint not null,
+    hash varchar(66) not null,
+    updated_at timestamp not null,
+    PRIMARY KEY (chain)
+);
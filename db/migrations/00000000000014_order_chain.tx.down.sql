@@ -0,0 +1,2 @@
+ALTER TABLE trades DROP COLUMN chain;
+ALTER TABLE orders DROP COLUMN chain;
@@ -0,0 +1,7 @@
+-- A currency symbol names a different token on each chain, so orders and
+-- trades record the chain they are settled on: the chain of their collection.
+ALTER TABLE orders ADD COLUMN chain smallint not null default 0;
+UPDATE orders SET chain = collections.chain FROM collections WHERE collections.id = orders.collection;
+
+ALTER TABLE trades ADD COLUMN chain smallint not null default 0;
+UPDATE trades SET chain = collections.chain FROM collections WHERE collections.id = trades.collection;
@@ -0,0 +1 @@
+DROP INDEX transfer_token_index;
@@ -0,0 +1,3 @@
+-- Asks are only checked against the balances of addresses that have indexed
+-- transfers of the token.
+CREATE INDEX transfer_token_index ON transfers(collection, token_id);
@@ -0,0 +1,20 @@
+// Package migrations holds the versioned schema of the database, embedded in
+// the binary. A migration is a pair of NNNNNNNNNNNNNN_name.tx.up.sql and
+// .tx.down.sql files, run in a transaction in the order of their versions.
+package migrations
+
+import (
+	"embed"
+	"github.com/uptrace/bun/migrate"
+)
+
+//go:embed *.sql
+var sqlMigrations embed.FS
+
+var Migrations = migrate.NewMigrations()
+
+func init() {
+	if err := Migrations.Discover(sqlMigrations); err != nil {
+		panic(err)
+	}
+}
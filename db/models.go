@@ -3,38 +3,92 @@ package db
 import "time"
 
 type Collection struct {
-	ID           int       `json:"id"`
-	Name         string    `json:"name"`
-	Address      string    `json:"address"`
-	Creator      string    `json:"creator"`
-	Chain        int8      `json:"chain"`
-	Visible      int8      `json:"visible"`
-	Status       int8      `json:"status"`
-	Type         int8      `json:"type"`
-	Tax          int8      `json:"tax"`
-	Symbol       string    `json:"symbol"`
-	Currency     string    `json:"currency"`
-	CreatedAt    time.Time `json:"created_at"`
-	Image        string    `json:"image"`
-	Background   string    `json:"background"`
-	Banner       string    `json:"banner"`
-	Description  string    `json:"description"`
-	Introduction string    `json:"introduction"`
-	Properties   string    `json:"properties"`
-	Twitter      string    `json:"twitter"`
-	Instagram    string    `json:"instagram"`
-	Discord      string    `json:"discord"`
-	Web          string    `json:"web"`
+	ID           int        `json:"id" bun:",pk,autoincrement"`
+	Name         string     `json:"name"`
+	Address      string     `json:"address"`
+	Creator      string     `json:"creator"`
+	Chain        int8       `json:"chain"`
+	Visible      int8       `json:"visible"`
+	Status       int8       `json:"status"`
+	Type         int8       `json:"type"`
+	Tax          int8       `json:"tax"`
+	Symbol       string     `json:"symbol"`
+	Currency     string     `json:"currency"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Image        string     `json:"image"`
+	Background   string     `json:"background"`
+	Banner       string     `json:"banner"`
+	Description  string     `json:"description"`
+	Introduction string     `json:"introduction"`
+	Properties   Attributes `json:"properties" bun:"type:jsonb"`
+	Twitter      string     `json:"twitter"`
+	Instagram    string     `json:"instagram"`
+	Discord      string     `json:"discord"`
+	Web          string     `json:"web"`
+
+	// Volume is the traded value of the collection and Floor its lowest
+	// open ask, or nil when nothing is listed, both in the currency of the
+	// collection. They are only set by GetCollections.
+	Volume float64  `json:"volume" bun:",scanonly"`
+	Floor  *float64 `json:"floor" bun:",scanonly"`
 }
 
 type Item struct {
-	Name        string    `json:"name"`
-	Collection  int       `json:"collection"`
-	TokenID     int       `json:"token_id"`
-	Chain       int8      `json:"chain"`
-	Creator     string    `json:"creator"`
+	Name        string     `json:"name"`
+	Collection  int        `json:"collection" bun:",pk"`
+	TokenID     int        `json:"token_id" bun:",pk"`
+	Chain       int8       `json:"chain"`
+	Creator     string     `json:"creator"`
+	Owner       string     `json:"owner"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Image       string     `json:"image"`
+	Description string     `json:"description"`
+	Properties  Attributes `json:"properties" bun:"type:jsonb"`
+	TokenURI    string     `json:"token_uri"`
+	Hidden      bool       `json:"hidden"`
+
+	// Rarity is computed over the collection by UpdateRarity. Ranks start
+	// at 1 for the rarest item and are 0 when the collection has no traits.
+	RarityScore       float64 `json:"rarity_score"`
+	RarityRank        int     `json:"rarity_rank"`
+	StatisticalRarity float64 `json:"statistical_rarity"`
+	StatisticalRank   int     `json:"statistical_rank"`
+}
+
+type APIKey struct {
+	ID         string    `json:"id" bun:",pk"`
+	Owner      string    `json:"owner"`
+	SecretHash string    `json:"-"`
+	Scopes     []string  `json:"scopes" bun:",array"`
+	Revoked    bool      `json:"revoked"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// HasScope reports whether the key was granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type Session struct {
+	TokenHash string    `json:"-" bun:",pk"`
+	Address   string    `json:"address"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IdempotencyKey is the stored response of a write request sent with an
+// Idempotency-Key header, replayed when the request is retried.
+type IdempotencyKey struct {
+	Owner       string    `json:"owner" bun:",pk"`
+	Key         string    `json:"key" bun:",pk"`
+	RequestHash string    `json:"request_hash"`
+	Status      int       `json:"status"`
+	Body        []byte    `json:"body"`
 	CreatedAt   time.Time `json:"created_at"`
-	Image       string    `json:"image"`
-	Description string    `json:"description"`
-	Properties  string    `json:"properties"`
 }
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/uptrace/bun"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrSortCurrency is returned when collections are sorted by volume or floor
+// without a chain and currency filter.
+var ErrSortCurrency = errors.New("sorting by volume or floor needs a chain and currency")
+
+// Cursor is the position of the last row of a page. Sort is the order of
+// the list it was taken from, and Name or Value the sort key of the row when
+// the list is not ordered by creation time. The remaining fields break ties
+// between rows with the same sort key: ID for orders, Collection for
+// collections, and Collection and TokenID for items.
+type Cursor struct {
+	Sort       string    `json:"s,omitempty"`
+	CreatedAt  time.Time `json:"t"`
+	Name       string    `json:"n,omitempty"`
+	Value      float64   `json:"v,omitempty"`
+	ID         string    `json:"i,omitempty"`
+	Collection int       `json:"c,omitempty"`
+	TokenID    int       `json:"k,omitempty"`
+}
+
+// Encode returns the cursor as an opaque string for clients.
+func (c *Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if err = json.Unmarshal(b, &c); err != nil || c.CreatedAt.IsZero() {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// PageParams selects a page of a list. A page starts after Cursor, or at the
+// first row when Cursor is nil. Number selects a page by offset instead; it
+// is kept for clients written before cursors and is slow on deep pages.
+type PageParams struct {
+	Size   int
+	Cursor *Cursor
+	Number int
+}
+
+// page orders q by columns, in descending order when desc is set, and limits
+// it to the page selected by p. key returns the values of columns in a
+// cursor. One row more than the page size is selected to tell whether another
+// page follows; see nextPage.
+func page(q *bun.SelectQuery, p PageParams, desc bool, columns []string, key func(*Cursor) []interface{}) *bun.SelectQuery {
+	dir, cmp := " ASC", ">"
+	if desc {
+		dir, cmp = " DESC", "<"
+	}
+	for _, column := range columns {
+		q = q.Order(column + dir)
+	}
+
+	switch {
+	case p.Cursor != nil:
+		q = q.Where("("+strings.Join(columns, ", ")+") "+cmp+" (?)", bun.In(key(p.Cursor)))
+	case p.Number > 1:
+		q = q.Offset(p.Size * (p.Number - 1))
+	}
+
+	return q.Limit(p.Size + 1)
+}
+
+// nextPage trims the extra row selected by page and returns the cursor of the
+// next page, or nil on the last page.
+func nextPage[T any](rows []T, p PageParams, cursor func(T) *Cursor) ([]T, *Cursor) {
+	if len(rows) <= p.Size {
+		return rows, nil
+	}
+
+	rows = rows[:p.Size]
+	return rows, cursor(rows[len(rows)-1])
+}
@@ -3,37 +3,101 @@ package db
 import "time"
 
 type CreateCollectionParams struct {
-	Name         string    `json:"name"`
-	Address      string    `json:"address"`
-	Creator      string    `json:"creator"`
-	Chain        int8      `json:"chain"`
-	Visible      int8      `json:"visible"`
-	Status       int8      `json:"status"`
-	Type         int8      `json:"type"`
-	Tax          int8      `json:"tax"`
-	Symbol       string    `json:"symbol"`
-	Currency     string    `json:"currency"`
-	CreatedAt    time.Time `json:"created_at"`
-	Image        string    `json:"image"`
-	Background   string    `json:"background"`
-	Banner       string    `json:"banner"`
-	Description  string    `json:"description"`
-	Introduction string    `json:"introduction"`
-	Properties   string    `json:"properties"`
-	Twitter      string    `json:"twitter"`
-	Instagram    string    `json:"instagram"`
-	Discord      string    `json:"discord"`
-	Web          string    `json:"web"`
+	Name         string     `json:"name"`
+	Address      string     `json:"address"`
+	Creator      string     `json:"creator"`
+	Chain        int8       `json:"chain"`
+	Visible      int8       `json:"visible"`
+	Status       int8       `json:"status"`
+	Type         int8       `json:"type"`
+	Tax          int8       `json:"tax"`
+	Symbol       string     `json:"symbol"`
+	Currency     string     `json:"currency"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Image        string     `json:"image"`
+	Background   string     `json:"background"`
+	Banner       string     `json:"banner"`
+	Description  string     `json:"description"`
+	Introduction string     `json:"introduction"`
+	Properties   Attributes `json:"properties"`
+	Twitter      string     `json:"twitter"`
+	Instagram    string     `json:"instagram"`
+	Discord      string     `json:"discord"`
+	Web          string     `json:"web"`
 }
 
 type CreateItemParams struct {
-	Name        string    `json:"name"`
-	Collection  int       `json:"collection"`
-	TokenID     int       `json:"token_id"`
-	Chain       int8      `json:"chain"`
-	CreatedAt   time.Time `json:"created_at"`
-	Creator     string    `json:"creator"`
-	Image       string    `json:"image"`
-	Description string    `json:"description"`
-	Properties  string    `json:"properties"`
+	Name        string     `json:"name"`
+	Collection  int        `json:"collection"`
+	TokenID     int        `json:"token_id"`
+	Chain       int8       `json:"chain"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Creator     string     `json:"creator"`
+	Image       string     `json:"image"`
+	Description string     `json:"description"`
+	Properties  Attributes `json:"properties"`
+	TokenURI    string     `json:"token_uri"`
+}
+
+// Limits of the item columns, in characters.
+const (
+	MaxItemNameLength        = 32
+	MaxItemImageLength       = 128
+	MaxItemDescriptionLength = 128
+	MaxTokenURILength        = 256
+)
+
+// NewItem returns the item created by arg, owned by its creator.
+func NewItem(arg CreateItemParams) *Item {
+	return &Item{
+		Name:        arg.Name,
+		Collection:  arg.Collection,
+		TokenID:     arg.TokenID,
+		Chain:       arg.Chain,
+		Creator:     arg.Creator,
+		Owner:       arg.Creator,
+		CreatedAt:   arg.CreatedAt,
+		Image:       arg.Image,
+		Description: arg.Description,
+		Properties:  arg.Properties,
+		TokenURI:    arg.TokenURI,
+	}
+}
+
+type CreateAPIKeyParams struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner"`
+	SecretHash string    `json:"secret_hash"`
+	Scopes     []string  `json:"scopes"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// UpdateCollectionParams holds the collection fields to change; nil fields
+// are left as they are.
+type UpdateCollectionParams struct {
+	Name         *string
+	Visible      *int8
+	Tax          *int8
+	Image        *string
+	Background   *string
+	Banner       *string
+	Description  *string
+	Introduction *string
+	Properties   *Attributes
+	Twitter      *string
+	Instagram    *string
+	Discord      *string
+	Web          *string
+}
+
+// UpdateItemParams holds the item fields to change; nil fields are left as
+// they are.
+type UpdateItemParams struct {
+	Name        *string
+	Image       *string
+	Description *string
+	Properties  *Attributes
+	TokenURI    *string
+	Hidden      *bool
 }
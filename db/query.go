@@ -0,0 +1,251 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/uptrace/bun"
+	"math"
+	"sort"
+)
+
+// Sort orders of collection and item lists. Items are sorted by creation
+// time, name or rarity rank; collections by creation time, name, volume or
+// floor.
+const (
+	SortCreated = "created"
+	SortName    = "name"
+	SortVolume  = "volume"
+	SortFloor   = "floor"
+	SortRarity  = "rarity"
+)
+
+// noFloor sorts collections without open asks after every listed one.
+const noFloor = 1e18
+
+// unranked sorts items without a rarity rank after every ranked one.
+const unranked = math.MaxInt32
+
+// CollectionQuery selects the collections of a listing. Nil and empty
+// filters match every collection.
+type CollectionQuery struct {
+	Chain    *int8
+	Type     *int8
+	Status   *int8
+	Visible  *int8
+	Currency string
+	Creator  string
+
+	// IncludeHidden also lists collections with Visible set to 0, which
+	// public listings leave out.
+	IncludeHidden bool
+
+	Sort string
+	Desc bool
+	Page PageParams
+}
+
+// ItemQuery selects the items of a listing. Hidden items and items of hidden
+// collections are left out unless IncludeHidden is set. Traits maps trait types to accepted
+// values: an item matches when it has one of the values of every type.
+type ItemQuery struct {
+	Collection int
+	Chain      *int8
+	Creator    string
+	Traits     map[string][]string
+
+	IncludeHidden bool
+
+	Sort string
+	Desc bool
+	Page PageParams
+}
+
+func (db *NartDB) GetCollections(ctx context.Context, arg CollectionQuery) ([]*Collection, *Cursor, error) {
+	if err := arg.check(); err != nil {
+		return nil, nil, err
+	}
+
+	var collections []*Collection
+	q := db.db.NewSelect().
+		Model(&collections).
+		ColumnExpr("?TableColumns").
+		ColumnExpr("COALESCE(v.volume, 0) AS volume").
+		ColumnExpr("f.floor AS floor").
+		Join("LEFT JOIN (SELECT collection, chain, currency, SUM(price * size)::float8 AS volume FROM trades GROUP BY collection, chain, currency) AS v "+
+			"ON v.collection = collection.id AND v.chain = collection.chain AND v.currency = collection.currency").
+		Join("LEFT JOIN (SELECT collection, chain, currency, MIN(price)::float8 AS floor FROM orders WHERE NOT bid AND status IN (?) GROUP BY collection, chain, currency) AS f "+
+			"ON f.collection = collection.id AND f.chain = collection.chain AND f.currency = collection.currency", bun.In(openStatuses()))
+
+	if arg.Chain != nil {
+		q = q.Where("collection.chain = ?", *arg.Chain)
+	}
+	if arg.Type != nil {
+		q = q.Where("collection.type = ?", *arg.Type)
+	}
+	if arg.Status != nil {
+		q = q.Where("collection.status = ?", *arg.Status)
+	}
+	if arg.Visible != nil {
+		q = q.Where("collection.visible = ?", *arg.Visible)
+	}
+	if !arg.IncludeHidden {
+		q = q.Where("collection.visible <> 0")
+	}
+	if arg.Currency != "" {
+		q = q.Where("collection.currency = ?", arg.Currency)
+	}
+	if arg.Creator != "" {
+		q = q.Where("collection.creator = ?", arg.Creator)
+	}
+
+	sortColumn := "collection.created_at"
+	switch arg.Sort {
+	case SortName:
+		sortColumn = "collection.name"
+	case SortVolume:
+		sortColumn = "COALESCE(v.volume, 0)"
+	case SortFloor:
+		sortColumn = fmt.Sprintf("COALESCE(f.floor, %g)", noFloor)
+	}
+	q = page(q, arg.Page, arg.Desc, []string{sortColumn, "collection.id"}, collectionKey)
+	if err := q.Scan(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	collections, next := nextPage(collections, arg.Page, func(col *Collection) *Cursor {
+		return collectionCursor(arg.Sort, col)
+	})
+	return collections, next, nil
+}
+
+// check validates the sort and cursor of a collection query. Volumes and
+// floors are in the currency of each collection, so sorting by them needs a
+// chain and currency filter to compare like with like.
+func (arg *CollectionQuery) check() error {
+	if arg.Sort == "" {
+		arg.Sort = SortCreated
+	}
+	if arg.Page.Cursor != nil && arg.Page.Cursor.Sort != arg.Sort {
+		return ErrInvalidCursor
+	}
+	if (arg.Sort == SortVolume || arg.Sort == SortFloor) && (arg.Chain == nil || arg.Currency == "") {
+		return ErrSortCurrency
+	}
+	return nil
+}
+
+func collectionCursor(sort string, col *Collection) *Cursor {
+	c := &Cursor{Sort: sort, CreatedAt: col.CreatedAt, Collection: col.ID}
+	switch sort {
+	case SortName:
+		c.Name = col.Name
+	case SortVolume:
+		c.Value = col.Volume
+	case SortFloor:
+		c.Value = noFloor
+		if col.Floor != nil {
+			c.Value = *col.Floor
+		}
+	}
+	return c
+}
+
+// collectionKey returns the sort key of a cursor in a collection list sorted
+// by its Sort.
+func collectionKey(c *Cursor) []interface{} {
+	switch c.Sort {
+	case SortName:
+		return []interface{}{c.Name, c.Collection}
+	case SortVolume, SortFloor:
+		return []interface{}{c.Value, c.Collection}
+	default:
+		return []interface{}{c.CreatedAt, c.Collection}
+	}
+}
+
+func (db *NartDB) GetItems(ctx context.Context, arg ItemQuery) ([]*Item, *Cursor, error) {
+	if arg.Sort == "" {
+		arg.Sort = SortCreated
+	}
+	if arg.Page.Cursor != nil && arg.Page.Cursor.Sort != arg.Sort {
+		return nil, nil, ErrInvalidCursor
+	}
+
+	var items []*Item
+	q := db.db.NewSelect().Model(&items)
+	if arg.Collection != 0 {
+		q = q.Where("item.collection = ?", arg.Collection)
+	}
+	if arg.Chain != nil {
+		q = q.Where("item.chain = ?", *arg.Chain)
+	}
+	if arg.Creator != "" {
+		q = q.Where("item.creator = ?", arg.Creator)
+	}
+	if !arg.IncludeHidden {
+		q = q.Where("NOT item.hidden").Where("item.collection IN (SELECT id FROM collections WHERE visible <> 0)")
+	}
+	traitTypes := make([]string, 0, len(arg.Traits))
+	for t := range arg.Traits {
+		traitTypes = append(traitTypes, t)
+	}
+	sort.Strings(traitTypes)
+	for _, t := range traitTypes {
+		values := arg.Traits[t]
+		q = q.WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			for _, v := range values {
+				q = q.WhereOr("item.properties @> ?::jsonb", traitFilter(t, v))
+			}
+			return q
+		})
+	}
+
+	sortColumn := "item.created_at"
+	switch arg.Sort {
+	case SortName:
+		sortColumn = "item.name"
+	case SortRarity:
+		sortColumn = fmt.Sprintf("COALESCE(NULLIF(item.rarity_rank, 0), %d)", unranked)
+	}
+	q = page(q, arg.Page, arg.Desc, []string{sortColumn, "item.collection", "item.token_id"}, itemKey)
+	if err := q.Scan(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	items, next := nextPage(items, arg.Page, func(item *Item) *Cursor {
+		return itemCursor(arg.Sort, item)
+	})
+	return items, next, nil
+}
+
+func itemCursor(sort string, item *Item) *Cursor {
+	c := &Cursor{Sort: sort, CreatedAt: item.CreatedAt, Name: item.Name, Collection: item.Collection, TokenID: item.TokenID}
+	if sort == SortRarity {
+		c.Value = unranked
+		if item.RarityRank != 0 {
+			c.Value = float64(item.RarityRank)
+		}
+	}
+	return c
+}
+
+// itemKey returns the sort key of a cursor in an item list sorted by its
+// Sort.
+func itemKey(c *Cursor) []interface{} {
+	switch c.Sort {
+	case SortName:
+		return []interface{}{c.Name, c.Collection, c.TokenID}
+	case SortRarity:
+		return []interface{}{int(c.Value), c.Collection, c.TokenID}
+	default:
+		return []interface{}{c.CreatedAt, c.Collection, c.TokenID}
+	}
+}
+
+// traitFilter is the JSONB containment operand matching items with a trait
+// value.
+func traitFilter(traitType, value string) string {
+	b, _ := json.Marshal([]Attribute{{TraitType: traitType, Value: value}})
+	return string(b)
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/uptrace/bun"
+	"math"
+	"sort"
+)
+
+// TraitCount is the number of items of a collection with a trait value. An
+// empty Value counts the items that lack the trait.
+type TraitCount struct {
+	bun.BaseModel `bun:"table:collection_traits"`
+
+	Collection int    `json:"collection" bun:",pk"`
+	TraitType  string `json:"trait_type" bun:",pk"`
+	Value      string `json:"value" bun:",pk"`
+	Count      int    `json:"count"`
+}
+
+// scoreRarity counts the textual traits of the items of a collection and sets
+// their rarity with two methods:
+//
+//   - rarity score, the sum over trait types of 1 / (share of items with the
+//     item's value), highest first;
+//   - statistical rarity, the product of those shares, lowest first.
+//
+// Lacking a trait counts as a value of its own, so that one item missing a
+// common trait is rare. Items are only ranked when the collection has traits;
+// equal scores share a rank.
+func scoreRarity(items []*Item) []*TraitCount {
+	counts := make(map[string]map[string]int)
+	for _, item := range items {
+		for _, attr := range item.Properties {
+			if _, ok := attr.category(); ok && counts[attr.TraitType] == nil {
+				counts[attr.TraitType] = make(map[string]int)
+			}
+		}
+	}
+	types := make([]string, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	values := make([]map[string]string, len(items))
+	for i, item := range items {
+		values[i] = make(map[string]string)
+		for _, attr := range item.Properties {
+			if v, ok := attr.category(); ok {
+				values[i][attr.TraitType] = v
+			}
+		}
+		for _, t := range types {
+			counts[t][values[i][t]]++
+		}
+	}
+
+	n := float64(len(items))
+	logStat := make([]float64, len(items))
+	for i, item := range items {
+		item.RarityScore, item.StatisticalRarity, item.RarityRank, item.StatisticalRank = 0, 1, 0, 0
+		for _, t := range types {
+			share := float64(counts[t][values[i][t]]) / n
+			item.RarityScore += 1 / share
+			logStat[i] += math.Log(share)
+		}
+		item.StatisticalRarity = math.Exp(logStat[i])
+	}
+
+	if len(types) > 0 {
+		rank(items, func(i, j int) bool { return items[i].RarityScore > items[j].RarityScore },
+			func(i int) *int { return &items[i].RarityRank })
+		rank(items, func(i, j int) bool { return logStat[i] < logStat[j] },
+			func(i int) *int { return &items[i].StatisticalRank })
+	}
+
+	var traits []*TraitCount
+	for _, t := range types {
+		for v, c := range counts[t] {
+			traits = append(traits, &TraitCount{TraitType: t, Value: v, Count: c})
+		}
+	}
+	sort.Slice(traits, func(i, j int) bool {
+		if traits[i].TraitType != traits[j].TraitType {
+			return traits[i].TraitType < traits[j].TraitType
+		}
+		return traits[i].Value < traits[j].Value
+	})
+
+	return traits
+}
+
+// rank sets competition ranks, 1 for the rarest, in the order given by
+// rarer.
+func rank(items []*Item, rarer func(i, j int) bool, field func(i int) *int) {
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return rarer(order[a], order[b]) })
+
+	for pos, i := range order {
+		if pos > 0 && !rarer(order[pos-1], i) {
+			*field(i) = *field(order[pos-1])
+		} else {
+			*field(i) = pos + 1
+		}
+	}
+}
+
+// UpdateRarity recounts the traits of a collection and rescores its items.
+// Concurrent updates of the same collection are serialized on the collection
+// row.
+func (db *NartDB) UpdateRarity(ctx context.Context, collection int) error {
+	return db.db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewSelect().Model((*Collection)(nil)).Column("id").Where("id = ?", collection).For("UPDATE").Exec(ctx); err != nil {
+			return err
+		}
+
+		var items []*Item
+		if err := tx.NewSelect().Model(&items).Column("collection", "token_id", "properties").Where("collection = ?", collection).Scan(ctx); err != nil {
+			return err
+		}
+		traits := scoreRarity(items)
+		for _, t := range traits {
+			t.Collection = collection
+		}
+
+		if _, err := tx.NewDelete().Model((*TraitCount)(nil)).Where("collection = ?", collection).Exec(ctx); err != nil {
+			return err
+		}
+		if len(traits) > 0 {
+			if _, err := tx.NewInsert().Model(&traits).Exec(ctx); err != nil {
+				return err
+			}
+		}
+		if len(items) > 0 {
+			_, err := tx.NewUpdate().
+				Model(&items).
+				Column("rarity_score", "rarity_rank", "statistical_rarity", "statistical_rank").
+				Bulk().
+				Exec(ctx)
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (db *NartDB) GetCollectionTraits(ctx context.Context, collection int) ([]*TraitCount, error) {
+	traits := []*TraitCount{}
+	err := db.db.NewSelect().Model(&traits).Where("collection = ?", collection).Order("trait_type", "count DESC", "value").Scan(ctx)
+	return traits, err
+}
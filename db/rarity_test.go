@@ -0,0 +1,77 @@
+package db
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func attrs(t *testing.T, s string) Attributes {
+	t.Helper()
+	var a Attributes
+	if err := json.Unmarshal([]byte(s), &a); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestScoreRarity(t *testing.T) {
+	items := []*Item{
+		{TokenID: 1, Properties: attrs(t, `[{"trait_type":"Eyes","value":"Laser"},{"trait_type":"Hat","value":"Cap"}]`)},
+		{TokenID: 2, Properties: attrs(t, `[{"trait_type":"Eyes","value":"Blue"},{"trait_type":"Hat","value":"Cap"}]`)},
+		{TokenID: 3, Properties: attrs(t, `[{"trait_type":"Eyes","value":"Blue"},{"trait_type":"Level","value":5,"display_type":"number"}]`)},
+		{TokenID: 4, Properties: attrs(t, `[{"trait_type":"Eyes","value":"Blue"},{"trait_type":"Hat","value":"Cap"}]`)},
+	}
+
+	traits := scoreRarity(items)
+	want := []TraitCount{
+		{TraitType: "Eyes", Value: "Blue", Count: 3},
+		{TraitType: "Eyes", Value: "Laser", Count: 1},
+		{TraitType: "Hat", Value: "", Count: 1},
+		{TraitType: "Hat", Value: "Cap", Count: 3},
+	}
+	if len(traits) != len(want) {
+		t.Fatalf("traits = %+v", traits)
+	}
+	for i := range want {
+		if *traits[i] != want[i] {
+			t.Errorf("trait %d = %+v, want %+v", i, *traits[i], want[i])
+		}
+	}
+
+	// Laser eyes and no hat are both 1 in 4, so items 1 and 3 tie as rarest.
+	for i, rank := range []int{1, 3, 1, 3} {
+		if items[i].RarityRank != rank || items[i].StatisticalRank != rank {
+			t.Errorf("item %d ranks = %d, %d, want %d", items[i].TokenID, items[i].RarityRank, items[i].StatisticalRank, rank)
+		}
+	}
+	if items[0].RarityScore != 4+4.0/3 {
+		t.Errorf("rarity score = %v", items[0].RarityScore)
+	}
+	if items[1].StatisticalRarity != 0.75*0.75 {
+		t.Errorf("statistical rarity = %v", items[1].StatisticalRarity)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	// Properties used to be sent as a JSON encoded string.
+	a := attrs(t, `"[{\"trait_type\":\"Eyes\",\"value\":\"Blue\"}]"`)
+	if len(a) != 1 || a[0].Value != "Blue" {
+		t.Fatalf("attributes = %+v", a)
+	}
+	if a := attrs(t, `""`); a != nil {
+		t.Fatalf("attributes = %+v", a)
+	}
+
+	for s, valid := range map[string]bool{
+		`[{"trait_type":"Eyes","value":"Blue"}]`:                                     true,
+		`[{"trait_type":"Level","value":5,"display_type":"boost_number"}]`:           true,
+		`[{"trait_type":"","value":"Blue"}]`:                                         false,
+		`[{"trait_type":"Eyes","value":{"a":1}}]`:                                    false,
+		`[{"trait_type":"Eyes","value":"Blue","display_type":"number"}]`:             false,
+		`[{"trait_type":"Eyes","value":"Blue"},{"trait_type":"Eyes","value":"Red"}]`: false,
+	} {
+		if err := attrs(t, s).Validate(); (err == nil) != valid {
+			t.Errorf("Validate(%s) = %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// SearchQuery is a typeahead search. Every word of Terms must match, the last
+// one as a prefix of a word.
+type SearchQuery struct {
+	Terms string
+	Limit int
+}
+
+// Creator is a collection creator found by address prefix.
+type Creator struct {
+	Address     string `json:"address"`
+	Collections int    `json:"collections"`
+}
+
+// SearchResult groups the matches of a search, best first.
+type SearchResult struct {
+	Collections []*Collection `json:"collections"`
+	Items       []*Item       `json:"items"`
+	Creators    []*Creator    `json:"creators"`
+}
+
+// searchWords splits text into lower case words of letters and digits.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// tsQuery turns search terms into a prefix tsquery, keeping only the letters
+// and digits of each word so that user input cannot inject tsquery
+// operators. It returns "" when no word is left.
+func tsQuery(terms string) string {
+	words := searchWords(terms)
+	for i, w := range words {
+		words[i] = w + ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// likePrefix escapes the LIKE wildcards of s and matches it as a prefix.
+func likePrefix(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+	return s + "%"
+}
+
+func (db *NartDB) Search(ctx context.Context, arg SearchQuery) (*SearchResult, error) {
+	res := &SearchResult{
+		Collections: []*Collection{},
+		Items:       []*Item{},
+		Creators:    []*Creator{},
+	}
+
+	if query := tsQuery(arg.Terms); query != "" {
+		err := db.db.NewSelect().
+			Model(&res.Collections).
+			Where("search @@ to_tsquery('simple', ?)", query).
+			Where("visible <> 0").
+			OrderExpr("ts_rank(search, to_tsquery('simple', ?)) DESC, id DESC", query).
+			Limit(arg.Limit).
+			Scan(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.db.NewSelect().
+			Model(&res.Items).
+			Where("search @@ to_tsquery('simple', ?)", query).
+			Where("NOT hidden").
+			Where("collection IN (SELECT id FROM collections WHERE visible <> 0)").
+			OrderExpr("ts_rank(search, to_tsquery('simple', ?)) DESC, created_at DESC", query).
+			Limit(arg.Limit).
+			Scan(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if terms := strings.TrimSpace(arg.Terms); terms != "" {
+		err := db.db.NewSelect().
+			Model((*Collection)(nil)).
+			ColumnExpr("creator AS address").
+			ColumnExpr("count(*) AS collections").
+			Where("lower(creator) LIKE ?", likePrefix(strings.ToLower(terms))).
+			Where("visible <> 0").
+			Group("creator").
+			OrderExpr("collections DESC, creator").
+			Limit(arg.Limit).
+			Scan(ctx, &res.Creators)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,20 @@
+package db
+
+import "testing"
+
+func TestTsQuery(t *testing.T) {
+	for terms, want := range map[string]string{
+		"Bored Ape":       "bored:* & ape:*",
+		"cool-cats":       "cool:* & cats:*",
+		"a & !b | c:*":    "a:* & b:* & c:*",
+		"  ":              "",
+		"'); DROP TABLE;": "drop:* & table:*",
+	} {
+		if got := tsQuery(terms); got != want {
+			t.Errorf("tsQuery(%q) = %q, want %q", terms, got, want)
+		}
+	}
+	if got := likePrefix("0x_1%"); got != `0x\_1\%%` {
+		t.Errorf("likePrefix = %q", got)
+	}
+}
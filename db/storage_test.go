@@ -0,0 +1,590 @@
+package db
+
+import (
+	"cdex/exchange"
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testStorage runs the conformance suite of Storage. newStorage returns an
+// empty store for every subtest.
+func testStorage(t *testing.T, newStorage func(t *testing.T) Storage) {
+	for _, tc := range []struct {
+		name string
+		run  func(t *testing.T, ctx context.Context, store Storage)
+	}{
+		{"Collections", testCollections},
+		{"Items", testItems},
+		{"Trades", testTrades},
+		{"Transfers", testTransfers},
+		{"Orders", testOrders},
+		{"Search", testSearch},
+		{"Auth", testAuth},
+		{"Transactions", testTransactions},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.run(t, context.Background(), newStorage(t))
+		})
+	}
+}
+
+func TestMemoryDB(t *testing.T) {
+	testStorage(t, func(*testing.T) Storage { return NewMemoryDB() })
+}
+
+// TestNartDB runs the suite against the Postgres database of
+// CDEX_TEST_DB_SOURCE, which it migrates and empties.
+func TestNartDB(t *testing.T) {
+	dsn := os.Getenv("CDEX_TEST_DB_SOURCE")
+	if dsn == "" {
+		t.Skip("CDEX_TEST_DB_SOURCE is not set")
+	}
+
+	ctx := context.Background()
+	nartDB := NewNartDB(dsn, Options{})
+	m := nartDB.Migrator()
+	if err := m.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	testStorage(t, func(t *testing.T) Storage {
+		_, err := nartDB.db.ExecContext(ctx, "TRUNCATE collections, items, collection_traits, orders, trades, api_keys, sessions, idempotency_keys, transfers, balances, checkpoints RESTART IDENTITY")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nartDB
+	})
+}
+
+func check(t *testing.T, got, want any) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func checkErr(t *testing.T, err, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+}
+
+func must[T any](t *testing.T) func(T, error) T {
+	return func(v T, err error) T {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+}
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func at(sec int) time.Time {
+	return epoch.Add(time.Duration(sec) * time.Second)
+}
+
+func collectionNames(collections []*Collection) []string {
+	names := []string{}
+	for _, c := range collections {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func tokenIDs(items []*Item) []int {
+	ids := []int{}
+	for _, item := range items {
+		ids = append(ids, item.TokenID)
+	}
+	return ids
+}
+
+func orderIDs(orders []*exchange.Order) []string {
+	ids := []string{}
+	for _, o := range orders {
+		ids = append(ids, o.ID)
+	}
+	return ids
+}
+
+func newOrder(owner string, bid bool, collection int, price float64, created time.Time) *exchange.Order {
+	o := exchange.NewOrder(owner, "eth", bid, collection, 1, 1, price)
+	o.Market, o.Type = exchange.MarketFRA, exchange.LimitOrder
+	o.CreatedAt, o.UpdatedAt = created, created
+	return o
+}
+
+func testCollections(t *testing.T, ctx context.Context, store Storage) {
+	insert := func(name, creator string, visible int8, created time.Time) *Collection {
+		return must[*Collection](t)(store.InsertCollection(ctx, CreateCollectionParams{
+			Name: name, Creator: creator, Visible: visible, Symbol: name, Currency: "eth", CreatedAt: created,
+		}))
+	}
+	b := insert("b", "alice", 1, at(1))
+	a := insert("a", "bob", 1, at(2))
+	c := insert("c", "alice", 0, at(3))
+	if a.ID == b.ID || c.ID == a.ID {
+		t.Fatalf("collection ids not unique: %d, %d, %d", b.ID, a.ID, c.ID)
+	}
+
+	got := must[*Collection](t)(store.GetCollectionByID(ctx, a.ID))
+	check(t, got.Name, "a")
+	check(t, got.CreatedAt.Equal(at(2)), true)
+	_, err := store.GetCollectionByID(ctx, c.ID+100)
+	checkErr(t, err, ErrNotFound)
+
+	list := func(q CollectionQuery) ([]string, *Cursor) {
+		t.Helper()
+		collections, next, err := store.GetCollections(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return collectionNames(collections), next
+	}
+	names, next := list(CollectionQuery{Page: PageParams{Size: 10}})
+	check(t, names, []string{"b", "a"})
+	check(t, next, (*Cursor)(nil))
+	names, _ = list(CollectionQuery{IncludeHidden: true, Desc: true, Page: PageParams{Size: 10}})
+	check(t, names, []string{"c", "a", "b"})
+	names, _ = list(CollectionQuery{Creator: "alice", IncludeHidden: true, Page: PageParams{Size: 10}})
+	check(t, names, []string{"b", "c"})
+
+	// Walking the pages returns every row once.
+	var walked []string
+	p := PageParams{Size: 1}
+	for i := 0; i < 4; i++ {
+		names, p.Cursor = list(CollectionQuery{IncludeHidden: true, Sort: SortName, Page: p})
+		walked = append(walked, names...)
+		if p.Cursor == nil {
+			break
+		}
+	}
+	check(t, walked, []string{"a", "b", "c"})
+	names, _ = list(CollectionQuery{IncludeHidden: true, Sort: SortName, Page: PageParams{Size: 1, Number: 2}})
+	check(t, names, []string{"b"})
+	_, _, err = store.GetCollections(ctx, CollectionQuery{Sort: SortCreated, Page: PageParams{Size: 1, Cursor: &Cursor{Sort: SortName, CreatedAt: at(0)}}})
+	checkErr(t, err, ErrInvalidCursor)
+
+	// Volume sums trades, floor is the lowest open ask.
+	for _, o := range []*exchange.Order{
+		newOrder("carol", false, b.ID, 2, at(4)),
+		newOrder("carol", false, b.ID, 1.5, at(5)),
+		newOrder("dave", true, b.ID, 3, at(6)),
+	} {
+		if err = store.UpsertOrder(ctx, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	canceled := newOrder("carol", false, b.ID, 1, at(7))
+	canceled.Status = exchange.OrderCanceled
+	if err = store.UpsertOrder(ctx, canceled); err != nil {
+		t.Fatal(err)
+	}
+	// Trades and asks in another currency, or in the same symbol on another
+	// chain, count for neither.
+	usdc := newOrder("carol", false, b.ID, 0.5, at(7))
+	usdc.Currency = "usdc"
+	polygon := newOrder("carol", false, b.ID, 0.5, at(7))
+	polygon.Chain = 2
+	for _, o := range []*exchange.Order{usdc, polygon} {
+		if err = store.UpsertOrder(ctx, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, trade := range []*Trade{
+		{Market: "fra", Collection: b.ID, TokenID: 1, Price: 2, Size: 2, Currency: "eth", CreatedAt: at(8)},
+		{Market: "fra", Collection: b.ID, TokenID: 1, Price: 3000, Size: 1, Currency: "usdc", CreatedAt: at(8)},
+		{Market: "fra", Collection: b.ID, TokenID: 1, Price: 100, Size: 1, Chain: 2, Currency: "eth", CreatedAt: at(8)},
+	} {
+		if err = store.InsertTrade(ctx, trade); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chain := int8(0)
+	collections, _, err := store.GetCollections(ctx, CollectionQuery{Chain: &chain, Currency: "eth", Sort: SortFloor, Page: PageParams{Size: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, collectionNames(collections), []string{"b", "a"})
+	check(t, collections[0].Volume, 4.0)
+	check(t, *collections[0].Floor, 1.5)
+	check(t, collections[1].Floor, (*float64)(nil))
+	names, _ = list(CollectionQuery{Chain: &chain, Currency: "eth", Sort: SortVolume, Desc: true, Page: PageParams{Size: 10}})
+	check(t, names, []string{"b", "a"})
+	_, _, err = store.GetCollections(ctx, CollectionQuery{Currency: "eth", Sort: SortVolume, Page: PageParams{Size: 10}})
+	checkErr(t, err, ErrSortCurrency)
+
+	name, visible := "a2", int8(0)
+	got = must[*Collection](t)(store.UpdateCollection(ctx, a.ID, UpdateCollectionParams{Name: &name, Visible: &visible}))
+	check(t, got.Name, "a2")
+	check(t, got.Visible, int8(0))
+	check(t, got.Creator, "bob")
+	_, err = store.UpdateCollection(ctx, c.ID+100, UpdateCollectionParams{Name: &name})
+	checkErr(t, err, ErrNotFound)
+
+	must[*Item](t)(store.InsertItem(ctx, CreateItemParams{Name: "c1", Collection: c.ID, TokenID: 1, CreatedAt: at(9)}))
+	must[*Item](t)(store.InsertItem(ctx, CreateItemParams{Name: "c2", Collection: c.ID, TokenID: 2, CreatedAt: at(9)}))
+	if err = store.InsertTrade(ctx, &Trade{Market: "fra", Collection: c.ID, TokenID: 2, Price: 1, Size: 1, Buyer: "bob", CreatedAt: at(10)}); err != nil {
+		t.Fatal(err)
+	}
+	// A collection with sold items is kept whole.
+	checkErr(t, store.DeleteCollection(ctx, c.ID), ErrItemsSold)
+	must[*Item](t)(store.GetItem(ctx, c.ID, 1))
+	if err = store.DeleteItem(ctx, c.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.DeleteCollection(ctx, c.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetItem(ctx, c.ID, 1)
+	checkErr(t, err, ErrNotFound)
+	checkErr(t, store.DeleteCollection(ctx, c.ID), ErrNotFound)
+}
+
+func testItems(t *testing.T, ctx context.Context, store Storage) {
+	c := must[*Collection](t)(store.InsertCollection(ctx, CreateCollectionParams{Name: "c", Creator: "alice", Visible: 1, CreatedAt: at(0)}))
+	for i, background := range []string{"red", "red", "blue"} {
+		must[*Item](t)(store.InsertItem(ctx, CreateItemParams{
+			Name:       string(rune('z' - i)),
+			Collection: c.ID,
+			TokenID:    i + 1,
+			Creator:    "alice",
+			CreatedAt:  at(i + 1),
+			Properties: Attributes{{TraitType: "background", Value: background}},
+		}))
+	}
+	_, err := store.InsertItem(ctx, CreateItemParams{Name: "dup", Collection: c.ID, TokenID: 1, CreatedAt: at(9)})
+	checkErr(t, err, ErrDuplicate)
+
+	item := must[*Item](t)(store.GetItem(ctx, c.ID, 1))
+	check(t, item.Owner, "alice")
+	check(t, item.Properties, Attributes{{TraitType: "background", Value: "red"}})
+	_, err = store.GetItem(ctx, c.ID, 9)
+	checkErr(t, err, ErrNotFound)
+
+	if err = store.UpdateRarity(ctx, c.ID); err != nil {
+		t.Fatal(err)
+	}
+	traits := must[[]*TraitCount](t)(store.GetCollectionTraits(ctx, c.ID))
+	check(t, traits, []*TraitCount{
+		{Collection: c.ID, TraitType: "background", Value: "red", Count: 2},
+		{Collection: c.ID, TraitType: "background", Value: "blue", Count: 1},
+	})
+	check(t, must[[]*TraitCount](t)(store.GetCollectionTraits(ctx, c.ID+100)), []*TraitCount{})
+
+	list := func(q ItemQuery) []int {
+		t.Helper()
+		q.Page.Size = 10
+		items, _, err := store.GetItems(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenIDs(items)
+	}
+	check(t, list(ItemQuery{Collection: c.ID}), []int{1, 2, 3})
+	check(t, list(ItemQuery{Collection: c.ID, Sort: SortName}), []int{3, 2, 1})
+	check(t, list(ItemQuery{Collection: c.ID, Sort: SortRarity}), []int{3, 1, 2})
+	check(t, list(ItemQuery{Traits: map[string][]string{"background": {"blue"}}}), []int{3})
+	check(t, list(ItemQuery{Traits: map[string][]string{"background": {"blue", "red"}}}), []int{1, 2, 3})
+	check(t, list(ItemQuery{Traits: map[string][]string{"background": {"blue"}, "eyes": {"blue"}}}), []int{})
+
+	hidden := true
+	item = must[*Item](t)(store.UpdateItem(ctx, c.ID, 2, UpdateItemParams{Hidden: &hidden}))
+	check(t, item.Hidden, true)
+	check(t, list(ItemQuery{Collection: c.ID}), []int{1, 3})
+	check(t, list(ItemQuery{Collection: c.ID, IncludeHidden: true}), []int{1, 2, 3})
+	_, err = store.UpdateItem(ctx, c.ID, 9, UpdateItemParams{Hidden: &hidden})
+	checkErr(t, err, ErrNotFound)
+
+	if err = store.DeleteItem(ctx, c.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, store.DeleteItem(ctx, c.ID, 2), ErrNotFound)
+	check(t, list(ItemQuery{Collection: c.ID, IncludeHidden: true}), []int{1, 3})
+}
+
+func testTrades(t *testing.T, ctx context.Context, store Storage) {
+	c := must[*Collection](t)(store.InsertCollection(ctx, CreateCollectionParams{Name: "c", Creator: "alice", Visible: 1, CreatedAt: at(0)}))
+	for id := 1; id <= 2; id++ {
+		must[*Item](t)(store.InsertItem(ctx, CreateItemParams{Name: "i", Collection: c.ID, TokenID: id, Creator: "alice", CreatedAt: at(id)}))
+	}
+
+	for i, price := range []float64{1, 2.5} {
+		trade := &Trade{Market: "fra", Collection: c.ID, TokenID: 1, Price: price, Size: 1, Currency: "eth", Buyer: "bob", Seller: "alice", CreatedAt: at(10 + i)}
+		if err := store.InsertTrade(ctx, trade); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(t, must[*Item](t)(store.GetItem(ctx, c.ID, 1)).Owner, "bob")
+
+	trades := must[[]*Trade](t)(store.GetTrades(ctx, at(11)))
+	check(t, len(trades), 1)
+	check(t, trades[0].Price, 2.5)
+	check(t, len(must[[]*Trade](t)(store.GetTrades(ctx, at(0)))), 2)
+
+	check(t, must[[]*TradeTotal](t)(store.GetTradeTotals(ctx)), []*TradeTotal{{Collection: c.ID, Currency: "eth", Sales: 2, Volume: 3.5}})
+
+	owners := make(map[string]int)
+	for _, o := range must[[]*OwnerCount](t)(store.GetItemOwners(ctx)) {
+		owners[o.Owner] = o.Items
+	}
+	check(t, owners, map[string]int{"alice": 1, "bob": 1})
+}
+
+func testTransfers(t *testing.T, ctx context.Context, store Storage) {
+	c := must[*Collection](t)(store.InsertCollection(ctx, CreateCollectionParams{Name: "c", Creator: "alice", Visible: 1, CreatedAt: at(0)}))
+	must[*Item](t)(store.InsertItem(ctx, CreateItemParams{Name: "i", Collection: c.ID, TokenID: 1, Creator: "alice", CreatedAt: at(1)}))
+	balance := func(tokenID int, owner string) int {
+		return must[int](t)(store.GetBalance(ctx, c.ID, tokenID, owner))
+	}
+
+	transfers := []*Transfer{
+		{Chain: 1, TxHash: "0x01", Block: 10, Collection: c.ID, TokenID: 1, From: ZeroAddress, To: "0xa", Amount: 1, Standard: ERC721},
+		{Chain: 1, TxHash: "0x02", Block: 11, Collection: c.ID, TokenID: 1, From: "0xa", To: "0xb", Amount: 1, Standard: ERC721},
+		{Chain: 1, TxHash: "0x03", Block: 12, Collection: c.ID, TokenID: 2, From: ZeroAddress, To: "0xa", Amount: 5, Standard: ERC1155},
+		{Chain: 1, TxHash: "0x03", BatchIndex: 1, Block: 12, Collection: c.ID, TokenID: 2, From: "0xa", To: "0xb", Amount: 2, Standard: ERC1155},
+	}
+	changes := must[[]*OwnerChange](t)(store.ApplyTransfers(ctx, transfers))
+	check(t, changes, []*OwnerChange{
+		{Collection: c.ID, TokenID: 1, From: "alice", To: "0xa"},
+		{Collection: c.ID, TokenID: 1, From: "0xa", To: "0xb"},
+	})
+	check(t, must[*Item](t)(store.GetItem(ctx, c.ID, 1)).Owner, "0xb")
+	check(t, balance(1, "0xa"), 0)
+	check(t, balance(1, "0xb"), 1)
+	check(t, balance(2, "0xa"), 3)
+	check(t, balance(2, "0xb"), 2)
+	check(t, balance(2, ZeroAddress), 0)
+	check(t, must[bool](t)(store.HasTransfers(ctx, c.ID, 2, "0xb")), true)
+	check(t, must[bool](t)(store.HasTransfers(ctx, c.ID, 2, "alice")), false)
+	check(t, must[bool](t)(store.HasTransfers(ctx, c.ID, 3, "0xa")), false)
+
+	// Applying transfers again changes nothing.
+	check(t, len(must[[]*OwnerChange](t)(store.ApplyTransfers(ctx, transfers[1:2]))), 0)
+	check(t, balance(1, "0xb"), 1)
+
+	reverted, changes, err := store.RevertTransfers(ctx, 1, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, len(reverted), 3)
+	check(t, reverted[0].BatchIndex, 1)
+	check(t, changes, []*OwnerChange{{Collection: c.ID, TokenID: 1, From: "0xb", To: "0xa"}})
+	check(t, must[*Item](t)(store.GetItem(ctx, c.ID, 1)).Owner, "0xa")
+	check(t, balance(1, "0xa"), 1)
+	check(t, balance(1, "0xb"), 0)
+	check(t, balance(2, "0xa"), 0)
+
+	_, err = store.GetCheckpoint(ctx, 1)
+	checkErr(t, err, ErrNotFound)
+	cp := &Checkpoint{Chain: 1, Block: 10, Hash: "0xaa", UpdatedAt: at(20)}
+	check(t, store.SaveCheckpoint(ctx, cp), nil)
+	cp.Block, cp.Hash = 11, "0xbb"
+	check(t, store.SaveCheckpoint(ctx, cp), nil)
+	check(t, must[*Checkpoint](t)(store.GetCheckpoint(ctx, 1)), cp)
+}
+
+func testOrders(t *testing.T, ctx context.Context, store Storage) {
+	bids := []*exchange.Order{
+		newOrder("alice", true, 1, 1, at(1)),
+		newOrder("bob", true, 1, 1, at(2)),
+		newOrder("alice", true, 1, 1, at(3)),
+	}
+	ask := newOrder("alice", false, 1, 1, at(4))
+	for _, o := range append(bids, ask) {
+		if err := store.UpsertOrder(ctx, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := must[*exchange.Order](t)(store.GetOrder(ctx, ask.ID))
+	check(t, got.Bid, false)
+	check(t, got.Status, exchange.OrderNew)
+	_, err := store.GetOrder(ctx, "missing")
+	checkErr(t, err, ErrNotFound)
+
+	// An upsert only changes the state of an order.
+	filled := bids[1].Copy()
+	filled.Status, filled.Filled, filled.Price = exchange.OrderFilled, 1, 9
+	if err = store.UpsertOrder(ctx, filled); err != nil {
+		t.Fatal(err)
+	}
+	got = must[*exchange.Order](t)(store.GetOrder(ctx, filled.ID))
+	check(t, got.Status, exchange.OrderFilled)
+	check(t, got.Filled, 1)
+	check(t, got.Price, 1.0)
+
+	list := func(status, sort string, p PageParams) ([]string, *Cursor) {
+		t.Helper()
+		orders, next, err := store.GetOrders(ctx, true, status, sort, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return orderIDs(orders), next
+	}
+	ids, next := list(OpenOrderStatus, "asc", PageParams{Size: 1})
+	check(t, ids, []string{bids[0].ID})
+	ids, next = list(OpenOrderStatus, "asc", PageParams{Size: 1, Cursor: next})
+	check(t, ids, []string{bids[2].ID})
+	check(t, next, (*Cursor)(nil))
+	ids, _ = list(OpenOrderStatus, "desc", PageParams{Size: 10})
+	check(t, ids, []string{bids[2].ID, bids[0].ID})
+	ids, _ = list(string(exchange.OrderFilled), "asc", PageParams{Size: 10})
+	check(t, ids, []string{bids[1].ID})
+
+	check(t, orderIDs(must[[]*exchange.Order](t)(store.GetOpenOrders(ctx))), []string{bids[0].ID, bids[2].ID, ask.ID})
+
+	// Client order ids are unique per owner.
+	first := newOrder("alice", true, 1, 1, at(5))
+	first.ClientOrderID = "x"
+	if err = store.UpsertOrder(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	second := newOrder("alice", true, 1, 1, at(6))
+	second.ClientOrderID = "x"
+	checkErr(t, store.UpsertOrder(ctx, second), ErrDuplicate)
+	other := newOrder("bob", true, 1, 1, at(7))
+	other.ClientOrderID = "x"
+	if err = store.UpsertOrder(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	check(t, must[*exchange.Order](t)(store.GetOrderByClientID(ctx, "alice", "x")).ID, first.ID)
+	_, err = store.GetOrderByClientID(ctx, "carol", "x")
+	checkErr(t, err, ErrNotFound)
+	_, err = store.GetOrderByClientID(ctx, "alice", "")
+	checkErr(t, err, ErrNotFound)
+}
+
+func testSearch(t *testing.T, ctx context.Context, store Storage) {
+	apes := must[*Collection](t)(store.InsertCollection(ctx, CreateCollectionParams{Name: "Bored Apes", Symbol: "BA", Creator: "0xab1", Visible: 1, CreatedAt: at(1)}))
+	must[*Collection](t)(store.InsertCollection(ctx, CreateCollectionParams{Name: "Cats", Symbol: "CAT", Description: "bored cats", Creator: "0xab2", Visible: 1, CreatedAt: at(2)}))
+	must[*Collection](t)(store.InsertCollection(ctx, CreateCollectionParams{Name: "Bored Hidden", Symbol: "BH", Creator: "0xab1", Visible: 0, CreatedAt: at(3)}))
+	must[*Collection](t)(store.InsertCollection(ctx, CreateCollectionParams{Name: "Dogs", Symbol: "DOG", Creator: "0xab1", Visible: 1, CreatedAt: at(4)}))
+	must[*Item](t)(store.InsertItem(ctx, CreateItemParams{Name: "Ape 1", Collection: apes.ID, TokenID: 1, CreatedAt: at(5)}))
+
+	res := must[*SearchResult](t)(store.Search(ctx, SearchQuery{Terms: "bor", Limit: 10}))
+	check(t, collectionNames(res.Collections), []string{"Bored Apes", "Cats"})
+	check(t, tokenIDs(res.Items), []int{})
+
+	res = must[*SearchResult](t)(store.Search(ctx, SearchQuery{Terms: "ape", Limit: 10}))
+	check(t, collectionNames(res.Collections), []string{"Bored Apes"})
+	check(t, tokenIDs(res.Items), []int{1})
+
+	res = must[*SearchResult](t)(store.Search(ctx, SearchQuery{Terms: "0xAB", Limit: 1}))
+	check(t, res.Creators, []*Creator{{Address: "0xab1", Collections: 2}})
+
+	res = must[*SearchResult](t)(store.Search(ctx, SearchQuery{Terms: "  ", Limit: 10}))
+	check(t, res, &SearchResult{Collections: []*Collection{}, Items: []*Item{}, Creators: []*Creator{}})
+}
+
+func testAuth(t *testing.T, ctx context.Context, store Storage) {
+	for i, id := range []string{"k1", "k2"} {
+		must[*APIKey](t)(store.InsertAPIKey(ctx, CreateAPIKeyParams{ID: id, Owner: "alice", Scopes: []string{"read"}, ExpiresAt: at(100), CreatedAt: at(i)}))
+	}
+	_, err := store.InsertAPIKey(ctx, CreateAPIKeyParams{ID: "k1", Owner: "bob", ExpiresAt: at(100), CreatedAt: at(3)})
+	checkErr(t, err, ErrDuplicate)
+
+	key := must[*APIKey](t)(store.GetAPIKey(ctx, "k1"))
+	check(t, key.Owner, "alice")
+	check(t, key.Scopes, []string{"read"})
+	_, err = store.GetAPIKey(ctx, "missing")
+	checkErr(t, err, ErrNotFound)
+
+	keys := must[[]*APIKey](t)(store.GetAPIKeysByOwner(ctx, "alice"))
+	check(t, len(keys), 2)
+	check(t, keys[0].ID, "k2")
+
+	checkErr(t, store.RevokeAPIKey(ctx, "k1", "bob"), ErrNotFound)
+	if err = store.RevokeAPIKey(ctx, "k1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	check(t, must[*APIKey](t)(store.GetAPIKey(ctx, "k1")).Revoked, true)
+
+	if err = store.Insert(ctx, &Session{TokenHash: "h", Address: "alice", ExpiresAt: at(100), CreatedAt: at(0)}); err != nil {
+		t.Fatal(err)
+	}
+	check(t, must[*Session](t)(store.GetSession(ctx, "h")).Address, "alice")
+	_, err = store.GetSession(ctx, "missing")
+	checkErr(t, err, ErrNotFound)
+
+	_, err = store.GetIdempotencyKey(ctx, "alice", "k")
+	checkErr(t, err, ErrNotFound)
+	for _, body := range []string{"first", "second"} {
+		k := &IdempotencyKey{Owner: "alice", Key: "k", RequestHash: "h", Status: 200, Body: []byte(body), CreatedAt: at(0)}
+		if err = store.SaveIdempotencyKey(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(t, string(must[*IdempotencyKey](t)(store.GetIdempotencyKey(ctx, "alice", "k")).Body), "second")
+}
+
+func testTransactions(t *testing.T, ctx context.Context, store Storage) {
+	c := must[*Collection](t)(store.InsertCollection(ctx, CreateCollectionParams{Name: "c", Creator: "alice", Visible: 1, CreatedAt: at(0)}))
+	must[*Item](t)(store.InsertItem(ctx, CreateItemParams{Name: "i", Collection: c.ID, TokenID: 1, Creator: "alice", CreatedAt: at(1)}))
+	ask := newOrder("alice", false, c.ID, 1, at(2))
+	if err := store.UpsertOrder(ctx, ask); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed transaction leaves nothing behind.
+	errAbort := errors.New("abort")
+	err := store.RunInTx(ctx, func(tx Storage) error {
+		filled := ask.Copy()
+		filled.Status, filled.Filled = exchange.OrderFilled, 1
+		if err := tx.UpsertOrder(ctx, filled); err != nil {
+			return err
+		}
+		if err := tx.InsertTrade(ctx, &Trade{Market: "fra", Collection: c.ID, TokenID: 1, Price: 1, Size: 1, Buyer: "bob", Seller: "alice", CreatedAt: at(3)}); err != nil {
+			return err
+		}
+		check(t, must[*Item](t)(tx.GetItem(ctx, c.ID, 1)).Owner, "bob")
+		return errAbort
+	})
+	checkErr(t, err, errAbort)
+	check(t, must[*exchange.Order](t)(store.GetOrder(ctx, ask.ID)).Status, exchange.OrderNew)
+	check(t, must[*Item](t)(store.GetItem(ctx, c.ID, 1)).Owner, "alice")
+	check(t, len(must[[]*Trade](t)(store.GetTrades(ctx, at(0)))), 0)
+
+	err = store.RunInTx(ctx, func(tx Storage) error {
+		return tx.InsertTrade(ctx, &Trade{Market: "fra", Collection: c.ID, TokenID: 1, Price: 1, Size: 1, Buyer: "Bob", Seller: "alice", CreatedAt: at(3)})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, must[*Item](t)(store.GetItem(ctx, c.ID, 1)).Owner, "Bob")
+	// Balances only change when the settlement is indexed.
+	check(t, must[int](t)(store.GetBalance(ctx, c.ID, 1, "bob")), 0)
+	check(t, must[int](t)(store.GetBalance(ctx, c.ID, 1, "alice")), 0)
+
+	// A batch is inserted whole or not at all.
+	err = store.Insert(ctx, []interface{}{
+		&Item{Name: "j", Collection: c.ID, TokenID: 2, CreatedAt: at(4)},
+		&Item{Name: "k", Collection: c.ID, TokenID: 3, CreatedAt: at(4)},
+		&Item{Name: "dup", Collection: c.ID, TokenID: 1, CreatedAt: at(4)},
+	})
+	checkErr(t, err, ErrDuplicate)
+	_, err = store.GetItem(ctx, c.ID, 2)
+	checkErr(t, err, ErrNotFound)
+
+	d := &Collection{Name: "d", Creator: "bob", Visible: 1, CreatedAt: at(5)}
+	err = store.Insert(ctx, []interface{}{
+		&Item{Name: "j", Collection: c.ID, TokenID: 2, CreatedAt: at(4)},
+		&Item{Name: "k", Collection: c.ID, TokenID: 3, CreatedAt: at(4)},
+		d,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, must[*Item](t)(store.GetItem(ctx, c.ID, 3)).Name, "k")
+	check(t, must[*Collection](t)(store.GetCollectionByID(ctx, d.ID)).Name, "d")
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/uptrace/bun"
+	"time"
+)
+
+// Trade is a match of the engine. The buyer becomes the owner of the token.
+type Trade struct {
+	ID         int64     `json:"id" bun:",pk,autoincrement"`
+	Market     string    `json:"market"`
+	Collection int       `json:"collection"`
+	TokenID    int       `json:"token_id"`
+	Chain      int8      `json:"chain"`
+	Price      float64   `json:"price"`
+	Size       int       `json:"size"`
+	Currency   string    `json:"currency"`
+	Buyer      string    `json:"buyer"`
+	Seller     string    `json:"seller"`
+	BidOrder   string    `json:"bid_order"`
+	AskOrder   string    `json:"ask_order"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TradeTotal sums the trades of a collection in one currency.
+type TradeTotal struct {
+	Collection int     `json:"collection"`
+	Currency   string  `json:"currency"`
+	Sales      int     `json:"sales"`
+	Volume     float64 `json:"volume"`
+}
+
+// OwnerCount is the number of items of a collection held by one owner.
+type OwnerCount struct {
+	Collection int    `json:"collection"`
+	Owner      string `json:"owner"`
+	Items      int    `json:"items"`
+}
+
+// InsertTrade records a trade and transfers the token to the buyer. Balances
+// follow the chain only, and change when the settlement is indexed.
+func (db *NartDB) InsertTrade(ctx context.Context, trade *Trade) error {
+	return db.db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(trade).Exec(ctx); err != nil {
+			return err
+		}
+		_, err := tx.NewUpdate().
+			Model((*Item)(nil)).
+			Set("owner = ?", trade.Buyer).
+			Where("collection = ? AND token_id = ?", trade.Collection, trade.TokenID).
+			Exec(ctx)
+		return err
+	})
+}
+
+// GetTrades returns the trades made since a time, oldest first.
+func (db *NartDB) GetTrades(ctx context.Context, since time.Time) ([]*Trade, error) {
+	var trades []*Trade
+	err := db.db.NewSelect().Model(&trades).Where("created_at >= ?", since).Order("created_at ASC", "id ASC").Scan(ctx)
+	return trades, err
+}
+
+func (db *NartDB) GetTradeTotals(ctx context.Context) ([]*TradeTotal, error) {
+	var totals []*TradeTotal
+	err := db.db.NewSelect().
+		Model((*Trade)(nil)).
+		Column("collection", "currency").
+		ColumnExpr("count(*) AS sales").
+		ColumnExpr("SUM(price * size)::float8 AS volume").
+		Group("collection", "currency").
+		Scan(ctx, &totals)
+	return totals, err
+}
+
+func (db *NartDB) GetItemOwners(ctx context.Context) ([]*OwnerCount, error) {
+	var owners []*OwnerCount
+	err := db.db.NewSelect().
+		Model((*Item)(nil)).
+		Column("collection", "owner").
+		ColumnExpr("count(*) AS items").
+		Group("collection", "owner").
+		Scan(ctx, &owners)
+	return owners, err
+}
@@ -0,0 +1,237 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/uptrace/bun"
+	"time"
+)
+
+// ZeroAddress is the sender of minted tokens and the receiver of burned ones.
+// It holds no balance.
+const ZeroAddress = "0x0000000000000000000000000000000000000000"
+
+// Token standards of transfers.
+const (
+	ERC721  int16 = 721
+	ERC1155 int16 = 1155
+)
+
+// Transfer is a token transfer read from the chain. Addresses are lowercase.
+// An ERC-721 transfer also moves the item, when it exists, to its receiver;
+// PreviousOwner is the owner it had before.
+type Transfer struct {
+	Chain         int8   `json:"chain" bun:",pk"`
+	TxHash        string `json:"tx_hash" bun:",pk"`
+	LogIndex      int    `json:"log_index" bun:",pk"`
+	BatchIndex    int    `json:"batch_index" bun:",pk"`
+	Block         int64  `json:"block"`
+	Collection    int    `json:"collection"`
+	TokenID       int    `json:"token_id"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Amount        int    `json:"amount"`
+	Standard      int16  `json:"standard"`
+	PreviousOwner string `json:"previous_owner"`
+}
+
+// Balance is the number of a token held by an address, from the indexed
+// transfers. Addresses that hold none have no balance.
+type Balance struct {
+	Collection int    `json:"collection" bun:",pk"`
+	TokenID    int    `json:"token_id" bun:",pk"`
+	Owner      string `json:"owner" bun:",pk"`
+	Amount     int    `json:"amount"`
+}
+
+// Checkpoint is the last block indexed on a chain.
+type Checkpoint struct {
+	Chain     int8      `json:"chain" bun:",pk"`
+	Block     int64     `json:"block"`
+	Hash      string    `json:"hash"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// OwnerChange is an item moved from one owner to another by a transfer, or
+// moved back when the transfer is reverted.
+type OwnerChange struct {
+	Collection int    `json:"collection"`
+	TokenID    int    `json:"token_id"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+}
+
+// ApplyTransfers records transfers in order, updating balances and the
+// owners of the transferred ERC-721 items. Transfers already recorded are
+// skipped. It returns the items whose owner changed.
+func (db *NartDB) ApplyTransfers(ctx context.Context, transfers []*Transfer) ([]*OwnerChange, error) {
+	var changes []*OwnerChange
+	err := db.db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+		for _, t := range transfers {
+			t.PreviousOwner = ""
+			var item Item
+			var found bool
+			if t.Standard == ERC721 {
+				err := tx.NewSelect().Model(&item).Column("owner").
+					Where("collection = ? AND token_id = ?", t.Collection, t.TokenID).
+					For("UPDATE").Scan(ctx)
+				if err != nil && !errors.Is(err, sql.ErrNoRows) {
+					return err
+				}
+				if found = err == nil; found {
+					t.PreviousOwner = item.Owner
+				}
+			}
+
+			res, err := tx.NewInsert().Model(t).On("CONFLICT DO NOTHING").Exec(ctx)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				continue
+			}
+			if err = addBalance(ctx, tx, t.Collection, t.TokenID, t.From, -t.Amount); err != nil {
+				return err
+			}
+			if err = addBalance(ctx, tx, t.Collection, t.TokenID, t.To, t.Amount); err != nil {
+				return err
+			}
+
+			if found && item.Owner != t.To {
+				if err = setOwner(ctx, tx, t.Collection, t.TokenID, t.To); err != nil {
+					return err
+				}
+				changes = append(changes, &OwnerChange{Collection: t.Collection, TokenID: t.TokenID, From: item.Owner, To: t.To})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// RevertTransfers deletes the transfers of a chain from a block on, after a
+// reorg, undoing them newest first. It returns the reverted transfers and
+// the items whose owner changed back.
+func (db *NartDB) RevertTransfers(ctx context.Context, chain int8, fromBlock int64) ([]*Transfer, []*OwnerChange, error) {
+	var (
+		transfers []*Transfer
+		changes   []*OwnerChange
+	)
+	err := db.db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+		err := tx.NewSelect().Model(&transfers).
+			Where("chain = ? AND block >= ?", chain, fromBlock).
+			Order("block DESC", "log_index DESC", "batch_index DESC").
+			Scan(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range transfers {
+			if err = addBalance(ctx, tx, t.Collection, t.TokenID, t.To, -t.Amount); err != nil {
+				return err
+			}
+			if err = addBalance(ctx, tx, t.Collection, t.TokenID, t.From, t.Amount); err != nil {
+				return err
+			}
+			if t.PreviousOwner == "" || t.PreviousOwner == t.To {
+				continue
+			}
+			res, err := tx.NewUpdate().Model((*Item)(nil)).
+				Set("owner = ?", t.PreviousOwner).
+				Where("collection = ? AND token_id = ?", t.Collection, t.TokenID).
+				Exec(ctx)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				changes = append(changes, &OwnerChange{Collection: t.Collection, TokenID: t.TokenID, From: t.To, To: t.PreviousOwner})
+			}
+		}
+
+		_, err = tx.NewDelete().Model((*Transfer)(nil)).Where("chain = ? AND block >= ?", chain, fromBlock).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return transfers, changes, nil
+}
+
+// addBalance adds amount, which may be negative, to the balance of owner.
+// Balances that drop to zero are deleted. A balance may go negative when
+// indexing started after the owner received the token.
+func addBalance(ctx context.Context, tx bun.Tx, collection, tokenID int, owner string, amount int) error {
+	if owner == ZeroAddress || amount == 0 {
+		return nil
+	}
+	b := &Balance{Collection: collection, TokenID: tokenID, Owner: owner, Amount: amount}
+	_, err := tx.NewInsert().
+		Model(b).
+		On("CONFLICT (collection, token_id, owner) DO UPDATE").
+		Set("amount = balance.amount + EXCLUDED.amount").
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.NewDelete().Model((*Balance)(nil)).
+		Where("collection = ? AND token_id = ? AND owner = ? AND amount = 0", collection, tokenID, owner).
+		Exec(ctx)
+	return err
+}
+
+func setOwner(ctx context.Context, tx bun.Tx, collection, tokenID int, owner string) error {
+	_, err := tx.NewUpdate().Model((*Item)(nil)).
+		Set("owner = ?", owner).
+		Where("collection = ? AND token_id = ?", collection, tokenID).
+		Exec(ctx)
+	return err
+}
+
+// GetBalance returns the number of a token held by owner, 0 when it holds
+// none.
+func (db *NartDB) GetBalance(ctx context.Context, collection, tokenID int, owner string) (int, error) {
+	var b Balance
+	err := db.db.NewSelect().Model(&b).
+		Where("collection = ? AND token_id = ? AND owner = ?", collection, tokenID, owner).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return b.Amount, err
+}
+
+// HasTransfers reports whether an indexed transfer of a token was sent or
+// received by address. Without one, its balance is not known.
+func (db *NartDB) HasTransfers(ctx context.Context, collection, tokenID int, address string) (bool, error) {
+	return db.db.NewSelect().Model((*Transfer)(nil)).
+		Where(`collection = ? AND token_id = ? AND ("from" = ? OR "to" = ?)`, collection, tokenID, address, address).
+		Exists(ctx)
+}
+
+func (db *NartDB) GetCheckpoint(ctx context.Context, chain int8) (*Checkpoint, error) {
+	var cp Checkpoint
+	err := db.db.NewSelect().Model(&cp).Where("chain = ?", chain).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &cp, nil
+}
+
+func (db *NartDB) SaveCheckpoint(ctx context.Context, cp *Checkpoint) error {
+	_, err := db.db.NewInsert().
+		Model(cp).
+		On("CONFLICT (chain) DO UPDATE").
+		Set("block = EXCLUDED.block").
+		Set("hash = EXCLUDED.hash").
+		Set("updated_at = EXCLUDED.updated_at").
+		Exec(ctx)
+	return err
+}
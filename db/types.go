@@ -4,171 +4,286 @@ import (
 	"cdex/exchange"
 	"context"
 	"database/sql"
-	"fmt"
+	"errors"
 	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/dialect/pgdialect"
 	"github.com/uptrace/bun/driver/pgdriver"
+	"reflect"
 	"time"
 )
 
 type Storage interface {
+	// RunInTx runs fn in a transaction, committed when fn returns nil and
+	// rolled back otherwise. fn makes its changes through tx.
+	RunInTx(ctx context.Context, fn func(tx Storage) error) error
+
 	Insert(ctx context.Context, value interface{}) error
 	InsertCollection(ctx context.Context, arg CreateCollectionParams) (*Collection, error)
 	InsertItem(ctx context.Context, arg CreateItemParams) (*Item, error)
-	GetCollections(ctx context.Context, page, pageSize int) ([]*Collection, error)
-	GetItems(ctx context.Context, page, pageSize int) ([]*Item, error)
+	GetCollections(ctx context.Context, arg CollectionQuery) ([]*Collection, *Cursor, error)
+	GetItems(ctx context.Context, arg ItemQuery) ([]*Item, *Cursor, error)
+	GetItem(ctx context.Context, collection, tokenID int) (*Item, error)
+	UpdateItem(ctx context.Context, collection, tokenID int, arg UpdateItemParams) (*Item, error)
+	DeleteItem(ctx context.Context, collection, tokenID int) error
+	UpdateRarity(ctx context.Context, collection int) error
+	GetCollectionTraits(ctx context.Context, collection int) ([]*TraitCount, error)
 	GetCollectionByID(ctx context.Context, id int) (*Collection, error)
-	GetCollectionByCreator(ctx context.Context, address string, page, pageSize int) ([]*Collection, error)
-	GetCollectionItems(ctx context.Context, id, page, pageSize int) ([]*Item, error)
+	UpdateCollection(ctx context.Context, id int, arg UpdateCollectionParams) (*Collection, error)
+	DeleteCollection(ctx context.Context, id int) error
+	Search(ctx context.Context, arg SearchQuery) (*SearchResult, error)
+
+	GetOrder(ctx context.Context, id string) (*exchange.Order, error)
+	GetOrderByClientID(ctx context.Context, owner, clientOrderID string) (*exchange.Order, error)
+	GetOrders(ctx context.Context, bid bool, status, sort string, p PageParams) ([]*exchange.Order, *Cursor, error)
+	GetOpenOrders(ctx context.Context) ([]*exchange.Order, error)
+	UpsertOrder(ctx context.Context, order *exchange.Order) error
+
+	InsertTrade(ctx context.Context, trade *Trade) error
+	GetTrades(ctx context.Context, since time.Time) ([]*Trade, error)
+	GetTradeTotals(ctx context.Context) ([]*TradeTotal, error)
+	GetItemOwners(ctx context.Context) ([]*OwnerCount, error)
+
+	InsertAPIKey(ctx context.Context, arg CreateAPIKeyParams) (*APIKey, error)
+	GetAPIKey(ctx context.Context, id string) (*APIKey, error)
+	GetAPIKeysByOwner(ctx context.Context, owner string) ([]*APIKey, error)
+	RevokeAPIKey(ctx context.Context, id, owner string) error
+	GetSession(ctx context.Context, tokenHash string) (*Session, error)
 
-	GetOrders(ctx context.Context, bid, page, pageSize int, status, sort string) ([]*exchange.Order, error)
-	UpdateOrderStatus(ctx context.Context, id, status string) error
+	GetIdempotencyKey(ctx context.Context, owner, key string) (*IdempotencyKey, error)
+	SaveIdempotencyKey(ctx context.Context, k *IdempotencyKey) error
+
+	ApplyTransfers(ctx context.Context, transfers []*Transfer) ([]*OwnerChange, error)
+	RevertTransfers(ctx context.Context, chain int8, fromBlock int64) ([]*Transfer, []*OwnerChange, error)
+	GetBalance(ctx context.Context, collection, tokenID int, owner string) (int, error)
+	HasTransfers(ctx context.Context, collection, tokenID int, address string) (bool, error)
+	GetCheckpoint(ctx context.Context, chain int8) (*Checkpoint, error)
+	SaveCheckpoint(ctx context.Context, cp *Checkpoint) error
 }
 
 type NartDB struct {
-	db *bun.DB
+	// db runs the queries: the database, or the transaction of RunInTx.
+	db bun.IDB
+	// root is the database itself, for migrations.
+	root *bun.DB
+}
+
+// Options configures the connection pool of a NartDB. Zero values keep the
+// defaults of database/sql, but for Timeout, which defaults to 10s.
+type Options struct {
+	// Timeout bounds dialing and every read and write on a connection.
+	Timeout         time.Duration
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
 }
 
-func NewNartDB(dsn string) *NartDB {
+func NewNartDB(dsn string, opts Options) *NartDB {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
 	pgConn := pgdriver.NewConnector(pgdriver.WithDSN(dsn),
-		pgdriver.WithTimeout(10*time.Second),
-		pgdriver.WithDialTimeout(10*time.Second),
-		pgdriver.WithReadTimeout(10*time.Second),
-		pgdriver.WithWriteTimeout(10*time.Second))
+		pgdriver.WithTimeout(opts.Timeout),
+		pgdriver.WithDialTimeout(opts.Timeout),
+		pgdriver.WithReadTimeout(opts.Timeout),
+		pgdriver.WithWriteTimeout(opts.Timeout))
 
 	sqlDB := sql.OpenDB(pgConn)
+	sqlDB.SetMaxOpenConns(opts.MaxOpenConns)
+	if opts.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	sqlDB.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
 	db := bun.NewDB(sqlDB, pgdialect.New())
 
-	return &NartDB{db: db}
+	return &NartDB{db: db, root: db}
+}
+
+// Close closes the connection pool once the queries in flight are done.
+func (db *NartDB) Close() error {
+	return db.root.Close()
 }
 
+// RunInTx runs fn in a transaction. Within fn, tx runs every query in the
+// transaction and nested transactions become savepoints.
+func (db *NartDB) RunInTx(ctx context.Context, fn func(tx Storage) error) error {
+	return db.db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+		return fn(&NartDB{db: tx, root: db.root})
+	})
+}
+
+// Insert inserts a model, or the models of a []interface{} in a single
+// transaction, with one multi-row INSERT for every run of models of the same
+// type.
 func (db *NartDB) Insert(ctx context.Context, value interface{}) error {
-	switch values := value.(type) {
-	case []interface{}:
-		for v := range values {
-			if _, err := db.db.NewInsert().
-				Model(v).
-				Exec(ctx); err != nil {
-				return err
+	values, ok := value.([]interface{})
+	if !ok {
+		_, err := db.db.NewInsert().Model(value).Exec(ctx)
+		return uniqueViolation(err)
+	}
+
+	return db.db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+		for len(values) > 0 {
+			typ := reflect.TypeOf(values[0])
+			n := 1
+			for n < len(values) && reflect.TypeOf(values[n]) == typ {
+				n++
+			}
+
+			rows := reflect.New(reflect.SliceOf(typ))
+			for _, v := range values[:n] {
+				rows.Elem().Set(reflect.Append(rows.Elem(), reflect.ValueOf(v)))
+			}
+			if _, err := tx.NewInsert().Model(rows.Interface()).Exec(ctx); err != nil {
+				return uniqueViolation(err)
 			}
+			values = values[n:]
 		}
-	case interface{}:
-		_, err := db.db.NewInsert().
-			Model(value).
-			Exec(ctx)
-		return err
-	}
-	return nil
+		return nil
+	})
 }
 
 func (db *NartDB) InsertCollection(ctx context.Context, arg CreateCollectionParams) (*Collection, error) {
-	var (
-		err error
-		c   Collection
-	)
-
-	err = db.db.QueryRowContext(ctx, "INSERT INTO collections(name,address,creator,chain,visible,status,created_at,type,tax,symbol,currency,image,background,banner,properties,introduction,description,twitter,instagram,discord,web) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?) RETURNING *",
-		&arg.Name, &arg.Address, &arg.Creator, &arg.Chain, &arg.Visible, &arg.Status, &arg.CreatedAt, &arg.Type, &arg.Tax, &arg.Symbol, &arg.Currency, &arg.Image, &arg.Background, &arg.Banner, &arg.Properties, &arg.Introduction, &arg.Description, &arg.Twitter, &arg.Instagram, &arg.Discord, &arg.Web).
-		Scan(&c.ID, &c.Name, &c.Address, &c.Creator, &c.Chain, &c.Visible, &c.Status, &c.CreatedAt, &c.Type, &c.Tax, &c.Symbol, &c.Currency,
-			&c.Image, &c.Background, &c.Banner, &c.Properties, &c.Introduction, &c.Description, &c.Twitter, &c.Instagram, &c.Discord, &c.Web)
-	if err != nil {
-		return nil, err
+	c := Collection{
+		Name:         arg.Name,
+		Address:      arg.Address,
+		Creator:      arg.Creator,
+		Chain:        arg.Chain,
+		Visible:      arg.Visible,
+		Status:       arg.Status,
+		Type:         arg.Type,
+		Tax:          arg.Tax,
+		Symbol:       arg.Symbol,
+		Currency:     arg.Currency,
+		CreatedAt:    arg.CreatedAt,
+		Image:        arg.Image,
+		Background:   arg.Background,
+		Banner:       arg.Banner,
+		Description:  arg.Description,
+		Introduction: arg.Introduction,
+		Properties:   arg.Properties,
+		Twitter:      arg.Twitter,
+		Instagram:    arg.Instagram,
+		Discord:      arg.Discord,
+		Web:          arg.Web,
+	}
+	if _, err := db.db.NewInsert().Model(&c).Exec(ctx); err != nil {
+		return nil, uniqueViolation(err)
 	}
 
 	return &c, nil
 }
 
+// InsertItem inserts an item owned by its creator.
 func (db *NartDB) InsertItem(ctx context.Context, arg CreateItemParams) (*Item, error) {
-	var (
-		err  error
-		item Item
-	)
-
-	err = db.db.QueryRowContext(ctx, "INSERT INTO items(name,collection,token_id,creator,created_at,chain,image,description,properties) VALUES(?,?,?,?,?,?,?,?,?) RETURNING *",
-		&arg.Name, &arg.Collection, &arg.TokenID, &arg.Creator, &arg.CreatedAt, &arg.Chain, &arg.Image, &arg.Description, &arg.Properties).
-		Scan(&item.Name, &item.Collection, &item.TokenID, &item.Creator, &item.CreatedAt, &item.Chain, &item.Image, &item.Description, &item.Properties)
-	if err != nil {
-		return nil, err
+	item := NewItem(arg)
+	if _, err := db.db.NewInsert().Model(item).Exec(ctx); err != nil {
+		return nil, uniqueViolation(err)
 	}
 
-	return &item, nil
+	return item, nil
 }
 
 func (db *NartDB) GetCollectionByID(ctx context.Context, id int) (*Collection, error) {
 	var c Collection
 	err := db.db.NewSelect().Model(&c).Where("id = ?", id).Scan(ctx)
-	return &c, err
-}
-
-func (db *NartDB) GetCollections(ctx context.Context, page, pageSize int) ([]*Collection, error) {
-	var (
-		err         error
-		collections []*Collection
-	)
-	err = db.db.NewSelect().Model((*Collection)(nil)).Order("id DESC").Limit(pageSize).Offset(pageSize*(page-1)).Scan(ctx, &collections)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return collections, nil
+	return &c, nil
 }
 
-func (db *NartDB) GetItems(ctx context.Context, page, pageSize int) ([]*Item, error) {
-	var (
-		err   error
-		items []*Item
-	)
-	err = db.db.NewSelect().Model((*Item)(nil)).Order("created_at DESC").Limit(pageSize).Offset(pageSize*(page-1)).Scan(ctx, &items)
+func (db *NartDB) GetItem(ctx context.Context, collection, tokenID int) (*Item, error) {
+	var item Item
+	err := db.db.NewSelect().Model(&item).Where("collection = ? AND token_id = ?", collection, tokenID).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return items, nil
-}
-
-func (db *NartDB) GetCollectionItems(ctx context.Context, id, page, pageSize int) ([]*Item, error) {
-	var items []*Item
-	err := db.db.NewSelect().Model(&items).Where("collection = ?", id).Order("created_at DESC").Limit(pageSize).Offset(pageSize * (page - 1)).Scan(ctx)
-	return items, err
+	return &item, nil
 }
 
-func (db *NartDB) GetCollectionByCreator(ctx context.Context, address string, page, pageSize int) ([]*Collection, error) {
-	var (
-		err         error
-		collections []*Collection
-	)
-
-	err = db.db.NewSelect().Model((*Collection)(nil)).Where("creator = ?", address).Order("id DESC").Limit(pageSize).Offset(pageSize*(page-1)).Scan(ctx, &collections)
+func (db *NartDB) GetOrder(ctx context.Context, id string) (*exchange.Order, error) {
+	var order exchange.Order
+	err := db.db.NewSelect().Model(&order).Where("id = ?", id).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	return collections, nil
+
+	return &order, nil
 }
 
-func (db *NartDB) GetOrders(ctx context.Context, bid, page, pageSize int, status, sort string) ([]*exchange.Order, error) {
-	var (
-		err    error
-		orders []*exchange.Order
-	)
-	fmt.Println(bid, page, pageSize, status, sort)
-	if sort == "desc" {
-		err = db.db.NewSelect().Model((*exchange.Order)(nil)).Where("bid = ? AND status = ?", bid, status).Order("created_at DESC").Limit(pageSize).Offset(pageSize*(page-1)).Scan(ctx, &orders)
-	} else {
-		err = db.db.NewSelect().Model((*exchange.Order)(nil)).Where("bid = ? AND status = ?", bid, status).Order("created_at ASC").Limit(pageSize).Offset(pageSize*(page-1)).Scan(ctx, &orders)
+func (db *NartDB) GetOrderByClientID(ctx context.Context, owner, clientOrderID string) (*exchange.Order, error) {
+	var order exchange.Order
+	err := db.db.NewSelect().Model(&order).Where("owner = ? AND client_order_id = ?", owner, clientOrderID).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
 	}
-
 	if err != nil {
 		return nil, err
 	}
 
-	return orders, nil
+	return &order, nil
 }
 
-func (db *NartDB) UpdateOrderStatus(ctx context.Context, id, status string) error {
-	var err error
-	_, err = db.db.NewUpdate().Model((*exchange.Order)(nil)).Set("status = ?", status).Where("id = ?", id).Exec(ctx)
-	if err != nil {
-		return err
+// OpenOrderStatus selects the orders that can still be filled in GetOrders.
+const OpenOrderStatus = "open"
+
+func openStatuses() []exchange.OrderStatus {
+	return []exchange.OrderStatus{exchange.OrderNew, exchange.OrderPartiallyFilled}
+}
+
+func (db *NartDB) GetOrders(ctx context.Context, bid bool, status, sort string, p PageParams) ([]*exchange.Order, *Cursor, error) {
+	var orders []*exchange.Order
+
+	q := db.db.NewSelect().Model(&orders).Where("bid = ?", bid)
+	if status == OpenOrderStatus {
+		q = q.Where("status IN (?)", bun.In(openStatuses()))
+	} else {
+		q = q.Where("status = ?", status)
+	}
+	if err := page(q, p, sort == "desc", []string{"created_at", "id"}, orderKey).Scan(ctx); err != nil {
+		return nil, nil, err
 	}
-	return nil
+
+	orders, next := nextPage(orders, p, orderCursor)
+	return orders, next, nil
+}
+
+func orderCursor(o *exchange.Order) *Cursor {
+	return &Cursor{CreatedAt: o.CreatedAt, ID: o.ID}
+}
+
+func orderKey(c *Cursor) []interface{} {
+	return []interface{}{c.CreatedAt, c.ID}
+}
+
+// GetOpenOrders returns every open order, oldest first.
+func (db *NartDB) GetOpenOrders(ctx context.Context) ([]*exchange.Order, error) {
+	var orders []*exchange.Order
+	err := db.db.NewSelect().Model(&orders).Where("status IN (?)", bun.In(openStatuses())).Order("created_at ASC").Scan(ctx)
+	return orders, err
+}
+
+// UpsertOrder inserts the order, or updates its state when it already exists.
+func (db *NartDB) UpsertOrder(ctx context.Context, order *exchange.Order) error {
+	_, err := db.db.NewInsert().
+		Model(order).
+		On("CONFLICT (id) DO UPDATE").
+		Set("status = EXCLUDED.status").
+		Set("filled = EXCLUDED.filled").
+		Set("updated_at = EXCLUDED.updated_at").
+		Exec(ctx)
+	return uniqueViolation(err)
 }
@@ -0,0 +1,101 @@
+package exchange
+
+type EventType string
+
+const (
+	EventOrderAdded    EventType = "order_added"
+	EventOrderCanceled EventType = "order_canceled"
+	EventOrderExpired  EventType = "order_expired"
+	EventOrderRejected EventType = "order_rejected"
+	EventMatch         EventType = "match"
+)
+
+// Level is the aggregated volume resting at one price.
+type Level struct {
+	Price  float64 `json:"price"`
+	Volume int     `json:"volume"`
+}
+
+// Quote is the top of a book for the orders in one currency of one chain.
+// Prices in different currencies cannot be compared, so a book has one quote
+// per currency. A side without orders has a zero best price.
+type Quote struct {
+	Chain          int8    `json:"chain"`
+	Currency       string  `json:"currency"`
+	BestBid        float64 `json:"best_bid"`
+	BestAsk        float64 `json:"best_ask"`
+	TotalBidVolume int     `json:"total_bid_volume"`
+	TotalAskVolume int     `json:"total_ask_volume"`
+}
+
+// Book is the levels of one token in one currency of one chain, the orders
+// that can match each other, from best to worst price.
+type Book struct {
+	Collection int     `json:"collection"`
+	TokenID    int     `json:"token_id"`
+	Chain      int8    `json:"chain"`
+	Currency   string  `json:"currency"`
+	Bids       []Level `json:"bids"`
+	Asks       []Level `json:"asks"`
+}
+
+// BookUpdate is the new state of a price level touched by an event: for the
+// whole level, for the token the event was about, and for that token in the
+// currency and chain of the event.
+type BookUpdate struct {
+	Bid            bool    `json:"bid"`
+	Price          float64 `json:"price"`
+	Volume         int     `json:"volume"`
+	Collection     int     `json:"collection"`
+	TokenID        int     `json:"token_id"`
+	TokenVolume    int     `json:"token_volume"`
+	Chain          int8    `json:"chain"`
+	Currency       string  `json:"currency"`
+	CurrencyVolume int     `json:"currency_volume"`
+}
+
+// Event is emitted by the exchange after every change to a book, and when an
+// order is rejected. Order is the order the event is about, or the taker of a
+// match.
+type Event struct {
+	Type    EventType
+	Market  Market
+	Order   *Order
+	Match   *Match
+	Updates []BookUpdate
+}
+
+// Listener receives exchange events. Listeners are called synchronously while
+// the exchange is locked, so they must not block and must not call back into
+// the exchange.
+type Listener func(Event)
+
+// Subscribe registers l to receive every event emitted from now on.
+func (ex *Exchange) Subscribe(l Listener) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	ex.listeners = append(ex.listeners, l)
+}
+
+func (ex *Exchange) emit(ev Event) {
+	for _, l := range ex.listeners {
+		l(ev)
+	}
+}
+
+// Snapshot calls fn with the levels of the market book, filtered to the
+// orders accepted by filter when it is not nil. No event is emitted while fn
+// runs, so a snapshot lines up exactly with the events that follow it.
+func (ex *Exchange) Snapshot(market Market, filter func(*Order) bool, fn func(bids, asks []Level)) error {
+	ob, err := ex.OrderBook(market)
+	if err != nil {
+		return err
+	}
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	fn(ob.Levels(true, filter), ob.Levels(false, filter))
+	return nil
+}
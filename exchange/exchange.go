@@ -2,7 +2,9 @@ package exchange
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"time"
 )
 
 type OrderType string
@@ -18,10 +20,37 @@ const (
 	MarketFRA Market = "fra"
 )
 
+var (
+	// ErrDuplicateClientOrderID is returned when an owner reuses a client
+	// order id.
+	ErrDuplicateClientOrderID = errors.New("duplicate client order id")
+	// ErrCurrencyNotAccepted is returned for an order in a currency its
+	// market does not quote.
+	ErrCurrencyNotAccepted = errors.New("currency not accepted by market")
+	// ErrClosed is returned for orders and cancels sent after Close.
+	ErrClosed = errors.New("exchange is closed")
+)
+
+// Exchange matches orders in one book per market. Orders only match orders
+// for the same token in the same quote currency, so each token and currency
+// trades as a book of its own within the market book.
 type Exchange struct {
-	Orders     map[string][]*Order2 // user => []*Order
+	Orders     map[string][]*Order // user => []*Order
 	orderBooks map[Market]*OrderBook
+	currencies map[Market]map[string]bool
+	listeners  []Listener
+	closed     bool
 	mu         *sync.RWMutex
+
+	// clientIDs has a lock of its own, taken after mu, so that claims can be
+	// released by listeners that write events out of the exchange lock.
+	clientIDs map[clientOrderKey]string // owner, client order id => order id
+	clientMu  sync.Mutex
+}
+
+type clientOrderKey struct {
+	owner string
+	id    string
 }
 
 func NewExchange() *Exchange {
@@ -30,11 +59,68 @@ func NewExchange() *Exchange {
 
 	return &Exchange{
 		orderBooks: orderBooks,
-		Orders:     make(map[string][]*Order2),
+		Orders:     make(map[string][]*Order),
+		clientIDs:  make(map[clientOrderKey]string),
+		currencies: make(map[Market]map[string]bool),
 		mu:         &sync.RWMutex{},
 	}
 }
 
+// Markets returns the markets served by the exchange.
+func (ex *Exchange) Markets() []Market {
+	markets := make([]Market, 0, len(ex.orderBooks))
+	for market := range ex.orderBooks {
+		markets = append(markets, market)
+	}
+	sort.Slice(markets, func(i, j int) bool {
+		return markets[i] < markets[j]
+	})
+	return markets
+}
+
+// SetCurrencies declares the quote currencies a market accepts. Until it is
+// called a market accepts every currency.
+func (ex *Exchange) SetCurrencies(market Market, currencies ...string) error {
+	if _, err := ex.OrderBook(market); err != nil {
+		return err
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	accepted := make(map[string]bool, len(currencies))
+	for _, c := range currencies {
+		accepted[c] = true
+	}
+	ex.currencies[market] = accepted
+
+	return nil
+}
+
+// Currencies returns the quote currencies a market accepts, or nil when it
+// accepts every currency.
+func (ex *Exchange) Currencies(market Market) []string {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	accepted, ok := ex.currencies[market]
+	if !ok {
+		return nil
+	}
+	currencies := make([]string, 0, len(accepted))
+	for c := range accepted {
+		currencies = append(currencies, c)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+// accepts reports whether a market accepts a currency. ex.mu is held.
+func (ex *Exchange) accepts(market Market, currency string) bool {
+	accepted, ok := ex.currencies[market]
+	return !ok || accepted[currency]
+}
+
 func (ex *Exchange) OrderBook(market Market) (*OrderBook, error) {
 	ob, ok := ex.orderBooks[market]
 	if !ok {
@@ -44,7 +130,7 @@ func (ex *Exchange) OrderBook(market Market) (*OrderBook, error) {
 	return ob, nil
 }
 
-func (ex *Exchange) PlaceLimitOrder(market Market, price float64, order *Order2) ([]Match, error) {
+func (ex *Exchange) PlaceLimitOrder(market Market, price float64, order *Order) ([]Match, error) {
 	var (
 		err     error
 		matches []Match
@@ -54,46 +140,337 @@ func (ex *Exchange) PlaceLimitOrder(market Market, price float64, order *Order2)
 		return matches, err
 	}
 
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if ex.closed {
+		return matches, ErrClosed
+	}
+	if err := ex.claimClientOrderID(order); err != nil {
+		return matches, err
+	}
+	order.Market = market
+	order.Type = LimitOrder
+	order.Price = price
+	if !ex.accepts(market, order.Currency) {
+		ex.reject(order)
+		return matches, ErrCurrencyNotAccepted
+	}
+	if !order.ExpiresAt.IsZero() && !order.ExpiresAt.After(time.Now()) {
+		ex.reject(order)
+		return matches, errors.New("order already expired")
+	}
+
 	matches, err = ob.placeLimitOrder(price, order)
 	if err != nil {
+		ex.reject(order)
 		return matches, err
 	}
 
-	ex.mu.Lock()
-	if len(matches) == 0 {
+	ex.untrackFilled(matches)
+	ex.emitMatches(market, ob, order, matches)
+	if order.Limit != nil {
 		ex.Orders[order.Owner] = append(ex.Orders[order.Owner], order)
-	} else {
-		for _, m := range matches {
-			delete(ex.Orders, m.Ask.Owner)
-			delete(ex.Orders, m.Bid.Owner)
-		}
+		ex.emit(Event{
+			Type:    EventOrderAdded,
+			Market:  market,
+			Order:   order,
+			Updates: []BookUpdate{ob.bookUpdate(order.Bid, price, order)},
+		})
 	}
-	ex.mu.Unlock()
 
 	return matches, nil
 }
 
-func (ex *Exchange) PlaceMarketOrder(market Market, order *Order2) ([]Match, error) {
+func (ex *Exchange) PlaceMarketOrder(market Market, order *Order) ([]Match, error) {
 	var (
 		err     error
 		matches []Match
 	)
 
-	ob := ex.orderBooks[market]
+	ob, err := ex.OrderBook(market)
+	if err != nil {
+		return matches, err
+	}
 
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if ex.closed {
+		return matches, ErrClosed
+	}
+	if err := ex.claimClientOrderID(order); err != nil {
+		return matches, err
+	}
+	order.Market = market
+	order.Type = MarketOrder
+	if !ex.accepts(market, order.Currency) {
+		ex.reject(order)
+		return matches, ErrCurrencyNotAccepted
+	}
 	matches, err = ob.placeMarketOrder(order)
 	if err != nil {
+		ex.reject(order)
 		return matches, err
 	}
 
+	ex.untrackFilled(matches)
+	ex.emitMatches(market, ob, order, matches)
+
+	return matches, nil
+}
+
+// Restore rests an open order loaded from storage in its market book without
+// matching it or emitting events. It is used to rebuild the books at startup.
+func (ex *Exchange) Restore(order *Order) error {
+	ob, err := ex.OrderBook(order.Market)
+	if err != nil {
+		return err
+	}
+
 	ex.mu.Lock()
-	if len(matches) > 0 {
-		for _, m := range matches {
-			delete(ex.Orders, m.Ask.Owner)
-			delete(ex.Orders, m.Bid.Owner)
+	defer ex.mu.Unlock()
+
+	observeOrderID(order.ID)
+	if order.ClientOrderID != "" {
+		ex.clientMu.Lock()
+		ex.clientIDs[clientOrderKey{order.Owner, order.ClientOrderID}] = order.ID
+		ex.clientMu.Unlock()
+	}
+	ob.rest(order.Price, order)
+	ex.Orders[order.Owner] = append(ex.Orders[order.Owner], order)
+
+	return nil
+}
+
+// claimClientOrderID reserves the client order id of order for its owner
+// until ReleaseClientOrderID is called for the order. Storage guards against
+// reuse once claims are released and across restarts.
+func (ex *Exchange) claimClientOrderID(order *Order) error {
+	if order.ClientOrderID == "" {
+		return nil
+	}
+
+	ex.clientMu.Lock()
+	defer ex.clientMu.Unlock()
+
+	key := clientOrderKey{order.Owner, order.ClientOrderID}
+	if _, ok := ex.clientIDs[key]; ok {
+		return ErrDuplicateClientOrderID
+	}
+	ex.clientIDs[key] = order.ID
+
+	return nil
+}
+
+// ReleaseClientOrderID forgets the claim on the client order id of an order
+// in a final state. It must only be called once storage holds the order, so
+// that the id cannot be reused. Unlike the other methods it does not take the
+// exchange lock, and may be called by listeners.
+func (ex *Exchange) ReleaseClientOrderID(order *Order) {
+	if order.ClientOrderID == "" || order.Status.Open() {
+		return
+	}
+
+	ex.clientMu.Lock()
+	defer ex.clientMu.Unlock()
+
+	key := clientOrderKey{order.Owner, order.ClientOrderID}
+	if ex.clientIDs[key] == order.ID {
+		delete(ex.clientIDs, key)
+	}
+}
+
+// CancelOrder removes the resting order with the given id from the market
+// book.
+func (ex *Exchange) CancelOrder(market Market, id string) (*Order, error) {
+	ob, err := ex.OrderBook(market)
+	if err != nil {
+		return nil, err
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if ex.closed {
+		return nil, ErrClosed
+	}
+	o, ok := ob.Order(id)
+	if !ok {
+		return nil, errors.New("order not found")
+	}
+	ex.remove(ob, o, OrderCanceled)
+
+	return o, nil
+}
+
+// CancelAll cancels every resting order of owner in every market book.
+func (ex *Exchange) CancelAll(owner string) []*Order {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if ex.closed {
+		return nil
+	}
+	canceled := append([]*Order{}, ex.Orders[owner]...)
+	for _, o := range canceled {
+		ex.remove(ex.orderBooks[o.Market], o, OrderCanceled)
+	}
+
+	return canceled
+}
+
+// ExpireOrders removes every resting order whose expiry is not after now.
+func (ex *Exchange) ExpireOrders(now time.Time) []*Order {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if ex.closed {
+		return nil
+	}
+	var expired []*Order
+	for _, orders := range ex.Orders {
+		for _, o := range orders {
+			if !o.ExpiresAt.IsZero() && !o.ExpiresAt.After(now) {
+				expired = append(expired, o)
+			}
 		}
 	}
-	ex.mu.Unlock()
+	for _, o := range expired {
+		ex.remove(ex.orderBooks[o.Market], o, OrderExpired)
+	}
 
-	return matches, nil
+	return expired
+}
+
+// remove takes a resting order out of its book with a final status.
+func (ex *Exchange) remove(ob *OrderBook, o *Order, status OrderStatus) {
+	price := o.Limit.Price
+	ob.CancelOrder(o)
+	ex.untrack(o)
+	o.Status = status
+	o.UpdatedAt = time.Now()
+
+	typ := EventOrderCanceled
+	if status == OrderExpired {
+		typ = EventOrderExpired
+	}
+	ex.emit(Event{
+		Type:    typ,
+		Market:  o.Market,
+		Order:   o,
+		Updates: []BookUpdate{ob.bookUpdate(o.Bid, price, o)},
+	})
+}
+
+func (ex *Exchange) reject(o *Order) {
+	o.Status = OrderRejected
+	o.UpdatedAt = time.Now()
+	ex.emit(Event{Type: EventOrderRejected, Market: o.Market, Order: o})
+}
+
+// Close stops the exchange and returns copies of its resting orders, by id.
+// Orders placed or canceled once Close has returned fail with ErrClosed, and
+// no event is emitted anymore, so listeners can be shut down. Orders in
+// flight when it is called are matched first.
+func (ex *Exchange) Close() []*Order {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	ex.closed = true
+	var orders []*Order
+	for _, owned := range ex.Orders {
+		for _, o := range owned {
+			orders = append(orders, o.Copy())
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].ID < orders[j].ID
+	})
+
+	return orders
+}
+
+// Order returns a copy of the resting order with the given id, in any market
+// book.
+func (ex *Exchange) Order(id string) (*Order, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	for _, ob := range ex.orderBooks {
+		if o, ok := ob.Order(id); ok {
+			return o.Copy(), true
+		}
+	}
+	return nil, false
+}
+
+// OpenOrders calls fn with the resting orders of owner. No event is emitted
+// while fn runs.
+func (ex *Exchange) OpenOrders(owner string, fn func([]*Order)) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	fn(ex.Orders[owner])
+}
+
+// OpenAsks returns copies of the resting asks for a token, in every market.
+func (ex *Exchange) OpenAsks(collection, tokenID int) []*Order {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	var asks []*Order
+	for _, orders := range ex.Orders {
+		for _, o := range orders {
+			if !o.Bid && o.Collection == collection && o.TokenID == tokenID {
+				asks = append(asks, o.Copy())
+			}
+		}
+	}
+	sort.Slice(asks, func(i, j int) bool {
+		return asks[i].ID < asks[j].ID
+	})
+
+	return asks
+}
+
+func (ex *Exchange) untrack(o *Order) {
+	orders := ex.Orders[o.Owner]
+	for i := range orders {
+		if orders[i] == o {
+			orders = append(orders[:i], orders[i+1:]...)
+			break
+		}
+	}
+	if len(orders) == 0 {
+		delete(ex.Orders, o.Owner)
+	} else {
+		ex.Orders[o.Owner] = orders
+	}
+}
+
+// untrackFilled forgets the resting orders filled by matches.
+func (ex *Exchange) untrackFilled(matches []Match) {
+	for _, m := range matches {
+		if m.Ask.IsFilled() {
+			ex.untrack(m.Ask)
+		}
+		if m.Bid.IsFilled() {
+			ex.untrack(m.Bid)
+		}
+	}
+}
+
+// emitMatches emits one event per match, with the maker level it consumed.
+func (ex *Exchange) emitMatches(market Market, ob *OrderBook, taker *Order, matches []Match) {
+	for i := range matches {
+		m := &matches[i]
+		ex.emit(Event{
+			Type:    EventMatch,
+			Market:  market,
+			Order:   taker,
+			Match:   m,
+			Updates: []BookUpdate{ob.bookUpdate(!taker.Bid, m.Price, taker)},
+		})
+	}
 }
@@ -0,0 +1,43 @@
+package exchange
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// lastOrderID is the last order id handed out, in microseconds since the
+// epoch.
+var lastOrderID atomic.Int64
+
+// nextOrderID returns a unique order id that is greater than every id handed
+// out before. It is the current unix time in microseconds, bumped when orders
+// arrive faster than the clock ticks, zero padded so that ids sort as strings.
+func nextOrderID() string {
+	for {
+		last := lastOrderID.Load()
+		next := time.Now().UnixMicro()
+		if next <= last {
+			next = last + 1
+		}
+		if lastOrderID.CompareAndSwap(last, next) {
+			return fmt.Sprintf("%020d", next)
+		}
+	}
+}
+
+// observeOrderID makes sure ids handed out from now on are greater than id,
+// so a restarted engine never reuses the id of a persisted order.
+func observeOrderID(id string) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return
+	}
+	for {
+		last := lastOrderID.Load()
+		if n <= last || lastOrderID.CompareAndSwap(last, n) {
+			return
+		}
+	}
+}
@@ -1,66 +1,58 @@
 package exchange
 
 import (
-	"bytes"
-	"cdex/utils"
-	"encoding/gob"
+	"fmt"
 	"time"
 )
 
-type Order struct {
-	ID         string      `json:"id"`
-	Status     OrderStatus `json:"status"`
-	Currency   string      `json:"currency"`
-	Owner      string      `json:"owner"`
-	Collection int         `json:"collection"`
-	TokenID    int         `json:"token_id"`
-	Quantity   int         `json:"quantity"`
-	Bid        int8        `json:"bid"`
-	Price      float64     `json:"price"`
-	CreatedAt  time.Time   `json:"created_at"`
-}
+type OrderStatus string
 
-type OrderRaw struct {
-	Currency   string    `json:"currency"`
-	Owner      string    `json:"owner"`
-	Collection int       `json:"collection"`
-	TokenID    int       `json:"token_id"`
-	Quantity   int       `json:"quantity"`
-	Bid        int8      `json:"bid"`
-	Price      float64   `json:"price"`
-	CreatedAt  time.Time `json:"created_at"`
-}
+// An order starts as new, may be partially filled while it rests in a book,
+// and ends filled, canceled, expired or rejected.
+const (
+	OrderNew             OrderStatus = "new"
+	OrderPartiallyFilled OrderStatus = "partially_filled"
+	OrderFilled          OrderStatus = "filled"
+	OrderCanceled        OrderStatus = "canceled"
+	OrderExpired         OrderStatus = "expired"
+	OrderRejected        OrderStatus = "rejected"
+)
 
-func (or *OrderRaw) ID() string {
-	var (
-		err error
-		buf bytes.Buffer
-	)
+// Open reports whether an order with this status can still be filled.
+func (s OrderStatus) Open() bool {
+	return s == OrderNew || s == OrderPartiallyFilled
+}
 
-	enc := gob.NewEncoder(&buf)
-	err = enc.Encode(*or)
-	if err != nil {
-		return ""
-	}
+// Order is the single order model shared by the engine, storage and the API.
+// Quantity is the original size; Filled grows as the order matches.
+type Order struct {
+	ID            string      `json:"id" bun:",pk"`
+	ClientOrderID string      `json:"client_order_id,omitempty" bun:",nullzero"`
+	Market        Market      `json:"market"`
+	Type          OrderType   `json:"type"`
+	Status        OrderStatus `json:"status"`
+	Chain         int8        `json:"chain"`
+	Currency      string      `json:"currency"`
+	Owner         string      `json:"owner"`
+	Collection    int         `json:"collection"`
+	TokenID       int         `json:"token_id"`
+	Bid           bool        `json:"bid"`
+	Price         float64     `json:"price"`
+	Quantity      int         `json:"quantity"`
+	Filled        int         `json:"filled"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+	ExpiresAt     time.Time   `json:"expires_at" bun:",nullzero"`
 
-	return utils.MD5(buf.Bytes())
+	Limit *Limit `json:"-" bun:"-"`
 }
 
-func NewOrder(owner, currency string, bid int8, collection, tokenID, quantity int, price float64) *Order {
-	raw := OrderRaw{
-		Currency:   currency,
-		Owner:      owner,
-		Collection: collection,
-		TokenID:    tokenID,
-		Quantity:   quantity,
-		Bid:        bid,
-		Price:      price,
-		CreatedAt:  time.Now(),
-	}
+func NewOrder(owner, currency string, bid bool, collection, tokenID, quantity int, price float64) *Order {
+	now := time.Now()
 
 	return &Order{
-		ID:         raw.ID(),
-		Status:     PendingOrder,
+		ID:         nextOrderID(),
+		Status:     OrderNew,
 		Currency:   currency,
 		Owner:      owner,
 		Collection: collection,
@@ -68,6 +60,65 @@ func NewOrder(owner, currency string, bid int8, collection, tokenID, quantity in
 		Quantity:   quantity,
 		Bid:        bid,
 		Price:      price,
-		CreatedAt:  time.Now(),
+		CreatedAt:  now,
+		UpdatedAt:  now,
 	}
 }
+
+// sameBook reports whether o and r trade the same token in the same currency
+// of the same chain, and so can match each other.
+func (o *Order) sameBook(r *Order) bool {
+	return o.Collection == r.Collection && o.TokenID == r.TokenID && o.Chain == r.Chain && o.Currency == r.Currency
+}
+
+// Remaining is the quantity still to be filled.
+func (o *Order) Remaining() int {
+	return o.Quantity - o.Filled
+}
+
+func (o *Order) IsFilled() bool {
+	return o.Remaining() == 0
+}
+
+// Copy returns a copy of the order detached from the book.
+func (o *Order) Copy() *Order {
+	c := *o
+	c.Limit = nil
+	return &c
+}
+
+func (o *Order) fill(size int, now time.Time) {
+	o.Filled += size
+	o.UpdatedAt = now
+	if o.IsFilled() {
+		o.Status = OrderFilled
+	} else {
+		o.Status = OrderPartiallyFilled
+	}
+}
+
+func (o *Order) String() string {
+	return fmt.Sprintf("[quantity:%v filled:%v]", o.Quantity, o.Filled)
+}
+
+func (o *Order) Side() string {
+	if o.Bid {
+		return "BID"
+	}
+
+	return "ASK"
+}
+
+type Orders []*Order
+
+func (o Orders) Len() int {
+	return len(o)
+}
+
+func (o Orders) Swap(i, j int) {
+	o[i], o[j] = o[j], o[i]
+}
+
+func (o Orders) Less(i, j int) bool {
+	return o[i].CreatedAt.Before(o[j].CreatedAt)
+}
@@ -1,9 +1,6 @@
 package exchange
 
 import (
-	"bytes"
-	"cdex/utils"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
@@ -12,101 +9,18 @@ import (
 	"time"
 )
 
-type OrderStatus string
-
-const (
-	PendingOrder  OrderStatus = "pending"
-	FilledOrder   OrderStatus = "filled"
-	CanceledOrder OrderStatus = "canceled"
-)
-
+// Match is a fill between a bid and an ask in the same currency of the same
+// chain, which the trade is settled in.
 type Match struct {
 	Collection int     `json:"collection"`
 	TokenID    int     `json:"token_id"`
+	Chain      int8    `json:"chain"`
+	Currency   string  `json:"currency"`
 	SizeFilled int     `json:"size_filled"`
 	Price      float64 `json:"price"`
 	Timestamp  int64   `json:"timestamp"`
-	Ask        *Order2 `json:"ask"`
-	Bid        *Order2 `json:"bid"`
-}
-
-type Order2 struct {
-	ID    string
-	Limit *Limit
-
-	OrderRaw2
-}
-
-type Orders []*Order2
-
-func (o Orders) Len() int {
-	return len(o)
-}
-
-func (o Orders) Swap(i, j int) {
-	o[i], o[j] = o[j], o[i]
-}
-
-func (o Orders) Less(i, j int) bool {
-	return o[i].Timestamp < o[j].Timestamp
-}
-
-type OrderRaw2 struct {
-	Currency   string
-	Owner      string
-	Collection int
-	TokenID    int
-	Quantity   int
-	Bid        bool
-	Timestamp  int64
-}
-
-func (or *OrderRaw2) ID() string {
-	var (
-		err error
-		buf bytes.Buffer
-	)
-
-	enc := gob.NewEncoder(&buf)
-	err = enc.Encode(*or)
-	if err != nil {
-		return ""
-	}
-
-	return utils.MD5(buf.Bytes())
-}
-
-func NewOrder2(owner, currency string, bid bool, collection, tokenID, quantity int) *Order2 {
-	raw := OrderRaw2{
-		Currency:   currency,
-		Owner:      owner,
-		Collection: collection,
-		TokenID:    tokenID,
-		Quantity:   quantity,
-		Bid:        bid,
-		Timestamp:  time.Now().UnixNano(),
-	}
-
-	return &Order2{
-		ID:        raw.ID(),
-		OrderRaw2: raw,
-	}
-}
-
-func (o *Order2) String() string {
-	return fmt.Sprintf("[quantity:%v]", o.Quantity)
-}
-
-func (o *Order2) IsFilled() bool {
-	return o.Quantity == 0
-}
-
-func (o *Order2) Type() string {
-	if o.Bid {
-		return "BID"
-	}
-
-	return "ASK"
+	Ask        *Order  `json:"ask"`
+	Bid        *Order  `json:"bid"`
 }
 
 type Limit struct {
@@ -151,22 +65,34 @@ func (b ByBestBid) Less(i, j int) bool {
 func NewLimit(price float64) *Limit {
 	return &Limit{
 		Price:       price,
-		Orders:      []*Order2{},
+		Orders:      []*Order{},
 		TotalVolume: 0,
 	}
 }
 
+// clone returns a deep copy of the limit, safe to read after the book lock is
+// released.
+func (l *Limit) clone() *Limit {
+	c := &Limit{Price: l.Price, TotalVolume: l.TotalVolume, Orders: make(Orders, 0, len(l.Orders))}
+	for _, o := range l.Orders {
+		oc := *o
+		oc.Limit = c
+		c.Orders = append(c.Orders, &oc)
+	}
+	return c
+}
+
 func (l *Limit) String() string {
 	return fmt.Sprintf("[price: %v | Volume: %v | Orders: %v]", l.Price, l.TotalVolume, l.Orders)
 }
 
-func (l *Limit) AddOrder(o *Order2) {
+func (l *Limit) AddOrder(o *Order) {
 	o.Limit = l
 	l.Orders = append(l.Orders, o)
-	l.TotalVolume += o.Quantity
+	l.TotalVolume += o.Remaining()
 }
 
-func (l *Limit) DeleteOrder(o *Order2) {
+func (l *Limit) DeleteOrder(o *Order) {
 	for i := 0; i < len(l.Orders); i++ {
 		if l.Orders[i] == o {
 			l.Orders[i] = l.Orders[len(l.Orders)-1]
@@ -175,25 +101,38 @@ func (l *Limit) DeleteOrder(o *Order2) {
 	}
 
 	o.Limit = nil
-	l.TotalVolume -= o.Quantity
+	l.TotalVolume -= o.Remaining()
 
 	sort.Sort(l.Orders)
 }
 
-func (l *Limit) Fill(o *Order2) []Match {
+func (l *Limit) volume(filter func(*Order) bool) int {
+	volume := 0
+	for _, o := range l.Orders {
+		if filter(o) {
+			volume += o.Remaining()
+		}
+	}
+	return volume
+}
+
+func (l *Limit) Fill(o *Order) []Match {
 	var (
 		matches        []Match
-		ordersToDelete []*Order2
+		ordersToDelete []*Order
 	)
 
 	for _, order := range l.Orders {
 		if o.IsFilled() {
 			break
 		}
+		if !order.sameBook(o) {
+			continue
+		}
 
 		match, err := l.fillOrder(order, o)
 		if err != nil {
-			return []Match{}
+			continue
 		}
 
 		matches = append(matches, match)
@@ -210,13 +149,13 @@ func (l *Limit) Fill(o *Order2) []Match {
 	return matches
 }
 
-func (l *Limit) fillOrder(a, b *Order2) (Match, error) {
-	if a.Collection != b.Collection || a.TokenID != b.TokenID {
-		return Match{}, errors.New("collection or token not is not matched")
+func (l *Limit) fillOrder(a, b *Order) (Match, error) {
+	if !a.sameBook(b) {
+		return Match{}, errors.New("collection, token, chain or currency is not matched")
 	}
 	var (
-		bid        *Order2
-		ask        *Order2
+		bid        *Order
+		ask        *Order
 		sizeFilled int
 	)
 
@@ -228,22 +167,22 @@ func (l *Limit) fillOrder(a, b *Order2) (Match, error) {
 		ask = a
 	}
 
-	if a.Quantity > b.Quantity {
-		a.Quantity -= b.Quantity
-		sizeFilled = b.Quantity
-		b.Quantity = 0
-	} else {
-		b.Quantity -= a.Quantity
-		sizeFilled = a.Quantity
-		a.Quantity = 0
+	sizeFilled = a.Remaining()
+	if b.Remaining() < sizeFilled {
+		sizeFilled = b.Remaining()
 	}
+	now := time.Now()
+	a.fill(sizeFilled, now)
+	b.fill(sizeFilled, now)
 
 	return Match{
 		Collection: a.Collection,
 		TokenID:    a.TokenID,
+		Chain:      a.Chain,
+		Currency:   a.Currency,
 		SizeFilled: sizeFilled,
 		Price:      l.Price,
-		Timestamp:  time.Now().UnixNano(),
+		Timestamp:  now.UnixNano(),
 		Bid:        bid,
 		Ask:        ask,
 	}, nil
@@ -255,7 +194,7 @@ type OrderBook struct {
 	bids      []*Limit
 	AskLimits map[float64]*Limit
 	BidLimits map[float64]*Limit
-	Orders    map[string]*Order2
+	Orders    map[string]*Order
 }
 
 func NewOrderBook() *OrderBook {
@@ -264,101 +203,83 @@ func NewOrderBook() *OrderBook {
 		bids:      []*Limit{},
 		AskLimits: make(map[float64]*Limit),
 		BidLimits: make(map[float64]*Limit),
-		Orders:    make(map[string]*Order2),
+		Orders:    make(map[string]*Order),
 		mu:        &sync.RWMutex{},
 	}
 }
 
-func (ob *OrderBook) placeMarketOrder(o *Order2) ([]Match, error) {
+func (ob *OrderBook) placeMarketOrder(o *Order) ([]Match, error) {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
 	var (
-		matches []Match
+		matches  []Match
+		limits   []*Limit
+		sameItem = o.sameBook
 	)
 
 	if o.Bid {
-		if o.Quantity > ob.AskTotalVolume() {
-			return matches, fmt.Errorf("not enough volume [quantity: %v] for market order [quantity: %v]", ob.AskTotalVolume(), o.Quantity)
-		}
-
-		for _, limit := range ob.Asks() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
-
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(false, limit)
-			}
-		}
+		limits = ob.Asks()
 	} else {
-		if o.Quantity > ob.BidTotalVolume() {
-			return matches, fmt.Errorf("not enough volume [quantity: %v] for market order [quantity: %v]", ob.BidTotalVolume(), o.Quantity)
-		}
-		for _, limit := range ob.Bids() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
+		limits = ob.Bids()
+	}
 
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(true, limit)
-			}
+	volume := 0
+	for _, limit := range limits {
+		volume += limit.volume(sameItem)
+	}
+	if o.Remaining() > volume {
+		return matches, fmt.Errorf("not enough volume [quantity: %v] for market order [quantity: %v]", volume, o.Remaining())
+	}
+
+	// clearLimit reorders the book, so walk a copy of it.
+	for _, limit := range append([]*Limit{}, limits...) {
+		if o.IsFilled() {
+			break
 		}
+		matches = append(matches, ob.fillLimit(!o.Bid, limit, o)...)
 	}
 
 	return matches, nil
 }
 
-func (ob *OrderBook) placeLimitOrder(price float64, o *Order2) ([]Match, error) {
+func (ob *OrderBook) placeLimitOrder(price float64, o *Order) ([]Match, error) {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
 	var (
-		limit            *Limit
-		limitCounterpart *Limit
-		matches          []Match
+		limit   *Limit
+		limits  []*Limit
+		matches []Match
 	)
 
 	if o.Bid {
-		limit = ob.BidLimits[price]
-		limitCounterpart = ob.AskLimits[price]
+		limits = ob.Asks()
 	} else {
-		limit = ob.AskLimits[price]
-		limitCounterpart = ob.BidLimits[price]
-	}
-
-	if limitCounterpart == nil {
-		if limit == nil {
-			limit = NewLimit(price)
-			if o.Bid {
-				ob.bids = append(ob.bids, limit)
-				ob.BidLimits[price] = limit
-			} else {
-				ob.asks = append(ob.asks, limit)
-				ob.AskLimits[price] = limit
-			}
+		limits = ob.Bids()
+	}
+
+	// Match against every counterpart level that crosses the limit price,
+	// best first, before resting what is left.
+	for _, counterpart := range append([]*Limit{}, limits...) {
+		if o.IsFilled() {
+			break
 		}
+		if (o.Bid && counterpart.Price > price) || (!o.Bid && counterpart.Price < price) {
+			break
+		}
+		matches = append(matches, ob.fillLimit(!o.Bid, counterpart, o)...)
+	}
 
-		logrus.WithFields(logrus.Fields{
-			"price": limit.Price,
-			"type":  o.Type(),
-			"size":  o.Quantity,
-			"owner": o.Owner,
-		}).Info("new limit order")
+	if o.IsFilled() {
+		return matches, nil
+	}
 
-		ob.Orders[o.ID] = o
-		limit.AddOrder(o)
+	if o.Bid {
+		limit = ob.BidLimits[price]
 	} else {
-		limitMatches := limitCounterpart.Fill(o)
-		matches = append(matches, limitMatches...)
-
-		if len(limitCounterpart.Orders) == 0 {
-			if o.Bid {
-				ob.clearLimit(false, limitCounterpart)
-			} else {
-				ob.clearLimit(true, limitCounterpart)
-			}
-		}
+		limit = ob.AskLimits[price]
 	}
-
 	if limit == nil {
 		limit = NewLimit(price)
 		if o.Bid {
@@ -370,9 +291,44 @@ func (ob *OrderBook) placeLimitOrder(price float64, o *Order2) ([]Match, error)
 		}
 	}
 
+	logrus.WithFields(logrus.Fields{
+		"price": limit.Price,
+		"type":  o.Side(),
+		"size":  o.Remaining(),
+		"owner": o.Owner,
+	}).Info("new limit order")
+
+	ob.Orders[o.ID] = o
+	limit.AddOrder(o)
+
 	return matches, nil
 }
 
+// fillLimit fills o against the resting orders of limit and clears the limit
+// once it is empty.
+func (ob *OrderBook) fillLimit(bid bool, limit *Limit, o *Order) []Match {
+	matches := limit.Fill(o)
+	ob.forgetFilled(matches)
+
+	if len(limit.Orders) == 0 {
+		ob.clearLimit(bid, limit)
+	}
+
+	return matches
+}
+
+// forgetFilled drops the resting orders filled by matches from the order index.
+func (ob *OrderBook) forgetFilled(matches []Match) {
+	for _, m := range matches {
+		if m.Ask.IsFilled() {
+			delete(ob.Orders, m.Ask.ID)
+		}
+		if m.Bid.IsFilled() {
+			delete(ob.Orders, m.Bid.ID)
+		}
+	}
+}
+
 func (ob *OrderBook) clearLimit(bid bool, l *Limit) {
 	if bid {
 		delete(ob.BidLimits, l.Price)
@@ -393,9 +349,260 @@ func (ob *OrderBook) clearLimit(bid bool, l *Limit) {
 	}
 }
 
-func (ob *OrderBook) CancelOrder(o *Order2) {
+func (ob *OrderBook) CancelOrder(o *Order) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
 	limit := o.Limit
 	limit.DeleteOrder(o)
+	delete(ob.Orders, o.ID)
+
+	if len(limit.Orders) == 0 {
+		ob.clearLimit(o.Bid, limit)
+	}
+}
+
+// Depth returns copies of the bid and ask limits from best to worst.
+func (ob *OrderBook) Depth() (bids, asks []*Limit) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	for _, l := range ob.Bids() {
+		bids = append(bids, l.clone())
+	}
+	for _, l := range ob.Asks() {
+		asks = append(asks, l.clone())
+	}
+	return bids, asks
+}
+
+// rest adds o to the book at price without matching it.
+func (ob *OrderBook) rest(price float64, o *Order) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	limits, index := ob.asks, ob.AskLimits
+	if o.Bid {
+		limits, index = ob.bids, ob.BidLimits
+	}
+	limit := index[price]
+	if limit == nil {
+		limit = NewLimit(price)
+		index[price] = limit
+		if o.Bid {
+			ob.bids = append(limits, limit)
+		} else {
+			ob.asks = append(limits, limit)
+		}
+	}
+
+	ob.Orders[o.ID] = o
+	limit.AddOrder(o)
+}
+
+// Order returns the resting order with the given id.
+func (ob *OrderBook) Order(id string) (*Order, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	o, ok := ob.Orders[id]
+	return o, ok
+}
+
+// Levels returns the bid or ask levels from best to worst. When filter is not
+// nil only the volume of the orders it accepts is counted, and levels left
+// empty are skipped.
+func (ob *OrderBook) Levels(bid bool, filter func(*Order) bool) []Level {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	var limits []*Limit
+	if bid {
+		limits = ob.Bids()
+	} else {
+		limits = ob.Asks()
+	}
+
+	levels := []Level{}
+	for _, limit := range limits {
+		volume := limit.TotalVolume
+		if filter != nil {
+			volume = limit.volume(filter)
+		}
+		if volume > 0 {
+			levels = append(levels, Level{Price: limit.Price, Volume: volume})
+		}
+	}
+
+	return levels
+}
+
+// Quotes returns the quote of every currency with resting orders, by chain
+// and then currency.
+func (ob *OrderBook) Quotes() []Quote {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	type key struct {
+		chain    int8
+		currency string
+	}
+	index := make(map[key]*Quote)
+	quote := func(o *Order) *Quote {
+		k := key{o.Chain, o.Currency}
+		q := index[k]
+		if q == nil {
+			q = &Quote{Chain: o.Chain, Currency: o.Currency}
+			index[k] = q
+		}
+		return q
+	}
+
+	// Limits come best first, so the first order seen in a currency sets its
+	// best price.
+	for _, limit := range ob.Bids() {
+		for _, o := range limit.Orders {
+			q := quote(o)
+			if q.TotalBidVolume == 0 {
+				q.BestBid = limit.Price
+			}
+			q.TotalBidVolume += o.Remaining()
+		}
+	}
+	for _, limit := range ob.Asks() {
+		for _, o := range limit.Orders {
+			q := quote(o)
+			if q.TotalAskVolume == 0 {
+				q.BestAsk = limit.Price
+			}
+			q.TotalAskVolume += o.Remaining()
+		}
+	}
+
+	quotes := make([]Quote, 0, len(index))
+	for _, q := range index {
+		quotes = append(quotes, *q)
+	}
+	sort.Slice(quotes, func(i, j int) bool {
+		if quotes[i].Chain != quotes[j].Chain {
+			return quotes[i].Chain < quotes[j].Chain
+		}
+		return quotes[i].Currency < quotes[j].Currency
+	})
+	return quotes
+}
+
+// Books returns the levels of every token and currency with resting orders,
+// by collection, token, chain and then currency.
+func (ob *OrderBook) Books() []Book {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	type key struct {
+		collection int
+		tokenID    int
+		chain      int8
+		currency   string
+	}
+	index := make(map[key]*Book)
+	// add counts o in the level at price, which is the last level of its side
+	// when it is not new, as limits come best first.
+	add := func(bid bool, price float64, o *Order) {
+		k := key{o.Collection, o.TokenID, o.Chain, o.Currency}
+		b := index[k]
+		if b == nil {
+			b = &Book{Collection: o.Collection, TokenID: o.TokenID, Chain: o.Chain, Currency: o.Currency, Bids: []Level{}, Asks: []Level{}}
+			index[k] = b
+		}
+		levels := &b.Asks
+		if bid {
+			levels = &b.Bids
+		}
+		if n := len(*levels); n > 0 && (*levels)[n-1].Price == price {
+			(*levels)[n-1].Volume += o.Remaining()
+		} else {
+			*levels = append(*levels, Level{Price: price, Volume: o.Remaining()})
+		}
+	}
+	for _, limit := range ob.Bids() {
+		for _, o := range limit.Orders {
+			add(true, limit.Price, o)
+		}
+	}
+	for _, limit := range ob.Asks() {
+		for _, o := range limit.Orders {
+			add(false, limit.Price, o)
+		}
+	}
+
+	books := make([]Book, 0, len(index))
+	for _, b := range index {
+		books = append(books, *b)
+	}
+	sort.Slice(books, func(i, j int) bool {
+		a, b := books[i], books[j]
+		if a.Collection != b.Collection {
+			return a.Collection < b.Collection
+		}
+		if a.TokenID != b.TokenID {
+			return a.TokenID < b.TokenID
+		}
+		if a.Chain != b.Chain {
+			return a.Chain < b.Chain
+		}
+		return a.Currency < b.Currency
+	})
+	return books
+}
+
+// Best returns the best bid or ask price.
+func (ob *OrderBook) Best(bid bool) (float64, bool) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	var limits []*Limit
+	if bid {
+		limits = ob.Bids()
+	} else {
+		limits = ob.Asks()
+	}
+	for _, limit := range limits {
+		if limit.TotalVolume > 0 {
+			return limit.Price, true
+		}
+	}
+
+	return 0, false
+}
+
+func (ob *OrderBook) bookUpdate(bid bool, price float64, o *Order) BookUpdate {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	update := BookUpdate{
+		Bid:        bid,
+		Price:      price,
+		Collection: o.Collection,
+		TokenID:    o.TokenID,
+		Chain:      o.Chain,
+		Currency:   o.Currency,
+	}
+
+	var limit *Limit
+	if bid {
+		limit = ob.BidLimits[price]
+	} else {
+		limit = ob.AskLimits[price]
+	}
+	if limit != nil {
+		update.Volume = limit.TotalVolume
+		update.TokenVolume = limit.volume(func(r *Order) bool {
+			return r.Collection == o.Collection && r.TokenID == o.TokenID
+		})
+		update.CurrencyVolume = limit.volume(o.sameBook)
+	}
+
+	return update
 }
 
 func (ob *OrderBook) BidTotalVolume() int {
@@ -3,6 +3,7 @@ package exchange
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func assert(t *testing.T, a, b any) {
@@ -107,3 +108,233 @@ func assert(t *testing.T, a, b any) {
 //	ob.CancelOrder(buyOrder)
 //	assert(t, ob.BidTotalVolume(), 0)
 //}
+
+func TestPlaceLimitOrderCrossesBook(t *testing.T) {
+	ob := NewOrderBook()
+	ask1 := NewOrder("alice", "eth", false, 1, 2, 1, 9)
+	ask2 := NewOrder("bob", "eth", false, 1, 2, 1, 10)
+	other := NewOrder("carol", "eth", false, 1, 3, 1, 9)
+	ob.placeLimitOrder(9, ask1)
+	ob.placeLimitOrder(10, ask2)
+	ob.placeLimitOrder(9, other)
+
+	bid := NewOrder("dave", "eth", true, 1, 2, 3, 11)
+	matches, err := ob.placeLimitOrder(11, bid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, len(matches), 2)
+	assert(t, matches[0].Ask, ask1)
+	assert(t, matches[0].Price, 9.0)
+	assert(t, matches[1].Ask, ask2)
+	assert(t, matches[1].Price, 10.0)
+	assert(t, ob.AskTotalVolume(), 1)
+	assert(t, ob.BidTotalVolume(), 1)
+	assert(t, bid.Limit.Price, 11.0)
+	assert(t, bid.Filled, 2)
+	assert(t, bid.Status, OrderPartiallyFilled)
+	assert(t, ask1.Status, OrderFilled)
+	_, ok := ob.Order(ask1.ID)
+	assert(t, ok, false)
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	ex := NewExchange()
+	var events []EventType
+	ex.Subscribe(func(ev Event) {
+		events = append(events, ev.Type)
+	})
+
+	ask := NewOrder("alice", "eth", false, 1, 2, 1, 10)
+	ask.ExpiresAt = time.Now().Add(time.Minute)
+	if _, err := ex.PlaceLimitOrder(MarketFRA, 10, ask); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, ask.Status, OrderNew)
+
+	bid := NewOrder("bob", "eth", true, 1, 2, 2, 0)
+	_, err := ex.PlaceMarketOrder(MarketFRA, bid)
+	assert(t, err != nil, true)
+	assert(t, bid.Status, OrderRejected)
+
+	ex.ExpireOrders(time.Now().Add(2 * time.Minute))
+	assert(t, ask.Status, OrderExpired)
+	assert(t, events, []EventType{EventOrderAdded, EventOrderRejected, EventOrderExpired})
+}
+
+func TestClientOrderID(t *testing.T) {
+	ex := NewExchange()
+
+	a := NewOrder("alice", "eth", true, 1, 2, 1, 10)
+	b := NewOrder("alice", "eth", true, 1, 2, 1, 10)
+	if a.ID >= b.ID {
+		t.Fatalf("order ids not increasing: %s, %s", a.ID, b.ID)
+	}
+
+	a.ClientOrderID = "x"
+	if _, err := ex.PlaceLimitOrder(MarketFRA, 10, a); err != nil {
+		t.Fatal(err)
+	}
+	b.ClientOrderID = "x"
+	_, err := ex.PlaceLimitOrder(MarketFRA, 10, b)
+	assert(t, err, ErrDuplicateClientOrderID)
+	assert(t, b.Status, OrderNew)
+
+	c := NewOrder("bob", "eth", true, 1, 2, 1, 10)
+	c.ClientOrderID = "x"
+	if _, err := ex.PlaceLimitOrder(MarketFRA, 10, c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Claims of open orders are kept; those of orders in a final state are
+	// released.
+	ex.ReleaseClientOrderID(a)
+	_, err = ex.PlaceLimitOrder(MarketFRA, 10, b)
+	assert(t, err, ErrDuplicateClientOrderID)
+	if _, err = ex.CancelOrder(MarketFRA, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	ex.ReleaseClientOrderID(a)
+	if _, err = ex.PlaceLimitOrder(MarketFRA, 10, b); err != nil {
+		t.Fatal(err)
+	}
+	// A released order does not release the claim of a newer one.
+	ex.ReleaseClientOrderID(a)
+	assert(t, len(ex.clientIDs), 2)
+}
+
+func TestOpenAsks(t *testing.T) {
+	ex := NewExchange()
+	for _, o := range []*Order{
+		NewOrder("alice", "eth", false, 1, 2, 1, 10),
+		NewOrder("bob", "eth", false, 1, 2, 1, 12),
+		NewOrder("bob", "eth", false, 1, 3, 1, 12),
+		NewOrder("carol", "eth", true, 1, 2, 1, 5),
+	} {
+		if _, err := ex.PlaceLimitOrder(MarketFRA, o.Price, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	asks := ex.OpenAsks(1, 2)
+	assert(t, len(asks), 2)
+	assert(t, asks[0].Owner, "alice")
+	assert(t, asks[1].Owner, "bob")
+	assert(t, asks[0].Market, MarketFRA)
+	assert(t, len(ex.OpenAsks(2, 2)), 0)
+}
+
+func TestCurrencySegregation(t *testing.T) {
+	ex := NewExchange()
+	ask := NewOrder("alice", "eth", false, 1, 2, 1, 10)
+	if _, err := ex.PlaceLimitOrder(MarketFRA, 10, ask); err != nil {
+		t.Fatal(err)
+	}
+
+	usdc := NewOrder("bob", "usdc", true, 1, 2, 1, 11)
+	matches, err := ex.PlaceLimitOrder(MarketFRA, 11, usdc)
+	assert(t, err, nil)
+	assert(t, len(matches), 0)
+	_, err = ex.PlaceMarketOrder(MarketFRA, NewOrder("bob", "usdc", true, 1, 2, 1, 0))
+	assert(t, err != nil, true)
+
+	var updates []BookUpdate
+	ex.Subscribe(func(ev Event) {
+		updates = append(updates, ev.Updates...)
+	})
+	eth := NewOrder("carol", "eth", true, 1, 2, 1, 0)
+	matches, err = ex.PlaceMarketOrder(MarketFRA, eth)
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+	assert(t, matches[0].Ask, ask)
+	assert(t, matches[0].Currency, "eth")
+	assert(t, usdc.Status, OrderNew)
+	assert(t, updates[0].Currency, "eth")
+	assert(t, updates[0].CurrencyVolume, 0)
+
+	// The same symbol on another chain is another currency.
+	polygon := NewOrder("carol", "usdc", false, 1, 2, 1, 11)
+	polygon.Chain = 2
+	matches, err = ex.PlaceLimitOrder(MarketFRA, 11, polygon)
+	assert(t, err, nil)
+	assert(t, len(matches), 0)
+	assert(t, usdc.Status, OrderNew)
+	assert(t, updates[len(updates)-1].Chain, int8(2))
+	assert(t, updates[len(updates)-1].CurrencyVolume, 1)
+
+	assert(t, ex.SetCurrencies("btc", "eth") != nil, true)
+	if err = ex.SetCurrencies(MarketFRA, "usdc", "eth"); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, ex.Currencies(MarketFRA), []string{"eth", "usdc"})
+	fra := NewOrder("dave", "fra", false, 1, 2, 1, 10)
+	_, err = ex.PlaceLimitOrder(MarketFRA, 10, fra)
+	assert(t, err, ErrCurrencyNotAccepted)
+	assert(t, fra.Status, OrderRejected)
+}
+
+func TestQuotes(t *testing.T) {
+	ex := NewExchange()
+	place := func(o *Order, chain int8) {
+		o.Chain = chain
+		if _, err := ex.PlaceLimitOrder(MarketFRA, o.Price, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	place(NewOrder("alice", "usdc", false, 1, 1, 1, 12), 1)
+	place(NewOrder("alice", "usdc", false, 1, 2, 2, 11), 1)
+	place(NewOrder("bob", "usdc", true, 1, 1, 1, 10), 1)
+	place(NewOrder("bob", "usdc", true, 2, 1, 1, 3), 2)
+	place(NewOrder("bob", "eth", true, 1, 1, 1, 1), 1)
+
+	ob, _ := ex.OrderBook(MarketFRA)
+	assert(t, ob.Quotes(), []Quote{
+		{Chain: 1, Currency: "eth", BestBid: 1, TotalBidVolume: 1},
+		{Chain: 1, Currency: "usdc", BestBid: 10, BestAsk: 11, TotalBidVolume: 1, TotalAskVolume: 3},
+		{Chain: 2, Currency: "usdc", BestBid: 3, TotalBidVolume: 1},
+	})
+}
+
+func TestBooks(t *testing.T) {
+	ex := NewExchange()
+	place := func(o *Order) {
+		if _, err := ex.PlaceLimitOrder(MarketFRA, o.Price, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	place(NewOrder("alice", "usdc", false, 1, 1, 1, 12))
+	place(NewOrder("alice", "usdc", false, 1, 1, 2, 12))
+	place(NewOrder("alice", "usdc", false, 1, 1, 1, 11))
+	place(NewOrder("bob", "usdc", true, 1, 2, 1, 10))
+	place(NewOrder("bob", "eth", true, 1, 1, 3, 10))
+
+	ob, _ := ex.OrderBook(MarketFRA)
+	assert(t, ob.Books(), []Book{
+		{Collection: 1, TokenID: 1, Currency: "eth", Bids: []Level{{Price: 10, Volume: 3}}, Asks: []Level{}},
+		{Collection: 1, TokenID: 1, Currency: "usdc", Bids: []Level{}, Asks: []Level{{Price: 11, Volume: 1}, {Price: 12, Volume: 3}}},
+		{Collection: 1, TokenID: 2, Currency: "usdc", Bids: []Level{{Price: 10, Volume: 1}}, Asks: []Level{}},
+	})
+}
+
+func TestClose(t *testing.T) {
+	ex := NewExchange()
+	ask := NewOrder("alice", "eth", false, 1, 2, 1, 10)
+	if _, err := ex.PlaceLimitOrder(MarketFRA, 10, ask); err != nil {
+		t.Fatal(err)
+	}
+	var events int
+	ex.Subscribe(func(ev Event) {
+		events++
+	})
+
+	orders := ex.Close()
+	assert(t, len(orders), 1)
+	assert(t, orders[0].ID, ask.ID)
+	_, err := ex.PlaceLimitOrder(MarketFRA, 10, NewOrder("bob", "eth", true, 1, 2, 1, 10))
+	assert(t, err, ErrClosed)
+	_, err = ex.CancelOrder(MarketFRA, ask.ID)
+	assert(t, err, ErrClosed)
+	assert(t, len(ex.CancelAll("alice")), 0)
+	assert(t, events, 0)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"cdex/db"
+	"cdex/importer"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const importUsage = "usage: cdex import <collection id> <items.csv|items.ndjson|metadata dir|metadata.zip>"
+
+// runImport runs the import command, which adds the items of a file or a
+// directory to a collection and prints the report. Running it again after an
+// interruption imports the remaining items. A server that is running keeps
+// its collection statistics until it restarts.
+func runImport(ctx context.Context, store db.Storage, args []string) error {
+	if len(args) != 2 {
+		return errors.New(importUsage)
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errors.New(importUsage)
+	}
+	c, err := store.GetCollectionByID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("collection %d: %w", id, err)
+	}
+
+	rows, err := readImport(args[1])
+	if err != nil {
+		return err
+	}
+
+	report, err := importer.Import(ctx, store, c, rows, nil)
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	if err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d rows failed", report.Failed, report.Total)
+	}
+	return nil
+}
+
+// readImport reads the rows of a file or a directory, by its extension.
+func readImport(name string) ([]importer.Row, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return importer.ReadDir(os.DirFS(name))
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".zip":
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return importer.ReadZip(f, info.Size())
+	case ".csv":
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return importer.ReadCSV(f)
+	case ".ndjson", ".jsonl":
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return importer.ReadNDJSON(f)
+	}
+	return nil, errors.New(importUsage)
+}
@@ -0,0 +1,200 @@
+// Package importer adds the items of a collection in bulk, from a CSV file,
+// an NDJSON file or a directory of ERC-721 metadata files.
+package importer
+
+import (
+	"cdex/db"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+	"unicode/utf8"
+)
+
+// ChunkSize is how many items are inserted per transaction.
+const ChunkSize = 500
+
+// RowError is a row that was not imported.
+type RowError struct {
+	Line    int    `json:"line,omitempty"`
+	File    string `json:"file,omitempty"`
+	TokenID int    `json:"token_id,omitempty"`
+	Error   string `json:"error"`
+}
+
+// Report is the outcome of an import. Skipped counts the rows whose token id
+// the collection already had. Items are the imported items.
+type Report struct {
+	Total    int        `json:"total"`
+	Imported int        `json:"imported"`
+	Skipped  int        `json:"skipped"`
+	Failed   int        `json:"failed"`
+	Errors   []RowError `json:"errors"`
+	Items    []*db.Item `json:"-"`
+}
+
+func (r *Report) fail(row Row, err error) {
+	r.Failed++
+	r.Errors = append(r.Errors, RowError{Line: row.Line, File: row.File, TokenID: row.Item.TokenID, Error: err.Error()})
+}
+
+// CheckImage checks the image URL of a row; an error fails the row. It is
+// used to refuse images under the media URL that were never uploaded.
+type CheckImage func(ctx context.Context, url string) error
+
+// Import validates rows against a collection, inserts the valid ones in
+// transactions of ChunkSize items and rescores the collection. Rows whose
+// token id the collection already has are skipped, so an interrupted import
+// resumes where it stopped when it is run again. Invalid rows, and rows whose
+// image fails check when it is not nil, are listed in the report; the error
+// is only set when storage fails, and the report then counts the items
+// imported so far.
+func Import(ctx context.Context, store db.Storage, c *db.Collection, rows []Row, check CheckImage) (*Report, error) {
+	report := &Report{Total: len(rows), Errors: []RowError{}}
+
+	existing, err := tokenIDs(ctx, store, c.ID)
+	if err != nil {
+		return report, err
+	}
+
+	now := time.Now()
+	seen := make(map[int]bool)
+	var items []*db.Item
+	for _, row := range rows {
+		if row.Err != nil {
+			report.fail(row, row.Err)
+			continue
+		}
+		if err = validate(row.Item); err != nil {
+			report.fail(row, err)
+			continue
+		}
+		if seen[row.Item.TokenID] {
+			report.fail(row, fmt.Errorf("token_id %d appears twice", row.Item.TokenID))
+			continue
+		}
+		seen[row.Item.TokenID] = true
+		if existing[row.Item.TokenID] {
+			report.Skipped++
+			continue
+		}
+		if check != nil && row.Item.Image != "" {
+			if err = check(ctx, row.Item.Image); err != nil {
+				report.fail(row, err)
+				continue
+			}
+		}
+
+		properties := row.Item.Attributes
+		if properties == nil {
+			properties = row.Item.Properties
+		}
+		items = append(items, db.NewItem(db.CreateItemParams{
+			Name:        row.Item.Name,
+			Collection:  c.ID,
+			TokenID:     row.Item.TokenID,
+			Chain:       c.Chain,
+			CreatedAt:   now,
+			Creator:     c.Creator,
+			Image:       row.Item.Image,
+			Description: row.Item.Description,
+			Properties:  properties,
+			TokenURI:    row.Item.TokenURI,
+		}))
+	}
+
+	for start := 0; start < len(items); start += ChunkSize {
+		end := start + ChunkSize
+		if end > len(items) {
+			end = len(items)
+		}
+		if err = insert(ctx, store, items[start:end], report); err != nil {
+			return report, err
+		}
+	}
+
+	// The items are kept even when the collection cannot be rescored; the
+	// next item added to the collection rescores it.
+	if report.Imported > 0 {
+		if err = store.UpdateRarity(ctx, c.ID); err != nil {
+			logrus.WithError(err).WithField("collection", c.ID).Error("cannot update rarity")
+		}
+	}
+
+	return report, nil
+}
+
+// insert inserts a chunk of items in one transaction. When a token was added
+// since the import started, the chunk is inserted again one item at a time
+// to skip it.
+func insert(ctx context.Context, store db.Storage, items []*db.Item, report *Report) error {
+	values := make([]interface{}, len(items))
+	for i, item := range items {
+		values[i] = item
+	}
+	err := store.Insert(ctx, values)
+	if err == nil {
+		report.Imported += len(items)
+		report.Items = append(report.Items, items...)
+		return nil
+	}
+	if !errors.Is(err, db.ErrDuplicate) {
+		return err
+	}
+
+	for _, item := range items {
+		err = store.Insert(ctx, item)
+		if errors.Is(err, db.ErrDuplicate) {
+			report.Skipped++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		report.Imported++
+		report.Items = append(report.Items, item)
+	}
+	return nil
+}
+
+// tokenIDs returns the token ids of the items of a collection.
+func tokenIDs(ctx context.Context, store db.Storage, collection int) (map[int]bool, error) {
+	ids := make(map[int]bool)
+	q := db.ItemQuery{Collection: collection, IncludeHidden: true, Page: db.PageParams{Size: 1000}}
+	for {
+		items, next, err := store.GetItems(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			ids[item.TokenID] = true
+		}
+		if next == nil {
+			return ids, nil
+		}
+		q.Page.Cursor = next
+	}
+}
+
+func validate(m Metadata) error {
+	switch {
+	case m.TokenID <= 0:
+		return errors.New("token_id must be positive")
+	case m.Name == "" || utf8.RuneCountInString(m.Name) > db.MaxItemNameLength:
+		return fmt.Errorf("name must have 1 to %d characters", db.MaxItemNameLength)
+	case utf8.RuneCountInString(m.Image) > db.MaxItemImageLength:
+		return fmt.Errorf("image must have at most %d characters", db.MaxItemImageLength)
+	case utf8.RuneCountInString(m.Description) > db.MaxItemDescriptionLength:
+		return fmt.Errorf("description must have at most %d characters", db.MaxItemDescriptionLength)
+	case utf8.RuneCountInString(m.TokenURI) > db.MaxTokenURILength:
+		return fmt.Errorf("token_uri must have at most %d characters", db.MaxTokenURILength)
+	case m.Attributes != nil && m.Properties != nil:
+		return errors.New("attributes and properties are both set")
+	}
+
+	if m.Attributes != nil {
+		return m.Attributes.Validate()
+	}
+	return m.Properties.Validate()
+}
@@ -0,0 +1,183 @@
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"cdex/db"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	rows, err := ReadCSV(strings.NewReader("token_id,name,image,Background,attributes\n" +
+		"1,Ape,a.png,red,\"[{\"\"trait_type\"\":\"\"Eyes\"\",\"\"value\"\":\"\"blue\"\"}]\"\n" +
+		"2,Ape,a.png,,\n" +
+		"x,Ape,a.png,,\n" +
+		"4,Ape\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, len(rows), 4)
+	assert(t, rows[0].Item, Metadata{TokenID: 1, Name: "Ape", Image: "a.png", Attributes: db.Attributes{
+		{TraitType: "Background", Value: "red"},
+		{TraitType: "Eyes", Value: "blue"},
+	}})
+	assert(t, rows[1].Item.Attributes, db.Attributes(nil))
+	assert(t, rows[2].Err != nil, true)
+	assert(t, rows[3].Line, 5)
+	assert(t, rows[3].Err != nil, true)
+
+	_, err = ReadCSV(strings.NewReader("name\nApe\n"))
+	assert(t, err != nil, true)
+}
+
+func TestReadNDJSON(t *testing.T) {
+	rows, err := ReadNDJSON(strings.NewReader(`{"token_id":1,"name":"Ape","properties":[{"trait_type":"Level","value":3}]}
+
+{"token_id":
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, len(rows), 2)
+	assert(t, rows[0].Item.Properties, db.Attributes{{TraitType: "Level", Value: 3.0}})
+	assert(t, rows[1].Line, 3)
+	assert(t, rows[1].Err != nil, true)
+}
+
+func TestReadDir(t *testing.T) {
+	rows, err := ReadDir(fstest.MapFS{
+		"metadata/10.json":     {Data: []byte(`{"name":"Ten","attributes":[{"trait_type":"Hat","value":"cap"}]}`)},
+		"metadata/2":           {Data: []byte(`{"name":"Two"}`)},
+		"metadata/readme.txt":  {Data: []byte(`hello`)},
+		"metadata/.DS_Store":   {Data: []byte{0}},
+		"__MACOSX/metadata/2":  {Data: []byte{0}},
+		"metadata/3.json":      {Data: []byte(`{`)},
+		"metadata/.hidden/4":   {Data: []byte(`{}`)},
+		"metadata/nested/5.js": {Data: []byte(`{"name":"Five"}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int
+	for _, row := range rows {
+		ids = append(ids, row.Item.TokenID)
+	}
+	assert(t, ids, []int{0, 2, 3, 5, 10})
+	assert(t, rows[0].File, "metadata/readme.txt")
+	assert(t, rows[0].Err != nil, true)
+	assert(t, rows[1].Item.Name, "Two")
+	assert(t, rows[2].Err != nil, true)
+	assert(t, rows[4].Item.Attributes, db.Attributes{{TraitType: "Hat", Value: "cap"}})
+}
+
+func TestReadZip(t *testing.T) {
+	archive := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		for name, data := range files {
+			f, err := w.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte(data))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	read := func(data []byte, limits dirLimits) ([]Row, error) {
+		return readZip(bytes.NewReader(data), int64(len(data)), limits)
+	}
+	limits := dirLimits{file: 64, entries: 4, total: 128}
+
+	// A file that expands past the file limit is reported in its row.
+	rows, err := read(archive(map[string]string{
+		"1.json": `{"name":"One"}`,
+		"2.json": `{"name":"` + strings.Repeat("a", 1000) + `"}`,
+	}), limits)
+	assert(t, err, nil)
+	assert(t, len(rows), 2)
+	assert(t, rows[0].Item.Name, "One")
+	assert(t, rows[1].Item.TokenID, 2)
+	assert(t, rows[1].Err != nil, true)
+
+	_, err = read(archive(map[string]string{"1": "{}", "2": "{}", "3": "{}", "4": "{}", "5": "{}"}), limits)
+	assert(t, errors.Is(err, ErrTooLarge), true)
+	big := `{"name":"` + strings.Repeat("a", 50) + `"}`
+	_, err = read(archive(map[string]string{"1": big, "2": big, "3": big}), limits)
+	assert(t, errors.Is(err, ErrTooLarge), true)
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryDB()
+	c, err := store.InsertCollection(ctx, db.CreateCollectionParams{Name: "c", Creator: "alice", Chain: 2, Visible: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.InsertItem(ctx, db.CreateItemParams{Name: "One", Collection: c.ID, TokenID: 1, Creator: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []Row
+	for id := 1; id <= ChunkSize+10; id++ {
+		rows = append(rows, Row{Line: id, Item: Metadata{TokenID: id, Name: "Ape", Attributes: db.Attributes{{TraitType: "Hat", Value: "cap"}}}})
+	}
+	rows = append(rows,
+		Row{Line: 1000, Item: Metadata{TokenID: 2, Name: "Again"}},
+		Row{Line: 1001, Item: Metadata{TokenID: 1001}},
+		Row{Line: 1002, Item: Metadata{TokenID: 1002, Name: "Bad", Properties: db.Attributes{{TraitType: "Hat"}}}},
+		Row{Line: 1003, Item: Metadata{TokenID: 1003, Name: "Lost", Image: "/static/missing.png"}},
+	)
+	check := func(ctx context.Context, url string) error {
+		if url == "/static/missing.png" {
+			return errors.New("not uploaded")
+		}
+		return nil
+	}
+
+	report, err := Import(ctx, store, c, rows, check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, report.Total, ChunkSize+14)
+	assert(t, report.Imported, ChunkSize+9)
+	assert(t, report.Skipped, 1)
+	assert(t, report.Failed, 4)
+	assert(t, report.Errors[0], RowError{Line: 1000, TokenID: 2, Error: "token_id 2 appears twice"})
+	assert(t, report.Errors[1].Line, 1001)
+	assert(t, report.Errors[3], RowError{Line: 1003, TokenID: 1003, Error: "not uploaded"})
+
+	item, err := store.GetItem(ctx, c.ID, ChunkSize+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, item.Chain, int8(2))
+	assert(t, item.Owner, "alice")
+	// Token 1 lacks the hat, which makes it the rarest.
+	assert(t, item.RarityRank, 2)
+
+	// Running the import again resumes it: nothing is imported twice.
+	report, err = Import(ctx, store, c, rows[:ChunkSize+10], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, report.Imported, 0)
+	assert(t, report.Skipped, ChunkSize+10)
+}
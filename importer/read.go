@@ -0,0 +1,251 @@
+package importer
+
+import (
+	"archive/zip"
+	"bufio"
+	"cdex/db"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxLine bounds an NDJSON line, which holds a whole item with its traits.
+const maxLine = 1 << 20
+
+// ErrTooLarge is returned for a metadata directory with more files or more
+// data than an import takes. A small zip archive can expand to much more.
+var ErrTooLarge = errors.New("too many or too large metadata files")
+
+// dirLimits bounds what is read from a metadata directory: the size of one
+// file, the number of entries and the bytes read in all.
+type dirLimits struct {
+	file    int64
+	entries int
+	total   int64
+}
+
+var defaultLimits = dirLimits{file: 1 << 20, entries: 100000, total: 256 << 20}
+
+// Metadata is an item as read from an import file, in the ERC-721 metadata
+// JSON format. Properties is accepted in place of attributes.
+type Metadata struct {
+	TokenID     int           `json:"token_id"`
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Image       string        `json:"image"`
+	TokenURI    string        `json:"token_uri"`
+	Attributes  db.Attributes `json:"attributes"`
+	Properties  db.Attributes `json:"properties"`
+}
+
+// Row is an item read from an import file, or the error that kept it from
+// being read. Line is its line in a CSV or NDJSON file, File its file in a
+// metadata directory.
+type Row struct {
+	Line int
+	File string
+	Item Metadata
+	Err  error
+}
+
+// ReadCSV reads items from a CSV file with a header row. The token_id, name,
+// description, image, token_uri and attributes columns are the fields of the
+// item, with attributes as a JSON list of attributes. Every other column is a
+// string trait named after its header, left out where the cell is empty.
+func ReadCSV(r io.Reader) ([]Row, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	hasTokenID := false
+	for i, column := range header {
+		header[i] = strings.TrimSpace(column)
+		hasTokenID = hasTokenID || header[i] == "token_id"
+	}
+	if !hasTokenID {
+		return nil, errors.New("the header has no token_id column")
+	}
+
+	var rows []Row
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		line, _ := cr.FieldPos(0)
+		row := Row{Line: line}
+		if errors.Is(err, csv.ErrFieldCount) {
+			row.Err = fmt.Errorf("expected %d fields, got %d", len(header), len(record))
+			rows = append(rows, row)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for i, value := range record {
+			switch header[i] {
+			case "token_id":
+				row.Item.TokenID, err = strconv.Atoi(strings.TrimSpace(value))
+				if err != nil {
+					row.Err = fmt.Errorf("invalid token_id %q", value)
+				}
+			case "name":
+				row.Item.Name = value
+			case "description":
+				row.Item.Description = value
+			case "image":
+				row.Item.Image = value
+			case "token_uri":
+				row.Item.TokenURI = value
+			case "attributes", "properties":
+				if value == "" {
+					continue
+				}
+				var attrs db.Attributes
+				if err = json.Unmarshal([]byte(value), &attrs); err != nil {
+					row.Err = err
+				}
+				row.Item.Attributes = append(row.Item.Attributes, attrs...)
+			default:
+				if value != "" {
+					row.Item.Attributes = append(row.Item.Attributes, db.Attribute{TraitType: header[i], Value: value})
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// ReadNDJSON reads items from a file with one Metadata object per line.
+// Blank lines are skipped.
+func ReadNDJSON(r io.Reader) ([]Row, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+
+	var rows []Row
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		row := Row{Line: line}
+		row.Err = json.Unmarshal([]byte(text), &row.Item)
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// ReadZip reads the metadata files of a zip archive like ReadDir.
+func ReadZip(r io.ReaderAt, size int64) ([]Row, error) {
+	return readZip(r, size, defaultLimits)
+}
+
+func readZip(r io.ReaderAt, size int64, limits dirLimits) ([]Row, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if len(archive.File) > limits.entries {
+		return nil, fmt.Errorf("%w: more than %d entries", ErrTooLarge, limits.entries)
+	}
+	return readDir(archive, limits)
+}
+
+// ReadDir reads the ERC-721 metadata files of a directory and its
+// subdirectories. Each file is named after its token id, with or without a
+// .json extension. Hidden files and directories are skipped. Rows are
+// ordered by token id. A file over 1 MiB is reported in its row; more than
+// 100000 entries or 256 MiB of files in all fail with ErrTooLarge.
+func ReadDir(fsys fs.FS) ([]Row, error) {
+	return readDir(fsys, defaultLimits)
+}
+
+func readDir(fsys fs.FS, limits dirLimits) ([]Row, error) {
+	var (
+		rows    []Row
+		entries int
+		total   int64
+	)
+	tooLarge := fmt.Errorf("the file is larger than %d bytes", limits.file)
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if entries++; entries > limits.entries {
+			return fmt.Errorf("%w: more than %d entries", ErrTooLarge, limits.entries)
+		}
+		base := d.Name()
+		if strings.HasPrefix(base, ".") || strings.HasPrefix(base, "__") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		row := Row{File: name}
+		tokenID, err := strconv.Atoi(strings.TrimSuffix(base, path.Ext(base)))
+		if err != nil {
+			row.Err = errors.New("the file name is not a token id")
+			rows = append(rows, row)
+			return nil
+		}
+		row.Item.TokenID = tokenID
+
+		// The size in a zip header may lie, so the read is bounded too.
+		if info, err := d.Info(); err == nil && info.Size() > limits.file {
+			row.Err = tooLarge
+			rows = append(rows, row)
+			return nil
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(f, limits.file+1))
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if total += int64(len(data)); total > limits.total {
+			return fmt.Errorf("%w: more than %d bytes", ErrTooLarge, limits.total)
+		}
+		if int64(len(data)) > limits.file {
+			row.Err = tooLarge
+			rows = append(rows, row)
+			return nil
+		}
+
+		row.Err = json.Unmarshal(data, &row.Item)
+		row.Item.TokenID = tokenID
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Item.TokenID < rows[j].Item.TokenID })
+	return rows, nil
+}
@@ -0,0 +1,177 @@
+package indexer
+
+import (
+	"cdex/db"
+	"encoding/hex"
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Topics of the transfer events, the Keccak-256 hashes of their signatures.
+const (
+	// Transfer(address,address,uint256) of ERC-721. ERC-20 has the same
+	// topic with the value in the data instead of a fourth topic.
+	TopicTransfer = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+	// TransferSingle(address,address,address,uint256,uint256) of ERC-1155.
+	TopicTransferSingle = "0xc3d58168c5ae7397731d063d5bbf3d657854427343f4c083240f7aacaa2d0f62"
+	// TransferBatch(address,address,address,uint256[],uint256[]) of ERC-1155.
+	TopicTransferBatch = "0x4a39dc06d4c0dbc64b70af90fd698a233a518aa5d07e595d983b8c0526c8f7fb"
+)
+
+var errMalformedLog = errors.New("malformed log")
+
+// Skipped is a transfer that is not indexed because its token id or amount
+// does not fit the int32 columns of the database. Ids and amounts are in
+// decimal.
+type Skipped struct {
+	Chain      int8
+	Collection int
+	TxHash     string
+	LogIndex   int
+	BatchIndex int
+	Block      int64
+	TokenID    string
+	Amount     string
+}
+
+// decode returns the transfers of a log, without their chain and
+// collection, and the transfers it skips. Logs of other events return none.
+func decode(l Log) ([]*db.Transfer, []*Skipped, error) {
+	if len(l.Topics) == 0 {
+		return nil, nil, nil
+	}
+	data, err := hex.DecodeString(strings.TrimPrefix(l.Data, "0x"))
+	if err != nil {
+		return nil, nil, errMalformedLog
+	}
+
+	var (
+		transfers []*db.Transfer
+		skipped   []*Skipped
+	)
+	add := func(standard int16, batchIndex int, from, to string, tokenID, amount *big.Int) {
+		id, ok := small(tokenID)
+		n, ok2 := small(amount)
+		if !ok || !ok2 {
+			skipped = append(skipped, &Skipped{
+				TxHash:     strings.ToLower(l.TxHash),
+				LogIndex:   int(l.LogIndex),
+				BatchIndex: batchIndex,
+				Block:      int64(l.BlockNumber),
+				TokenID:    tokenID.String(),
+				Amount:     amount.String(),
+			})
+			return
+		}
+		transfers = append(transfers, &db.Transfer{
+			TxHash:     strings.ToLower(l.TxHash),
+			LogIndex:   int(l.LogIndex),
+			BatchIndex: batchIndex,
+			Block:      int64(l.BlockNumber),
+			From:       from,
+			To:         to,
+			TokenID:    id,
+			Amount:     n,
+			Standard:   standard,
+		})
+	}
+
+	switch strings.ToLower(l.Topics[0]) {
+	case TopicTransfer:
+		if len(l.Topics) != 4 {
+			// An ERC-20 transfer.
+			return nil, nil, nil
+		}
+		id, err := word(hexBytes(l.Topics[3]))
+		if err != nil {
+			return nil, nil, err
+		}
+		add(db.ERC721, 0, topicAddress(l.Topics[1]), topicAddress(l.Topics[2]), id, big.NewInt(1))
+
+	case TopicTransferSingle:
+		if len(l.Topics) != 4 || len(data) != 64 {
+			return nil, nil, errMalformedLog
+		}
+		id, _ := word(data[:32])
+		amount, _ := word(data[32:])
+		add(db.ERC1155, 0, topicAddress(l.Topics[2]), topicAddress(l.Topics[3]), id, amount)
+
+	case TopicTransferBatch:
+		if len(l.Topics) != 4 {
+			return nil, nil, errMalformedLog
+		}
+		ids, err := array(data, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		amounts, err := array(data, 32)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(ids) != len(amounts) {
+			return nil, nil, errMalformedLog
+		}
+		// Skipped tokens keep their batch index, like the others.
+		from, to := topicAddress(l.Topics[2]), topicAddress(l.Topics[3])
+		for i := range ids {
+			add(db.ERC1155, i, from, to, ids[i], amounts[i])
+		}
+	}
+	return transfers, skipped, nil
+}
+
+// topicAddress returns the lowercase address of an indexed address
+// parameter, the last 20 bytes of the topic.
+func topicAddress(topic string) string {
+	topic = strings.ToLower(strings.TrimPrefix(topic, "0x"))
+	if len(topic) < 40 {
+		return ""
+	}
+	return "0x" + topic[len(topic)-40:]
+}
+
+func hexBytes(s string) []byte {
+	b, _ := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	return b
+}
+
+// word decodes a uint256.
+func word(b []byte) (*big.Int, error) {
+	if len(b) != 32 {
+		return nil, errMalformedLog
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// small returns n when it fits an int32 column.
+func small(n *big.Int) (int, bool) {
+	if !n.IsInt64() || n.Int64() > math.MaxInt32 {
+		return 0, false
+	}
+	return int(n.Int64()), true
+}
+
+// array decodes the uint256[] whose offset is at head in ABI-encoded data.
+func array(data []byte, head int) ([]*big.Int, error) {
+	if len(data) < head+32 {
+		return nil, errMalformedLog
+	}
+	offset := new(big.Int).SetBytes(data[head : head+32])
+	if !offset.IsInt64() || offset.Int64() > int64(len(data)-32) {
+		return nil, errMalformedLog
+	}
+	start := int(offset.Int64())
+	length := new(big.Int).SetBytes(data[start : start+32])
+	if !length.IsInt64() || length.Int64() > int64(len(data)-start-32)/32 {
+		return nil, errMalformedLog
+	}
+
+	values := make([]*big.Int, length.Int64())
+	for i := range values {
+		at := start + 32 + 32*i
+		values[i] = new(big.Int).SetBytes(data[at : at+32])
+	}
+	return values, nil
+}
@@ -0,0 +1,333 @@
+// Package indexer follows the ERC-721 and ERC-1155 transfers of the
+// collections registered on a chain, keeping the owners of items and the
+// token balances up to date and canceling the asks of sellers who no longer
+// hold their token.
+package indexer
+
+import (
+	"cdex/db"
+	"cdex/exchange"
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// Config configures the Indexer of a chain.
+type Config struct {
+	// Chain is the chain of the indexed collections.
+	Chain int8
+	// Confirmations is how many blocks must follow a block before it is
+	// indexed. A reorg is also rewound by this many blocks.
+	Confirmations int64
+	// BlockRange bounds the blocks read by one eth_getLogs call.
+	BlockRange int64
+	// StartBlock is the first block indexed when there is no checkpoint.
+	StartBlock int64
+	// PollInterval is how often Run looks for new blocks.
+	PollInterval time.Duration
+}
+
+// Orders are the resting orders of the exchange.
+type Orders interface {
+	OpenAsks(collection, tokenID int) []*exchange.Order
+	CancelOrder(market exchange.Market, id string) (*exchange.Order, error)
+}
+
+// Indexer indexes the transfers of one chain. Progress is kept in a
+// checkpoint of the chain, so a restarted indexer picks up where it stopped.
+type Indexer struct {
+	chain  Chain
+	store  db.Storage
+	orders Orders
+	config Config
+	now    func() time.Time
+
+	onOwnerChange func([]*db.OwnerChange)
+	onSkipped     func([]*Skipped)
+}
+
+func New(chain Chain, store db.Storage, orders Orders, config Config) *Indexer {
+	if config.BlockRange <= 0 {
+		config.BlockRange = 1000
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = 5 * time.Second
+	}
+	return &Indexer{chain: chain, store: store, orders: orders, config: config, now: time.Now}
+}
+
+// OnOwnerChange registers fn to be called with the items whose owner was
+// changed by indexed or reverted transfers, once they are stored.
+func (ix *Indexer) OnOwnerChange(fn func([]*db.OwnerChange)) {
+	ix.onOwnerChange = fn
+}
+
+// OnSkipped registers fn to be called with the transfers left out of the
+// indexed blocks because their token id or amount is out of range, once the
+// others are stored. Balances of the skipped tokens are not followed.
+func (ix *Indexer) OnSkipped(fn func([]*Skipped)) {
+	ix.onSkipped = fn
+}
+
+// Run polls the chain until ctx is done.
+func (ix *Indexer) Run(ctx context.Context) {
+	ticker := time.NewTicker(ix.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := ix.Poll(ctx); err != nil && ctx.Err() == nil {
+			logrus.WithError(err).WithField("chain", ix.config.Chain).Error("cannot index chain")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll indexes the confirmed blocks that follow the checkpoint. A checkpoint
+// no longer on the canonical chain is rewound first.
+func (ix *Indexer) Poll(ctx context.Context) error {
+	head, err := ix.chain.BlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+	safe := head - ix.config.Confirmations
+
+	next := ix.config.StartBlock
+	cp, err := ix.store.GetCheckpoint(ctx, ix.config.Chain)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+	case err != nil:
+		return err
+	default:
+		if cp, err = ix.checkReorg(ctx, cp); err != nil {
+			return err
+		}
+		next = cp.Block + 1
+	}
+	if next > safe {
+		return nil
+	}
+
+	addresses, collections, err := ix.collections(ctx)
+	if err != nil {
+		return err
+	}
+
+	for from := next; from <= safe; from += ix.config.BlockRange {
+		to := from + ix.config.BlockRange - 1
+		if to > safe {
+			to = safe
+		}
+		if err = ix.index(ctx, from, to, addresses, collections); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReorg rewinds the checkpoint by Confirmations blocks, reverting the
+// transfers after it, when its block is no longer on the canonical chain.
+func (ix *Indexer) checkReorg(ctx context.Context, cp *db.Checkpoint) (*db.Checkpoint, error) {
+	if cp.Block < ix.config.StartBlock {
+		return cp, nil
+	}
+	hash, err := ix.chain.BlockHash(ctx, cp.Block)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(hash, cp.Hash) {
+		return cp, nil
+	}
+
+	rewound := &db.Checkpoint{Chain: cp.Chain, Block: cp.Block - ix.config.Confirmations - 1, UpdatedAt: ix.now()}
+	if rewound.Block < ix.config.StartBlock {
+		rewound.Block = ix.config.StartBlock - 1
+	}
+	if rewound.Block >= ix.config.StartBlock {
+		if rewound.Hash, err = ix.chain.BlockHash(ctx, rewound.Block); err != nil {
+			return nil, err
+		}
+	}
+	logrus.WithField("chain", cp.Chain).WithField("block", cp.Block).WithField("to", rewound.Block).Warn("chain reorganized, rewinding")
+
+	var (
+		reverted []*db.Transfer
+		changes  []*db.OwnerChange
+	)
+	err = ix.store.RunInTx(ctx, func(tx db.Storage) error {
+		var err error
+		if reverted, changes, err = tx.RevertTransfers(ctx, cp.Chain, rewound.Block+1); err != nil {
+			return err
+		}
+		return tx.SaveCheckpoint(ctx, rewound)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ix.applied(ctx, reverted, changes, true)
+	return rewound, nil
+}
+
+// collections returns the addresses of the collections registered on the
+// chain, and the collection ids by lowercase address.
+func (ix *Indexer) collections(ctx context.Context) ([]string, map[string]int, error) {
+	var addresses []string
+	ids := make(map[string]int)
+	query := db.CollectionQuery{Chain: &ix.config.Chain, IncludeHidden: true, Page: db.PageParams{Size: 100}}
+	for {
+		collections, cursor, err := ix.store.GetCollections(ctx, query)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range collections {
+			address := strings.ToLower(strings.TrimSpace(c.Address))
+			if address == "" {
+				continue
+			}
+			if _, ok := ids[address]; !ok {
+				addresses = append(addresses, address)
+			}
+			ids[address] = c.ID
+		}
+		if cursor == nil {
+			return addresses, ids, nil
+		}
+		query.Page.Cursor = cursor
+	}
+}
+
+// index stores the transfers of the blocks from from to to, and moves the
+// checkpoint to to.
+func (ix *Indexer) index(ctx context.Context, from, to int64, addresses []string, collections map[string]int) error {
+	var (
+		transfers []*db.Transfer
+		skipped   []*Skipped
+	)
+	if len(addresses) > 0 {
+		logs, err := ix.chain.Logs(ctx, LogFilter{
+			FromBlock: from,
+			ToBlock:   to,
+			Addresses: addresses,
+			Topics:    []string{TopicTransfer, TopicTransferSingle, TopicTransferBatch},
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range logs {
+			collection, ok := collections[strings.ToLower(l.Address)]
+			if l.Removed || !ok {
+				continue
+			}
+			decoded, left, err := decode(l)
+			if err != nil {
+				logrus.WithError(err).WithField("tx", l.TxHash).WithField("log", int64(l.LogIndex)).Warn("cannot index transfer")
+				continue
+			}
+			for _, t := range decoded {
+				t.Chain, t.Collection = ix.config.Chain, collection
+			}
+			for _, t := range left {
+				t.Chain, t.Collection = ix.config.Chain, collection
+			}
+			transfers = append(transfers, decoded...)
+			skipped = append(skipped, left...)
+		}
+	}
+
+	hash, err := ix.chain.BlockHash(ctx, to)
+	if err != nil {
+		return err
+	}
+	var changes []*db.OwnerChange
+	err = ix.store.RunInTx(ctx, func(tx db.Storage) error {
+		var err error
+		if changes, err = tx.ApplyTransfers(ctx, transfers); err != nil {
+			return err
+		}
+		return tx.SaveCheckpoint(ctx, &db.Checkpoint{Chain: ix.config.Chain, Block: to, Hash: hash, UpdatedAt: ix.now()})
+	})
+	if err != nil {
+		return err
+	}
+	if len(skipped) > 0 && ix.onSkipped != nil {
+		ix.onSkipped(skipped)
+	}
+	ix.applied(ctx, transfers, changes, false)
+	return nil
+}
+
+// applied reports owner changes and cancels the asks for the transferred
+// tokens whose seller no longer holds them. Reverted transfers come newest
+// first.
+func (ix *Indexer) applied(ctx context.Context, transfers []*db.Transfer, changes []*db.OwnerChange, reverted bool) {
+	if len(changes) > 0 && ix.onOwnerChange != nil {
+		ix.onOwnerChange(changes)
+	}
+
+	// The holder of an ERC-721 token is the receiver of its last transfer,
+	// or the sender of the oldest reverted one.
+	holders := make(map[token]*db.Transfer)
+	var tokens []token
+	for _, t := range transfers {
+		key := token{t.Collection, t.TokenID}
+		if _, ok := holders[key]; !ok {
+			tokens = append(tokens, key)
+		}
+		holders[key] = t
+	}
+	for _, key := range tokens {
+		t := holders[key]
+		holder := t.To
+		if reverted {
+			holder = t.From
+		}
+		ix.checkAsks(ctx, t, holder)
+	}
+}
+
+type token struct {
+	collection, tokenID int
+}
+
+// checkAsks cancels the asks for the token of t whose owner is not holder,
+// for ERC-721, or holds fewer tokens than the ask sells, for ERC-1155.
+// Balances only count transfers from the start block on, so they are only
+// known for owners with indexed transfers of the token, and only when they
+// are not negative: an owner that received tokens before the start block may
+// hold more.
+func (ix *Indexer) checkAsks(ctx context.Context, t *db.Transfer, holder string) {
+	for _, o := range ix.orders.OpenAsks(t.Collection, t.TokenID) {
+		if t.Standard == db.ERC721 {
+			if strings.EqualFold(o.Owner, holder) {
+				continue
+			}
+		} else {
+			owner := strings.ToLower(o.Owner)
+			known, err := ix.store.HasTransfers(ctx, t.Collection, t.TokenID, owner)
+			if err != nil {
+				logrus.WithError(err).WithField("order", o.ID).Error("cannot check balance")
+				continue
+			}
+			if !known {
+				continue
+			}
+			balance, err := ix.store.GetBalance(ctx, t.Collection, t.TokenID, owner)
+			if err != nil {
+				logrus.WithError(err).WithField("order", o.ID).Error("cannot check balance")
+				continue
+			}
+			if balance < 0 || balance >= o.Remaining() {
+				continue
+			}
+		}
+		// The ask may have been filled or canceled meanwhile.
+		if _, err := ix.orders.CancelOrder(o.Market, o.ID); err == nil {
+			logrus.WithField("order", o.ID).WithField("owner", o.Owner).Info("canceled ask of a transferred token")
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package indexer
+
+import (
+	"cdex/db"
+	"cdex/exchange"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+const (
+	contract = "0x00000000000000000000000000000000000000c1"
+	alice    = "0x00000000000000000000000000000000000000a1"
+	bob      = "0x00000000000000000000000000000000000000b0"
+	carol    = "0x00000000000000000000000000000000000000ca"
+)
+
+func topic(address string) string {
+	return "0x" + strings.Repeat("0", 24) + strings.TrimPrefix(address, "0x")
+}
+
+func uint256(n int) string {
+	return fmt.Sprintf("%064x", n)
+}
+
+func transfer721(block int64, from, to string, tokenID int) Log {
+	return Log{
+		Address:     strings.ToUpper(contract[:2]) + contract[2:],
+		Topics:      []string{TopicTransfer, topic(from), topic(to), "0x" + uint256(tokenID)},
+		Data:        "0x",
+		BlockNumber: quantity(block),
+		TxHash:      fmt.Sprintf("0x%064x", block),
+	}
+}
+
+// fakeChain is a chain of blocks whose hashes change with their fork.
+type fakeChain struct {
+	mu   sync.Mutex
+	head int64
+	fork map[int64]int // block => fork, 0 by default
+	logs []Log
+}
+
+func (c *fakeChain) BlockNumber(ctx context.Context) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.head, nil
+}
+
+func (c *fakeChain) BlockHash(ctx context.Context, number int64) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if number > c.head {
+		return "", fmt.Errorf("block %d not found", number)
+	}
+	return fmt.Sprintf("0x%d-%d", number, c.fork[number]), nil
+}
+
+func (c *fakeChain) Logs(ctx context.Context, filter LogFilter) ([]Log, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var logs []Log
+	for _, l := range c.logs {
+		if int64(l.BlockNumber) >= filter.FromBlock && int64(l.BlockNumber) <= filter.ToBlock {
+			logs = append(logs, l)
+		}
+	}
+	return logs, nil
+}
+
+// reorg replaces the blocks from block on, and their logs.
+func (c *fakeChain) reorg(block int64, logs ...Log) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n := block; n <= c.head; n++ {
+		c.fork[n]++
+	}
+	var kept []Log
+	for _, l := range c.logs {
+		if int64(l.BlockNumber) < block {
+			kept = append(kept, l)
+		}
+	}
+	c.logs = append(kept, logs...)
+}
+
+func TestIndexer(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryDB()
+	c, err := store.InsertCollection(ctx, db.CreateCollectionParams{Name: "c", Address: contract, Creator: alice, Chain: 1, Visible: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.InsertItem(ctx, db.CreateItemParams{Name: "i", Collection: c.ID, TokenID: 1, Chain: 1, Creator: alice}); err != nil {
+		t.Fatal(err)
+	}
+
+	ex := exchange.NewExchange()
+	ask := exchange.NewOrder(alice, "eth", false, c.ID, 1, 1, 10)
+	if _, err = ex.PlaceLimitOrder(exchange.MarketFRA, 10, ask); err != nil {
+		t.Fatal(err)
+	}
+
+	chain := &fakeChain{head: 20, fork: make(map[int64]int), logs: []Log{
+		transfer721(5, db.ZeroAddress, alice, 1),
+		transfer721(16, alice, bob, 1),
+		// Another contract.
+		{Address: "0x00000000000000000000000000000000000000ff", Topics: transfer721(6, alice, bob, 1).Topics, BlockNumber: 6},
+	}}
+	ix := New(chain, store, ex, Config{Chain: 1, Confirmations: 3, BlockRange: 4, StartBlock: 2})
+	var changes []*db.OwnerChange
+	ix.OnOwnerChange(func(c []*db.OwnerChange) { changes = append(changes, c...) })
+	owner := func() string {
+		item, err := store.GetItem(ctx, c.ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item.Owner
+	}
+
+	if err = ix.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cp, _ := store.GetCheckpoint(ctx, 1)
+	assert(t, cp.Block, int64(17))
+	assert(t, owner(), bob)
+	assert(t, ask.Status, exchange.OrderCanceled)
+	// The item was created by alice, who minted it.
+	assert(t, changes, []*db.OwnerChange{{Collection: c.ID, TokenID: 1, From: alice, To: bob}})
+
+	// The transfer to bob is replaced by one to carol.
+	chain.reorg(15, transfer721(18, alice, carol, 1))
+	chain.head = 22
+	changes = nil
+	if err = ix.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cp, _ = store.GetCheckpoint(ctx, 1)
+	assert(t, cp.Block, int64(19))
+	assert(t, cp.Hash, "0x19-1")
+	assert(t, owner(), carol)
+	assert(t, changes, []*db.OwnerChange{
+		{Collection: c.ID, TokenID: 1, From: bob, To: alice},
+		{Collection: c.ID, TokenID: 1, From: alice, To: carol},
+	})
+	balance, _ := store.GetBalance(ctx, c.ID, 1, bob)
+	assert(t, balance, 0)
+	balance, _ = store.GetBalance(ctx, c.ID, 1, carol)
+	assert(t, balance, 1)
+
+	// Nothing new is confirmed.
+	if err = ix.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cp, _ = store.GetCheckpoint(ctx, 1)
+	assert(t, cp.Block, int64(19))
+}
+
+func TestIndexerERC1155(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryDB()
+	c, err := store.InsertCollection(ctx, db.CreateCollectionParams{Name: "c", Address: contract, Creator: alice, Chain: 1, Visible: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ex := exchange.NewExchange()
+	ask := exchange.NewOrder(alice, "eth", false, c.ID, 7, 3, 10)
+	if _, err = ex.PlaceLimitOrder(exchange.MarketFRA, 10, ask); err != nil {
+		t.Fatal(err)
+	}
+	// Carol minted before the start block: her balance is not known.
+	unknown := exchange.NewOrder(carol, "eth", false, c.ID, 7, 1, 11)
+	if _, err = ex.PlaceLimitOrder(exchange.MarketFRA, 11, unknown); err != nil {
+		t.Fatal(err)
+	}
+
+	operator := topic(alice)
+	chain := &fakeChain{head: 10, fork: make(map[int64]int), logs: []Log{{
+		Address:     contract,
+		Topics:      []string{TopicTransferSingle, operator, topic(db.ZeroAddress), topic(alice)},
+		Data:        "0x" + uint256(7) + uint256(5),
+		BlockNumber: 2,
+		TxHash:      "0x02",
+	}, {
+		// Batch of ids 7, 8 and 2^40, 3, 1 and 1 of them.
+		Address:     contract,
+		Topics:      []string{TopicTransferBatch, operator, topic(alice), topic(bob)},
+		Data:        "0x" + uint256(64) + uint256(192) + uint256(3) + uint256(7) + uint256(8) + uint256(1<<40) + uint256(3) + uint256(3) + uint256(1) + uint256(1),
+		BlockNumber: 3,
+		TxHash:      "0x03",
+	}}}
+
+	ix := New(chain, store, ex, Config{Chain: 1, BlockRange: 100})
+	var skipped []*Skipped
+	ix.OnSkipped(func(s []*Skipped) {
+		skipped = append(skipped, s...)
+	})
+	if err = ix.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, skipped, []*Skipped{{Chain: 1, Collection: c.ID, TxHash: "0x03", BatchIndex: 2, Block: 3, TokenID: "1099511627776", Amount: "1"}})
+	for owner, want := range map[string]int{alice: 2, bob: 3} {
+		balance, _ := store.GetBalance(ctx, c.ID, 7, owner)
+		assert(t, balance, want)
+	}
+	balance, _ := store.GetBalance(ctx, c.ID, 8, bob)
+	assert(t, balance, 1)
+	assert(t, ask.Status, exchange.OrderCanceled)
+	assert(t, unknown.Status, exchange.OrderNew)
+}
+
+func TestDecode(t *testing.T) {
+	// An ERC-20 transfer is not a token transfer.
+	transfers, skipped, err := decode(Log{Topics: []string{TopicTransfer, topic(alice), topic(bob)}, Data: "0x" + uint256(5)})
+	assert(t, err, nil)
+	assert(t, len(transfers), 0)
+	assert(t, len(skipped), 0)
+
+	huge := transfer721(1, alice, bob, 1)
+	huge.Topics[3] = "0x" + strings.Repeat("0", 54) + "0100000000"
+	transfers, skipped, err = decode(huge)
+	assert(t, err, nil)
+	assert(t, len(transfers), 0)
+	assert(t, skipped, []*Skipped{{TxHash: huge.TxHash, Block: 1, TokenID: "4294967296", Amount: "1"}})
+
+	_, _, err = decode(Log{Topics: []string{TopicTransferBatch, topic(alice), topic(alice), topic(bob)}, Data: "0x" + uint256(4096)})
+	assert(t, err, errMalformedLog)
+}
+
+// rpcServer answers JSON-RPC requests with the results of methods.
+func rpcServer(t *testing.T, methods map[string]func(params []json.RawMessage) interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     int64             `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		res := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		if method, ok := methods[req.Method]; ok {
+			res["result"] = method(req.Params)
+		} else {
+			res["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+}
+
+func TestClient(t *testing.T) {
+	srv := rpcServer(t, map[string]func([]json.RawMessage) interface{}{
+		"eth_blockNumber": func([]json.RawMessage) interface{} { return "0x1b4" },
+		"eth_getBlockByNumber": func(params []json.RawMessage) interface{} {
+			if string(params[0]) != `"0x10"` {
+				return nil
+			}
+			return map[string]string{"hash": "0xabc", "number": "0x10"}
+		},
+		"eth_getLogs": func(params []json.RawMessage) interface{} {
+			var filter struct {
+				FromBlock string     `json:"fromBlock"`
+				Address   []string   `json:"address"`
+				Topics    [][]string `json:"topics"`
+			}
+			json.Unmarshal(params[0], &filter)
+			assert(t, filter.FromBlock, "0xa")
+			assert(t, filter.Address, []string{contract})
+			assert(t, filter.Topics, [][]string{{TopicTransfer}})
+			return []map[string]interface{}{{
+				"address": contract, "topics": []string{TopicTransfer}, "data": "0x",
+				"blockNumber": "0xb", "transactionHash": "0x01", "logIndex": "0x2", "removed": false,
+			}}
+		},
+	})
+	defer srv.Close()
+	ctx := context.Background()
+	client := NewClient(srv.Client(), srv.URL)
+
+	n, err := client.BlockNumber(ctx)
+	assert(t, err, nil)
+	assert(t, n, int64(436))
+
+	hash, err := client.BlockHash(ctx, 16)
+	assert(t, err, nil)
+	assert(t, hash, "0xabc")
+	_, err = client.BlockHash(ctx, 17)
+	assert(t, err != nil, true)
+
+	logs, err := client.Logs(ctx, LogFilter{FromBlock: 10, ToBlock: 20, Addresses: []string{contract}, Topics: []string{TopicTransfer}})
+	assert(t, err, nil)
+	assert(t, len(logs), 1)
+	assert(t, logs[0].BlockNumber, quantity(11))
+	assert(t, logs[0].LogIndex, quantity(2))
+
+	err = client.call(ctx, nil, "eth_chainId")
+	assert(t, err, error(&rpcError{Code: -32601, Message: "method not found"}))
+}
+
+// TestClientDevnet runs against the node of CDEX_TEST_RPC_URL, such as a
+// local anvil.
+func TestClientDevnet(t *testing.T) {
+	url := os.Getenv("CDEX_TEST_RPC_URL")
+	if url == "" {
+		t.Skip("CDEX_TEST_RPC_URL is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := NewClient(http.DefaultClient, url)
+
+	head, err := client.BlockNumber(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := client.BlockHash(ctx, head)
+	assert(t, err, nil)
+	assert(t, len(hash), 66)
+	_, err = client.Logs(ctx, LogFilter{FromBlock: 0, ToBlock: head, Addresses: []string{contract}, Topics: []string{TopicTransfer}})
+	assert(t, err, nil)
+}
@@ -0,0 +1,157 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Chain is the part of an EVM node the indexer reads.
+type Chain interface {
+	// BlockNumber returns the number of the latest block.
+	BlockNumber(ctx context.Context) (int64, error)
+	// BlockHash returns the hash of a block of the canonical chain.
+	BlockHash(ctx context.Context, number int64) (string, error)
+	// Logs returns the logs of the blocks from FromBlock to ToBlock included,
+	// emitted by one of Addresses with a first topic in Topics.
+	Logs(ctx context.Context, filter LogFilter) ([]Log, error)
+}
+
+type LogFilter struct {
+	FromBlock int64
+	ToBlock   int64
+	Addresses []string
+	Topics    []string
+}
+
+// Log is a log of a transaction, as returned by eth_getLogs.
+type Log struct {
+	Address     string   `json:"address"`
+	Topics      []string `json:"topics"`
+	Data        string   `json:"data"`
+	BlockNumber quantity `json:"blockNumber"`
+	BlockHash   string   `json:"blockHash"`
+	TxHash      string   `json:"transactionHash"`
+	LogIndex    quantity `json:"logIndex"`
+	Removed     bool     `json:"removed"`
+}
+
+// quantity is a number encoded in hex, as the JSON-RPC API writes them.
+type quantity int64
+
+func (q *quantity) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	n, err := strconv.ParseInt(strings.TrimPrefix(s, "0x"), 16, 64)
+	if err != nil {
+		return fmt.Errorf("invalid quantity %q", s)
+	}
+	*q = quantity(n)
+	return nil
+}
+
+func hexQuantity(n int64) string {
+	return "0x" + strconv.FormatInt(n, 16)
+}
+
+// Client calls the JSON-RPC API of an EVM node over HTTP, such as anvil at
+// http://localhost:8545.
+type Client struct {
+	client *http.Client
+	url    string
+	id     int64
+}
+
+func NewClient(client *http.Client, url string) *Client {
+	return &Client{client: client, url: url}
+}
+
+// rpcError is the error member of a JSON-RPC response.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc: %s (%d)", e.Message, e.Code)
+}
+
+// call runs method and decodes its result into result.
+func (c *Client) call(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      atomic.AddInt64(&c.id, 1),
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("rpc: %s: %s: %s", method, res.Status, bytes.TrimSpace(data))
+	}
+
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return fmt.Errorf("rpc: %s: %w", method, err)
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+func (c *Client) BlockNumber(ctx context.Context) (int64, error) {
+	var n quantity
+	err := c.call(ctx, &n, "eth_blockNumber")
+	return int64(n), err
+}
+
+func (c *Client) BlockHash(ctx context.Context, number int64) (string, error) {
+	var block *struct {
+		Hash string `json:"hash"`
+	}
+	if err := c.call(ctx, &block, "eth_getBlockByNumber", hexQuantity(number), false); err != nil {
+		return "", err
+	}
+	if block == nil {
+		return "", fmt.Errorf("rpc: block %d not found", number)
+	}
+	return block.Hash, nil
+}
+
+func (c *Client) Logs(ctx context.Context, filter LogFilter) ([]Log, error) {
+	var logs []Log
+	err := c.call(ctx, &logs, "eth_getLogs", map[string]interface{}{
+		"fromBlock": hexQuantity(filter.FromBlock),
+		"toBlock":   hexQuantity(filter.ToBlock),
+		"address":   filter.Addresses,
+		"topics":    [][]string{filter.Topics},
+	})
+	return logs, err
+}
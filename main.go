@@ -4,7 +4,13 @@ import (
 	"cdex/api"
 	"cdex/db"
 	"cdex/utils"
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -12,12 +18,104 @@ func main() {
 	if err != nil {
 		log.Fatal("Cannot load config:", err)
 	}
+	setupLogging(config)
 
-	nartDB := db.NewNartDB(config.DBSource)
-	server := api.NewServer(nartDB)
+	var command string
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	var (
+		store  db.Storage
+		nartDB *db.NartDB
+	)
+	if config.DBDriver == "memory" {
+		if command != "" {
+			log.Fatal("cannot run ", command, ": the memory driver keeps no data")
+		}
+		// Everything is lost on exit; for local development only.
+		store = db.NewMemoryDB()
+	} else {
+		nartDB = db.NewNartDB(config.DBSource, db.Options{
+			Timeout:         config.DBTimeout,
+			MaxOpenConns:    config.DBMaxOpenConns,
+			MaxIdleConns:    config.DBMaxIdleConns,
+			ConnMaxLifetime: config.DBConnMaxLifetime,
+			ConnMaxIdleTime: config.DBConnMaxIdleTime,
+		})
+		if command == "migrate" {
+			if err = runMigrate(context.Background(), nartDB, os.Args[2:]); err != nil {
+				log.Fatal("cannot migrate: ", err)
+			}
+			return
+		}
+
+		if err = nartDB.CheckSchema(context.Background()); err != nil {
+			log.Fatal("cannot start: ", err, "; run cdex migrate up")
+		}
+		store = nartDB
+	}
 
-	err = server.Start(config.ServerAddress)
+	switch command {
+	case "":
+	case "import":
+		if err = runImport(context.Background(), store, os.Args[2:]); err != nil {
+			log.Fatal("cannot import: ", err)
+		}
+		return
+	default:
+		log.Fatal("unknown command ", command, "; commands are migrate and import")
+	}
+
+	server, err := api.NewServer(config, store)
 	if err != nil {
+		log.Fatal("cannot create server: ", err)
+	}
+	if err = server.LoadOrders(context.Background()); err != nil {
+		log.Fatal("cannot load orders:", err)
+	}
+	if err = server.LoadStats(context.Background()); err != nil {
+		log.Fatal("cannot load stats:", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	server.StartIndexers(ctx)
+
+	started := make(chan error, 1)
+	go func() {
+		started <- server.Start()
+	}()
+	select {
+	case err = <-started:
 		log.Fatal("cannot start server:", err)
+	case <-server.Failed():
+		logrus.Error("cannot persist the exchange")
+	case <-ctx.Done():
+	}
+	// A second signal kills the process.
+	stop()
+
+	logrus.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err = server.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Error("cannot shut down cleanly")
+	}
+	if nartDB != nil {
+		if err = nartDB.Close(); err != nil {
+			logrus.WithError(err).Error("cannot close database")
+		}
+	}
+	logrus.Info("stopped")
+}
+
+// setupLogging applies LOG_LEVEL, LOG_FORMAT and GIN_MODE, which
+// LoadConfig has checked.
+func setupLogging(config utils.Config) {
+	level, _ := logrus.ParseLevel(config.LogLevel)
+	logrus.SetLevel(level)
+	if config.LogFormat == "json" {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
 	}
+	gin.SetMode(config.GinMode)
 }
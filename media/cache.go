@@ -0,0 +1,137 @@
+package media
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// diskCache keeps files in a directory up to a total size, evicting the
+// least recently used ones. Files already in the directory are taken over,
+// oldest first, so the cache survives restarts.
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+func newDiskCache(dir string, maxSize int64) *diskCache {
+	c := &diskCache{dir: dir, maxSize: maxSize, lru: list.New(), entries: make(map[string]*list.Element)}
+
+	// A missing directory is an empty cache; it is created on the first put.
+	files, _ := os.ReadDir(dir)
+	var infos []os.FileInfo
+	for _, f := range files {
+		if info, err := f.Info(); err == nil && info.Mode().IsRegular() && !strings.HasPrefix(f.Name(), ".") {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		c.add(info.Name(), info.Size())
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c
+}
+
+// get reads a cached file.
+func (c *diskCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		// Removed behind our back, or evicted meanwhile.
+		c.remove(key)
+		return nil, false
+	}
+	return data, true
+}
+
+// put caches a file, evicting others to stay under the size limit. A file
+// larger than the limit is not cached.
+func (c *diskCache) put(key string, data []byte) error {
+	if int64(len(data)) > c.maxSize {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.dir, ".variant-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), filepath.Join(c.dir, key)); err != nil {
+		return err
+	}
+
+	c.add(key, int64(len(data)))
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *diskCache) add(key string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: size})
+	c.size += size
+}
+
+func (c *diskCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// evict removes the least recently used files until the cache fits. c.mu is
+// held.
+func (c *diskCache) evict() {
+	for c.size > c.maxSize {
+		e := c.lru.Back()
+		entry := e.Value.(*cacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		os.Remove(filepath.Join(c.dir, entry.key))
+	}
+}
@@ -0,0 +1,162 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ipfsDir is the directory of the files in the mutable file system of the
+// node, which keeps the name of each file next to its CID.
+const ipfsDir = "/cdex/"
+
+// IPFSStore adds files to an IPFS node through its HTTP RPC API, pins them
+// and links to them through a gateway.
+type IPFSStore struct {
+	client  *http.Client
+	api     string
+	gateway string
+
+	// cids caches the CIDs of the stored files, which never change.
+	cids sync.Map
+}
+
+// NewIPFSStore returns an IPFSStore for the node whose RPC API listens at
+// api, such as http://localhost:5001, with URLs on gateway, such as
+// https://ipfs.io.
+func NewIPFSStore(client *http.Client, api, gateway string) *IPFSStore {
+	return &IPFSStore{
+		client:  client,
+		api:     strings.TrimSuffix(api, "/"),
+		gateway: strings.TrimSuffix(gateway, "/"),
+	}
+}
+
+// ipfsError is the error body of the RPC API, which answers 500 to most
+// failed commands.
+type ipfsError struct {
+	Message string
+}
+
+func (e *ipfsError) Error() string {
+	return "ipfs: " + e.Message
+}
+
+// call runs an RPC command. The caller closes the body of the response.
+func (s *IPFSStore) call(ctx context.Context, command string, args url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.api+"/api/v0/"+command+"?"+args.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		e := &ipfsError{}
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+		if json.Unmarshal(data, e) != nil || e.Message == "" {
+			e.Message = fmt.Sprintf("%s: %s", command, res.Status)
+		}
+		if strings.Contains(e.Message, "does not exist") {
+			return nil, ErrNotUploaded
+		}
+		return nil, e
+	}
+	return res, nil
+}
+
+// Put writes the file in the mutable file system and pins it, so that it
+// stays on the node and can be pinned by other nodes as well.
+func (s *IPFSStore) Put(ctx context.Context, name, contentType string, data []byte) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		return err
+	}
+	if _, err = part.Write(data); err != nil {
+		return err
+	}
+	if err = form.Close(); err != nil {
+		return err
+	}
+
+	args := url.Values{"arg": {ipfsDir + name}, "create": {"true"}, "parents": {"true"}, "truncate": {"true"}}
+	res, err := s.call(ctx, "files/write", args, &body, form.FormDataContentType())
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	cid, err := s.cid(ctx, name)
+	if err != nil {
+		return err
+	}
+	res, err = s.call(ctx, "pin/add", url.Values{"arg": {cid}}, nil, "")
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// cid returns the CID of a stored file.
+func (s *IPFSStore) cid(ctx context.Context, name string) (string, error) {
+	if cid, ok := s.cids.Load(name); ok {
+		return cid.(string), nil
+	}
+
+	res, err := s.call(ctx, "files/stat", url.Values{"arg": {ipfsDir + name}, "hash": {"true"}}, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var stat struct {
+		Hash string
+	}
+	if err = json.NewDecoder(res.Body).Decode(&stat); err != nil {
+		return "", err
+	}
+	if stat.Hash == "" {
+		return "", errors.New("ipfs: files/stat returned no hash")
+	}
+	s.cids.Store(name, stat.Hash)
+	return stat.Hash, nil
+}
+
+func (s *IPFSStore) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := s.cid(ctx, name)
+	if errors.Is(err, ErrNotUploaded) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *IPFSStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	res, err := s.call(ctx, "files/read", url.Values{"arg": {ipfsDir + name}}, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// URL returns the URL of the file on the gateway. IPFS content is public.
+func (s *IPFSStore) URL(ctx context.Context, name string) (string, error) {
+	cid, err := s.cid(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return s.gateway + "/ipfs/" + cid, nil
+}
@@ -0,0 +1,240 @@
+// Package media stores uploaded images under their content hash, next to
+// resized thumbnails, and checks that image URLs name uploaded files. Files
+// are kept by an AssetStore: a local directory, an S3-compatible bucket or an
+// IPFS node.
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrTooLarge        = errors.New("file is too large")
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrInvalidImage    = errors.New("invalid image")
+	ErrNotUploaded     = errors.New("file was not uploaded")
+)
+
+// ThumbnailWidths are the widths of the thumbnails made of every image, in
+// pixels. Images are never scaled up: a thumbnail of an image narrower than
+// its width is the image itself.
+var ThumbnailWidths = []int{128, 512}
+
+// maxPixels bounds the size of a decoded image, so that a small file cannot
+// expand into gigabytes of pixels.
+const maxPixels = 64 << 20
+
+// jpegQuality is the quality of JPEG thumbnails.
+const jpegQuality = 85
+
+// extensions are the accepted content types, as sniffed from the file rather
+// than as declared by the client, with their file extensions.
+var extensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+}
+
+// fileName matches the names of stored files: a SHA-256 hash, with the width
+// of a thumbnail.
+var fileName = regexp.MustCompile(`^[0-9a-f]{64}(_[0-9]+)?\.(png|jpg|gif)$`)
+
+// Asset is a stored image.
+type Asset struct {
+	URL        string         `json:"url"`
+	Hash       string         `json:"hash"`
+	Type       string         `json:"type"`
+	Size       int64          `json:"size"`
+	Width      int            `json:"width"`
+	Height     int            `json:"height"`
+	Thumbnails map[int]string `json:"thumbnails"`
+}
+
+// Service checks images and keeps them in an AssetStore. Images are named
+// by URLs under a base URL, which the server serves whatever the store.
+type Service struct {
+	assets  AssetStore
+	baseURL string
+	maxSize int64
+}
+
+// NewService returns a Service that keeps files in assets, names them by
+// baseURL, such as /static/, and rejects files larger than maxSize bytes.
+func NewService(assets AssetStore, baseURL string, maxSize int64) *Service {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return &Service{assets: assets, baseURL: baseURL, maxSize: maxSize}
+}
+
+// Assets is the store of the files.
+func (s *Service) Assets() AssetStore {
+	return s.assets
+}
+
+// MaxSize is the size limit of a file, in bytes.
+func (s *Service) MaxSize() int64 {
+	return s.maxSize
+}
+
+// Save checks and stores an image with its thumbnails. Saving the same image
+// twice stores it once.
+func (s *Service) Save(ctx context.Context, r io.Reader) (*Asset, error) {
+	data, err := io.ReadAll(io.LimitReader(r, s.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.maxSize {
+		return nil, ErrTooLarge
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := extensions[contentType]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedType, contentType)
+	}
+	img, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	size := img.Bounds().Size()
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	asset := &Asset{
+		URL:        s.baseURL + hash + ext,
+		Hash:       hash,
+		Type:       contentType,
+		Size:       int64(len(data)),
+		Width:      size.X,
+		Height:     size.Y,
+		Thumbnails: make(map[int]string, len(ThumbnailWidths)),
+	}
+	if err = s.assets.Put(ctx, hash+ext, contentType, data); err != nil {
+		return nil, err
+	}
+
+	// GIF thumbnails are of the first frame, so they are PNG files.
+	if ext == ".gif" {
+		ext, contentType = ".png", "image/png"
+	}
+	// Smaller thumbnails are scaled from larger ones, which is much faster
+	// than scaling the image again and looks the same.
+	widths := append([]int(nil), ThumbnailWidths...)
+	sort.Sort(sort.Reverse(sort.IntSlice(widths)))
+	for _, width := range widths {
+		if width >= size.X {
+			asset.Thumbnails[width] = asset.URL
+			continue
+		}
+		name := fmt.Sprintf("%s_%d%s", hash, width, ext)
+		b := img.Bounds()
+		img = resize(img, width, b.Dy()*width/b.Dx())
+		var buf bytes.Buffer
+		if err = encode(&buf, img, ext); err != nil {
+			return nil, err
+		}
+		if err = s.assets.Put(ctx, name, contentType, buf.Bytes()); err != nil {
+			return nil, err
+		}
+		asset.Thumbnails[width] = s.baseURL + name
+	}
+
+	return asset, nil
+}
+
+// Uploaded reports whether name is the name of an uploaded file or of one of
+// its thumbnails, which never change.
+func Uploaded(name string) bool {
+	return fileName.MatchString(name)
+}
+
+// Check returns ErrNotUploaded when url is under the base URL of the service
+// but does not name a stored file. Other URLs, such as IPFS or external ones,
+// are not checked.
+func (s *Service) Check(ctx context.Context, url string) error {
+	if !strings.HasPrefix(url, s.baseURL) {
+		return nil
+	}
+	name := strings.TrimPrefix(url, s.baseURL)
+	if !fileName.MatchString(name) {
+		return fmt.Errorf("%w: %s", ErrNotUploaded, url)
+	}
+	exists, err := s.assets.Exists(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNotUploaded, url)
+	}
+	return nil
+}
+
+// decode decodes an image, checking its size before decoding its pixels.
+func decode(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrInvalidImage
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, fmt.Errorf("%w: %dx%d pixels is too large", ErrInvalidImage, config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	return img, nil
+}
+
+func encode(w io.Writer, img image.Image, ext string) error {
+	if ext == ".jpg" {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+	}
+	return png.Encode(w, img)
+}
+
+// resize scales img down to width and height, which are at most its own.
+// Each pixel is the average of the pixels it covers, which is good enough for
+// thumbnails and needs no image library beyond the standard one.
+func resize(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(bl / n >> 8), A: uint8(a / n >> 8)})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,93 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func pngImage(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, 0, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSave(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := NewService(NewDirStore(dir), "/static", 1<<20)
+
+	asset, err := s.Save(ctx, bytes.NewReader(pngImage(t, 600, 300)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, asset.Type, "image/png")
+	assert(t, asset.Width, 600)
+	assert(t, asset.URL, "/static/"+asset.Hash+".png")
+	assert(t, asset.Thumbnails[128], "/static/"+asset.Hash+"_128.png")
+
+	f, err := os.Open(filepath.Join(dir, asset.Hash+"_128.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	thumb, err := png.DecodeConfig(f)
+	assert(t, err, nil)
+	assert(t, [2]int{thumb.Width, thumb.Height}, [2]int{128, 64})
+
+	// The same image is stored once.
+	again, err := s.Save(ctx, bytes.NewReader(pngImage(t, 600, 300)))
+	assert(t, err, nil)
+	assert(t, again.URL, asset.URL)
+	files, _ := os.ReadDir(dir)
+	assert(t, len(files), 3)
+
+	// Small images are their own thumbnails.
+	small, err := s.Save(ctx, bytes.NewReader(pngImage(t, 100, 100)))
+	assert(t, err, nil)
+	assert(t, small.Thumbnails[512], small.URL)
+
+	_, err = s.Save(ctx, strings.NewReader("hello"))
+	assert(t, errors.Is(err, ErrUnsupportedType), true)
+	_, err = s.Save(ctx, bytes.NewReader(pngImage(t, 100, 100)[:40]))
+	assert(t, errors.Is(err, ErrInvalidImage), true)
+	_, err = NewService(NewDirStore(dir), "/static/", 100).Save(ctx, bytes.NewReader(pngImage(t, 100, 100)))
+	assert(t, errors.Is(err, ErrTooLarge), true)
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(NewDirStore(t.TempDir()), "/static/", 1<<20)
+	asset, err := s.Save(ctx, bytes.NewReader(pngImage(t, 600, 300)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, s.Check(ctx, asset.URL), nil)
+	assert(t, s.Check(ctx, asset.Thumbnails[512]), nil)
+	assert(t, s.Check(ctx, "ipfs://Qm/1.png"), nil)
+	assert(t, s.Check(ctx, "https://example.com/1.png"), nil)
+	assert(t, errors.Is(s.Check(ctx, "/static/"+strings.Repeat("0", 64)+".png"), ErrNotUploaded), true)
+	assert(t, errors.Is(s.Check(ctx, "/static/../app.env"), ErrNotUploaded), true)
+}
@@ -0,0 +1,263 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3Store.
+type S3Config struct {
+	// Endpoint is the base URL of the service, such as
+	// https://s3.us-east-1.amazonaws.com or http://localhost:9000 for MinIO.
+	// Buckets are addressed by path, which every S3-compatible service
+	// supports.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PublicURL is where the objects of a public bucket are read from, such
+	// as a CDN. When it is empty the bucket is private and URLs are signed.
+	PublicURL string
+	// URLExpiry is how long signed URLs are valid.
+	URLExpiry time.Duration
+}
+
+// S3Store keeps files in a bucket of an S3-compatible service. Requests are
+// signed with AWS Signature Version 4.
+type S3Store struct {
+	client *http.Client
+	config S3Config
+	now    func() time.Time
+}
+
+func NewS3Store(client *http.Client, config S3Config) *S3Store {
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	config.PublicURL = strings.TrimSuffix(config.PublicURL, "/")
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	return &S3Store{client: client, config: config, now: time.Now}
+}
+
+func (s *S3Store) objectURL(name string) string {
+	return s.config.Endpoint + "/" + s.config.Bucket + "/" + name
+}
+
+// do sends a signed request for an object.
+func (s *S3Store) do(ctx context.Context, method, name string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(name), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	s.sign(req, hashHex(body), s.now())
+	return s.client.Do(req)
+}
+
+func (s *S3Store) Put(ctx context.Context, name, contentType string, data []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	// Names are content hashes: a file never changes.
+	header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	res, err := s.do(ctx, http.MethodPut, name, header, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *S3Store) Exists(ctx context.Context, name string) (bool, error) {
+	res, err := s.do(ctx, http.MethodHead, name, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("s3: HEAD %s: %s", name, res.Status)
+}
+
+func (s *S3Store) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrNotUploaded
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, s3Error(res)
+	}
+	return res.Body, nil
+}
+
+// URL returns the public URL of an object, or a URL signed for URLExpiry in
+// a private bucket.
+func (s *S3Store) URL(ctx context.Context, name string) (string, error) {
+	if s.config.PublicURL != "" {
+		return s.config.PublicURL + "/" + name, nil
+	}
+	u, err := url.Parse(s.objectURL(name))
+	if err != nil {
+		return "", err
+	}
+	return s.presign(http.MethodGet, u, s.now(), s.config.URLExpiry), nil
+}
+
+// s3Error reads the message of an S3 error response.
+func s3Error(res *http.Response) error {
+	var body struct {
+		Code    string
+		Message string
+	}
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+	if xml.Unmarshal(data, &body) == nil && body.Code != "" {
+		return fmt.Errorf("s3: %s %s: %s: %s", res.Request.Method, res.Request.URL.Path, body.Code, body.Message)
+	}
+	return fmt.Errorf("s3: %s %s: %s", res.Request.Method, res.Request.URL.Path, res.Status)
+}
+
+const (
+	amzDateFormat   = "20060102T150405Z"
+	amzDayFormat    = "20060102"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// sign adds the Signature Version 4 authorization header to req.
+func (s *S3Store) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	canonical, signed := canonicalRequest(req.Method, req.URL, req.URL.Query(), headers, payloadHash)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, s.scope(t), signed, s.signature(t, canonical)))
+}
+
+// presign returns u signed in its query string, valid for expires.
+func (s *S3Store) presign(method string, u *url.URL, t time.Time, expires time.Duration) string {
+	t = t.UTC()
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.config.AccessKey+"/"+s.scope(t))
+	query.Set("X-Amz-Date", t.Format(amzDateFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonical, _ := canonicalRequest(method, u, query, map[string]string{"host": u.Host}, unsignedPayload)
+	query.Set("X-Amz-Signature", s.signature(t, canonical))
+
+	signed := *u
+	signed.RawQuery = canonicalQuery(query)
+	return signed.String()
+}
+
+func (s *S3Store) scope(t time.Time) string {
+	return t.Format(amzDayFormat) + "/" + s.config.Region + "/s3/aws4_request"
+}
+
+func (s *S3Store) signature(t time.Time, canonical string) string {
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format(amzDateFormat) + "\n" + s.scope(t) + "\n" + hashHex([]byte(canonical))
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), t.Format(amzDayFormat))
+	for _, part := range []string{s.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalRequest returns the canonical form of a request and the list of
+// its signed headers.
+func canonicalRequest(method string, u *url.URL, query url.Values, headers map[string]string, payloadHash string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(method + "\n")
+	b.WriteString(uriEncode(u.EscapedPath(), false) + "\n")
+	b.WriteString(canonicalQuery(query) + "\n")
+	for _, name := range names {
+		b.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	b.WriteString("\n" + signed + "\n" + payloadHash)
+	return b.String(), signed
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes s as Signature Version 4 requires: every byte but the
+// unreserved characters, and slashes unless encodeSlash. Escapes already in
+// s are kept.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		case c == '%' && !encodeSlash && i+2 < len(s):
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
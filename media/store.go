@@ -0,0 +1,102 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// AssetStore keeps the files of the media service. Names are flat file
+// names, such as <hash>.png.
+type AssetStore interface {
+	// Put stores data under name. Names are derived from the content, so a
+	// name that is already stored may be left as it is.
+	Put(ctx context.Context, name, contentType string, data []byte) error
+	// Exists reports whether name is stored.
+	Exists(ctx context.Context, name string) (bool, error)
+	// Open reads a stored file. It returns ErrNotUploaded for a missing one.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// URL returns a URL that clients can fetch name from without going
+	// through the server, signed if the store is private, or "" when the
+	// server has to serve the file itself.
+	URL(ctx context.Context, name string) (string, error)
+}
+
+// DirStore keeps files in a local directory, which the server serves.
+type DirStore struct {
+	dir string
+}
+
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{dir: dir}
+}
+
+func (s *DirStore) path(name string) string {
+	// Cleaning a rooted path drops any .. so that name stays in the directory.
+	return filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// Put writes a file unless it exists. The file is written under a temporary
+// name and renamed, so it is never served half written.
+func (s *DirStore) Put(ctx context.Context, name, contentType string, data []byte) error {
+	target := s.path(name)
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), target)
+}
+
+func (s *DirStore) Exists(ctx context.Context, name string) (bool, error) {
+	info, err := os.Stat(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !info.IsDir(), nil
+}
+
+// Open returns an *os.File, which the server serves with range requests.
+func (s *DirStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotUploaded
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil, ErrNotUploaded
+	}
+	return f, nil
+}
+
+// URL returns "": the files of a DirStore are only reachable through the
+// server.
+func (s *DirStore) URL(ctx context.Context, name string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,265 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"path"
+	"runtime"
+	"sync"
+)
+
+// ErrVariantNotAllowed is returned for a size, format or quality that is not
+// allowed. Allowing only a few keeps clients from filling the cache with
+// variants of every size.
+var ErrVariantNotAllowed = errors.New("image variant is not allowed")
+
+// VariantConfig configures Variants.
+type VariantConfig struct {
+	// Sizes are the allowed widths and heights, in pixels.
+	Sizes []int
+	// Qualities are the allowed JPEG and WebP qualities. The first one is the
+	// default.
+	Qualities []int
+	// Workers bounds how many images are resized at once; 0 is the number of
+	// CPUs.
+	Workers int
+	// CacheDir keeps up to CacheSize bytes of variants.
+	CacheDir  string
+	CacheSize int64
+}
+
+// VariantOptions describe a variant of an image. A zero Width or Height
+// follows from the other one and the aspect ratio of the image; with both,
+// the image fits in the box. An empty Format is the format of the image, and
+// GIF images become PNG. Quality only applies to JPEG and WebP.
+type VariantOptions struct {
+	Width   int
+	Height  int
+	Format  string
+	Quality int
+}
+
+// Variant is a resized and encoded image.
+type Variant struct {
+	Data        []byte
+	ContentType string
+	ETag        string
+}
+
+// Variants makes resized variants of uploaded images on demand and keeps
+// them in a disk cache.
+type Variants struct {
+	service   *Service
+	sizes     map[int]bool
+	qualities map[int]bool
+	quality   int
+	cache     *diskCache
+	workers   chan struct{}
+	inflight  *group
+}
+
+func NewVariants(service *Service, config VariantConfig) *Variants {
+	v := &Variants{
+		service:   service,
+		sizes:     make(map[int]bool, len(config.Sizes)),
+		qualities: make(map[int]bool, len(config.Qualities)),
+		quality:   jpegQuality,
+		cache:     newDiskCache(config.CacheDir, config.CacheSize),
+		inflight:  newGroup(),
+	}
+	for _, size := range config.Sizes {
+		v.sizes[size] = true
+	}
+	for _, quality := range config.Qualities {
+		v.qualities[quality] = true
+	}
+	if len(config.Qualities) > 0 {
+		v.quality = config.Qualities[0]
+	}
+	if config.Workers <= 0 {
+		config.Workers = runtime.NumCPU()
+	}
+	v.workers = make(chan struct{}, config.Workers)
+	return v
+}
+
+// key checks and completes opts, and returns the cache key of the variant.
+// Stored images never change, so the key is also a strong ETag.
+func (v *Variants) key(name string, opts *VariantOptions) (string, error) {
+	if !Uploaded(name) {
+		return "", ErrNotUploaded
+	}
+	if (opts.Width != 0 && !v.sizes[opts.Width]) || (opts.Height != 0 && !v.sizes[opts.Height]) {
+		return "", fmt.Errorf("%w: size %dx%d", ErrVariantNotAllowed, opts.Width, opts.Height)
+	}
+
+	switch opts.Format {
+	case "":
+		opts.Format = "png"
+		if path.Ext(name) == ".jpg" {
+			opts.Format = "jpeg"
+		}
+	case "jpg":
+		opts.Format = "jpeg"
+	case "jpeg", "png":
+	case "webp":
+		if !WebPSupported {
+			return "", fmt.Errorf("%w: format webp needs a build with cgo", ErrVariantNotAllowed)
+		}
+	default:
+		return "", fmt.Errorf("%w: format %q, want jpeg, png or webp", ErrVariantNotAllowed, opts.Format)
+	}
+
+	if opts.Format == "png" {
+		opts.Quality = 0
+	} else if opts.Quality == 0 {
+		opts.Quality = v.quality
+	} else if !v.qualities[opts.Quality] {
+		return "", fmt.Errorf("%w: quality %d", ErrVariantNotAllowed, opts.Quality)
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s?w=%d&h=%d&format=%s&q=%d", name, opts.Width, opts.Height, opts.Format, opts.Quality)))
+	return hex.EncodeToString(sum[:20]) + "." + opts.Format, nil
+}
+
+// ETag returns the ETag of a variant without making it, to answer
+// conditional requests.
+func (v *Variants) ETag(name string, opts VariantOptions) (string, error) {
+	key, err := v.key(name, &opts)
+	if err != nil {
+		return "", err
+	}
+	return etag(key), nil
+}
+
+func etag(key string) string {
+	return `"` + key + `"`
+}
+
+// Get returns a variant of an uploaded image, from the cache or made now.
+// Concurrent requests for the same variant make it once.
+func (v *Variants) Get(ctx context.Context, name string, opts VariantOptions) (*Variant, error) {
+	key, err := v.key(name, &opts)
+	if err != nil {
+		return nil, err
+	}
+	variant := &Variant{ContentType: "image/" + opts.Format, ETag: etag(key)}
+
+	if data, ok := v.cache.get(key); ok {
+		variant.Data = data
+		return variant, nil
+	}
+	// The variant is made for every request waiting for it, so it is not
+	// canceled when the request that started it ends.
+	variant.Data, err = v.inflight.do(ctx, key, func() ([]byte, error) {
+		data, err := v.make(context.Background(), name, opts)
+		if err != nil {
+			return nil, err
+		}
+		// A variant that cannot be cached is made again next time.
+		v.cache.put(key, data)
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return variant, nil
+}
+
+// make reads, resizes and encodes an image on one of the workers.
+func (v *Variants) make(ctx context.Context, name string, opts VariantOptions) ([]byte, error) {
+	select {
+	case v.workers <- struct{}{}:
+		defer func() { <-v.workers }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	f, err := v.service.assets.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(f, v.service.maxSize+1))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	img, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	size := img.Bounds().Size()
+	scale := 1.0
+	if opts.Width > 0 {
+		scale = float64(opts.Width) / float64(size.X)
+	}
+	if opts.Height > 0 {
+		scale = math.Min(scale, float64(opts.Height)/float64(size.Y))
+	}
+	if scale < 1 {
+		img = resize(img, int(math.Round(float64(size.X)*scale)), int(math.Round(float64(size.Y)*scale)))
+	}
+
+	var buf bytes.Buffer
+	switch opts.Format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: opts.Quality})
+	case "webp":
+		err = encodeWebP(&buf, img, opts.Quality)
+	default:
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// group runs a function once for concurrent calls with the same key.
+type group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newGroup() *group {
+	return &group{calls: make(map[string]*call)}
+}
+
+// do starts fn, unless a run started by an earlier call with the same key is
+// still going, and waits for its result until ctx is done. fn runs to the end
+// even when every caller has stopped waiting.
+func (g *group) do(ctx context.Context, key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	c, ok := g.calls[key]
+	if !ok {
+		c = &call{done: make(chan struct{})}
+		g.calls[key] = c
+		go func() {
+			c.data, c.err = fn()
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.data, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,150 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestVariants(t *testing.T) {
+	ctx := context.Background()
+	service := NewService(NewDirStore(t.TempDir()), "/static/", 1<<20)
+	asset, err := service.Save(ctx, bytes.NewReader(pngImage(t, 600, 300)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := asset.Hash + ".png"
+	cacheDir := t.TempDir()
+	v := NewVariants(service, VariantConfig{Sizes: []int{100, 1000}, Qualities: []int{75, 50}, Workers: 2, CacheDir: cacheDir, CacheSize: 1 << 20})
+
+	variant, err := v.Get(ctx, name, VariantOptions{Width: 100, Format: "jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, variant.ContentType, "image/jpeg")
+	img, err := jpeg.Decode(bytes.NewReader(variant.Data))
+	assert(t, err, nil)
+	assert(t, img.Bounds().Size(), image.Pt(100, 50))
+	etag, _ := v.ETag(name, VariantOptions{Width: 100, Format: "jpeg", Quality: 75})
+	assert(t, variant.ETag, etag)
+	files, _ := os.ReadDir(cacheDir)
+	assert(t, len(files), 1)
+
+	// Images are fitted in the box and never scaled up.
+	variant, err = v.Get(ctx, name, VariantOptions{Width: 1000, Height: 100})
+	assert(t, err, nil)
+	img, _, _ = image.Decode(bytes.NewReader(variant.Data))
+	assert(t, img.Bounds().Size(), image.Pt(200, 100))
+	variant, err = v.Get(ctx, name, VariantOptions{Width: 1000})
+	assert(t, err, nil)
+	img, _, _ = image.Decode(bytes.NewReader(variant.Data))
+	assert(t, img.Bounds().Size(), image.Pt(600, 300))
+
+	// Concurrent requests share the work and the cache.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := v.Get(ctx, name, VariantOptions{Height: 100, Format: "jpeg", Quality: 50}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	files, _ = os.ReadDir(cacheDir)
+	assert(t, len(files), 4)
+
+	for _, opts := range []VariantOptions{{Width: 300}, {Height: 99}, {Format: "gif"}, {Format: "webp", Quality: 99}, {Format: "jpeg", Quality: 99}} {
+		_, err = v.Get(ctx, name, opts)
+		assert(t, errors.Is(err, ErrVariantNotAllowed), true)
+	}
+	_, err = v.Get(ctx, "test.png", VariantOptions{})
+	assert(t, errors.Is(err, ErrNotUploaded), true)
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	c := newDiskCache(dir, 10)
+	assert(t, c.put("a", []byte("aaaa")), nil)
+	assert(t, c.put("b", []byte("bbbb")), nil)
+	_, ok := c.get("a")
+	assert(t, ok, true)
+	// b is the least recently used.
+	assert(t, c.put("c", []byte("cccc")), nil)
+	_, ok = c.get("b")
+	assert(t, ok, false)
+	_, err := os.Stat(filepath.Join(dir, "b"))
+	assert(t, os.IsNotExist(err), true)
+	assert(t, c.put("huge", []byte("hugehugehuge")), nil)
+	_, ok = c.get("huge")
+	assert(t, ok, false)
+
+	// The cache takes the files over when it starts again.
+	c = newDiskCache(dir, 10)
+	data, ok := c.get("c")
+	assert(t, ok, true)
+	assert(t, string(data), "cccc")
+	assert(t, c.size, int64(8))
+}
+
+func TestGroup(t *testing.T) {
+	g := newGroup()
+	release := make(chan struct{})
+	fn := func() ([]byte, error) {
+		<-release
+		return []byte("variant"), nil
+	}
+
+	// The first caller leaving does not cancel the run others wait for.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := g.do(ctx, "k", fn)
+		first <- err
+	}()
+	for {
+		g.mu.Lock()
+		_, started := g.calls["k"]
+		g.mu.Unlock()
+		if started {
+			break
+		}
+		runtime.Gosched()
+	}
+	cancel()
+	assert(t, <-first, context.Canceled)
+
+	// The second caller joins the run before asking for its Done channel.
+	joined := &doneNotifier{Context: context.Background(), called: make(chan struct{})}
+	second := make(chan []byte)
+	go func() {
+		data, _ := g.do(joined, "k", func() ([]byte, error) {
+			t.Error("variant made twice")
+			return nil, nil
+		})
+		second <- data
+	}()
+	<-joined.called
+	close(release)
+	assert(t, string(<-second), "variant")
+}
+
+// doneNotifier is a context that tells when its Done channel is asked for.
+type doneNotifier struct {
+	context.Context
+	once   sync.Once
+	called chan struct{}
+}
+
+func (c *doneNotifier) Done() <-chan struct{} {
+	c.once.Do(func() { close(c.called) })
+	return c.Context.Done()
+}
@@ -0,0 +1,17 @@
+//go:build cgo
+
+package media
+
+import (
+	"github.com/chai2010/webp"
+	"image"
+	"io"
+)
+
+// WebPSupported reports whether variants can be encoded as WebP, which
+// libwebp does through cgo.
+const WebPSupported = true
+
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+}
@@ -0,0 +1,17 @@
+//go:build !cgo
+
+package media
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// WebPSupported reports whether variants can be encoded as WebP, which
+// libwebp does through cgo.
+const WebPSupported = false
+
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	return fmt.Errorf("%w: format webp needs a build with cgo", ErrVariantNotAllowed)
+}
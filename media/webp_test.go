@@ -0,0 +1,28 @@
+//go:build cgo
+
+package media
+
+import (
+	"bytes"
+	"context"
+	"github.com/chai2010/webp"
+	"image"
+	"testing"
+)
+
+func TestWebPVariant(t *testing.T) {
+	ctx := context.Background()
+	service := NewService(NewDirStore(t.TempDir()), "/static/", 1<<20)
+	asset, err := service.Save(ctx, bytes.NewReader(pngImage(t, 600, 300)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewVariants(service, VariantConfig{Sizes: []int{100}, Qualities: []int{80, 50}, Workers: 1})
+
+	variant, err := v.Get(ctx, asset.Hash+".png", VariantOptions{Width: 100, Format: "webp", Quality: 50})
+	assert(t, err, nil)
+	assert(t, variant.ContentType, "image/webp")
+	img, err := webp.Decode(bytes.NewReader(variant.Data))
+	assert(t, err, nil)
+	assert(t, img.Bounds().Size(), image.Pt(100, 50))
+}
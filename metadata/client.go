@@ -0,0 +1,117 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// maxRedirects bounds the redirects followed for one token URI.
+const maxRedirects = 5
+
+// ErrForbiddenAddress is returned for a token URI that resolves to an address
+// that is not publicly routable.
+var ErrForbiddenAddress = errors.New("address is not public")
+
+// reserved are the IPv4 blocks that are not publicly routable and that the
+// net.IP predicates do not cover.
+var reserved = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// NewClient returns an HTTP client for token URIs, which anyone creating a
+// collection can choose. It only connects to public addresses, checked once
+// names are resolved so a name cannot point it at the internal network, and
+// follows up to 5 redirects to http and https URLs. Connections to the hosts
+// of the trusted URLs, such as a local IPFS gateway, are not checked.
+func NewClient(timeout time.Duration, trusted ...string) *http.Client {
+	allowed := make(map[string]bool)
+	for _, raw := range trusted {
+		if u, err := url.Parse(raw); err == nil && u.Host != "" {
+			allowed[hostPort(u)] = true
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	public := &net.Dialer{Timeout: dialer.Timeout, KeepAlive: dialer.KeepAlive, Control: publicOnly}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if allowed[address] {
+				return dialer.DialContext(ctx, network, address)
+			}
+			return public.DialContext(ctx, network, address)
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("%w: redirect to %q", ErrUnsupportedURI, req.URL)
+			}
+			return nil
+		},
+	}
+}
+
+// hostPort returns the host and port an URL connects to.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// publicOnly is a net.Dialer Control function that refuses to connect to
+// addresses that are not public.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !isPublic(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
+
+// isPublic reports whether ip is a publicly routable unicast address.
+// Loopback, private, link-local (such as cloud metadata services at
+// 169.254.169.254), multicast and unspecified addresses are not.
+func isPublic(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range reserved {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
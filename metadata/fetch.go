@@ -0,0 +1,164 @@
+// Package metadata fetches the metadata of tokens from their token URI and
+// normalizes the OpenSea, ERC-721 and ERC-1155 metadata JSON into items.
+package metadata
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnsupportedURI = errors.New("unsupported token uri")
+	ErrTooLarge       = errors.New("metadata is too large")
+)
+
+// Doer sends HTTP requests. *http.Client is a Doer, NewClient the one to use
+// in production; tests can plug in a local stand-in.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Fetcher fetches token metadata over HTTP, from IPFS through a gateway, or
+// from data: URIs. Requests that fail on the network, time out or get a 429
+// or 5xx response are retried with exponential backoff.
+type Fetcher struct {
+	client  Doer
+	gateway string
+	maxSize int64
+	retries int
+	backoff time.Duration
+}
+
+// NewFetcher returns a Fetcher that sends its requests with client, resolves
+// ipfs:// URIs with gateway, such as https://ipfs.io, and rejects metadata
+// larger than maxSize bytes.
+func NewFetcher(client Doer, gateway string, maxSize int64) *Fetcher {
+	return &Fetcher{
+		client:  client,
+		gateway: strings.TrimSuffix(gateway, "/"),
+		maxSize: maxSize,
+		retries: 3,
+		backoff: 500 * time.Millisecond,
+	}
+}
+
+// Fetch fetches and normalizes the metadata of a token. An {id} in uri is
+// replaced with the token id, as ERC-1155 defines.
+func (f *Fetcher) Fetch(ctx context.Context, uri string, tokenID int) (*Metadata, error) {
+	uri = strings.ReplaceAll(strings.TrimSpace(uri), "{id}", fmt.Sprintf("%064x", tokenID))
+
+	data, err := f.read(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func (f *Fetcher) read(ctx context.Context, uri string) ([]byte, error) {
+	scheme, rest, _ := strings.Cut(uri, ":")
+	switch strings.ToLower(scheme) {
+	case "http", "https":
+		return f.get(ctx, uri)
+	case "ipfs":
+		// ipfs://<cid>/<path>, sometimes written ipfs://ipfs/<cid>/<path>.
+		rest = strings.TrimPrefix(strings.TrimPrefix(rest, "//"), "ipfs/")
+		return f.get(ctx, f.gateway+"/ipfs/"+rest)
+	case "data":
+		return f.decodeData(rest)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedURI, uri)
+}
+
+// decodeData decodes the content of a data: URI, [<media type>][;base64],<data>.
+func (f *Fetcher) decodeData(rest string) ([]byte, error) {
+	mediaType, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, fmt.Errorf("%w: data uri without a comma", ErrUnsupportedURI)
+	}
+	if int64(len(payload)) > f.maxSize*4/3+4 {
+		return nil, ErrTooLarge
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if strings.HasSuffix(mediaType, ";base64") {
+		data, err = base64.StdEncoding.DecodeString(payload)
+	} else {
+		var s string
+		s, err = url.PathUnescape(payload)
+		data = []byte(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > f.maxSize {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+func (f *Fetcher) get(ctx context.Context, url string) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt <= f.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(f.backoff << (attempt - 1)):
+			}
+		}
+
+		var (
+			data  []byte
+			retry bool
+		)
+		data, retry, err = f.getOnce(ctx, url)
+		if err == nil || !retry {
+			return data, err
+		}
+	}
+	return nil, err
+}
+
+// getOnce sends one request, and reports whether a failed one is worth
+// sending again.
+func (f *Fetcher) getOnce(ctx context.Context, url string) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil && !errors.Is(err, ErrForbiddenAddress) && !errors.Is(err, ErrUnsupportedURI), err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return nil, true, fmt.Errorf("GET %s: %s", url, res.Status)
+	case res.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("GET %s: %s", url, res.Status)
+	case res.ContentLength > f.maxSize:
+		return nil, false, ErrTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, f.maxSize+1))
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	if int64(len(data)) > f.maxSize {
+		return nil, false, ErrTooLarge
+	}
+	return data, false, nil
+}
@@ -0,0 +1,198 @@
+package metadata
+
+import (
+	"cdex/db"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func newTestFetcher(url string, maxSize int64) *Fetcher {
+	f := NewFetcher(http.DefaultClient, url, maxSize)
+	f.backoff = 0
+	return f
+}
+
+func TestFetch(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/flaky":
+			if calls < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case "/large":
+			w.Write([]byte(`{"name":"` + strings.Repeat("a", 100) + `"}`))
+			return
+		case "/ipfs/Qm/1.json", "/0000000000000000000000000000000000000000000000000000000000000002.json":
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"name":"Ape"}`))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	f := newTestFetcher(srv.URL, 64)
+
+	m, err := f.Fetch(ctx, srv.URL+"/flaky", 1)
+	assert(t, err, nil)
+	assert(t, m.Name, "Ape")
+	assert(t, calls, 3)
+
+	calls = 0
+	_, err = f.Fetch(ctx, srv.URL+"/missing", 1)
+	assert(t, err != nil, true)
+	assert(t, calls, 1)
+
+	_, err = f.Fetch(ctx, srv.URL+"/large", 1)
+	assert(t, errors.Is(err, ErrTooLarge), true)
+
+	m, err = f.Fetch(ctx, "ipfs://ipfs/Qm/1.json", 1)
+	assert(t, err, nil)
+	assert(t, m.Name, "Ape")
+
+	m, err = f.Fetch(ctx, srv.URL+"/{id}.json", 2)
+	assert(t, err, nil)
+	assert(t, m.Name, "Ape")
+
+	m, err = f.Fetch(ctx, "data:application/json;base64,eyJuYW1lIjoiQXBlIn0=", 1)
+	assert(t, err, nil)
+	assert(t, m.Name, "Ape")
+
+	m, err = f.Fetch(ctx, `data:application/json,{"name":"Ape%20Two"}`, 1)
+	assert(t, err, nil)
+	assert(t, m.Name, "Ape Two")
+
+	_, err = f.Fetch(ctx, "ftp://example.com/1.json", 1)
+	assert(t, errors.Is(err, ErrUnsupportedURI), true)
+}
+
+func TestNewClient(t *testing.T) {
+	var calls int
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"name":"Secret"}`))
+	}))
+	defer internal.Close()
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal":
+			http.Redirect(w, r, internal.URL, http.StatusFound)
+		case "/file":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		default:
+			w.Write([]byte(`{"name":"Ape"}`))
+		}
+	}))
+	defer gateway.Close()
+
+	ctx := context.Background()
+	f := NewFetcher(NewClient(time.Second, gateway.URL), gateway.URL, 1<<10)
+	f.backoff = 0
+
+	m, err := f.Fetch(ctx, "ipfs://Qm/1.json", 1)
+	assert(t, err, nil)
+	assert(t, m.Name, "Ape")
+	_, err = f.Fetch(ctx, internal.URL, 1)
+	assert(t, errors.Is(err, ErrForbiddenAddress), true)
+	_, err = f.Fetch(ctx, gateway.URL+"/internal", 1)
+	assert(t, errors.Is(err, ErrForbiddenAddress), true)
+	_, err = f.Fetch(ctx, gateway.URL+"/file", 1)
+	assert(t, errors.Is(err, ErrUnsupportedURI), true)
+	assert(t, calls, 0)
+
+	for addr, public := range map[string]bool{
+		"8.8.8.8":          true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+		"::ffff:127.0.0.1": false,
+		"224.0.0.1":        false,
+	} {
+		if got := isPublic(netip.MustParseAddr(addr)); got != public {
+			t.Errorf("isPublic(%s) = %v", addr, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	m, err := Parse([]byte(`{
+		"name": " Ape #1 ",
+		"description": "` + strings.Repeat("é", 200) + `",
+		"image_url": "ipfs://Qm/1.png",
+		"attributes": [
+			{"trait_type": "Eyes", "value": " blue "},
+			{"trait_type": "Eyes", "value": "red"},
+			{"trait_type": "", "value": "none"},
+			{"trait_type": "Level", "value": "3", "display_type": "number", "max_value": 10},
+			{"trait_type": "Rare", "value": true},
+			{"trait_type": "Mood", "value": "calm", "display_type": "boost_number"},
+			{"trait_type": "Empty", "value": ""},
+			"bare"
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ten := 10.0
+	assert(t, m.Name, "Ape #1")
+	assert(t, len([]rune(m.Description)), db.MaxItemDescriptionLength)
+	assert(t, m.Image, "ipfs://Qm/1.png")
+	assert(t, m.Attributes, db.Attributes{
+		{TraitType: "Eyes", Value: "blue"},
+		{TraitType: "Level", Value: 3.0, DisplayType: db.DisplayNumber, MaxValue: &ten},
+		{TraitType: "Rare", Value: "true"},
+		{TraitType: "Mood", Value: "calm"},
+	})
+	assert(t, m.Attributes.Validate(), nil)
+
+	// ERC-1155 properties, as values or as objects.
+	m, err = Parse([]byte(`{"name": 7, "image": "data:image/png;base64,` + strings.Repeat("A", 200) + `",
+		"properties": {"size": {"value": 2}, "color": "red", "extra": [1]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, m.Name, "7")
+	assert(t, m.Image, "")
+	assert(t, m.Attributes, db.Attributes{
+		{TraitType: "color", Value: "red"},
+		{TraitType: "size", Value: 2.0},
+	})
+
+	_, err = Parse([]byte(`[]`))
+	assert(t, err != nil, true)
+}
+
+func TestApply(t *testing.T) {
+	item := &db.Item{Name: "Old", Image: "old.png"}
+	(&Metadata{Description: "new"}).Apply(item)
+	assert(t, item.Name, "Old")
+	assert(t, item.Image, "")
+	assert(t, item.Description, "new")
+}
@@ -0,0 +1,236 @@
+package metadata
+
+import (
+	"bytes"
+	"cdex/db"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Metadata is the normalized metadata of a token: every field fits its item
+// column and Attributes passes db.Attributes.Validate.
+type Metadata struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Image       string        `json:"image"`
+	Attributes  db.Attributes `json:"attributes"`
+}
+
+// Apply sets the fields of item to m. An item keeps its name when the
+// metadata has none.
+func (m *Metadata) Apply(item *db.Item) {
+	if m.Name != "" {
+		item.Name = m.Name
+	}
+	item.Description = m.Description
+	item.Image = m.Image
+	item.Properties = m.Attributes
+}
+
+// document is the metadata JSON as marketplaces write it. Fields are decoded
+// loosely: names may be numbers, and attributes may be a list of OpenSea
+// traits or an object of trait types to values.
+type document struct {
+	Name        text            `json:"name"`
+	Description text            `json:"description"`
+	Image       text            `json:"image"`
+	ImageURL    text            `json:"image_url"`
+	Attributes  json.RawMessage `json:"attributes"`
+	Traits      json.RawMessage `json:"traits"`
+	Properties  json.RawMessage `json:"properties"`
+}
+
+// text is a JSON string, or a number taken as its decimal form.
+type text string
+
+func (t *text) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		*t = text(v)
+	case float64:
+		*t = text(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return nil
+}
+
+// trait is an attribute before normalization.
+type trait struct {
+	TraitType   text        `json:"trait_type"`
+	Value       interface{} `json:"value"`
+	DisplayType string      `json:"display_type"`
+	MaxValue    *float64    `json:"max_value"`
+}
+
+// Parse decodes and normalizes metadata JSON. It accepts the OpenSea format,
+// the ERC-721 and ERC-1155 metadata JSON schemas and their common variants:
+// image_url for image, traits for attributes, attributes as an object, and
+// ERC-1155 properties as attributes when there are none. Values that do not
+// fit are truncated or dropped rather than failing the whole token.
+func Parse(data []byte) (*Metadata, error) {
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	m := &Metadata{
+		Name:        truncate(strings.TrimSpace(string(doc.Name)), db.MaxItemNameLength),
+		Description: truncate(strings.TrimSpace(string(doc.Description)), db.MaxItemDescriptionLength),
+	}
+
+	image := strings.TrimSpace(string(doc.Image))
+	if image == "" {
+		image = strings.TrimSpace(string(doc.ImageURL))
+	}
+	// A cut URL is worse than none, and inline data: images rarely fit.
+	if utf8.RuneCountInString(image) <= db.MaxItemImageLength {
+		m.Image = image
+	}
+
+	var traits []trait
+	for _, raw := range []json.RawMessage{doc.Attributes, doc.Traits, doc.Properties} {
+		var err error
+		if traits, err = decodeTraits(raw); err != nil {
+			return nil, err
+		}
+		if len(traits) > 0 {
+			break
+		}
+	}
+	m.Attributes = normalize(traits)
+
+	return m, nil
+}
+
+// decodeTraits decodes a list of traits, or an object of trait types to
+// values or to {"value": ...} objects as ERC-1155 properties are written.
+// Other shapes hold no traits.
+func decodeTraits(raw json.RawMessage) ([]trait, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	switch raw[0] {
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, fmt.Errorf("invalid attributes: %w", err)
+		}
+		traits := make([]trait, 0, len(items))
+		for _, item := range items {
+			var t trait
+			// Bare values and malformed entries are not traits.
+			if json.Unmarshal(item, &t) == nil {
+				traits = append(traits, t)
+			}
+		}
+		return traits, nil
+	case '{':
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, fmt.Errorf("invalid attributes: %w", err)
+		}
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		traits := make([]trait, 0, len(keys))
+		for _, key := range keys {
+			t := trait{TraitType: text(key)}
+			var nested struct {
+				Value       interface{} `json:"value"`
+				DisplayType string      `json:"display_type"`
+			}
+			if bytes.HasPrefix(bytes.TrimSpace(fields[key]), []byte("{")) {
+				if json.Unmarshal(fields[key], &nested) != nil {
+					continue
+				}
+				t.Value, t.DisplayType = nested.Value, nested.DisplayType
+			} else if json.Unmarshal(fields[key], &t.Value) != nil {
+				continue
+			}
+			traits = append(traits, t)
+		}
+		return traits, nil
+	}
+	return nil, nil
+}
+
+// normalize turns traits into attributes that pass db.Attributes.Validate.
+// Traits without a type or a usable value are dropped, and only the first
+// trait of each type is kept.
+func normalize(traits []trait) db.Attributes {
+	var attrs db.Attributes
+	seen := make(map[string]bool)
+	for _, t := range traits {
+		if len(attrs) == db.MaxAttributes {
+			break
+		}
+		traitType := truncateBytes(strings.TrimSpace(string(t.TraitType)), db.MaxTraitTypeLength)
+		if traitType == "" || seen[traitType] {
+			continue
+		}
+
+		attr := db.Attribute{TraitType: traitType, MaxValue: t.MaxValue}
+		switch t.DisplayType {
+		case db.DisplayNumber, db.DisplayBoostNumber, db.DisplayBoostPercentage, db.DisplayDate:
+			attr.DisplayType = t.DisplayType
+		}
+
+		switch v := t.Value.(type) {
+		case float64:
+			attr.Value = v
+		case bool:
+			attr.Value = strconv.FormatBool(v)
+		case string:
+			v = strings.TrimSpace(v)
+			if f, err := strconv.ParseFloat(v, 64); err == nil && attr.DisplayType != "" {
+				attr.Value = f
+			} else if v != "" {
+				attr.Value = truncateBytes(v, db.MaxTraitValueLength)
+			}
+		}
+		if attr.Value == nil {
+			continue
+		}
+		if _, ok := attr.Value.(string); ok {
+			attr.DisplayType, attr.MaxValue = "", nil
+		}
+
+		seen[traitType] = true
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+// truncate cuts s to at most n characters.
+func truncate(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return strings.TrimSpace(s[:i])
+		}
+		n--
+	}
+	return s
+}
+
+// truncateBytes cuts s to at most n bytes without splitting a character.
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return strings.TrimSpace(s[:n])
+}
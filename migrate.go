@@ -0,0 +1,88 @@
+package main
+
+import (
+	"cdex/db"
+	"context"
+	"errors"
+	"fmt"
+)
+
+const migrateUsage = "usage: cdex migrate up|down|status|baseline [version]"
+
+// runMigrate runs the migrate command:
+//
+//	up        apply every pending migration
+//	down      roll back the last group of applied migrations
+//	status    list the migrations and whether they are applied
+//	baseline  mark the migrations up to version (the first one by default)
+//	          applied, for a database whose tables were created by hand
+func runMigrate(ctx context.Context, nartDB *db.NartDB, args []string) error {
+	if len(args) == 0 || len(args) > 2 || len(args) == 2 && args[0] != "baseline" {
+		return errors.New(migrateUsage)
+	}
+
+	m := nartDB.Migrator()
+	switch args[0] {
+	case "up":
+		if err := m.Init(ctx); err != nil {
+			return err
+		}
+		if err := m.Lock(ctx); err != nil {
+			return err
+		}
+		defer m.Unlock(ctx)
+
+		group, err := m.Migrate(ctx)
+		if err != nil {
+			return err
+		}
+		if group.IsZero() {
+			fmt.Println("the schema is up to date")
+			return nil
+		}
+		fmt.Printf("migrated to %s\n", group)
+	case "down":
+		if err := m.Init(ctx); err != nil {
+			return err
+		}
+		if err := m.Lock(ctx); err != nil {
+			return err
+		}
+		defer m.Unlock(ctx)
+
+		group, err := m.Rollback(ctx)
+		if err != nil {
+			return err
+		}
+		if group.IsZero() {
+			fmt.Println("there are no migrations to roll back")
+			return nil
+		}
+		fmt.Printf("rolled back %s\n", group)
+	case "status":
+		if err := m.Init(ctx); err != nil {
+			return err
+		}
+		ms, err := m.MigrationsWithStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range ms {
+			status := "pending"
+			if migration.IsApplied() {
+				status = fmt.Sprintf("applied in group %d", migration.GroupID)
+			}
+			fmt.Printf("%s_%s\t%s\n", migration.Name, migration.Comment, status)
+		}
+	case "baseline":
+		var version string
+		if len(args) == 2 {
+			version = args[1]
+		}
+		return nartDB.Baseline(ctx, version)
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	return nil
+}
@@ -0,0 +1,251 @@
+// Package registry defines the chains, currencies and markets the exchange
+// supports. Collections and items name their chain by the ID of a registered
+// chain, and collections and orders their currency by the symbol of a
+// registered currency.
+package registry
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnknownChain    = errors.New("unknown chain")
+	ErrUnknownCurrency = errors.New("unknown currency")
+)
+
+// maxDecimals bounds the decimals of a currency; ERC-20 tokens use up to 18.
+const maxDecimals = 36
+
+// Chain is a supported EVM chain.
+type Chain struct {
+	// ID is the code of the chain in the chain columns of the database.
+	ID int8 `json:"id"`
+	// ChainID is the EIP-155 id of the chain, 1 for Ethereum.
+	ChainID int64  `json:"chain_id"`
+	Name    string `json:"name"`
+	// RPC is the JSON-RPC endpoint the indexer reads the chain from. Chains
+	// without one are not indexed.
+	RPC string `json:"rpc"`
+	// Explorer is the URL of a block explorer of the chain.
+	Explorer string `json:"explorer"`
+	// Confirmations is how many blocks must follow a block before its
+	// transfers are indexed.
+	Confirmations int64 `json:"confirmations"`
+	// StartBlock is the first block indexed, the block the first registered
+	// contract was deployed in.
+	StartBlock int64 `json:"start_block"`
+}
+
+// Currency is a quote currency of a chain: its native coin, without an
+// address, or an ERC-20 token.
+type Currency struct {
+	Symbol   string `json:"symbol"`
+	Chain    int8   `json:"chain"`
+	Address  string `json:"address,omitempty"`
+	Decimals int    `json:"decimals"`
+}
+
+// Market is a market of the exchange and the symbols of the currencies it
+// quotes. Orders of a market in other currencies are rejected, and orders
+// only match orders in the same currency.
+type Market struct {
+	Name       string   `json:"name"`
+	Currencies []string `json:"currencies"`
+}
+
+// Registry holds the supported chains, currencies and markets. It is not
+// modified once loaded.
+type Registry struct {
+	chains     []*Chain
+	currencies []*Currency
+	markets    []*Market
+}
+
+//go:embed chains.json
+var defaultRegistry []byte
+
+// Default returns the registry built into the binary.
+func Default() *Registry {
+	r, err := Parse(defaultRegistry)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Load reads a registry from a JSON file in the format of chains.json. An
+// empty path loads the default registry.
+func Load(path string) (*Registry, error) {
+	if path == "" {
+		return Default(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// Parse reads a registry from JSON.
+func Parse(data []byte) (*Registry, error) {
+	var file struct {
+		Chains     []*Chain    `json:"chains"`
+		Currencies []*Currency `json:"currencies"`
+		Markets    []*Market   `json:"markets"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return New(file.Chains, file.Currencies, file.Markets)
+}
+
+// New checks chains, currencies and markets and returns their registry. Chain
+// ids and EIP-155 ids are unique, and so are the symbols of the currencies of
+// a chain. Markets quote registered symbols. Symbols are lowercase.
+func New(chains []*Chain, currencies []*Currency, markets []*Market) (*Registry, error) {
+	r := &Registry{}
+	ids := make(map[int8]bool)
+	chainIDs := make(map[int64]bool)
+	for _, c := range chains {
+		switch {
+		case ids[c.ID]:
+			return nil, fmt.Errorf("chain %d is defined twice", c.ID)
+		case chainIDs[c.ChainID]:
+			return nil, fmt.Errorf("chain_id %d is defined twice", c.ChainID)
+		case c.Name == "":
+			return nil, fmt.Errorf("chain %d has no name", c.ID)
+		case c.Confirmations < 0 || c.StartBlock < 0:
+			return nil, fmt.Errorf("chain %d: confirmations and start_block must not be negative", c.ID)
+		}
+		ids[c.ID], chainIDs[c.ChainID] = true, true
+		clone := *c
+		r.chains = append(r.chains, &clone)
+	}
+	sort.Slice(r.chains, func(i, j int) bool { return r.chains[i].ID < r.chains[j].ID })
+
+	for _, c := range currencies {
+		clone := *c
+		clone.Symbol = strings.ToLower(strings.TrimSpace(c.Symbol))
+		clone.Address = strings.ToLower(c.Address)
+		switch {
+		case clone.Symbol == "":
+			return nil, fmt.Errorf("currency of chain %d has no symbol", c.Chain)
+		case !ids[c.Chain]:
+			return nil, fmt.Errorf("currency %s: %w %d", clone.Symbol, ErrUnknownChain, c.Chain)
+		case c.Decimals < 0 || c.Decimals > maxDecimals:
+			return nil, fmt.Errorf("currency %s: decimals must be between 0 and %d", clone.Symbol, maxDecimals)
+		}
+		if _, ok := r.Currency(c.Chain, clone.Symbol); ok {
+			return nil, fmt.Errorf("currency %s of chain %d is defined twice", clone.Symbol, c.Chain)
+		}
+		r.currencies = append(r.currencies, &clone)
+	}
+
+	names := make(map[string]bool)
+	for _, m := range markets {
+		clone := Market{Name: strings.TrimSpace(m.Name)}
+		switch {
+		case clone.Name == "":
+			return nil, errors.New("market has no name")
+		case names[clone.Name]:
+			return nil, fmt.Errorf("market %s is defined twice", clone.Name)
+		case len(m.Currencies) == 0:
+			return nil, fmt.Errorf("market %s has no currencies", clone.Name)
+		}
+		names[clone.Name] = true
+		for _, c := range m.Currencies {
+			symbol, err := r.CheckSymbol(strings.TrimSpace(c))
+			if err != nil {
+				return nil, fmt.Errorf("market %s: %w", clone.Name, err)
+			}
+			clone.Currencies = append(clone.Currencies, symbol)
+		}
+		r.markets = append(r.markets, &clone)
+	}
+	return r, nil
+}
+
+// Chains returns the chains by id. The result is shared and must not be
+// modified.
+func (r *Registry) Chains() []*Chain {
+	return r.chains
+}
+
+// Markets returns the markets. The result is shared and must not be
+// modified.
+func (r *Registry) Markets() []*Market {
+	return r.markets
+}
+
+func (r *Registry) Chain(id int8) (*Chain, bool) {
+	for _, c := range r.chains {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Currencies returns the currencies of a chain.
+func (r *Registry) Currencies(chain int8) []*Currency {
+	var currencies []*Currency
+	for _, c := range r.currencies {
+		if c.Chain == chain {
+			currencies = append(currencies, c)
+		}
+	}
+	return currencies
+}
+
+// Currency returns the currency of a chain with a symbol, in any case.
+func (r *Registry) Currency(chain int8, symbol string) (*Currency, bool) {
+	for _, c := range r.currencies {
+		if c.Chain == chain && strings.EqualFold(c.Symbol, symbol) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// CheckChain returns ErrUnknownChain, wrapped with the id, for a chain that
+// is not registered.
+func (r *Registry) CheckChain(id int8) error {
+	if _, ok := r.Chain(id); !ok {
+		return fmt.Errorf("%w %d", ErrUnknownChain, id)
+	}
+	return nil
+}
+
+// CheckCurrency returns the registered symbol of a currency of a chain, or
+// ErrUnknownCurrency.
+func (r *Registry) CheckCurrency(chain int8, symbol string) (string, error) {
+	if err := r.CheckChain(chain); err != nil {
+		return "", err
+	}
+	c, ok := r.Currency(chain, symbol)
+	if !ok {
+		return "", fmt.Errorf("%w %q on chain %d", ErrUnknownCurrency, symbol, chain)
+	}
+	return c.Symbol, nil
+}
+
+// CheckSymbol returns the registered symbol of a currency of any chain, or
+// ErrUnknownCurrency. Markets name their currencies without a chain.
+func (r *Registry) CheckSymbol(symbol string) (string, error) {
+	for _, c := range r.currencies {
+		if strings.EqualFold(c.Symbol, symbol) {
+			return c.Symbol, nil
+		}
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownCurrency, symbol)
+}
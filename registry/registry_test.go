@@ -0,0 +1,88 @@
+package registry
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	r := Default()
+	assert(t, len(r.Chains()) > 0, true)
+	for _, c := range r.Chains() {
+		assert(t, len(r.Currencies(c.ID)) > 0, true)
+	}
+
+	symbol, err := r.CheckCurrency(1, "ETH")
+	assert(t, err, nil)
+	assert(t, symbol, "eth")
+	_, err = r.CheckCurrency(0, "eth")
+	assert(t, errors.Is(err, ErrUnknownCurrency), true)
+	_, err = r.CheckCurrency(100, "eth")
+	assert(t, errors.Is(err, ErrUnknownChain), true)
+	symbol, err = r.CheckSymbol("USDC")
+	assert(t, err, nil)
+	assert(t, symbol, "usdc")
+
+	assert(t, len(r.Markets()) > 0, true)
+	for _, m := range r.Markets() {
+		for _, c := range m.Currencies {
+			_, err = r.CheckSymbol(c)
+			assert(t, err, nil)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	eth := &Chain{ID: 1, ChainID: 1, Name: "Ethereum"}
+	for _, tc := range []struct {
+		name       string
+		chains     []*Chain
+		currencies []*Currency
+		markets    []*Market
+	}{
+		{"duplicate id", []*Chain{eth, {ID: 1, ChainID: 5, Name: "Goerli"}}, nil, nil},
+		{"duplicate chain_id", []*Chain{eth, {ID: 2, ChainID: 1, Name: "Mainnet"}}, nil, nil},
+		{"no name", []*Chain{{ID: 1, ChainID: 1}}, nil, nil},
+		{"unknown chain", []*Chain{eth}, []*Currency{{Symbol: "eth", Chain: 2}}, nil},
+		{"duplicate symbol", []*Chain{eth}, []*Currency{{Symbol: "eth", Chain: 1}, {Symbol: "ETH", Chain: 1}}, nil},
+		{"decimals", []*Chain{eth}, []*Currency{{Symbol: "eth", Chain: 1, Decimals: 100}}, nil},
+		{"market currency", []*Chain{eth}, []*Currency{{Symbol: "eth", Chain: 1}}, []*Market{{Name: "fra", Currencies: []string{"doge"}}}},
+		{"market no currency", []*Chain{eth}, []*Currency{{Symbol: "eth", Chain: 1}}, []*Market{{Name: "fra"}}},
+		{"duplicate market", []*Chain{eth}, []*Currency{{Symbol: "eth", Chain: 1}},
+			[]*Market{{Name: "fra", Currencies: []string{"eth"}}, {Name: "fra", Currencies: []string{"eth"}}}},
+	} {
+		if _, err := New(tc.chains, tc.currencies, tc.markets); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chains.json")
+	data := `{"chains":[{"id":5,"chain_id":31337,"name":"Anvil","rpc":"http://localhost:8545","confirmations":1}],
+		"currencies":[{"symbol":"ETH","chain":5,"decimals":18}],
+		"markets":[{"name":"fra","currencies":["ETH"]}]}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, r.Chains(), []*Chain{{ID: 5, ChainID: 31337, Name: "Anvil", RPC: "http://localhost:8545", Confirmations: 1}})
+	assert(t, r.Currencies(5), []*Currency{{Symbol: "eth", Chain: 5, Decimals: 18}})
+	assert(t, r.Markets(), []*Market{{Name: "fra", Currencies: []string{"eth"}}})
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.json"))
+	assert(t, err != nil, true)
+}
@@ -0,0 +1,326 @@
+// Package stats keeps market statistics per collection. They are loaded from
+// storage at startup and then updated from the events of the matching engine,
+// so reading them never touches the database.
+package stats
+
+import (
+	"cdex/db"
+	"cdex/exchange"
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	day   = 24 * time.Hour
+	week  = 7 * day
+	month = 30 * day
+
+	// cacheTTL bounds how long a computed Stats is served, so that volume
+	// windows move even when a collection is not traded.
+	cacheTTL = time.Minute
+)
+
+// Volume is the traded value of a collection in one currency over rolling
+// windows and all time.
+type Volume struct {
+	Day   float64 `json:"24h"`
+	Week  float64 `json:"7d"`
+	Month float64 `json:"30d"`
+	All   float64 `json:"all"`
+}
+
+// Stats are the market statistics of a collection. Floor is the lowest open
+// ask per currency, and Listed the number of items with an open ask.
+type Stats struct {
+	Collection    int                `json:"collection"`
+	Floor         map[string]float64 `json:"floor"`
+	Volume        map[string]*Volume `json:"volume"`
+	Sales         int                `json:"sales"`
+	Owners        int                `json:"owners"`
+	Items         int                `json:"items"`
+	Listed        int                `json:"listed"`
+	ListedPercent float64            `json:"listed_percent"`
+}
+
+type ask struct {
+	tokenID  int
+	currency string
+	price    float64
+}
+
+type trade struct {
+	at       time.Time
+	currency string
+	value    float64
+}
+
+type total struct {
+	sales  int
+	volume float64
+}
+
+type collection struct {
+	asks   map[string]ask // order id => ask
+	listed map[int]int    // token id => open asks
+	owners map[string]int // owner => items
+	items  int
+	trades []trade // of the last month, oldest first
+	totals map[string]*total
+
+	cached   *Stats
+	cachedAt time.Time
+}
+
+// Tracker keeps the statistics of every collection.
+type Tracker struct {
+	mu          sync.Mutex
+	collections map[int]*collection
+	now         func() time.Time
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		collections: make(map[int]*collection),
+		now:         time.Now,
+	}
+}
+
+// get returns the state of a collection, creating it on first use. Callers
+// hold t.mu.
+func (t *Tracker) get(id int) *collection {
+	c, ok := t.collections[id]
+	if !ok {
+		c = &collection{
+			asks:   make(map[string]ask),
+			listed: make(map[int]int),
+			owners: make(map[string]int),
+			totals: make(map[string]*total),
+		}
+		t.collections[id] = c
+	}
+	c.cached = nil
+	return c
+}
+
+// Load reads the state of every collection from storage. It is called once,
+// after the order books have been restored and before the server starts.
+func (t *Tracker) Load(ctx context.Context, store db.Storage) error {
+	owners, err := store.GetItemOwners(ctx)
+	if err != nil {
+		return err
+	}
+	totals, err := store.GetTradeTotals(ctx)
+	if err != nil {
+		return err
+	}
+	trades, err := store.GetTrades(ctx, t.now().Add(-month))
+	if err != nil {
+		return err
+	}
+	orders, err := store.GetOpenOrders(ctx)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, o := range owners {
+		c := t.get(o.Collection)
+		c.owners[o.Owner] += o.Items
+		c.items += o.Items
+	}
+	for _, tt := range totals {
+		t.get(tt.Collection).totals[tt.Currency] = &total{sales: tt.Sales, volume: tt.Volume}
+	}
+	for _, tr := range trades {
+		c := t.get(tr.Collection)
+		c.trades = append(c.trades, trade{at: tr.CreatedAt, currency: tr.Currency, value: tr.Price * float64(tr.Size)})
+	}
+	for _, o := range orders {
+		if !o.Bid {
+			t.get(o.Collection).addAsk(o)
+		}
+	}
+
+	return nil
+}
+
+// ItemAdded counts a new item held by owner.
+func (t *Tracker) ItemAdded(collection int, owner string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.get(collection)
+	c.items++
+	c.owners[owner]++
+}
+
+// ItemRemoved forgets a deleted item held by owner.
+func (t *Tracker) ItemRemoved(collection int, owner string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.get(collection)
+	if c.items > 0 {
+		c.items--
+	}
+	if c.owners[owner]--; c.owners[owner] <= 0 {
+		delete(c.owners, owner)
+	}
+}
+
+// ItemTransferred moves an item from one owner to another, for transfers
+// made outside the exchange.
+func (t *Tracker) ItemTransferred(collection int, from, to string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.get(collection)
+	if c.owners[from]--; c.owners[from] <= 0 {
+		delete(c.owners, from)
+	}
+	c.owners[to]++
+}
+
+// CollectionRemoved forgets a deleted collection.
+func (t *Tracker) CollectionRemoved(collection int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.collections, collection)
+}
+
+// OnEvent is registered as an exchange listener.
+func (t *Tracker) OnEvent(ev exchange.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch ev.Type {
+	case exchange.EventOrderAdded:
+		if !ev.Order.Bid {
+			t.get(ev.Order.Collection).addAsk(ev.Order)
+		}
+	case exchange.EventOrderCanceled, exchange.EventOrderExpired:
+		if !ev.Order.Bid {
+			t.get(ev.Order.Collection).removeAsk(ev.Order.ID)
+		}
+	case exchange.EventMatch:
+		m := ev.Match
+		c := t.get(m.Collection)
+		if m.Ask.IsFilled() {
+			c.removeAsk(m.Ask.ID)
+		}
+		c.trade(m, time.Unix(0, m.Timestamp))
+	}
+}
+
+func (c *collection) addAsk(o *exchange.Order) {
+	c.asks[o.ID] = ask{tokenID: o.TokenID, currency: o.Currency, price: o.Price}
+	c.listed[o.TokenID]++
+}
+
+func (c *collection) removeAsk(id string) {
+	a, ok := c.asks[id]
+	if !ok {
+		return
+	}
+	delete(c.asks, id)
+	if c.listed[a.tokenID]--; c.listed[a.tokenID] <= 0 {
+		delete(c.listed, a.tokenID)
+	}
+}
+
+func (c *collection) trade(m *exchange.Match, at time.Time) {
+	currency := m.Currency
+	value := m.Price * float64(m.SizeFilled)
+	c.trades = append(c.trades, trade{at: at, currency: currency, value: value})
+
+	tt, ok := c.totals[currency]
+	if !ok {
+		tt = &total{}
+		c.totals[currency] = tt
+	}
+	tt.sales++
+	tt.volume += value
+
+	// The seller may not be known as an owner when the item was transferred
+	// outside the exchange.
+	if n := c.owners[m.Ask.Owner]; n > m.SizeFilled {
+		c.owners[m.Ask.Owner] = n - m.SizeFilled
+	} else {
+		delete(c.owners, m.Ask.Owner)
+	}
+	c.owners[m.Bid.Owner] += m.SizeFilled
+}
+
+// Stats returns the statistics of a collection. A collection the tracker has
+// never seen has empty statistics. The result is shared and must not be
+// modified.
+func (t *Tracker) Stats(id int) *Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	c, ok := t.collections[id]
+	if !ok {
+		return &Stats{Collection: id, Floor: map[string]float64{}, Volume: map[string]*Volume{}}
+	}
+	if c.cached == nil || now.Sub(c.cachedAt) >= cacheTTL {
+		c.cached = c.compute(id, now)
+		c.cachedAt = now
+	}
+
+	return c.cached
+}
+
+func (c *collection) compute(id int, now time.Time) *Stats {
+	s := &Stats{
+		Collection: id,
+		Floor:      make(map[string]float64),
+		Volume:     make(map[string]*Volume),
+		Owners:     len(c.owners),
+		Items:      c.items,
+		Listed:     len(c.listed),
+	}
+	if s.Items > 0 {
+		s.ListedPercent = 100 * float64(s.Listed) / float64(s.Items)
+	}
+
+	for _, a := range c.asks {
+		if floor, ok := s.Floor[a.currency]; !ok || a.price < floor {
+			s.Floor[a.currency] = a.price
+		}
+	}
+
+	for currency, tt := range c.totals {
+		s.Sales += tt.sales
+		s.Volume[currency] = &Volume{All: tt.volume}
+	}
+
+	// Forget the trades that left the longest window.
+	i := 0
+	for i < len(c.trades) && now.Sub(c.trades[i].at) >= month {
+		i++
+	}
+	c.trades = c.trades[i:]
+
+	for _, tr := range c.trades {
+		v, ok := s.Volume[tr.currency]
+		if !ok {
+			v = &Volume{}
+			s.Volume[tr.currency] = v
+		}
+		age := now.Sub(tr.at)
+		v.Month += tr.value
+		if age < week {
+			v.Week += tr.value
+		}
+		if age < day {
+			v.Day += tr.value
+		}
+	}
+
+	return s
+}
@@ -0,0 +1,58 @@
+package stats
+
+import (
+	"cdex/exchange"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	ex := exchange.NewExchange()
+	tr := NewTracker()
+	ex.Subscribe(tr.OnEvent)
+	tr.ItemAdded(1, "alice")
+	tr.ItemAdded(1, "alice")
+	tr.ItemAdded(1, "carol")
+	tr.ItemAdded(1, "carol")
+
+	place := func(o *exchange.Order) {
+		t.Helper()
+		if _, err := ex.PlaceLimitOrder(exchange.MarketFRA, o.Price, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	place(exchange.NewOrder("alice", "eth", false, 1, 1, 1, 10))
+	place(exchange.NewOrder("alice", "eth", false, 1, 2, 1, 12))
+	place(exchange.NewOrder("alice", "usdt", false, 1, 2, 1, 9000))
+
+	s := tr.Stats(1)
+	if s.Floor["eth"] != 10 || s.Floor["usdt"] != 9000 || s.Listed != 2 || s.ListedPercent != 50 {
+		t.Fatalf("stats before the sale = %+v", s)
+	}
+
+	place(exchange.NewOrder("bob", "eth", true, 1, 1, 1, 10))
+	s = tr.Stats(1)
+	if s.Floor["eth"] != 12 || s.Listed != 1 || s.Sales != 1 || s.Owners != 3 || s.Items != 4 {
+		t.Fatalf("stats after the sale = %+v", s)
+	}
+	if v := *s.Volume["eth"]; v != (Volume{Day: 10, Week: 10, Month: 10, All: 10}) {
+		t.Fatalf("volume = %+v", v)
+	}
+
+	// The sale leaves the 24h window but stays in the others.
+	tr.now = func() time.Time { return time.Now().Add(2 * day) }
+	if v := *tr.Stats(1).Volume["eth"]; v != (Volume{Week: 10, Month: 10, All: 10}) {
+		t.Fatalf("volume two days later = %+v", v)
+	}
+
+	// carol sends both her items to bob, who already owns one.
+	tr.ItemTransferred(1, "carol", "bob")
+	tr.ItemTransferred(1, "carol", "bob")
+	if s := tr.Stats(1); s.Owners != 2 || s.Items != 4 {
+		t.Fatalf("stats after the transfers = %+v", s)
+	}
+
+	if s := tr.Stats(2); s.Items != 0 || len(s.Floor) != 0 {
+		t.Fatalf("unknown collection = %+v", s)
+	}
+}
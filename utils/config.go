@@ -1,25 +1,222 @@
 package utils
 
-import "github.com/spf13/viper"
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
 
 type Config struct {
-	DBDriver      string `mapstructure:"DB_DRIVER"`
-	DBSource      string `mapstructure:"DB_SOURCE"`
-	ServerAddress string `mapstructure:"SERVER_ADDRESS"`
+	DBDriver      string        `mapstructure:"DB_DRIVER"`
+	DBSource      string        `mapstructure:"DB_SOURCE"`
+	ServerAddress string        `mapstructure:"SERVER_ADDRESS"`
+	APIKeySecret  string        `mapstructure:"API_KEY_SECRET"`
+	CancelGrace   time.Duration `mapstructure:"CANCEL_ON_DISCONNECT_GRACE"`
+
+	// The server is served over TLS when both are set.
+	TLSCertFile string `mapstructure:"TLS_CERT_FILE"`
+	TLSKeyFile  string `mapstructure:"TLS_KEY_FILE"`
+	// CORSOrigins are the origins browsers may call the API from; "*" allows
+	// every origin.
+	CORSOrigins      []string      `mapstructure:"CORS_ORIGINS"`
+	HTTPReadTimeout  time.Duration `mapstructure:"HTTP_READ_TIMEOUT"`
+	HTTPWriteTimeout time.Duration `mapstructure:"HTTP_WRITE_TIMEOUT"`
+	HTTPIdleTimeout  time.Duration `mapstructure:"HTTP_IDLE_TIMEOUT"`
+	// ShutdownTimeout bounds the draining of requests on SIGTERM.
+	ShutdownTimeout time.Duration `mapstructure:"SHUTDOWN_TIMEOUT"`
+	// MaxBodySize bounds request bodies, but for uploads and imports, which
+	// have limits of their own. It must be positive.
+	MaxBodySize int64 `mapstructure:"MAX_BODY_SIZE"`
+
+	DBTimeout         time.Duration `mapstructure:"DB_TIMEOUT"`
+	DBMaxOpenConns    int           `mapstructure:"DB_MAX_OPEN_CONNS"`
+	DBMaxIdleConns    int           `mapstructure:"DB_MAX_IDLE_CONNS"`
+	DBConnMaxLifetime time.Duration `mapstructure:"DB_CONN_MAX_LIFETIME"`
+	DBConnMaxIdleTime time.Duration `mapstructure:"DB_CONN_MAX_IDLE_TIME"`
+
+	LogLevel  string `mapstructure:"LOG_LEVEL"`
+	LogFormat string `mapstructure:"LOG_FORMAT"`
+	GinMode   string `mapstructure:"GIN_MODE"`
+
+	IPFSGateway     string        `mapstructure:"IPFS_GATEWAY"`
+	MetadataMaxSize int64         `mapstructure:"METADATA_MAX_SIZE"`
+	MetadataTimeout time.Duration `mapstructure:"METADATA_TIMEOUT"`
+
+	MediaBackend string `mapstructure:"MEDIA_BACKEND"`
+	MediaDir     string `mapstructure:"MEDIA_DIR"`
+	MediaURL     string `mapstructure:"MEDIA_URL"`
+	MediaMaxSize int64  `mapstructure:"MEDIA_MAX_SIZE"`
+	MediaProxy   bool   `mapstructure:"MEDIA_PROXY"`
+
+	S3Endpoint  string        `mapstructure:"S3_ENDPOINT"`
+	S3Region    string        `mapstructure:"S3_REGION"`
+	S3Bucket    string        `mapstructure:"S3_BUCKET"`
+	S3AccessKey string        `mapstructure:"S3_ACCESS_KEY"`
+	S3SecretKey string        `mapstructure:"S3_SECRET_KEY"`
+	S3PublicURL string        `mapstructure:"S3_PUBLIC_URL"`
+	S3URLExpiry time.Duration `mapstructure:"S3_URL_EXPIRY"`
+
+	IPFSAPI string `mapstructure:"IPFS_API"`
+
+	ImageSizes     []int  `mapstructure:"IMAGE_SIZES"`
+	ImageQualities []int  `mapstructure:"IMAGE_QUALITIES"`
+	ImageWorkers   int    `mapstructure:"IMAGE_WORKERS"`
+	ImageCacheDir  string `mapstructure:"IMAGE_CACHE_DIR"`
+	ImageCacheSize int64  `mapstructure:"IMAGE_CACHE_SIZE"`
+
+	// ChainsFile is the chain and currency registry, in the format of
+	// registry/chains.json; the built-in registry is used when it is empty.
+	ChainsFile string `mapstructure:"CHAINS_FILE"`
+
+	IndexerPoll       time.Duration `mapstructure:"INDEXER_POLL"`
+	IndexerBlockRange int64         `mapstructure:"INDEXER_BLOCK_RANGE"`
 }
 
+// secrets are the keys that may be read from the file named by <KEY>_FILE,
+// such as a Docker or Kubernetes secret, instead of app.env. The file takes
+// precedence; a trailing newline is dropped.
+var secrets = []string{"DB_SOURCE", "API_KEY_SECRET", "S3_ACCESS_KEY", "S3_SECRET_KEY"}
+
+// LoadConfig reads app.env in path and the environment, which takes
+// precedence, and validates the result.
 func LoadConfig(path string) (config Config, err error) {
-	viper.AddConfigPath(path)
-	viper.SetConfigName("app")
-	viper.SetConfigType("env")
+	v := viper.New()
+	v.AddConfigPath(path)
+	v.SetConfigName("app")
+	v.SetConfigType("env")
 
-	viper.AutomaticEnv()
+	v.SetDefault("DB_DRIVER", "postgres")
+	v.SetDefault("CANCEL_ON_DISCONNECT_GRACE", 10*time.Second)
+	v.SetDefault("HTTP_READ_TIMEOUT", 30*time.Second)
+	v.SetDefault("HTTP_WRITE_TIMEOUT", 30*time.Second)
+	v.SetDefault("HTTP_IDLE_TIMEOUT", 2*time.Minute)
+	v.SetDefault("SHUTDOWN_TIMEOUT", 30*time.Second)
+	v.SetDefault("MAX_BODY_SIZE", 1<<20)
+	v.SetDefault("DB_TIMEOUT", 10*time.Second)
+	v.SetDefault("DB_MAX_OPEN_CONNS", 20)
+	v.SetDefault("DB_MAX_IDLE_CONNS", 10)
+	v.SetDefault("DB_CONN_MAX_LIFETIME", time.Hour)
+	v.SetDefault("DB_CONN_MAX_IDLE_TIME", 10*time.Minute)
+	v.SetDefault("LOG_LEVEL", "info")
+	v.SetDefault("LOG_FORMAT", "text")
+	v.SetDefault("GIN_MODE", "release")
+	v.SetDefault("IPFS_GATEWAY", "https://ipfs.io")
+	v.SetDefault("METADATA_MAX_SIZE", 1<<20)
+	v.SetDefault("METADATA_TIMEOUT", 10*time.Second)
+	v.SetDefault("MEDIA_BACKEND", "fs")
+	v.SetDefault("MEDIA_DIR", "./public/images")
+	v.SetDefault("MEDIA_URL", "/static/")
+	v.SetDefault("MEDIA_MAX_SIZE", 10<<20)
+	v.SetDefault("S3_REGION", "us-east-1")
+	v.SetDefault("S3_URL_EXPIRY", 15*time.Minute)
+	v.SetDefault("IPFS_API", "http://localhost:5001")
+	v.SetDefault("IMAGE_SIZES", []int{64, 128, 256, 512, 1024, 2048})
+	v.SetDefault("IMAGE_QUALITIES", []int{80, 60, 90})
+	v.SetDefault("IMAGE_CACHE_DIR", "./cache/images")
+	v.SetDefault("IMAGE_CACHE_SIZE", 512<<20)
+	v.SetDefault("INDEXER_POLL", 5*time.Second)
+	v.SetDefault("INDEXER_BLOCK_RANGE", 1000)
+	v.AutomaticEnv()
 
-	err = viper.ReadInConfig()
-	if err != nil {
+	if err = v.ReadInConfig(); err != nil {
 		return
 	}
+	for _, key := range secrets {
+		file := v.GetString(key + "_FILE")
+		if file == "" {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return config, fmt.Errorf("%s_FILE: %w", key, err)
+		}
+		v.Set(key, strings.TrimRight(string(data), "\r\n"))
+	}
 
-	err = viper.Unmarshal(&config)
+	if err = v.Unmarshal(&config); err != nil {
+		return
+	}
+	err = config.Validate()
 	return
 }
+
+// Validate checks the settings that would otherwise fail once the server is
+// running, and reports all the invalid ones at once.
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.DBDriver == "memory" || c.DBDriver == "postgres", "DB_DRIVER must be postgres or memory, not %q", c.DBDriver)
+	check(c.DBDriver != "postgres" || c.DBSource != "", "DB_SOURCE is required by the postgres driver")
+	if c.ServerAddress != "" {
+		_, _, err := net.SplitHostPort(c.ServerAddress)
+		check(err == nil, "SERVER_ADDRESS %q is not host:port", c.ServerAddress)
+	}
+	check(c.APIKeySecret != "", "API_KEY_SECRET is required")
+
+	check((c.TLSCertFile == "") == (c.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	for key, file := range map[string]string{"TLS_CERT_FILE": c.TLSCertFile, "TLS_KEY_FILE": c.TLSKeyFile} {
+		if file != "" {
+			_, err := os.Stat(file)
+			check(err == nil, "%s: %v", key, err)
+		}
+	}
+	for _, origin := range c.CORSOrigins {
+		check(origin == "*" || strings.HasPrefix(origin, "http://") || strings.HasPrefix(origin, "https://"),
+			"CORS_ORIGINS: %q is not * or an http(s) origin", origin)
+	}
+
+	check(c.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT must be positive")
+	check(c.MaxBodySize > 0, "MAX_BODY_SIZE must be positive")
+	for key, d := range map[string]time.Duration{
+		"CANCEL_ON_DISCONNECT_GRACE": c.CancelGrace,
+		"HTTP_READ_TIMEOUT":          c.HTTPReadTimeout,
+		"HTTP_WRITE_TIMEOUT":         c.HTTPWriteTimeout,
+		"HTTP_IDLE_TIMEOUT":          c.HTTPIdleTimeout,
+		"DB_TIMEOUT":                 c.DBTimeout,
+		"DB_CONN_MAX_LIFETIME":       c.DBConnMaxLifetime,
+		"DB_CONN_MAX_IDLE_TIME":      c.DBConnMaxIdleTime,
+		"METADATA_TIMEOUT":           c.MetadataTimeout,
+		"INDEXER_POLL":               c.IndexerPoll,
+	} {
+		check(d >= 0, "%s must not be negative", key)
+	}
+	for key, n := range map[string]int64{
+		"DB_MAX_OPEN_CONNS":   int64(c.DBMaxOpenConns),
+		"DB_MAX_IDLE_CONNS":   int64(c.DBMaxIdleConns),
+		"METADATA_MAX_SIZE":   c.MetadataMaxSize,
+		"MEDIA_MAX_SIZE":      c.MediaMaxSize,
+		"IMAGE_CACHE_SIZE":    c.ImageCacheSize,
+		"INDEXER_BLOCK_RANGE": c.IndexerBlockRange,
+	} {
+		check(n >= 0, "%s must not be negative", key)
+	}
+
+	_, err := logrus.ParseLevel(c.LogLevel)
+	check(err == nil, "LOG_LEVEL must be one of panic, fatal, error, warn, info, debug or trace, not %q", c.LogLevel)
+	check(c.LogFormat == "text" || c.LogFormat == "json", "LOG_FORMAT must be text or json, not %q", c.LogFormat)
+	check(c.GinMode == "debug" || c.GinMode == "release" || c.GinMode == "test", "GIN_MODE must be debug, release or test, not %q", c.GinMode)
+
+	check(c.MediaBackend == "fs" || c.MediaBackend == "s3" || c.MediaBackend == "ipfs", "MEDIA_BACKEND must be fs, s3 or ipfs, not %q", c.MediaBackend)
+	check(c.MediaBackend != "s3" || (c.S3Endpoint != "" && c.S3Bucket != ""), "S3_ENDPOINT and S3_BUCKET are required by the s3 media backend")
+	if c.ChainsFile != "" {
+		_, err = os.Stat(c.ChainsFile)
+		check(err == nil, "CHAINS_FILE: %v", err)
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
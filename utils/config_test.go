@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "app.env"), "DB_DRIVER=postgres\nDB_SOURCE=postgresql://plain\nAPI_KEY_SECRET=\nCORS_ORIGINS=\n")
+	writeFile(t, filepath.Join(dir, "secret"), "s3cret\n")
+	t.Setenv("API_KEY_SECRET_FILE", filepath.Join(dir, "secret"))
+	t.Setenv("CORS_ORIGINS", "https://a.example,https://b.example")
+
+	config, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, config.APIKeySecret, "s3cret")
+	assert(t, config.DBSource, "postgresql://plain")
+	assert(t, config.CORSOrigins, []string{"https://a.example", "https://b.example"})
+	assert(t, config.HTTPReadTimeout, 30*time.Second)
+	assert(t, config.DBTimeout, 10*time.Second)
+	assert(t, config.LogLevel, "info")
+
+	t.Setenv("API_KEY_SECRET_FILE", filepath.Join(dir, "missing"))
+	_, err = LoadConfig(dir)
+	assert(t, err != nil && strings.Contains(err.Error(), "API_KEY_SECRET_FILE"), true)
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{
+		DBDriver:     "memory",
+		APIKeySecret: "secret",
+		LogLevel:     "info",
+		LogFormat:    "text",
+		GinMode:      "release",
+		MediaBackend: "fs",
+
+		ShutdownTimeout: time.Second,
+		MaxBodySize:     1 << 20,
+	}
+	assert(t, valid.Validate(), nil)
+
+	for _, tc := range []struct {
+		problem string
+		change  func(c *Config)
+	}{
+		{"DB_SOURCE", func(c *Config) { c.DBDriver = "postgres" }},
+		{"DB_DRIVER", func(c *Config) { c.DBDriver = "mysql" }},
+		{"SERVER_ADDRESS", func(c *Config) { c.ServerAddress = "8998" }},
+		{"TLS_CERT_FILE and TLS_KEY_FILE", func(c *Config) { c.TLSCertFile = "cert.pem" }},
+		{"CORS_ORIGINS", func(c *Config) { c.CORSOrigins = []string{"example.com"} }},
+		{"HTTP_WRITE_TIMEOUT", func(c *Config) { c.HTTPWriteTimeout = -time.Second }},
+		{"SHUTDOWN_TIMEOUT", func(c *Config) { c.ShutdownTimeout = 0 }},
+		{"MAX_BODY_SIZE", func(c *Config) { c.MaxBodySize = 0 }},
+		{"DB_MAX_OPEN_CONNS", func(c *Config) { c.DBMaxOpenConns = -1 }},
+		{"LOG_LEVEL", func(c *Config) { c.LogLevel = "verbose" }},
+		{"LOG_FORMAT", func(c *Config) { c.LogFormat = "xml" }},
+		{"GIN_MODE", func(c *Config) { c.GinMode = "prod" }},
+		{"MEDIA_BACKEND", func(c *Config) { c.MediaBackend = "ftp" }},
+		{"S3_BUCKET", func(c *Config) { c.MediaBackend = "s3" }},
+		{"CHAINS_FILE", func(c *Config) { c.ChainsFile = filepath.Join(t.TempDir(), "chains.json") }},
+	} {
+		c := valid
+		tc.change(&c)
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.problem) {
+			t.Errorf("%s: %v", tc.problem, err)
+		}
+	}
+}